@@ -8,6 +8,7 @@ import (
 type ClientConfig struct {
 	ServerAddr         string `toml:"server_addr"`
 	ServerName         string `toml:"server_name"`
+	Servers            []ServerEndpoint `toml:"servers"` // failover profile; server_addr/server_name is the only endpoint when empty
 	CAFile             string `toml:"ca_file"`
 	CAPEM              string `toml:"ca_pem"`
 	TLSCert            string `toml:"tls_cert"`
@@ -20,14 +21,44 @@ type ClientConfig struct {
 	LogLevel           string `toml:"log_level"`
 	MTU                int    `toml:"mtu"`
 	PreferIPv6         bool   `toml:"prefer_ipv6"`
+	RenewFraction      float64 `toml:"renew_fraction"` // renew after this share of the certificate lifetime; <0 disables
+	AuthTokenFile      string `toml:"auth_token_file"` // bearer token sent with CONNECT-IP, read on every connect
+	AuthTokenEnv       string `toml:"auth_token_env"`  // environment variable holding the bearer token
+	JournalFile        string `toml:"journal_file"`    // record of host network changes to undo on exit or after a crash
+	IncludeRoutes      []string `toml:"include_routes"`  // tunnel only these networks instead of everything
+	ExcludeRoutes      []string `toml:"exclude_routes"`  // networks that never go through the tunnel
+	ExcludeLocalLAN    bool     `toml:"exclude_local_lan"` // keep the networks of the host's interfaces off the tunnel
+	IncludeDomains     []string `toml:"include_domains"` // tunnel the addresses these names resolve to
+	DomainRefreshSeconds int    `toml:"domain_refresh_seconds"` // how often include_domains are resolved again (300)
+	DNSMode            string   `toml:"dns_mode"`        // apply server DNS via: auto (default), resolved, resolv.conf, off
+	DNSLeakProtection  bool     `toml:"dns_leak_protection"` // block DNS and DoT outside the tunnel while connected (Linux, nftables)
+	KillSwitch         bool     `toml:"kill_switch"`         // always-on: block traffic outside the tunnel until the client is stopped (Linux, nftables)
+	KillSwitchAllowLAN bool     `toml:"kill_switch_allow_lan"` // keep the local networks reachable under the kill switch
+	ReconnectMaxAttempts     int `toml:"reconnect_max_attempts"`      // give up after this many failed reconnects in a row (0 = never)
+	ReconnectMaxDelaySeconds int `toml:"reconnect_max_delay_seconds"` // upper bound of the reconnect backoff (60)
+	DisableMigration   bool     `toml:"disable_migration"`   // keep the QUIC connection on its socket when the host network changes
+	SessionCacheFile   string   `toml:"session_cache_file"`  // encrypted TLS session tickets for resumption across restarts
+	Disable0RTT        bool     `toml:"disable_0rtt"`        // never send the CONNECT-IP request as 0-RTT early data
 	FEC                common_fec.Config `toml:"fec"`
 }
 
+// ServerEndpoint is one server of a multi-server client profile
+type ServerEndpoint struct {
+	Addr     string `toml:"addr"`     // host:port
+	Name     string `toml:"name"`     // TLS server name; defaults to server_name
+	Priority int    `toml:"priority"` // lower is preferred; higher ones are used only when no lower one is reachable
+	Weight   int    `toml:"weight"`   // within a priority the measured RTT is divided by the weight (1)
+}
+
 // APIServerConfig 结构体，用于存储 API 服务器的配置信息
 type APIServerConfig struct {
 	ListenAddr   string `toml:"listen_addr"`
 	StaticDir    string `toml:"static_dir"`
 	DatabasePath string `toml:"database_path"`
+	// Токен администратора для "Authorization: Bearer"; без него административные
+	// маршруты доступны только с loopback адресов
+	AdminTokenFile string `toml:"admin_token_file"`
+	AdminTokenEnv  string `toml:"admin_token_env"`
 }
 
 // ServerConfig структура для хранения конфигурации сервера из TOML файла
@@ -47,9 +78,12 @@ type ServerConfig struct {
 	AdvertiseRoutesv6 []string `toml:"advertise_routes_v6"`
 	TunName         string   `toml:"tun_name"`
 	LogLevel        string   `toml:"log_level"`
+	LogFormat       string   `toml:"log_format"` // json или console; по умолчанию json при ENVIRONMENT=production
 	ServerName      string   `toml:"server_name"`
+	PublicAddr      string   `toml:"public_addr"` // адрес для клиентов (host:port), по умолчанию server_name + порт listen_addr
 	MTU             int      `toml:"mtu"`
 	EnableIPv6      bool     `toml:"enable_ipv6"`
+	Allow0RTT       bool     `toml:"allow_0rtt"` // принимать 0-RTT от клиентов с возобновленной TLS сессией
 
 	// API server configuration
 	APIServer APIServerConfig `toml:"api_server"`
@@ -59,6 +93,173 @@ type ServerConfig struct {
 
 	// FEC configuration
 	FEC common_fec.Config `toml:"fec"`
+
+	// Built-in certificate authority configuration
+	CA CAConfig `toml:"ca"`
+
+	// Client identity mapping from certificate SANs and extensions
+	Identity IdentityConfig `toml:"identity"`
+
+	// Optional JWT bearer token check after mTLS
+	JWT JWTConfig `toml:"jwt"`
+
+	// Concurrent session and duplicate-login policy
+	Sessions SessionConfig `toml:"sessions"`
+
+	// Per-client bandwidth shaping
+	Shaping ShapingConfig `toml:"shaping"`
+
+	// Traffic quotas per user and group
+	Quotas QuotaConfig `toml:"quotas"`
+
+	// Masquerade of client traffic via nftables
+	NAT NATConfig `toml:"nat"`
+
+	// DNS settings pushed to clients
+	DNS DNSConfig `toml:"dns"`
+
+	// Shared lease and revocation state of several servers
+	Cluster ClusterConfig `toml:"cluster"`
+
+	// Graceful drain on shutdown and restart
+	Drain DrainConfig `toml:"drain"`
+}
+
+// CAConfig настройки встроенного центра сертификации клиентов.
+// Ключ и сертификат CA берутся из ca_key_file/ca_key_pem и ca_cert_file/ca_cert_pem.
+type CAConfig struct {
+	StoreDir            string `toml:"store_dir"`             // каталог для выданных сертификатов; пусто - только в памяти
+	AuditFile           string `toml:"audit_file"`            // JSONL журнал аудита; по умолчанию <store_dir>/audit.jsonl
+	DefaultValidityDays int    `toml:"default_validity_days"` // срок действия по умолчанию (365)
+	MaxValidityDays     int    `toml:"max_validity_days"`     // верхняя граница срока действия (0 - без ограничения)
+}
+
+// IdentityConfig правила получения идентичности клиента (пользователь, устройство, группы) из сертификата
+type IdentityConfig struct {
+	UserSource   string `toml:"user_source"`   // cn (по умолчанию), email, uri, dns
+	UserPrefix   string `toml:"user_prefix"`   // берется первый SAN с этим префиксом, префикс отбрасывается
+	DeviceSource string `toml:"device_source"` // serial (по умолчанию), cn, email, uri, dns, none
+	DevicePrefix string `toml:"device_prefix"` // аналогично user_prefix для идентификатора устройства
+	GroupSource  string `toml:"group_source"`  // both (по умолчанию), ou, oid, none
+	GroupOID     string `toml:"group_oid"`     // OID расширения со списком групп; по умолчанию OID встроенного CA
+}
+
+// JWTConfig второй фактор после mTLS: JWT в заголовке "Authorization: Bearer",
+// проверяемый по локальному JWKS файлу
+type JWTConfig struct {
+	Enabled       bool     `toml:"enabled"`
+	JWKSFile      string   `toml:"jwks_file"`      // JWKS с открытыми ключами издателя; перечитывается при изменении
+	Issuer        string   `toml:"issuer"`         // ожидаемый iss; пусто - не проверяется
+	Audience      string   `toml:"audience"`       // ожидаемый aud (обязателен)
+	SubjectClaim  string   `toml:"subject_claim"`  // claim, который должен совпадать с пользователем из сертификата (sub)
+	Algorithms    []string `toml:"algorithms"`     // допустимые алгоритмы подписи; по умолчанию RS256, ES256, EdDSA
+	LeewaySeconds int      `toml:"leeway_seconds"` // допуск рассинхрона часов (60)
+}
+
+// SessionPolicy ограничение одновременных сессий одного пользователя
+type SessionPolicy struct {
+	Policy      string `toml:"policy"`       // allow (по умолчанию), reject - отклонить новую, replace - отключить самую старую
+	MaxSessions int    `toml:"max_sessions"` // предел сессий; для reject/replace по умолчанию 1, для allow 0 - без ограничения
+}
+
+// SessionConfig политика сессий по умолчанию и ее переопределения для пользователей и групп
+type SessionConfig struct {
+	Policy      string                   `toml:"policy"`
+	MaxSessions int                      `toml:"max_sessions"`
+	Users       map[string]SessionPolicy `toml:"users"`  // имеют приоритет над группами
+	Groups      map[string]SessionPolicy `toml:"groups"` // применяется первая группа клиента, для которой задана политика
+}
+
+// RateLimit ограничение полосы клиента в кбит/с; 0 - без ограничения
+type RateLimit struct {
+	DownloadKbps int64 `toml:"download_kbps" json:"download_kbps"` // от сервера к клиенту
+	UploadKbps   int64 `toml:"upload_kbps" json:"upload_kbps"`     // от клиента к серверу
+	BurstKB      int64 `toml:"burst_kb" json:"burst_kb"`           // емкость корзины; по умолчанию 100 мс трафика, не меньше 32 КБ
+}
+
+// ShapingConfig ограничение полосы по умолчанию и его переопределения для пользователей и групп
+type ShapingConfig struct {
+	DownloadKbps    int64                `toml:"download_kbps"`
+	UploadKbps      int64                `toml:"upload_kbps"`
+	BurstKB         int64                `toml:"burst_kb"`
+	MaxQueueDelayMs int                  `toml:"max_queue_delay_ms"` // пакеты, которые пришлось бы задержать дольше, отбрасываются (50)
+	Users           map[string]RateLimit `toml:"users"`              // имеют приоритет над группами
+	Groups          map[string]RateLimit `toml:"groups"`             // применяется первая группа клиента, для которой задано ограничение
+}
+
+// QuotaLimit квота трафика пользователя (сумма обоих направлений по всем устройствам); 0 - без квоты
+type QuotaLimit struct {
+	DailyMB      int64  `toml:"daily_mb" json:"daily_mb"`
+	MonthlyMB    int64  `toml:"monthly_mb" json:"monthly_mb"`
+	Action       string `toml:"action" json:"action"`               // disconnect (по умолчанию), throttle, notify
+	ThrottleKbps int64  `toml:"throttle_kbps" json:"throttle_kbps"` // полоса после превышения для action = "throttle"
+}
+
+// QuotaConfig квоты трафика по умолчанию, их переопределения и расписание сброса
+type QuotaConfig struct {
+	DailyMB      int64                 `toml:"daily_mb"`
+	MonthlyMB    int64                 `toml:"monthly_mb"`
+	Action       string                `toml:"action"`
+	ThrottleKbps int64                 `toml:"throttle_kbps"`
+	Users        map[string]QuotaLimit `toml:"users"`      // имеют приоритет над группами
+	Groups       map[string]QuotaLimit `toml:"groups"`     // квота группы действует для каждого ее пользователя отдельно
+	ResetDay     int                   `toml:"reset_day"`  // день месяца сброса месячной квоты, 1-28 (1)
+	Timezone     string                `toml:"timezone"`   // часовой пояс сброса, например "Europe/Moscow" (UTC)
+	StateFile    string                `toml:"state_file"` // учет трафика; по умолчанию <ca.store_dir>/quota_usage.json
+}
+
+// NATConfig маскарадинг трафика клиентов (assign_cidr, assign_cidr_v6) правилами nftables,
+// которые сервер создает при запуске и удаляет при остановке; включает IP forwarding
+type NATConfig struct {
+	Enabled      bool   `toml:"enabled"`
+	OutInterface string `toml:"out_interface"` // внешний интерфейс; пусто - любой, кроме TUN сервера
+	Table        string `toml:"table"`         // таблица nftables семейства inet (masque_vpn)
+}
+
+// DNSConfig DNS серверы и домены поиска, которые сервер передает клиентам в ответе CONNECT-IP,
+// и встроенный DNS сервер на адресе шлюза VPN сети
+type DNSConfig struct {
+	Servers       []string           `toml:"servers"`        // адреса DNS серверов, доступных через VPN; со встроенным сервером - адрес шлюза
+	SearchDomains []string           `toml:"search_domains"` // домены поиска для коротких имен; со встроенным сервером - zone
+	Embedded      bool               `toml:"embedded"`       // встроенный DNS сервер на адресе шлюза (требует tun_name)
+	Zone          string             `toml:"zone"`           // зона имен клиентов <client-id>.<zone> (vpn.internal)
+	Upstreams     []string           `toml:"upstreams"`      // DNS серверы для остальных имен; по умолчанию из /etc/resolv.conf
+	Zones         map[string]DNSZone `toml:"zones"`          // split-horizon зоны, отвечаемые только клиентам VPN
+}
+
+// DNSZone split-horizon зона встроенного DNS сервера
+type DNSZone struct {
+	Records   map[string][]string `toml:"records"`   // имя относительно зоны ("@" - сама зона) -> IP адреса
+	Upstreams []string            `toml:"upstreams"` // серверы для остальных имен зоны; пусто - NXDOMAIN
+}
+
+// ClusterConfig кластер серверов за anycast или DNS round-robin: аренды адресов клиентов,
+// отозванные сертификаты и ограничения полосы из API реплицируются через Raft.
+// assign_cidr должен совпадать на всех узлах.
+type ClusterConfig struct {
+	Enabled         bool          `toml:"enabled"`
+	NodeID          string        `toml:"node_id"`           // имя узла; должно быть в peers
+	BindAddr        string        `toml:"bind_addr"`         // адрес Raft транспорта; по умолчанию адрес узла из peers
+	DataDir         string        `toml:"data_dir"`          // журнал и снимки Raft
+	CertFile        string        `toml:"cert_file"`         // сертификат узла (serverAuth и clientAuth)
+	KeyFile         string        `toml:"key_file"`          // ключ сертификата узла
+	CAFile          string        `toml:"ca_file"`           // CA сертификатов узлов; не CA клиентов VPN
+	TLSServerName   string        `toml:"tls_server_name"`   // DNS имя в сертификатах всех узлов (masque-vpn-cluster)
+	LeaseTTLSeconds int           `toml:"lease_ttl_seconds"` // аренда узла, переставшего ее продлевать, освобождается (60)
+	Peers           []ClusterPeer `toml:"peers"`             // все узлы кластера, включая этот
+}
+
+// ClusterPeer узел кластера
+type ClusterPeer struct {
+	ID   string `toml:"id"`
+	Addr string `toml:"addr"` // host:port Raft транспорта, доступный другим узлам
+}
+
+// DrainConfig плавное завершение по SIGTERM или через API: сервер отклоняет новые
+// сессии, просит клиентов перейти на другие серверы и ждет их ухода до закрытия
+type DrainConfig struct {
+	TimeoutSeconds       int      `toml:"timeout_seconds"`       // сколько ждать ухода клиентов (30)
+	AlternativeEndpoints []string `toml:"alternative_endpoints"` // серверы (host:port), на которые переходят клиенты, лучшие первыми
 }
 
 // MetricsConfig holds metrics server configuration
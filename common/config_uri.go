@@ -0,0 +1,72 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+const (
+	// ConfigURIScheme is the URI scheme of importable client configurations
+	ConfigURIScheme = "masque"
+	// maxConfigURISize bounds the decompressed size of an imported configuration
+	maxConfigURISize = 1 << 20
+)
+
+// EncodeConfigURI packs a client TOML configuration into a self-contained
+// masque://import?config=<base64url(gzip(toml))> URI.
+func EncodeConfigURI(configTOML []byte) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(configTOML); err != nil {
+		return "", fmt.Errorf("failed to compress config: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return "", fmt.Errorf("failed to compress config: %w", err)
+	}
+
+	u := url.URL{
+		Scheme:   ConfigURIScheme,
+		Host:     "import",
+		RawQuery: "config=" + base64.RawURLEncoding.EncodeToString(buf.Bytes()),
+	}
+	return u.String(), nil
+}
+
+// DecodeConfigURI extracts the client TOML configuration from a URI produced by EncodeConfigURI
+func DecodeConfigURI(uri string) ([]byte, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid config URI: %v", ErrInvalidConfig, err)
+	}
+	if u.Scheme != ConfigURIScheme || u.Host != "import" {
+		return nil, fmt.Errorf("%w: unsupported config URI %s://%s", ErrInvalidConfig, u.Scheme, u.Host)
+	}
+
+	encoded := u.Query().Get("config")
+	if encoded == "" {
+		return nil, fmt.Errorf("%w: config URI has no config parameter", ErrInvalidConfig)
+	}
+	compressed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid config encoding: %v", ErrInvalidConfig, err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid config compression: %v", ErrInvalidConfig, err)
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(io.LimitReader(zr, maxConfigURISize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decompress config: %v", ErrInvalidConfig, err)
+	}
+	if len(data) > maxConfigURISize {
+		return nil, fmt.Errorf("%w: config exceeds %d bytes", ErrInvalidConfig, maxConfigURISize)
+	}
+	return data, nil
+}
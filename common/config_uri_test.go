@@ -0,0 +1,41 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigURIRoundTrip(t *testing.T) {
+	config := []byte("server_addr = \"vpn.example.com:4433\"\nserver_name = \"vpn.example.com\"\n")
+
+	uri, err := EncodeConfigURI(config)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(uri, "masque://import?config="))
+
+	decoded, err := DecodeConfigURI(uri)
+	require.NoError(t, err)
+	assert.Equal(t, config, decoded)
+}
+
+func TestDecodeConfigURIInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+	}{
+		{name: "wrong scheme", uri: "https://import?config=abc"},
+		{name: "wrong host", uri: "masque://export?config=abc"},
+		{name: "missing config", uri: "masque://import"},
+		{name: "bad base64", uri: "masque://import?config=***"},
+		{name: "not gzip", uri: "masque://import?config=aGVsbG8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeConfigURI(tt.uri)
+			assert.ErrorIs(t, err, ErrInvalidConfig)
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package common
+
+import "time"
+
+// EnrollPath is the API path clients post enrollment requests to
+const EnrollPath = "/api/v1/enroll"
+
+// EnrollRequest is sent by a client to exchange a one-time token and a CSR for a certificate
+type EnrollRequest struct {
+	Token string `json:"token"`
+	CSR   string `json:"csr"` // PEM "CERTIFICATE REQUEST"
+}
+
+// EnrollResponse carries the signed certificate and the settings needed to connect
+type EnrollResponse struct {
+	ClientID   string    `json:"client_id"`
+	Serial     string    `json:"serial"`
+	CertPEM    string    `json:"cert_pem"`
+	CAPEM      string    `json:"ca_pem"`
+	NotAfter   time.Time `json:"not_after"`
+	ServerAddr string    `json:"server_addr"`
+	ServerName string    `json:"server_name"`
+	MTU        int       `json:"mtu"`
+}
+
+// RenewPath is served on the VPN listener; clients authenticate with the
+// certificate being renewed, so no token is needed.
+const RenewPath = "/.well-known/masque-vpn/renew"
+
+// RenewRequest asks the server CA to re-issue the caller's certificate for a new key.
+// The response is an EnrollResponse.
+type RenewRequest struct {
+	CSR string `json:"csr"` // PEM "CERTIFICATE REQUEST"
+}
@@ -34,6 +34,7 @@ var (
 	ErrPermissionDenied    = errors.New("permission denied")
 	ErrResourceExhausted   = errors.New("resource exhausted")
 	ErrSystemCall          = errors.New("system call failed")
+	ErrNotSupported        = errors.New("not supported on this platform")
 )
 
 // VPNError represents a structured error with context
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"go.uber.org/zap"
+)
+
+// CapsuleTypeMove is the capsule a draining server sends on a CONNECT-IP
+// stream to ask the client to reconnect elsewhere. The type encodes as a
+// four-byte varint whose first byte is 0x80-0xBF, which no IPv4 or IPv6
+// packet starts with, so the capsule can share the stream with packets.
+const CapsuleTypeMove http3.CapsuleType = 0x1f4d4f56
+
+// MoveCapsule asks the client to leave a draining server before Deadline
+type MoveCapsule struct {
+	// Endpoints are host:port addresses of servers to reconnect to, best first; may be empty
+	Endpoints []string  `json:"endpoints,omitempty"`
+	Deadline  time.Time `json:"deadline"`
+}
+
+// WriteMoveCapsule writes a move capsule to a CONNECT-IP stream
+func WriteMoveCapsule(w io.Writer, move MoveCapsule) error {
+	value, err := json.Marshal(move)
+	if err != nil {
+		return fmt.Errorf("failed to encode move capsule: %w", err)
+	}
+	return http3.WriteCapsule(quicvarint.NewWriter(w), CapsuleTypeMove, value)
+}
+
+// isCapsule tells a capsule read from a CONNECT-IP stream from an IP packet
+func isCapsule(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	version := data[0] >> 4
+	return version != 4 && version != 6
+}
+
+// parseCapsule parses a capsule read from a CONNECT-IP stream
+func parseCapsule(data []byte) (http3.CapsuleType, []byte, error) {
+	capsuleType, r, err := http3.ParseCapsule(quicvarint.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: malformed capsule: %v", ErrMASQUEProtocol, err)
+	}
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: truncated capsule: %v", ErrMASQUEProtocol, err)
+	}
+	return capsuleType, value, nil
+}
+
+// handleCapsule acts on a capsule received instead of a packet. Capsules of
+// unknown types are skipped, as RFC 9297 requires.
+func (m *MASQUEConn) handleCapsule(data []byte) {
+	capsuleType, value, err := parseCapsule(data)
+	if err != nil {
+		m.logDebug("Dropping malformed capsule", zap.Error(err))
+		return
+	}
+	if capsuleType != CapsuleTypeMove {
+		m.logDebug("Skipping capsule of unknown type", zap.Uint64("type", uint64(capsuleType)))
+		return
+	}
+
+	var move MoveCapsule
+	if err := json.Unmarshal(value, &move); err != nil {
+		m.logDebug("Dropping malformed move capsule", zap.Error(err))
+		return
+	}
+	// Only the latest request matters if the client has not acted on the previous one yet
+	select {
+	case <-m.moves:
+	default:
+	}
+	select {
+	case m.moves <- move:
+	default:
+	}
+}
+
+// Moves delivers the requests of a draining server to reconnect elsewhere
+func (m *MASQUEConn) Moves() <-chan MoveCapsule {
+	return m.moves
+}
+
+func (m *MASQUEConn) logDebug(msg string, fields ...zap.Field) {
+	if m.Logger != nil {
+		m.Logger.Debug(msg, fields...)
+	}
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestMoveCapsule(t *testing.T) {
+	deadline := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	var buf bytes.Buffer
+	require.NoError(t, WriteMoveCapsule(&buf, MoveCapsule{Endpoints: []string{"vpn2.example.com:4433"}, Deadline: deadline}))
+
+	// The capsule can not be taken for an IP packet
+	assert.True(t, isCapsule(buf.Bytes()))
+	assert.False(t, isCapsule([]byte{0x45, 0x00}))
+	assert.False(t, isCapsule([]byte{0x60, 0x00}))
+
+	capsuleType, value, err := parseCapsule(buf.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, CapsuleTypeMove, capsuleType)
+	assert.JSONEq(t, `{"endpoints":["vpn2.example.com:4433"],"deadline":"2026-01-02T03:04:05Z"}`, string(value))
+
+	_, _, err = parseCapsule(buf.Bytes()[:buf.Len()-1])
+	assert.ErrorIs(t, err, ErrMASQUEProtocol)
+}
+
+func TestMASQUEConn_MoveCapsule(t *testing.T) {
+	conn := NewMASQUEConnForServer(zaptest.NewLogger(t))
+	defer conn.Close()
+
+	var capsule bytes.Buffer
+	require.NoError(t, WriteMoveCapsule(&capsule, MoveCapsule{Endpoints: []string{"vpn2.example.com:4433"}}))
+	require.NoError(t, conn.WritePacket(capsule.Bytes()))
+
+	// The capsule is not returned as a packet
+	buf := make([]byte, 1500)
+	n, err := conn.ReadPacket(buf)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	select {
+	case move := <-conn.Moves():
+		assert.Equal(t, []string{"vpn2.example.com:4433"}, move.Endpoints)
+	default:
+		t.Fatal("move capsule not delivered")
+	}
+
+	// Packets still pass through
+	packet := []byte{0x45, 0x00, 0x00, 0x14}
+	require.NoError(t, conn.WritePacket(packet))
+	n, err = conn.ReadPacket(buf)
+	require.NoError(t, err)
+	assert.Equal(t, packet, buf[:n])
+}
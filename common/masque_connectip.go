@@ -1,11 +1,13 @@
 package common
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 	"sync"
 	"time"
@@ -21,18 +23,40 @@ type MASQUEClient struct {
 	logger     *zap.Logger
 	mu         sync.RWMutex
 	closed     bool
+
+	// Header holds extra CONNECT-IP request headers, e.g. Authorization
+	Header http.Header
 }
 
+// CONNECT-IP response headers with the client's network settings, each a comma-separated list
+const (
+	// RoutesHeader lists the networks the server routes for the client
+	RoutesHeader = "Masque-Routes"
+	// DNSHeader lists the DNS servers the client should use
+	DNSHeader = "Masque-DNS"
+	// DNSSearchHeader lists the DNS search domains
+	DNSSearchHeader = "Masque-DNS-Search"
+	// AlternativesHeader lists, when a draining server refuses CONNECT-IP, the servers to try instead
+	AlternativesHeader = "Masque-Alternatives"
+)
+
 // MASQUEConn represents a MASQUE CONNECT-IP connection for IP packet tunneling
 type MASQUEConn struct {
-	Stream     *quic.Stream
-	client     *MASQUEClient
-	Logger     *zap.Logger
-	mu         sync.RWMutex
-	closed     bool
+	Stream        *quic.Stream
+	// Routes advertised by the server for this session
+	Routes        []netip.Prefix
+	// DNS servers and search domains pushed by the server
+	DNSServers    []netip.Addr
+	SearchDomains []string
+	client        *MASQUEClient
+	Logger        *zap.Logger
+	mu            sync.RWMutex
+	closed        bool
 	// Для тестирования добавляем каналы
-	readChan   chan []byte
-	writeChan  chan []byte
+	readChan      chan []byte
+	writeChan     chan []byte
+	// Requests of a draining server to move, see Moves
+	moves         chan MoveCapsule
 }
 
 // NewMASQUEClient creates a new MASQUE client
@@ -46,6 +70,7 @@ func NewMASQUEClient(quicConn *quic.Conn, logger *zap.Logger) *MASQUEClient {
 		quicConn:   quicConn,
 		httpClient: httpClient,
 		logger:     logger,
+		Header:     make(http.Header),
 	}
 }
 
@@ -85,8 +110,10 @@ func (c *MASQUEClient) ConnectIP(ctx context.Context) (*MASQUEConn, error) {
 	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\n", serverAddr) +
 		"Capsule-Protocol: ?masque\r\n" +
 		"Upgrade: masque\r\n" +
-		"Connection: Upgrade\r\n" +
-		"\r\n"
+		"Connection: Upgrade\r\n"
+	var extra strings.Builder
+	c.Header.Write(&extra)
+	connectReq += extra.String() + "\r\n"
 
 	if _, err := stream.Write([]byte(connectReq)); err != nil {
 		stream.Close()
@@ -105,22 +132,142 @@ func (c *MASQUEClient) ConnectIP(ctx context.Context) (*MASQUEConn, error) {
 	c.logger.Debug("MASQUE CONNECT response", zap.String("response", response))
 
 	// Check for successful response (HTTP 200)
-	if !strings.Contains(response, "200") && !strings.Contains(response, "OK") {
+	header, err := checkConnectResponse(response)
+	if err != nil {
 		stream.Close()
-		return nil, fmt.Errorf("MASQUE CONNECT request failed: %s", response)
+		return nil, err
+	}
+	routes, err := ParseRoutesHeader(header.Get(RoutesHeader))
+	if err != nil {
+		c.logger.Warn("Ignoring invalid advertised routes", zap.Error(err))
+	}
+	dnsServers, err := ParseDNSHeader(header.Get(DNSHeader))
+	if err != nil {
+		c.logger.Warn("Ignoring invalid DNS servers", zap.Error(err))
 	}
 
 	c.logger.Info("MASQUE CONNECT-IP session established successfully")
 	
 	return &MASQUEConn{
-		Stream:    stream,
-		client:    c,
-		Logger:    c.logger,
-		readChan:  make(chan []byte, 100),
-		writeChan: make(chan []byte, 100),
+		Stream:        stream,
+		Routes:        routes,
+		DNSServers:    dnsServers,
+		SearchDomains: ParseListHeader(header.Get(DNSSearchHeader)),
+		client:        c,
+		Logger:        c.logger,
+		readChan:      make(chan []byte, 100),
+		writeChan:     make(chan []byte, 100),
+		moves:         make(chan MoveCapsule, 1),
 	}, nil
 }
 
+// ConnectRejectedError reports a CONNECT-IP request refused by the server,
+// e.g. by a session limit or failed authentication
+type ConnectRejectedError struct {
+	StatusCode int
+	Reason     string
+	// Alternatives are the servers a draining server suggests instead
+	Alternatives []string
+}
+
+func (e *ConnectRejectedError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("server rejected CONNECT-IP: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("server rejected CONNECT-IP: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Reason)
+}
+
+// Unwrap classifies the rejection for error handling and retry decisions
+func (e *ConnectRejectedError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrAuthenticationFailed
+	case http.StatusConflict, http.StatusTooManyRequests:
+		return ErrResourceExhausted
+	default:
+		return ErrConnectionFailed
+	}
+}
+
+// checkConnectResponse parses the server reply to CONNECT-IP and returns its headers
+func checkConnectResponse(response string) (http.Header, error) {
+	if !strings.HasPrefix(response, "HTTP/") {
+		if !strings.Contains(response, "200") && !strings.Contains(response, "OK") {
+			return nil, fmt.Errorf("MASQUE CONNECT request failed: %s", response)
+		}
+		return http.Header{}, nil
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(response)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed CONNECT response: %v", ErrMASQUEProtocol, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.Header, nil
+	}
+
+	// The body is whatever arrived with the status line; it carries the reason
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, &ConnectRejectedError{
+		StatusCode:   resp.StatusCode,
+		Reason:       strings.TrimSpace(string(body)),
+		Alternatives: ParseListHeader(resp.Header.Get(AlternativesHeader)),
+	}
+}
+
+// FormatListHeader joins values for a list header such as RoutesHeader
+func FormatListHeader(values []string) string {
+	return strings.Join(values, ", ")
+}
+
+// ParseListHeader splits a list header into its non-empty values
+func ParseListHeader(value string) []string {
+	var values []string
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			values = append(values, field)
+		}
+	}
+	return values
+}
+
+// ParseDNSHeader parses DNSHeader; invalid entries are skipped and reported
+func ParseDNSHeader(value string) ([]netip.Addr, error) {
+	var servers []netip.Addr
+	var invalid []string
+	for _, field := range ParseListHeader(value) {
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			invalid = append(invalid, field)
+			continue
+		}
+		servers = append(servers, addr.Unmap())
+	}
+	if len(invalid) > 0 {
+		return servers, fmt.Errorf("%w: invalid DNS servers %s", ErrMASQUEProtocol, strings.Join(invalid, ", "))
+	}
+	return servers, nil
+}
+
+// ParseRoutesHeader parses RoutesHeader; invalid entries are skipped and reported
+func ParseRoutesHeader(value string) ([]netip.Prefix, error) {
+	var routes []netip.Prefix
+	var invalid []string
+	for _, field := range ParseListHeader(value) {
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			invalid = append(invalid, field)
+			continue
+		}
+		routes = append(routes, prefix.Masked())
+	}
+	if len(invalid) > 0 {
+		return routes, fmt.Errorf("%w: invalid routes %s", ErrMASQUEProtocol, strings.Join(invalid, ", "))
+	}
+	return routes, nil
+}
+
 // NewMASQUEConnForServer creates a new MASQUE connection for server side
 func NewMASQUEConnForServer(logger *zap.Logger) *MASQUEConn {
 	// Для тестирования создаем связанные каналы
@@ -133,6 +280,7 @@ func NewMASQUEConnForServer(logger *zap.Logger) *MASQUEConn {
 		Logger:    logger,
 		readChan:  readChan,
 		writeChan: writeChan,
+		moves:     make(chan MoveCapsule, 1),
 	}
 	
 	// Запускаем горутину для связывания каналов (для тестирования)
@@ -189,6 +337,11 @@ func (m *MASQUEConn) ReadPacket(buf []byte) (int, error) {
 			}
 			return 0, fmt.Errorf("failed to read from MASQUE stream: %w", err)
 		}
+		// Capsules share the stream with packets; the caller skips empty reads
+		if isCapsule(buf[:n]) {
+			m.handleCapsule(buf[:n])
+			return 0, nil
+		}
 		return n, nil
 	}
 
@@ -196,6 +349,10 @@ func (m *MASQUEConn) ReadPacket(buf []byte) (int, error) {
 	select {
 	case packet := <-m.readChan:
 		n := copy(buf, packet)
+		if isCapsule(buf[:n]) {
+			m.handleCapsule(buf[:n])
+			return 0, nil
+		}
 		return n, nil
 	case <-time.After(30 * time.Second):
 		return 0, fmt.Errorf("read timeout")
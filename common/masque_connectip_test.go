@@ -2,6 +2,8 @@ package common
 
 import (
 	"context"
+	"errors"
+	"net/netip"
 	"testing"
 	"time"
 
@@ -87,4 +89,66 @@ func TestMASQUEConn_Methods(t *testing.T) {
 	// Test Close
 	err = conn.Close()
 	assert.NoError(t, err) // Should be no-op since already closed
-}
\ No newline at end of file
+}
+
+func TestCheckConnectResponse(t *testing.T) {
+	header, err := checkConnectResponse("HTTP/1.1 200 OK\r\nMasque-Routes: 10.99.0.0/24, fd00:99::/64\r\n\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.99.0.0/24, fd00:99::/64", header.Get(RoutesHeader))
+
+	_, err = checkConnectResponse("HTTP/1.1 409 Conflict\r\nContent-Type: text/plain\r\n\r\nsession limit reached: user alice already has 1 active session(s)\n")
+	var rejected *ConnectRejectedError
+	assert.True(t, errors.As(err, &rejected))
+	assert.Equal(t, 409, rejected.StatusCode)
+	assert.Equal(t, "session limit reached: user alice already has 1 active session(s)", rejected.Reason)
+	assert.ErrorIs(t, err, ErrResourceExhausted)
+
+	_, err = checkConnectResponse("HTTP/1.1 401 Unauthorized\r\n\r\n")
+	assert.ErrorIs(t, err, ErrAuthenticationFailed)
+
+	_, err = checkConnectResponse("HTTP/1.1 500 Internal Server Error\r\n\r\n")
+	assert.ErrorIs(t, err, ErrConnectionFailed)
+
+	// A draining server names the servers to try instead
+	_, err = checkConnectResponse("HTTP/1.1 503 Service Unavailable\r\nMasque-Alternatives: vpn2.example.com:4433, vpn3.example.com:4433\r\n\r\nserver is draining\n")
+	assert.True(t, errors.As(err, &rejected))
+	assert.Equal(t, []string{"vpn2.example.com:4433", "vpn3.example.com:4433"}, rejected.Alternatives)
+	assert.ErrorIs(t, err, ErrConnectionFailed)
+
+	// Legacy replies without a status line
+	_, err = checkConnectResponse("OK")
+	assert.NoError(t, err)
+	_, err = checkConnectResponse("denied")
+	assert.Error(t, err)
+}
+
+func TestParseRoutesHeader(t *testing.T) {
+	routes, err := ParseRoutesHeader(FormatListHeader([]string{"0.0.0.0/0", "10.99.0.7/24", "::/0"}))
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("10.99.0.0/24"),
+		netip.MustParsePrefix("::/0"),
+	}, routes)
+
+	routes, err = ParseRoutesHeader("10.1.0.0/16, bogus")
+	assert.ErrorIs(t, err, ErrMASQUEProtocol)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}, routes)
+
+	routes, err = ParseRoutesHeader("")
+	assert.NoError(t, err)
+	assert.Empty(t, routes)
+}
+
+func TestParseDNSHeader(t *testing.T) {
+	servers, err := ParseDNSHeader("10.0.0.1, fd00::1,,")
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")}, servers)
+
+	servers, err = ParseDNSHeader("10.0.0.1, dns.example.com")
+	assert.ErrorIs(t, err, ErrMASQUEProtocol)
+	assert.Len(t, servers, 1)
+
+	assert.Equal(t, []string{"corp.example.com", "example.com"}, ParseListHeader(" corp.example.com ,example.com"))
+	assert.Nil(t, ParseListHeader(""))
+}
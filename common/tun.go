@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/netip"
@@ -35,6 +36,123 @@ func (t *TUNDevice) AddRoute(ipNet net.IPNet) error {
 	return addPlatformRoute(t, ipNet)
 }
 
+// Route is a route through the TUN device
+type Route struct {
+	Destination netip.Prefix
+	Gateway     netip.Addr // optional next hop; empty for an on-link route
+	Metric      int        // route priority, lower wins; 0 is the kernel default
+	Table       int        // routing table; 0 is the main table
+}
+
+// String formats the route like "ip route" does
+func (r Route) String() string {
+	s := r.Destination.String()
+	if r.Gateway.IsValid() {
+		s += " via " + r.Gateway.String()
+	}
+	if r.Metric != 0 {
+		s += fmt.Sprintf(" metric %d", r.Metric)
+	}
+	if r.Table != 0 {
+		s += fmt.Sprintf(" table %d", r.Table)
+	}
+	return s
+}
+
+// RoutingRule is a policy routing rule that selects a routing table
+type RoutingRule struct {
+	Priority int
+	Table    int
+	From     netip.Prefix // optional source match
+	To       netip.Prefix // optional destination match
+	Mark     uint32       // optional fwmark match
+	Invert   bool         // match everything the selectors above do not
+	IPv6     bool         // address family when neither From nor To is set
+}
+
+// RemoveIP removes an address from the TUN device
+func (t *TUNDevice) RemoveIP(ipNet net.IPNet) error {
+	return removePlatformIP(t, ipNet)
+}
+
+// SetMTU changes the MTU of the TUN device
+func (t *TUNDevice) SetMTU(mtu int) error {
+	return setPlatformMTU(t, mtu)
+}
+
+// AddRouteEntry adds a route with metric and table; an identical existing route is not an error
+func (t *TUNDevice) AddRouteEntry(route Route) error {
+	return addPlatformRouteEntry(t, route)
+}
+
+// ReplaceRoute adds the route or updates an existing route to the same destination
+func (t *TUNDevice) ReplaceRoute(route Route) error {
+	return replacePlatformRoute(t, route)
+}
+
+// RemoveRoute deletes a route through the TUN device; a missing route is not an error
+func (t *TUNDevice) RemoveRoute(route Route) error {
+	return removePlatformRoute(t, route)
+}
+
+// ListRoutes returns the routes through the TUN device in all routing tables
+func (t *TUNDevice) ListRoutes() ([]Route, error) {
+	return listPlatformRoutes(t)
+}
+
+// AddRoutingRule installs a policy routing rule; an identical existing rule is not an error
+func AddRoutingRule(rule RoutingRule) error {
+	return addPlatformRule(rule)
+}
+
+// RemoveRoutingRule deletes a policy routing rule; a missing rule is not an error
+func RemoveRoutingRule(rule RoutingRule) error {
+	return removePlatformRule(rule)
+}
+
+// LookupRoute returns the route the host uses to reach dst and the name of its interface
+func LookupRoute(dst netip.Addr) (Route, string, error) {
+	return lookupPlatformRoute(dst)
+}
+
+// AddInterfaceRoute adds a route through the named interface, e.g. a host route
+// via the original gateway; an identical existing route is not an error
+func AddInterfaceRoute(ifname string, route Route) error {
+	return addInterfaceRoute(ifname, route)
+}
+
+// RemoveInterfaceIP removes an address from the named interface, e.g. one configured
+// by an earlier process; a missing interface or address is not an error
+func RemoveInterfaceIP(ifname string, prefix netip.Prefix) error {
+	return removeInterfaceIP(ifname, prefix)
+}
+
+// RemoveInterfaceRoute deletes a route through the named interface, e.g. one added
+// by an earlier process; a missing interface or route is not an error
+func RemoveInterfaceRoute(ifname string, route Route) error {
+	return removeInterfaceRoute(ifname, route)
+}
+
+// LookupRouteExcluding returns the route the host would use to reach dst if the
+// routes matched by exclude did not exist, e.g. those through the VPN's own TUN
+// device, and the name of its interface
+func LookupRouteExcluding(dst netip.Addr, exclude func(route Route, ifname string) bool) (Route, string, error) {
+	return lookupPlatformRouteExcluding(dst, exclude)
+}
+
+// NetworkChange is an address, route or link event on a host interface
+type NetworkChange struct {
+	Kind      string // address, route or link
+	Interface string // empty once the interface is gone
+}
+
+// WatchNetworkChanges reports address, route and link changes on the host until
+// ctx is done, except those on the interface named ignore. Changes are dropped
+// while the reader is busy: it only needs to know that the network moved.
+func WatchNetworkChanges(ctx context.Context, ignore string) (<-chan NetworkChange, error) {
+	return watchPlatformNetwork(ctx, ignore)
+}
+
 // getDefaultTunName returns the default TUN device name for the platform
 func getDefaultTunName() string {
 	return getDefaultPlatformTunName()
@@ -3,10 +3,15 @@
 package common
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"os/exec"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -19,36 +24,393 @@ func getDefaultPlatformTunName() string {
 	return "tun0"
 }
 
-// setPlatformIP sets the IP address on Linux
+// link looks up the netlink handle of the TUN device
+func (t *TUNDevice) link() (netlink.Link, error) {
+	link, err := netlink.LinkByName(t.Name())
+	if err != nil {
+		return nil, fmt.Errorf("%w: interface %s: %v", ErrSystemCall, t.Name(), err)
+	}
+	return link, nil
+}
+
+// setPlatformIP sets the IP address on Linux and brings the interface up
 func setPlatformIP(tunDev *TUNDevice, ipNet net.IPNet) error {
-	ip := ipNet.IP.String()
+	link, err := tunDev.link()
+	if err != nil {
+		return err
+	}
+
+	// Replace is idempotent when the address is already present
 	mask, _ := ipNet.Mask.Size()
-	
-	// Use ip command on Linux
-	cmd := exec.Command("ip", "addr", "add", fmt.Sprintf("%s/%d", ip, mask), "dev", tunDev.Name())
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to set IP address: %v, output: %s", err, string(output))
+	if err := netlink.AddrReplace(link, &netlink.Addr{IPNet: &ipNet}); err != nil {
+		return fmt.Errorf("failed to set IP address %s: %w", ipNet.String(), err)
 	}
 
 	// Bring interface up
-	cmd = exec.Command("ip", "link", "set", "dev", tunDev.Name(), "up")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to bring interface up: %v, output: %s", err, string(output))
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring interface up: %w", err)
 	}
 
-	log.Printf("Set IP address %s/%d on interface %s", ip, mask, tunDev.Name())
+	log.Printf("Set IP address %s/%d on interface %s", ipNet.IP, mask, tunDev.Name())
+	return nil
+}
+
+// removePlatformIP removes an address from the interface on Linux
+func removePlatformIP(tunDev *TUNDevice, ipNet net.IPNet) error {
+	link, err := tunDev.link()
+	if err != nil {
+		return err
+	}
+	if err := netlink.AddrDel(link, &netlink.Addr{IPNet: &ipNet}); err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) {
+		return fmt.Errorf("failed to remove IP address %s: %w", ipNet.String(), err)
+	}
+	return nil
+}
+
+// setPlatformMTU sets the interface MTU on Linux
+func setPlatformMTU(tunDev *TUNDevice, mtu int) error {
+	link, err := tunDev.link()
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU %d on %s: %w", mtu, tunDev.Name(), err)
+	}
 	return nil
 }
 
 // addPlatformRoute adds a route on Linux
 func addPlatformRoute(tunDev *TUNDevice, ipNet net.IPNet) error {
-	network := ipNet.String()
+	prefix, err := prefixFromIPNet(ipNet)
+	if err != nil {
+		return err
+	}
+	return addPlatformRouteEntry(tunDev, Route{Destination: prefix})
+}
+
+// addPlatformRouteEntry adds a route with metric and table on Linux
+func addPlatformRouteEntry(tunDev *TUNDevice, route Route) error {
+	link, err := tunDev.link()
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteAdd(toNetlinkRoute(link.Attrs().Index, route)); err != nil {
+		if errors.Is(err, unix.EEXIST) {
+			log.Printf("Route %s via %s already exists", route, tunDev.Name())
+			return nil
+		}
+		return fmt.Errorf("%w: %s via %s: %v", ErrRouteAddition, route, tunDev.Name(), err)
+	}
+	return nil
+}
+
+// replacePlatformRoute adds or updates a route on Linux
+func replacePlatformRoute(tunDev *TUNDevice, route Route) error {
+	link, err := tunDev.link()
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteReplace(toNetlinkRoute(link.Attrs().Index, route)); err != nil {
+		return fmt.Errorf("%w: %s via %s: %v", ErrRouteAddition, route, tunDev.Name(), err)
+	}
+	return nil
+}
+
+// removePlatformRoute deletes a route on Linux
+func removePlatformRoute(tunDev *TUNDevice, route Route) error {
+	link, err := tunDev.link()
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteDel(toNetlinkRoute(link.Attrs().Index, route)); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("failed to delete route %s via %s: %w", route, tunDev.Name(), err)
+	}
+	return nil
+}
+
+// listPlatformRoutes lists the routes through the interface in all tables on Linux
+func listPlatformRoutes(tunDev *TUNDevice) ([]Route, error) {
+	link, err := tunDev.link()
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &netlink.Route{LinkIndex: link.Attrs().Index, Table: unix.RT_TABLE_UNSPEC}
+	nlRoutes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes via %s: %w", tunDev.Name(), err)
+	}
+
+	routes := make([]Route, 0, len(nlRoutes))
+	for _, nlRoute := range nlRoutes {
+		// Local and broadcast routes are managed by the kernel
+		if nlRoute.Type != unix.RTN_UNICAST {
+			continue
+		}
+		routes = append(routes, fromNetlinkRoute(nlRoute))
+	}
+	return routes, nil
+}
 
-	// Use ip route command on Linux
-	cmd := exec.Command("ip", "route", "add", network, "dev", tunDev.Name())
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add route: %v, output: %s", err, string(output))
+// addPlatformRule installs a policy routing rule on Linux
+func addPlatformRule(rule RoutingRule) error {
+	if err := netlink.RuleAdd(toNetlinkRule(rule)); err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("failed to add routing rule to table %d: %w", rule.Table, err)
 	}
+	return nil
+}
 
+// removePlatformRule deletes a policy routing rule on Linux
+func removePlatformRule(rule RoutingRule) error {
+	if err := netlink.RuleDel(toNetlinkRule(rule)); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to delete routing rule to table %d: %w", rule.Table, err)
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// linkByName looks up an interface that may already be gone; nil means it does not exist
+func linkByName(ifname string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: interface %s: %v", ErrSystemCall, ifname, err)
+	}
+	return link, nil
+}
+
+// lookupPlatformRoute asks the kernel which route it would use for dst on Linux
+func lookupPlatformRoute(dst netip.Addr) (Route, string, error) {
+	nlRoutes, err := netlink.RouteGet(dst.AsSlice())
+	if err != nil {
+		return Route{}, "", fmt.Errorf("%w: no route to %s: %v", ErrSystemCall, dst, err)
+	}
+	if len(nlRoutes) == 0 {
+		return Route{}, "", fmt.Errorf("%w: no route to %s", ErrSystemCall, dst)
+	}
+	link, err := netlink.LinkByIndex(nlRoutes[0].LinkIndex)
+	if err != nil {
+		return Route{}, "", fmt.Errorf("%w: interface of route to %s: %v", ErrSystemCall, dst, err)
+	}
+	return fromNetlinkRoute(nlRoutes[0]), link.Attrs().Name, nil
+}
+
+// lookupPlatformRouteExcluding picks the most specific, then lowest metric,
+// route to dst from the main table on Linux, skipping excluded routes
+func lookupPlatformRouteExcluding(dst netip.Addr, exclude func(Route, string) bool) (Route, string, error) {
+	family := netlink.FAMILY_V4
+	if dst.Is6() {
+		family = netlink.FAMILY_V6
+	}
+	nlRoutes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return Route{}, "", fmt.Errorf("%w: failed to list routes: %v", ErrSystemCall, err)
+	}
+
+	names := make(map[int]string)
+	for _, nlRoute := range nlRoutes {
+		if _, ok := names[nlRoute.LinkIndex]; !ok {
+			if link, err := netlink.LinkByIndex(nlRoute.LinkIndex); err == nil {
+				names[nlRoute.LinkIndex] = link.Attrs().Name
+			}
+		}
+	}
+	route, ifname, ok := bestRoute(nlRoutes, names, dst, exclude)
+	if !ok {
+		return Route{}, "", fmt.Errorf("%w: no route to %s", ErrSystemCall, dst)
+	}
+	return route, ifname, nil
+}
+
+// bestRoute selects the route to dst like the kernel does for the main table:
+// longest prefix first, then lowest metric
+func bestRoute(nlRoutes []netlink.Route, names map[int]string, dst netip.Addr, exclude func(Route, string) bool) (Route, string, bool) {
+	var best Route
+	var bestName string
+	found := false
+	for _, nlRoute := range nlRoutes {
+		route := fromNetlinkRoute(nlRoute)
+		ifname := names[nlRoute.LinkIndex]
+		if !route.Destination.Contains(dst) || (exclude != nil && exclude(route, ifname)) {
+			continue
+		}
+		if found && (route.Destination.Bits() < best.Destination.Bits() ||
+			route.Destination.Bits() == best.Destination.Bits() && route.Metric >= best.Metric) {
+			continue
+		}
+		best, bestName, found = route, ifname, true
+	}
+	return best, bestName, found
+}
+
+// watchPlatformNetwork subscribes to rtnetlink address, route and link events on Linux
+func watchPlatformNetwork(ctx context.Context, ignore string) (<-chan NetworkChange, error) {
+	done := make(chan struct{})
+	addrs := make(chan netlink.AddrUpdate, 16)
+	routes := make(chan netlink.RouteUpdate, 16)
+	links := make(chan netlink.LinkUpdate, 16)
+	if err := netlink.AddrSubscribe(addrs, done); err != nil {
+		close(done)
+		return nil, fmt.Errorf("%w: failed to subscribe to address events: %v", ErrSystemCall, err)
+	}
+	if err := netlink.RouteSubscribe(routes, done); err != nil {
+		close(done)
+		return nil, fmt.Errorf("%w: failed to subscribe to route events: %v", ErrSystemCall, err)
+	}
+	if err := netlink.LinkSubscribe(links, done); err != nil {
+		close(done)
+		return nil, fmt.Errorf("%w: failed to subscribe to link events: %v", ErrSystemCall, err)
+	}
+
+	changes := make(chan NetworkChange, 1)
+	go func() {
+		defer close(changes)
+		defer close(done)
+		for {
+			var change NetworkChange
+			index := 0
+			select {
+			case <-ctx.Done():
+				return
+			case update, ok := <-addrs:
+				if !ok {
+					return
+				}
+				change.Kind, index = "address", update.LinkIndex
+			case update, ok := <-routes:
+				if !ok {
+					return
+				}
+				change.Kind, index = "route", update.LinkIndex
+			case update, ok := <-links:
+				if !ok {
+					return
+				}
+				change.Kind, change.Interface = "link", update.Attrs().Name
+			}
+
+			if change.Interface == "" && index != 0 {
+				if link, err := netlink.LinkByIndex(index); err == nil {
+					change.Interface = link.Attrs().Name
+				}
+			}
+			if ignore != "" && change.Interface == ignore {
+				continue
+			}
+			select {
+			case changes <- change:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// addInterfaceRoute adds a route through the named interface on Linux
+func addInterfaceRoute(ifname string, route Route) error {
+	link, err := linkByName(ifname)
+	if err != nil {
+		return err
+	}
+	if link == nil {
+		return fmt.Errorf("%w: %s via %s: no such interface", ErrRouteAddition, route, ifname)
+	}
+	if err := netlink.RouteAdd(toNetlinkRoute(link.Attrs().Index, route)); err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("%w: %s via %s: %v", ErrRouteAddition, route, ifname, err)
+	}
+	return nil
+}
+
+// removeInterfaceIP removes an address from the named interface on Linux
+func removeInterfaceIP(ifname string, prefix netip.Prefix) error {
+	link, err := linkByName(ifname)
+	if err != nil || link == nil {
+		return err
+	}
+	if err := netlink.AddrDel(link, &netlink.Addr{IPNet: PrefixToIPNet(prefix)}); err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) {
+		return fmt.Errorf("failed to remove IP address %s from %s: %w", prefix, ifname, err)
+	}
+	return nil
+}
+
+// removeInterfaceRoute deletes a route through the named interface on Linux
+func removeInterfaceRoute(ifname string, route Route) error {
+	link, err := linkByName(ifname)
+	if err != nil || link == nil {
+		return err
+	}
+	if err := netlink.RouteDel(toNetlinkRoute(link.Attrs().Index, route)); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("failed to delete route %s via %s: %w", route, ifname, err)
+	}
+	return nil
+}
+
+// toNetlinkRoute converts a Route through the interface with index linkIndex
+func toNetlinkRoute(linkIndex int, route Route) *netlink.Route {
+	nlRoute := &netlink.Route{
+		LinkIndex: linkIndex,
+		Dst:       PrefixToIPNet(route.Destination.Masked()),
+		Priority:  route.Metric,
+		Table:     route.Table,
+		Scope:     netlink.SCOPE_LINK,
+	}
+	if route.Gateway.IsValid() {
+		nlRoute.Gw = route.Gateway.AsSlice()
+		nlRoute.Scope = netlink.SCOPE_UNIVERSE
+	}
+	return nlRoute
+}
+
+// fromNetlinkRoute converts a kernel route; a missing destination is the default route
+func fromNetlinkRoute(nlRoute netlink.Route) Route {
+	var route Route
+	if nlRoute.Dst != nil {
+		route.Destination, _ = prefixFromIPNet(*nlRoute.Dst)
+	} else if nlRoute.Family == netlink.FAMILY_V6 {
+		route.Destination = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	} else {
+		route.Destination = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+	}
+	if gw, ok := netip.AddrFromSlice(nlRoute.Gw); ok {
+		route.Gateway = gw.Unmap()
+	}
+	route.Metric = nlRoute.Priority
+	if nlRoute.Table != unix.RT_TABLE_MAIN {
+		route.Table = nlRoute.Table
+	}
+	return route
+}
+
+// toNetlinkRule converts a RoutingRule
+func toNetlinkRule(rule RoutingRule) *netlink.Rule {
+	nlRule := netlink.NewRule()
+	nlRule.Priority = rule.Priority
+	nlRule.Table = rule.Table
+	nlRule.Invert = rule.Invert
+	nlRule.Family = netlink.FAMILY_V4
+	if rule.IPv6 || rule.From.Addr().Is6() || rule.To.Addr().Is6() {
+		nlRule.Family = netlink.FAMILY_V6
+	}
+	if rule.From.IsValid() {
+		nlRule.Src = PrefixToIPNet(rule.From.Masked())
+	}
+	if rule.To.IsValid() {
+		nlRule.Dst = PrefixToIPNet(rule.To.Masked())
+	}
+	if rule.Mark != 0 {
+		nlRule.Mark = rule.Mark
+	}
+	return nlRule
+}
+
+// prefixFromIPNet converts a net.IPNet to netip.Prefix
+func prefixFromIPNet(ipNet net.IPNet) (netip.Prefix, error) {
+	addr, ok := netip.AddrFromSlice(ipNet.IP)
+	if !ok {
+		return netip.Prefix{}, fmt.Errorf("%w: invalid network %s", ErrInvalidConfig, ipNet.String())
+	}
+	bits, _ := ipNet.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), bits).Masked(), nil
+}
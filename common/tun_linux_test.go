@@ -0,0 +1,110 @@
+//go:build linux
+
+package common
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestNetlinkRouteConversion(t *testing.T) {
+	route := Route{
+		Destination: netip.MustParsePrefix("192.168.10.7/24"),
+		Gateway:     netip.MustParseAddr("10.0.0.1"),
+		Metric:      50,
+		Table:       100,
+	}
+	nlRoute := toNetlinkRoute(7, route)
+	assert.Equal(t, 7, nlRoute.LinkIndex)
+	assert.Equal(t, "192.168.10.0/24", nlRoute.Dst.String())
+	assert.Equal(t, netlink.Scope(netlink.SCOPE_UNIVERSE), nlRoute.Scope)
+
+	back := fromNetlinkRoute(*nlRoute)
+	assert.Equal(t, netip.MustParsePrefix("192.168.10.0/24"), back.Destination)
+	assert.Equal(t, route.Gateway, back.Gateway)
+	assert.Equal(t, 50, back.Metric)
+	assert.Equal(t, 100, back.Table)
+	assert.Equal(t, "192.168.10.0/24 via 10.0.0.1 metric 50 table 100", back.String())
+
+	// A route without a gateway is on-link; the main table is reported as 0
+	onLink := toNetlinkRoute(7, Route{Destination: netip.MustParsePrefix("fd00::/64")})
+	assert.Equal(t, netlink.Scope(netlink.SCOPE_LINK), onLink.Scope)
+	onLink.Table = unix.RT_TABLE_MAIN
+	assert.Equal(t, Route{Destination: netip.MustParsePrefix("fd00::/64")}, fromNetlinkRoute(*onLink))
+
+	// The kernel reports default routes without a Dst
+	assert.Equal(t, netip.MustParsePrefix("::/0"),
+		fromNetlinkRoute(netlink.Route{Family: netlink.FAMILY_V6, Table: unix.RT_TABLE_MAIN}).Destination)
+	assert.Equal(t, netip.MustParsePrefix("0.0.0.0/0"),
+		fromNetlinkRoute(netlink.Route{Family: netlink.FAMILY_V4, Table: unix.RT_TABLE_MAIN}).Destination)
+}
+
+func TestNetlinkRuleConversion(t *testing.T) {
+	rule := toNetlinkRule(RoutingRule{
+		Priority: 1000,
+		Table:    51820,
+		From:     netip.MustParsePrefix("10.0.0.2/32"),
+		Mark:     0x1,
+		Invert:   true,
+	})
+	assert.Equal(t, netlink.FAMILY_V4, rule.Family)
+	assert.Equal(t, 1000, rule.Priority)
+	assert.Equal(t, 51820, rule.Table)
+	assert.Equal(t, "10.0.0.2/32", rule.Src.String())
+	assert.Nil(t, rule.Dst)
+	assert.Equal(t, uint32(1), rule.Mark)
+	assert.True(t, rule.Invert)
+
+	assert.Equal(t, netlink.FAMILY_V6, toNetlinkRule(RoutingRule{Table: 100, IPv6: true}).Family)
+	assert.Equal(t, netlink.FAMILY_V6, toNetlinkRule(RoutingRule{Table: 100, To: netip.MustParsePrefix("2001:db8::/32")}).Family)
+}
+
+func TestPrefixFromIPNet(t *testing.T) {
+	_, ipNet, err := net.ParseCIDR("10.1.2.3/16")
+	require.NoError(t, err)
+	prefix, err := prefixFromIPNet(*ipNet)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("10.1.0.0/16"), prefix)
+
+	_, err = prefixFromIPNet(net.IPNet{})
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+func TestBestRoute(t *testing.T) {
+	mustNet := func(s string) *net.IPNet {
+		_, ipNet, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return ipNet
+	}
+	nlRoutes := []netlink.Route{
+		{LinkIndex: 2, Gw: net.ParseIP("192.168.1.1"), Priority: 600, Table: unix.RT_TABLE_MAIN, Family: netlink.FAMILY_V4},
+		{LinkIndex: 3, Gw: net.ParseIP("10.1.0.1"), Priority: 100, Table: unix.RT_TABLE_MAIN, Family: netlink.FAMILY_V4},
+		{LinkIndex: 9, Dst: mustNet("0.0.0.0/1"), Table: unix.RT_TABLE_MAIN, Family: netlink.FAMILY_V4},
+		{LinkIndex: 2, Dst: mustNet("192.168.1.0/24"), Table: unix.RT_TABLE_MAIN, Family: netlink.FAMILY_V4},
+	}
+	names := map[int]string{2: "wlan0", 3: "eth0", 9: "tun0"}
+	notTun := func(route Route, ifname string) bool { return ifname == "tun0" }
+
+	// The more specific tunnel route wins unless it is excluded
+	_, ifname, ok := bestRoute(nlRoutes, names, netip.MustParseAddr("8.8.8.8"), nil)
+	require.True(t, ok)
+	assert.Equal(t, "tun0", ifname)
+
+	// Among default routes the lower metric wins
+	route, ifname, ok := bestRoute(nlRoutes, names, netip.MustParseAddr("8.8.8.8"), notTun)
+	require.True(t, ok)
+	assert.Equal(t, "eth0", ifname)
+	assert.Equal(t, netip.MustParseAddr("10.1.0.1"), route.Gateway)
+
+	_, ifname, _ = bestRoute(nlRoutes, names, netip.MustParseAddr("192.168.1.20"), notTun)
+	assert.Equal(t, "wlan0", ifname)
+
+	_, _, ok = bestRoute(nlRoutes, names, netip.MustParseAddr("fd00::1"), notTun)
+	assert.False(t, ok)
+}
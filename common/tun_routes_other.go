@@ -0,0 +1,84 @@
+//go:build !linux
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+)
+
+// removePlatformIP is not implemented on this platform
+func removePlatformIP(tunDev *TUNDevice, ipNet net.IPNet) error {
+	return fmt.Errorf("%w: removing addresses on %s", ErrNotSupported, runtime.GOOS)
+}
+
+// setPlatformMTU is not implemented on this platform
+func setPlatformMTU(tunDev *TUNDevice, mtu int) error {
+	return fmt.Errorf("%w: changing MTU on %s", ErrNotSupported, runtime.GOOS)
+}
+
+// addPlatformRouteEntry adds plain routes only; metric and table need Linux
+func addPlatformRouteEntry(tunDev *TUNDevice, route Route) error {
+	if route.Gateway.IsValid() || route.Metric != 0 || route.Table != 0 {
+		return fmt.Errorf("%w: route gateway, metric and table on %s", ErrNotSupported, runtime.GOOS)
+	}
+	return addPlatformRoute(tunDev, *PrefixToIPNet(route.Destination.Masked()))
+}
+
+// replacePlatformRoute is not implemented on this platform
+func replacePlatformRoute(tunDev *TUNDevice, route Route) error {
+	return fmt.Errorf("%w: replacing routes on %s", ErrNotSupported, runtime.GOOS)
+}
+
+// removePlatformRoute is not implemented on this platform
+func removePlatformRoute(tunDev *TUNDevice, route Route) error {
+	return fmt.Errorf("%w: removing routes on %s", ErrNotSupported, runtime.GOOS)
+}
+
+// listPlatformRoutes is not implemented on this platform
+func listPlatformRoutes(tunDev *TUNDevice) ([]Route, error) {
+	return nil, fmt.Errorf("%w: listing routes on %s", ErrNotSupported, runtime.GOOS)
+}
+
+// addPlatformRule is not implemented on this platform
+func addPlatformRule(rule RoutingRule) error {
+	return fmt.Errorf("%w: policy routing on %s", ErrNotSupported, runtime.GOOS)
+}
+
+// removePlatformRule is not implemented on this platform
+func removePlatformRule(rule RoutingRule) error {
+	return fmt.Errorf("%w: policy routing on %s", ErrNotSupported, runtime.GOOS)
+}
+
+// removeInterfaceIP is not implemented on this platform
+func removeInterfaceIP(ifname string, prefix netip.Prefix) error {
+	return fmt.Errorf("%w: removing addresses on %s", ErrNotSupported, runtime.GOOS)
+}
+
+// removeInterfaceRoute is not implemented on this platform
+func removeInterfaceRoute(ifname string, route Route) error {
+	return fmt.Errorf("%w: removing routes on %s", ErrNotSupported, runtime.GOOS)
+}
+
+// lookupPlatformRoute is not implemented on this platform
+func lookupPlatformRoute(dst netip.Addr) (Route, string, error) {
+	return Route{}, "", fmt.Errorf("%w: route lookup on %s", ErrNotSupported, runtime.GOOS)
+}
+
+// addInterfaceRoute is not implemented on this platform
+func addInterfaceRoute(ifname string, route Route) error {
+	return fmt.Errorf("%w: routes via other interfaces on %s", ErrNotSupported, runtime.GOOS)
+}
+
+// lookupPlatformRouteExcluding is not implemented on this platform
+func lookupPlatformRouteExcluding(dst netip.Addr, exclude func(Route, string) bool) (Route, string, error) {
+	return Route{}, "", fmt.Errorf("%w: route lookup on %s", ErrNotSupported, runtime.GOOS)
+}
+
+// watchPlatformNetwork is not implemented on this platform
+func watchPlatformNetwork(ctx context.Context, ignore string) (<-chan NetworkChange, error) {
+	return nil, fmt.Errorf("%w: network change events on %s", ErrNotSupported, runtime.GOOS)
+}
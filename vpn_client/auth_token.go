@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// loadAuthToken returns the bearer token sent with CONNECT-IP, or "" if none
+// is configured. It is read on every connect so rotated tokens are picked up.
+func loadAuthToken(config common.ClientConfig) (string, error) {
+	if config.AuthTokenFile != "" {
+		data, err := os.ReadFile(config.AuthTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read auth token file %s: %w", config.AuthTokenFile, err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("%w: auth token file %s is empty", common.ErrMissingConfig, config.AuthTokenFile)
+		}
+		return token, nil
+	}
+
+	if config.AuthTokenEnv != "" {
+		token := strings.TrimSpace(os.Getenv(config.AuthTokenEnv))
+		if token == "" {
+			return "", fmt.Errorf("%w: environment variable %s is not set", common.ErrMissingConfig, config.AuthTokenEnv)
+		}
+		return token, nil
+	}
+
+	return "", nil
+}
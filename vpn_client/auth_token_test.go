@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadAuthToken(t *testing.T) {
+	token, err := loadAuthToken(common.ClientConfig{})
+	require.NoError(t, err)
+	assert.Empty(t, token)
+
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("eyJhbGciOiJFUzI1NiJ9.e30.sig\n"), 0600))
+	t.Setenv("MASQUE_VPN_TOKEN", "from-env")
+
+	// The file takes precedence over the environment
+	token, err = loadAuthToken(common.ClientConfig{AuthTokenFile: path, AuthTokenEnv: "MASQUE_VPN_TOKEN"})
+	require.NoError(t, err)
+	assert.Equal(t, "eyJhbGciOiJFUzI1NiJ9.e30.sig", token)
+
+	token, err = loadAuthToken(common.ClientConfig{AuthTokenEnv: "MASQUE_VPN_TOKEN"})
+	require.NoError(t, err)
+	assert.Equal(t, "from-env", token)
+
+	_, err = loadAuthToken(common.ClientConfig{AuthTokenEnv: "MASQUE_VPN_TOKEN_UNSET"})
+	assert.ErrorIs(t, err, common.ErrMissingConfig)
+
+	_, err = loadAuthToken(common.ClientConfig{AuthTokenFile: filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// maxImportedConfigSize bounds configs downloaded from a bundle URL
+const maxImportedConfigSize = 1 << 20
+
+// adminTokenEnv holds the server admin token sent when downloading a bundle;
+// bundle links are served on the admin API
+const adminTokenEnv = "MASQUE_ADMIN_TOKEN"
+
+// runSubcommand dispatches client subcommands. It reports whether args named
+// a subcommand, so main can fall through to connecting.
+func runSubcommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	switch args[0] {
+	case "import":
+		return true, runImportCommand(args[1:])
+	case "enroll":
+		return true, runEnrollCommand(args[1:])
+	case "status":
+		return true, runStatusCommand(args[1:])
+	case "disconnect":
+		return true, runDisconnectCommand(args[1:])
+	default:
+		return false, nil
+	}
+}
+
+// runImportCommand writes a client config taken from a masque:// URI, a
+// one-time bundle download URL or a local file.
+func runImportCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	output := fs.String("o", "config.client.toml", "Where to write the imported config")
+	force := fs.Bool("f", false, "Overwrite an existing config file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: vpn-client import [-o config.client.toml] [-f] <masque://... | https://.../api/v1/bundles/<token> | file>")
+		fmt.Fprintln(fs.Output(), "Bundle links need the server admin token in $"+adminTokenEnv+" unless fetched from the server host.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("exactly one config source is required")
+	}
+
+	data, err := readConfigSource(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := validateImportedConfig(data); err != nil {
+		return err
+	}
+
+	if !*force {
+		if _, err := os.Stat(*output); err == nil {
+			return fmt.Errorf("%s already exists, use -f to overwrite", *output)
+		}
+	}
+
+	// The config embeds the client private key
+	if err := common.WriteFileAtomic(*output, data, 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported client config to %s\n", *output)
+	return nil
+}
+
+// readConfigSource loads raw TOML from a masque:// URI, an HTTP(S) URL or a file
+func readConfigSource(source string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(source, common.ConfigURIScheme+"://"):
+		return common.DecodeConfigURI(source)
+
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		req, err := http.NewRequest(http.MethodGet, source, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config URL: %w", err)
+		}
+		if token := os.Getenv(adminTokenEnv); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download config: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return nil, fmt.Errorf("failed to download config: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxImportedConfigSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to download config: %w", err)
+		}
+		if len(data) > maxImportedConfigSize {
+			return nil, fmt.Errorf("downloaded config exceeds %d bytes", maxImportedConfigSize)
+		}
+		return data, nil
+
+	default:
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", source, err)
+		}
+		return data, nil
+	}
+}
+
+// validateImportedConfig checks that data is a usable client config
+func validateImportedConfig(data []byte) error {
+	var config common.ClientConfig
+	if _, err := toml.Decode(string(data), &config); err != nil {
+		return fmt.Errorf("%w: imported config is not valid TOML: %v", common.ErrInvalidConfig, err)
+	}
+
+	var missing []string
+	if len(config.Servers) > 0 {
+		if err := validateServers(configuredServers(config)); err != nil {
+			return err
+		}
+	} else {
+		if config.ServerAddr == "" {
+			missing = append(missing, "server_addr")
+		}
+		if config.ServerName == "" {
+			missing = append(missing, "server_name")
+		}
+	}
+	if config.CertPEM == "" && config.TLSCert == "" {
+		missing = append(missing, "cert_pem")
+	}
+	if config.KeyPEM == "" && config.TLSKey == "" {
+		missing = append(missing, "key_pem")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: imported config lacks %s", common.ErrMissingConfig, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// runDisconnectCommand undoes the network changes a stopped client left in
+// place, such as the kill switch after the connection was lost
+func runDisconnectCommand(args []string) error {
+	fs := flag.NewFlagSet("disconnect", flag.ExitOnError)
+	configFile := fs.String("c", "config.client.toml", "Config file path")
+	fs.Parse(args)
+
+	if _, err := toml.DecodeFile(*configFile, &clientConfig); err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *configFile, err)
+	}
+	if err := initLogger(clientConfig.LogLevel); err != nil {
+		return err
+	}
+	defer logger.Sync()
+
+	journal = newChangeJournal(clientConfig.JournalFile)
+	if err := journal.Recover(); err != nil {
+		return err
+	}
+	fmt.Println("Network changes of the VPN client removed")
+	return nil
+}
+
+// exitOnSubcommandError prints err and exits if a subcommand failed
+func exitOnSubcommandError(err error) {
+	if err == nil {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(1)
+}
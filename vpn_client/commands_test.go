@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testImportedConfig = `server_addr = "vpn.example.com:4433"
+server_name = "vpn.example.com"
+cert_pem = "cert"
+key_pem = "key"
+`
+
+func TestReadConfigSource(t *testing.T) {
+	uri, err := common.EncodeConfigURI([]byte(testImportedConfig))
+	require.NoError(t, err)
+
+	data, err := readConfigSource(uri)
+	require.NoError(t, err)
+	assert.Equal(t, testImportedConfig, string(data))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer admin-token" {
+			http.Error(w, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/bundles/token" {
+			http.Error(w, "Bundle token not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(testImportedConfig))
+	}))
+	defer srv.Close()
+
+	t.Setenv(adminTokenEnv, "")
+	_, err = readConfigSource(srv.URL + "/api/v1/bundles/token")
+	assert.ErrorContains(t, err, "401")
+
+	t.Setenv(adminTokenEnv, "admin-token")
+	data, err = readConfigSource(srv.URL + "/api/v1/bundles/token")
+	require.NoError(t, err)
+	assert.Equal(t, testImportedConfig, string(data))
+
+	_, err = readConfigSource(srv.URL + "/api/v1/bundles/used")
+	assert.Error(t, err)
+}
+
+func TestRunImportCommand(t *testing.T) {
+	uri, err := common.EncodeConfigURI([]byte(testImportedConfig))
+	require.NoError(t, err)
+
+	output := filepath.Join(t.TempDir(), "config.client.toml")
+	require.NoError(t, runImportCommand([]string{"-o", output, uri}))
+
+	info, err := os.Stat(output)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Existing config is kept unless -f is given
+	assert.Error(t, runImportCommand([]string{"-o", output, uri}))
+	assert.NoError(t, runImportCommand([]string{"-o", output, "-f", uri}))
+}
+
+func TestValidateImportedConfig(t *testing.T) {
+	assert.NoError(t, validateImportedConfig([]byte(testImportedConfig)))
+	assert.ErrorIs(t, validateImportedConfig([]byte(`server_addr = "x:1"`)), common.ErrMissingConfig)
+	assert.ErrorIs(t, validateImportedConfig([]byte(`server_addr = `)), common.ErrInvalidConfig)
+}
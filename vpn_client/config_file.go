@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// sectionHeaderRe matches the first TOML table header, which ends the top-level keys
+var sectionHeaderRe = regexp.MustCompile(`(?m)^[ \t]*\[`)
+
+// setConfigStrings sets top-level string keys of a TOML document in place,
+// keeping comments and the layout of everything else. Missing keys are
+// appended to the top-level section.
+func setConfigStrings(doc []byte, values map[string]string) []byte {
+	top, rest := doc, []byte(nil)
+	if loc := sectionHeaderRe.FindIndex(doc); loc != nil {
+		top, rest = doc[:loc[0]], doc[loc[0]:]
+	}
+	top = append([]byte(nil), top...)
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		line := []byte(key + " = " + tomlString(values[key]))
+		re := regexp.MustCompile(`(?ms)^[ \t]*` + regexp.QuoteMeta(key) +
+			`[ \t]*=[ \t]*('''.*?'''|""".*?"""|'[^'\n]*'|"(?:[^"\\\n]|\\.)*")`)
+		if loc := re.FindIndex(top); loc != nil {
+			top = append(top[:loc[0]], append(line, top[loc[1]:]...)...)
+			continue
+		}
+		if len(top) > 0 && !bytes.HasSuffix(top, []byte("\n")) {
+			top = append(top, '\n')
+		}
+		top = append(top, line...)
+		top = append(top, '\n')
+	}
+
+	if len(rest) > 0 && !bytes.HasSuffix(top, []byte("\n\n")) {
+		top = append(top, '\n')
+	}
+	return append(top, rest...)
+}
+
+// tomlString formats value as a TOML string, using a multi-line literal for PEM blocks
+func tomlString(value string) string {
+	if strings.Contains(value, "\n") && !strings.Contains(value, "'''") {
+		return "'''\n" + strings.TrimRight(value, "\n") + "\n'''"
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// saveClientCredentials atomically stores a new client certificate and key.
+// Configs that reference tls_cert/tls_key files get those files rewritten;
+// otherwise the cert_pem/key_pem (and ca_pem, if given) fields are updated.
+func saveClientCredentials(configPath string, certPEM, keyPEM, caPEM []byte) error {
+	doc, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config %s: %w", configPath, err)
+	}
+
+	var config common.ClientConfig
+	if _, err := toml.Decode(string(doc), &config); err != nil {
+		return fmt.Errorf("failed to parse config %s: %w", configPath, err)
+	}
+
+	if config.CertPEM == "" && config.TLSCert != "" && config.TLSKey != "" {
+		// Key first: a crash in between leaves the old cert, which fails loudly
+		// on key mismatch rather than silently using a stale key.
+		if err := common.WriteFileAtomic(config.TLSKey, keyPEM, 0600); err != nil {
+			return err
+		}
+		if err := common.WriteFileAtomic(config.TLSCert, certPEM, 0644); err != nil {
+			return err
+		}
+		if len(caPEM) > 0 && config.CAFile != "" && config.CAPEM == "" {
+			return common.WriteFileAtomic(config.CAFile, caPEM, 0644)
+		}
+		return nil
+	}
+
+	values := map[string]string{
+		"cert_pem": string(certPEM),
+		"key_pem":  string(keyPEM),
+	}
+	if len(caPEM) > 0 && config.CAFile == "" {
+		values["ca_pem"] = string(caPEM)
+	}
+	return common.WriteFileAtomic(configPath, setConfigStrings(doc, values), 0600)
+}
+
+// configExists reports whether a config file is present at path
+func configExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
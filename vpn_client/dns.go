@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+// dns_mode values
+const (
+	dnsModeAuto       = "auto"
+	dnsModeResolved   = "resolved"
+	dnsModeResolvConf = "resolv.conf"
+	dnsModeOff        = "off"
+)
+
+// maxResolvConfServers is how many nameserver lines the libc resolver reads
+const maxResolvConfServers = 3
+
+var (
+	resolvConfPath     = "/etc/resolv.conf"
+	resolvedRuntimeDir = "/run/systemd/resolve"
+
+	// resolvectl runs resolvectl with args; replaced in tests
+	resolvectl = func(args ...string) error {
+		output, err := exec.Command("resolvectl", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("resolvectl %s: %w: %s", strings.Join(args, " "), err, bytes.TrimSpace(output))
+		}
+		return nil
+	}
+)
+
+// applyDNS points the host resolver at the DNS servers pushed by the server
+// and records the change in the journal. It returns the mode that was used.
+func applyDNS(tunName string, servers []netip.Addr, search []string) (string, error) {
+	mode := clientConfig.DNSMode
+	if mode == "" {
+		mode = dnsModeAuto
+	}
+	if mode == dnsModeOff {
+		return mode, nil
+	}
+	if runtime.GOOS != "linux" {
+		return mode, fmt.Errorf("%w: applying DNS settings on %s", common.ErrNotSupported, runtime.GOOS)
+	}
+
+	if mode == dnsModeAuto {
+		mode = dnsModeResolvConf
+		if resolvedAvailable() {
+			mode = dnsModeResolved
+		}
+	}
+
+	switch mode {
+	case dnsModeResolved:
+		return mode, setResolvedDNS(tunName, servers, search)
+	case dnsModeResolvConf:
+		return mode, writeResolvConf(servers, search)
+	}
+	return mode, fmt.Errorf("%w: dns_mode %q (auto, resolved, resolv.conf, off)", common.ErrInvalidConfig, mode)
+}
+
+// resolvedAvailable reports whether systemd-resolved is running and resolvectl is installed
+func resolvedAvailable() bool {
+	if _, err := os.Stat(resolvedRuntimeDir); err != nil {
+		return false
+	}
+	_, err := exec.LookPath("resolvectl")
+	return err == nil
+}
+
+// setResolvedDNS configures per-link DNS on the TUN device in systemd-resolved
+func setResolvedDNS(tunName string, servers []netip.Addr, search []string) error {
+	entry := journalEntry{Kind: changeDNS, Interface: tunName, DNS: &dnsChange{Link: tunName}}
+	return journal.Apply(entry, func() error {
+		args := []string{"dns", tunName}
+		for _, server := range servers {
+			args = append(args, server.String())
+		}
+		if err := resolvectl(args...); err != nil {
+			return err
+		}
+		if len(search) > 0 {
+			if err := resolvectl(append([]string{"domain", tunName}, search...)...); err != nil {
+				return err
+			}
+		}
+		// Use the link for names outside the search domains as well
+		return resolvectl("default-route", tunName, "yes")
+	})
+}
+
+// revertResolvedDNS drops the per-link DNS settings; a link that is gone has none left
+func revertResolvedDNS(link string) error {
+	if _, err := net.InterfaceByName(link); err != nil {
+		return nil
+	}
+	return resolvectl("revert", link)
+}
+
+// writeResolvConf replaces resolv.conf, keeping a backup of the original next
+// to it. The journal holds the original too, so it survives a crash.
+func writeResolvConf(servers []netip.Addr, search []string) error {
+	change := &dnsChange{Path: resolvConfPath, Backup: resolvConfPath + ".masque-vpn.bak"}
+	if info, err := os.Lstat(resolvConfPath); err == nil {
+		change.Existed = true
+		if info.Mode()&os.ModeSymlink != 0 {
+			if change.SymlinkTarget, err = os.Readlink(resolvConfPath); err != nil {
+				return fmt.Errorf("failed to read %s: %w", resolvConfPath, err)
+			}
+		}
+		// A dangling symlink has no contents to keep
+		if change.Previous, err = os.ReadFile(resolvConfPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to read %s: %w", resolvConfPath, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", resolvConfPath, err)
+	}
+
+	return journal.Apply(journalEntry{Kind: changeDNS, DNS: change}, func() error {
+		if change.Existed {
+			if err := common.WriteFileAtomic(change.Backup, change.Previous, 0644); err != nil {
+				return err
+			}
+		}
+		// Replacing the path swaps out a symlink instead of writing through it
+		return common.WriteFileAtomic(resolvConfPath, resolvConfContents(change.Previous, servers, search), 0644)
+	})
+}
+
+// resolvConfContents renders resolv.conf for the VPN, keeping the original options lines
+func resolvConfContents(previous []byte, servers []netip.Addr, search []string) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Written by masque-vpn client while connected; the original is restored on disconnect\n")
+	for i, server := range servers {
+		if i == maxResolvConfServers {
+			break
+		}
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(previous))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "options") {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.Bytes()
+}
+
+// restoreResolvConf puts back the resolver configuration saved by writeResolvConf
+func restoreResolvConf(change *dnsChange) error {
+	var err error
+	switch {
+	case change.SymlinkTarget != "":
+		if err = os.Remove(change.Path); err == nil || errors.Is(err, os.ErrNotExist) {
+			err = os.Symlink(change.SymlinkTarget, change.Path)
+		}
+	case change.Existed:
+		err = common.WriteFileAtomic(change.Path, change.Previous, 0644)
+	default:
+		if err = os.Remove(change.Path); errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if change.Backup != "" {
+		if err := os.Remove(change.Backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Failed to remove resolv.conf backup", zap.String("path", change.Backup), zap.Error(err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// useTestDNS points resolv.conf, the journal and resolvectl at test doubles
+func useTestDNS(t *testing.T) (dir string, calls *[][]string) {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skip("DNS settings are applied on Linux only")
+	}
+	dir = t.TempDir()
+	logger = zap.NewNop()
+
+	previousPath, previousResolved, previousCtl, previousJournal := resolvConfPath, resolvedRuntimeDir, resolvectl, journal
+	t.Cleanup(func() {
+		resolvConfPath, resolvedRuntimeDir, resolvectl, journal = previousPath, previousResolved, previousCtl, previousJournal
+		clientConfig.DNSMode = ""
+	})
+
+	resolvConfPath = filepath.Join(dir, "resolv.conf")
+	resolvedRuntimeDir = filepath.Join(dir, "missing")
+	journal = newChangeJournal(filepath.Join(dir, "client.journal"))
+	calls = &[][]string{}
+	resolvectl = func(args ...string) error {
+		*calls = append(*calls, args)
+		return nil
+	}
+	return dir, calls
+}
+
+func TestApplyDNS_ResolvConf(t *testing.T) {
+	dir, _ := useTestDNS(t)
+	original := "nameserver 192.168.1.1\noptions edns0 trust-ad\n"
+	require.NoError(t, os.WriteFile(resolvConfPath, []byte(original), 0644))
+
+	servers := []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")}
+	mode, err := applyDNS("tun0", servers, []string{"corp.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, dnsModeResolvConf, mode)
+
+	data, err := os.ReadFile(resolvConfPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "nameserver 10.0.0.1\nnameserver fd00::1\nsearch corp.example.com\noptions edns0 trust-ad\n")
+	backup, err := os.ReadFile(filepath.Join(dir, "resolv.conf.masque-vpn.bak"))
+	require.NoError(t, err)
+	assert.Equal(t, original, string(backup))
+
+	require.NoError(t, journal.Rollback())
+	data, err = os.ReadFile(resolvConfPath)
+	require.NoError(t, err)
+	assert.Equal(t, original, string(data))
+	assert.NoFileExists(t, filepath.Join(dir, "resolv.conf.masque-vpn.bak"))
+}
+
+func TestApplyDNS_ResolvConfSymlink(t *testing.T) {
+	dir, _ := useTestDNS(t)
+	stub := filepath.Join(dir, "stub-resolv.conf")
+	require.NoError(t, os.WriteFile(stub, []byte("nameserver 127.0.0.53\n"), 0644))
+	require.NoError(t, os.Symlink(stub, resolvConfPath))
+
+	_, err := applyDNS("tun0", []netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil)
+	require.NoError(t, err)
+
+	// The symlink is replaced, its target left alone
+	info, err := os.Lstat(resolvConfPath)
+	require.NoError(t, err)
+	assert.Zero(t, info.Mode()&os.ModeSymlink)
+	data, err := os.ReadFile(stub)
+	require.NoError(t, err)
+	assert.Equal(t, "nameserver 127.0.0.53\n", string(data))
+
+	// After a crash the next start restores the symlink from the journal
+	restarted := newChangeJournal(journal.path)
+	require.NoError(t, restarted.Recover())
+	target, err := os.Readlink(resolvConfPath)
+	require.NoError(t, err)
+	assert.Equal(t, stub, target)
+}
+
+func TestApplyDNS_Resolved(t *testing.T) {
+	_, calls := useTestDNS(t)
+	clientConfig.DNSMode = dnsModeResolved
+
+	mode, err := applyDNS("tun0", []netip.Addr{netip.MustParseAddr("10.0.0.1")}, []string{"corp.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, dnsModeResolved, mode)
+	assert.Equal(t, [][]string{
+		{"dns", "tun0", "10.0.0.1"},
+		{"domain", "tun0", "corp.example.com"},
+		{"default-route", "tun0", "yes"},
+	}, *calls)
+	assert.NoFileExists(t, resolvConfPath)
+
+	// The link is gone with the TUN device, so there is nothing to revert
+	require.NoError(t, journal.Rollback())
+	assert.Len(t, *calls, 3)
+}
+
+func TestApplyDNS_Modes(t *testing.T) {
+	useTestDNS(t)
+
+	clientConfig.DNSMode = dnsModeOff
+	mode, err := applyDNS("tun0", []netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, dnsModeOff, mode)
+	assert.NoFileExists(t, resolvConfPath)
+
+	clientConfig.DNSMode = "dnsmasq"
+	_, err = applyDNS("tun0", []netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil)
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+}
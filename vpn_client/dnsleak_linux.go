@@ -0,0 +1,226 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// dnsLeakTable is the nftables table owned by the client
+const dnsLeakTable = "masque_vpn_client"
+
+// dnsLeakPollInterval is how often the blocked query counters are read
+const dnsLeakPollInterval = 10 * time.Second
+
+// dnsLeakPorts are plain DNS and DNS over TLS (and DNS over QUIC on UDP)
+var dnsLeakPorts = []uint16{53, 853}
+
+// dnsLeakGuard is the nftables table that drops DNS queries leaving the host
+// other than to the tunnel DNS servers through the TUN device. The table is
+// recorded in the journal and removed with the other changes on disconnect.
+type dnsLeakGuard struct {
+	conn  *nftables.Conn
+	table *nftables.Table
+	chain *nftables.Chain
+
+	mu sync.Mutex
+	// blocked packets per drop rule already added to dnsLeaksBlocked
+	reported map[string]uint64
+}
+
+// newDNSLeakGuard installs the rules for the TUN device and DNS servers of a session
+func newDNSLeakGuard(tunName string, servers []netip.Addr) (*dnsLeakGuard, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open nftables netlink connection: %w", err)
+	}
+	g := &dnsLeakGuard{
+		conn:     conn,
+		table:    &nftables.Table{Name: dnsLeakTable, Family: nftables.TableFamilyINet},
+		reported: make(map[string]uint64),
+	}
+
+	err = journal.Apply(journalEntry{Kind: changeFirewall, Table: dnsLeakTable}, func() error {
+		// A table left behind by a crash is replaced as a whole
+		if existing, err := conn.ListTableOfFamily(g.table.Name, g.table.Family); err == nil && existing != nil {
+			conn.DelTable(g.table)
+		}
+
+		policy := nftables.ChainPolicyAccept
+		conn.AddTable(g.table)
+		g.chain = conn.AddChain(&nftables.Chain{
+			Name:     "output",
+			Table:    g.table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookOutput,
+			Priority: nftables.ChainPriorityFilter,
+			Policy:   &policy,
+		})
+		for _, rule := range dnsLeakRules(tunName, servers) {
+			rule.Table, rule.Chain = g.table, g.chain
+			conn.AddRule(rule)
+		}
+
+		if err := conn.Flush(); err != nil {
+			return fmt.Errorf("%w: failed to install nftables DNS leak rules: %v", common.ErrSystemCall, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// dnsLeakRules builds the output chain:
+//
+//	oifname "lo" accept
+//	meta l4proto <udp|tcp> th dport <port> <ip|ip6> daddr <server> oifname <tun> accept
+//	meta l4proto <udp|tcp> th dport <port> counter drop
+//
+// Loopback stays open for local stub resolvers, which forward through the tunnel.
+// Each drop rule carries "<proto>/<port>" as user data for the metrics.
+func dnsLeakRules(tunName string, servers []netip.Addr) []*nftables.Rule {
+	rules := []*nftables.Rule{{
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData("lo")},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	}}
+
+	for _, proto := range []string{"udp", "tcp"} {
+		for _, port := range dnsLeakPorts {
+			for _, server := range servers {
+				exprs := append(dnsPortExprs(proto, port), daddrExprs(server)...)
+				exprs = append(exprs,
+					&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData(tunName)},
+					&expr.Verdict{Kind: expr.VerdictAccept},
+				)
+				rules = append(rules, &nftables.Rule{Exprs: exprs})
+			}
+			rules = append(rules, &nftables.Rule{
+				Exprs:    append(dnsPortExprs(proto, port), &expr.Counter{}, &expr.Verdict{Kind: expr.VerdictDrop}),
+				UserData: []byte(fmt.Sprintf("%s/%d", proto, port)),
+			})
+		}
+	}
+	return rules
+}
+
+// dnsPortExprs matches "meta l4proto <proto> th dport <port>"
+func dnsPortExprs(proto string, port uint16) []expr.Any {
+	l4proto := byte(unix.IPPROTO_UDP)
+	if proto == "tcp" {
+		l4proto = unix.IPPROTO_TCP
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+	}
+}
+
+// daddrExprs matches "meta nfproto <ip|ip6> <ip|ip6> daddr <addr>"
+func daddrExprs(addr netip.Addr) []expr.Any {
+	addr = addr.Unmap()
+	proto, offset := byte(unix.NFPROTO_IPV4), uint32(16)
+	if addr.Is6() {
+		proto, offset = byte(unix.NFPROTO_IPV6), 24
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(addr.BitLen() / 8)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr.AsSlice()},
+	}
+}
+
+// ifnameData is an interface name as nftables compares it: NUL-terminated, padded to IFNAMSIZ
+func ifnameData(name string) []byte {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name+"\x00")
+	return data
+}
+
+// Run reports blocked queries until ctx is done
+func (g *dnsLeakGuard) Run(ctx context.Context) {
+	ticker := time.NewTicker(dnsLeakPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// Catch the last queries before the table is removed
+			g.collect()
+			return
+		case <-ticker.C:
+			g.collect()
+		}
+	}
+}
+
+// collect adds the queries dropped since the last call to the metrics
+func (g *dnsLeakGuard) collect() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rules, err := g.conn.GetRules(g.table, g.chain)
+	if err != nil {
+		logger.Debug("Failed to read DNS leak counters", zap.Error(err))
+		return
+	}
+	for label, packets := range blockedCounts(rules) {
+		if packets > g.reported[label] {
+			delta := packets - g.reported[label]
+			dnsLeaksBlocked.WithLabelValues(label).Add(float64(delta))
+			logger.Warn("Blocked DNS queries outside the tunnel", zap.String("protocol", label), zap.Uint64("queries", delta))
+			g.reported[label] = packets
+		}
+	}
+}
+
+// blockedCounts returns the packet counter of each drop rule by its user data
+func blockedCounts(rules []*nftables.Rule) map[string]uint64 {
+	counts := make(map[string]uint64)
+	for _, rule := range rules {
+		if len(rule.UserData) == 0 {
+			continue
+		}
+		for _, e := range rule.Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				counts[string(rule.UserData)] += counter.Packets
+			}
+		}
+	}
+	return counts
+}
+
+// removeFirewallTable deletes a client-owned nftables table; a missing table is already gone
+func removeFirewallTable(name string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables netlink connection: %w", err)
+	}
+	table, err := conn.ListTableOfFamily(name, nftables.TableFamilyINet)
+	if err != nil || table == nil {
+		return nil
+	}
+	conn.DelTable(table)
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("%w: failed to delete nftables table %s: %v", common.ErrSystemCall, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDNSLeakRules(t *testing.T) {
+	servers := []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00:10::1")}
+	rules := dnsLeakRules("tun0", servers)
+	// loopback + (2 servers + drop) for each of udp/53, udp/853, tcp/53, tcp/853
+	require.Len(t, rules, 1+4*3)
+
+	assert.Equal(t, ifnameData("lo"), rules[0].Exprs[1].(*expr.Cmp).Data)
+	assert.Equal(t, expr.VerdictAccept, rules[0].Exprs[2].(*expr.Verdict).Kind)
+
+	allow := rules[1].Exprs
+	require.Len(t, allow, 11)
+	assert.Equal(t, []byte{unix.IPPROTO_UDP}, allow[1].(*expr.Cmp).Data)
+	assert.Equal(t, []byte{0, 53}, allow[3].(*expr.Cmp).Data)
+	assert.Equal(t, uint32(16), allow[6].(*expr.Payload).Offset)
+	assert.Equal(t, []byte{10, 0, 0, 1}, allow[7].(*expr.Cmp).Data)
+	assert.Equal(t, ifnameData("tun0"), allow[9].(*expr.Cmp).Data)
+	assert.Equal(t, expr.VerdictAccept, allow[10].(*expr.Verdict).Kind)
+
+	ipv6 := rules[2].Exprs
+	assert.Equal(t, []byte{unix.NFPROTO_IPV6}, ipv6[5].(*expr.Cmp).Data)
+	assert.Equal(t, uint32(24), ipv6[6].(*expr.Payload).Offset)
+	assert.Equal(t, uint32(16), ipv6[6].(*expr.Payload).Len)
+
+	drop := rules[3]
+	assert.Equal(t, "udp/53", string(drop.UserData))
+	assert.IsType(t, &expr.Counter{}, drop.Exprs[4])
+	assert.Equal(t, expr.VerdictDrop, drop.Exprs[5].(*expr.Verdict).Kind)
+
+	dot := rules[12]
+	assert.Equal(t, "tcp/853", string(dot.UserData))
+	assert.Equal(t, []byte{unix.IPPROTO_TCP}, dot.Exprs[1].(*expr.Cmp).Data)
+	assert.Equal(t, []byte{3, 85}, dot.Exprs[3].(*expr.Cmp).Data)
+}
+
+func TestBlockedCounts(t *testing.T) {
+	rules := []*nftables.Rule{
+		{Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}},
+		{UserData: []byte("udp/53"), Exprs: []expr.Any{&expr.Counter{Packets: 7, Bytes: 420}, &expr.Verdict{Kind: expr.VerdictDrop}}},
+		{UserData: []byte("tcp/853"), Exprs: []expr.Any{&expr.Counter{Packets: 2}, &expr.Verdict{Kind: expr.VerdictDrop}}},
+	}
+	assert.Equal(t, map[string]uint64{"udp/53": 7, "tcp/853": 2}, blockedCounts(rules))
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"runtime"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// dnsLeakGuard blocking DNS outside the tunnel is only available on Linux (nftables)
+type dnsLeakGuard struct{}
+
+// newDNSLeakGuard reports that DNS leak protection is not supported on this platform
+func newDNSLeakGuard(tunName string, servers []netip.Addr) (*dnsLeakGuard, error) {
+	return nil, fmt.Errorf("%w: dns_leak_protection on %s", common.ErrNotSupported, runtime.GOOS)
+}
+
+// Run does nothing
+func (g *dnsLeakGuard) Run(ctx context.Context) {}
+
+// removeFirewallTable reports that there are no firewall tables on this platform
+func removeFirewallTable(name string) error {
+	return fmt.Errorf("%w: removing nftables table %s on %s", common.ErrNotSupported, name, runtime.GOOS)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// enrolledConfigTemplate is used when enrollment creates a new client config
+const enrolledConfigTemplate = `# MASQUE VPN client configuration created by "vpn-client enroll"
+
+# VPN server address and port
+server_addr = ""
+
+# Expected server name for TLS verification
+server_name = ""
+
+# MTU
+mtu = {{mtu}}
+
+# TUN device name
+tun_name = "tun0"
+
+# Log level: debug, info, warn, error
+log_level = "info"
+`
+
+// generateClientKey creates a new private key that never leaves this machine
+func generateClientKey() (crypto.Signer, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// parsePrivateKeyPEM decodes a PKCS#8 private key
+func parsePrivateKeyPEM(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM private key", common.ErrInvalidCertificate)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", common.ErrInvalidCertificate, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported private key type", common.ErrInvalidCertificate)
+	}
+	return signer, nil
+}
+
+// createCSR builds a PEM certificate signing request for key
+func createCSR(key crypto.Signer, commonName string) ([]byte, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSR: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// verifyIssuedCertificate checks that certPEM is for key and chains to caPEM
+func verifyIssuedCertificate(certPEM, caPEM []byte, key crypto.Signer) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%w: server returned no certificate", common.ErrInvalidCertificate)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", common.ErrInvalidCertificate, err)
+	}
+
+	type publicKeyEqualer interface{ Equal(crypto.PublicKey) bool }
+	if pub, ok := key.Public().(publicKeyEqualer); !ok || !pub.Equal(cert.PublicKey) {
+		return nil, fmt.Errorf("%w: certificate does not match the generated key", common.ErrInvalidCertificate)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("%w: server returned no CA certificate", common.ErrInvalidCertificate)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, fmt.Errorf("%w: %v", common.ErrInvalidCertificate, err)
+	}
+	return cert, nil
+}
+
+// runEnrollCommand generates a key locally, sends a CSR with a one-time
+// token to the server enrollment endpoint and stores the signed certificate.
+func runEnrollCommand(args []string) error {
+	fs := flag.NewFlagSet("enroll", flag.ExitOnError)
+	serverURL := fs.String("server", "", "Server API base URL, e.g. http://vpn.example.com:8080")
+	token := fs.String("token", "", "One-time enrollment token issued by an administrator")
+	configPath := fs.String("c", "config.client.toml", "Client config file to write the certificate into")
+	name := fs.String("name", "", "Common name to request (must match the token, optional)")
+	caFile := fs.String("ca", "", "Expected CA certificate, required for plain http:// to a remote server; enrollment fails if the server presents another one")
+	fs.Parse(args)
+
+	if *serverURL == "" || *token == "" {
+		fs.Usage()
+		return fmt.Errorf("-server and -token are required")
+	}
+	if *caFile == "" {
+		plain, err := plainRemoteURL(*serverURL)
+		if err != nil {
+			return err
+		}
+		if plain {
+			return fmt.Errorf("-ca is required for %s: the API is plain HTTP, so the CA certificate in the response cannot be trusted", *serverURL)
+		}
+	}
+
+	var expectedCA []byte
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	if *caFile != "" {
+		var err error
+		expectedCA, err = os.ReadFile(*caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file %s: %w", *caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(expectedCA) {
+			return fmt.Errorf("failed to parse CA file %s", *caFile)
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	} else {
+		fmt.Fprintln(os.Stderr, "Warning: no -ca given, trusting the CA certificate returned by the server")
+	}
+
+	key, keyPEM, err := generateClientKey()
+	if err != nil {
+		return err
+	}
+	csrPEM, err := createCSR(key, *name)
+	if err != nil {
+		return err
+	}
+
+	resp, err := postEnrollRequest(httpClient, strings.TrimRight(*serverURL, "/")+common.EnrollPath,
+		common.EnrollRequest{Token: *token, CSR: string(csrPEM)})
+	if err != nil {
+		return err
+	}
+
+	if expectedCA != nil && !samePEMCertificate(expectedCA, []byte(resp.CAPEM)) {
+		return fmt.Errorf("%w: server CA does not match %s", common.ErrInvalidCertificate, *caFile)
+	}
+	cert, err := verifyIssuedCertificate([]byte(resp.CertPEM), []byte(resp.CAPEM), key)
+	if err != nil {
+		return err
+	}
+
+	exists, err := configExists(*configPath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := writeEnrolledConfig(*configPath, resp); err != nil {
+			return err
+		}
+	}
+	if err := saveClientCredentials(*configPath, []byte(resp.CertPEM), keyPEM, []byte(resp.CAPEM)); err != nil {
+		return err
+	}
+
+	fmt.Printf("Enrolled as %s (serial %s, valid until %s); config written to %s\n",
+		cert.Subject.CommonName, resp.Serial, cert.NotAfter.Format(time.RFC3339), *configPath)
+	return nil
+}
+
+// plainRemoteURL reports whether serverURL is unencrypted HTTP to a host other
+// than this machine
+func plainRemoteURL(serverURL string) (bool, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Host == "" {
+		return false, fmt.Errorf("invalid server URL %q", serverURL)
+	}
+	if u.Scheme != "http" {
+		return false, nil
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return false, nil
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback(), nil
+}
+
+// postEnrollRequest sends an enrollment request and decodes the response
+func postEnrollRequest(client *http.Client, url string, req common.EnrollRequest) (*common.EnrollResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpResp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: enrollment request failed: %v", common.ErrConnectionFailed, err)
+	}
+	return decodeEnrollResponse(httpResp, "enrollment")
+}
+
+// decodeEnrollResponse reads a certificate response, turning API errors into
+// ErrAuthenticationFailed; operation names the request in error messages.
+func decodeEnrollResponse(httpResp *http.Response, operation string) (*common.EnrollResponse, error) {
+	defer httpResp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", operation, err)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("%w: %s rejected: %s", common.ErrAuthenticationFailed, operation, apiErr.Error)
+		}
+		if text := strings.TrimSpace(string(data)); text != "" && len(text) < 512 {
+			return nil, fmt.Errorf("%w: %s rejected: %s: %s", common.ErrAuthenticationFailed, operation, httpResp.Status, text)
+		}
+		return nil, fmt.Errorf("%w: %s rejected: %s", common.ErrAuthenticationFailed, operation, httpResp.Status)
+	}
+
+	var resp common.EnrollResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode %s response: %w", operation, err)
+	}
+	return &resp, nil
+}
+
+// writeEnrolledConfig creates a new client config with the server settings from resp
+func writeEnrolledConfig(path string, resp *common.EnrollResponse) error {
+	mtu := resp.MTU
+	if mtu <= 0 {
+		mtu = 1413
+	}
+	doc := []byte(strings.Replace(enrolledConfigTemplate, "{{mtu}}", strconv.Itoa(mtu), 1))
+	doc = setConfigStrings(doc, map[string]string{
+		"server_addr": resp.ServerAddr,
+		"server_name": resp.ServerName,
+	})
+	return common.WriteFileAtomic(path, doc, 0600)
+}
+
+// samePEMCertificate reports whether two PEM blobs start with the same certificate
+func samePEMCertificate(a, b []byte) bool {
+	blockA, _ := pem.Decode(a)
+	blockB, _ := pem.Decode(b)
+	return blockA != nil && blockB != nil && bytes.Equal(blockA.Bytes, blockB.Bytes)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestEnrollServer emulates the server enrollment endpoint with an in-memory CA
+func newTestEnrollServer(t *testing.T, token string) (*httptest.Server, []byte) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test-CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req common.EnrollRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if r.URL.Path != common.EnrollPath || req.Token != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"enrollment token is invalid, expired or already used"}`))
+			return
+		}
+
+		block, _ := pem.Decode([]byte(req.CSR))
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		require.NoError(t, err)
+		require.NoError(t, csr.CheckSignature())
+
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(42),
+			Subject:      pkix.Name{CommonName: "alice"},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, caCert, csr.PublicKey, caKey)
+		require.NoError(t, err)
+
+		json.NewEncoder(w).Encode(common.EnrollResponse{
+			ClientID:   "alice",
+			Serial:     "2a",
+			CertPEM:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			CAPEM:      string(caPEM),
+			ServerAddr: "vpn.example.com:4433",
+			ServerName: "vpn.example.com",
+			MTU:        1400,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, caPEM
+}
+
+func TestRunEnrollCommand(t *testing.T) {
+	srv, caPEM := newTestEnrollServer(t, "secret-token")
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.client.toml")
+	caPath := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caPath, caPEM, 0644))
+
+	err := runEnrollCommand([]string{"-server", srv.URL, "-token", "secret-token", "-c", configPath, "-ca", caPath})
+	require.NoError(t, err)
+
+	var config common.ClientConfig
+	_, err = toml.DecodeFile(configPath, &config)
+	require.NoError(t, err)
+	assert.Equal(t, "vpn.example.com:4433", config.ServerAddr)
+	assert.Equal(t, "vpn.example.com", config.ServerName)
+	assert.Equal(t, 1400, config.MTU)
+	assert.NotEmpty(t, config.CAPEM)
+
+	key, err := parsePrivateKeyPEM([]byte(config.KeyPEM))
+	require.NoError(t, err)
+	_, err = verifyIssuedCertificate([]byte(config.CertPEM), []byte(config.CAPEM), key)
+	assert.NoError(t, err)
+}
+
+func TestRunEnrollCommandRejected(t *testing.T) {
+	srv, _ := newTestEnrollServer(t, "secret-token")
+	configPath := filepath.Join(t.TempDir(), "config.client.toml")
+
+	err := runEnrollCommand([]string{"-server", srv.URL, "-token", "wrong", "-c", configPath})
+	assert.ErrorIs(t, err, common.ErrAuthenticationFailed)
+	assert.Contains(t, err.Error(), "already used")
+
+	exists, err := configExists(configPath)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestRunEnrollCommandRequiresCAForRemoteHTTP(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.client.toml")
+
+	err := runEnrollCommand([]string{"-server", "http://vpn.example.com:8080", "-token", "secret-token", "-c", configPath})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "-ca is required")
+
+	exists, err := configExists(configPath)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestPlainRemoteURL(t *testing.T) {
+	tests := map[string]bool{
+		"http://vpn.example.com:8080":  true,
+		"http://10.0.0.1:8080":         true,
+		"http://127.0.0.1:8080":        false,
+		"http://[::1]:8080":            false,
+		"http://localhost:8080":        false,
+		"https://vpn.example.com:8443": false,
+	}
+	for serverURL, want := range tests {
+		got, err := plainRemoteURL(serverURL)
+		require.NoError(t, err, serverURL)
+		assert.Equal(t, want, got, serverURL)
+	}
+
+	_, err := plainRemoteURL("vpn.example.com:8080")
+	assert.Error(t, err)
+}
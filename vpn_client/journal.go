@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+// Kinds of host network changes recorded in the journal
+const (
+	changeAddress  = "address"
+	changeRoute    = "route"
+	changeRule     = "rule"
+	changeDNS      = "dns"
+	changeFirewall = "firewall"
+)
+
+// defaultJournalFile is used when journal_file is not configured
+var defaultJournalFile = filepath.Join(os.TempDir(), "masque-vpn-client.journal")
+
+// journalEntry is one change to the host network configuration and what is needed to undo it
+type journalEntry struct {
+	Kind       string              `json:"kind"`
+	Interface  string              `json:"interface,omitempty"`
+	Address    netip.Prefix        `json:"address,omitempty"`
+	Route      *common.Route       `json:"route,omitempty"`
+	Rule       *common.RoutingRule `json:"rule,omitempty"`
+	DNS        *dnsChange          `json:"dns,omitempty"`
+	Table      string              `json:"table,omitempty"`
+	Persistent bool                `json:"persistent,omitempty"` // outlives the session, e.g. the kill switch
+	Time       time.Time           `json:"time"`
+}
+
+// dnsChange is either per-link DNS set in systemd-resolved or a rewritten
+// resolver configuration file with its previous contents
+type dnsChange struct {
+	Link          string `json:"link,omitempty"`
+	Path          string `json:"path,omitempty"`
+	Previous      []byte `json:"previous,omitempty"`
+	Existed       bool   `json:"existed,omitempty"`
+	SymlinkTarget string `json:"symlink_target,omitempty"`
+	Backup        string `json:"backup,omitempty"`
+}
+
+// String describes the change for logs
+func (e journalEntry) String() string {
+	switch e.Kind {
+	case changeAddress:
+		return fmt.Sprintf("address %s on %s", e.Address, e.Interface)
+	case changeRoute:
+		return fmt.Sprintf("route %s dev %s", e.Route, e.Interface)
+	case changeRule:
+		return fmt.Sprintf("rule to table %d priority %d", e.Rule.Table, e.Rule.Priority)
+	case changeDNS:
+		if e.DNS.Link != "" {
+			return fmt.Sprintf("resolved DNS on %s", e.DNS.Link)
+		}
+		return fmt.Sprintf("resolver config %s", e.DNS.Path)
+	case changeFirewall:
+		return fmt.Sprintf("nftables table inet %s", e.Table)
+	}
+	return e.Kind
+}
+
+// changeJournal records every change the client makes to the host network
+// configuration in a file, so that the changes can be undone in reverse order
+// on shutdown or, after a crash, on the next start.
+type changeJournal struct {
+	path string
+	// undo reverts one change; replaced in tests
+	undo func(journalEntry) error
+
+	mu      sync.Mutex
+	entries []journalEntry
+}
+
+// newChangeJournal returns an empty journal stored at path
+func newChangeJournal(path string) *changeJournal {
+	if path == "" {
+		path = defaultJournalFile
+	}
+	return &changeJournal{path: path, undo: undoChange}
+}
+
+// Recover rolls back the changes left in the journal file by a previous run
+// that did not shut down cleanly. It must run before any new change is made.
+func (j *changeJournal) Recover() error {
+	data, err := os.ReadFile(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read journal %s: %w", j.path, err)
+	}
+
+	var entries []journalEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		// A torn write cannot be replayed; drop it rather than refuse to start
+		logger.Warn("Discarding unreadable change journal", zap.String("path", j.path), zap.Error(err))
+		return os.Remove(j.path)
+	}
+
+	logger.Warn("Found change journal from a previous run, rolling back",
+		zap.String("path", j.path), zap.Int("changes", len(entries)))
+	j.mu.Lock()
+	j.entries = entries
+	j.mu.Unlock()
+	return j.Rollback()
+}
+
+// Record adds a change that has already been made
+func (j *changeJournal) Record(entry journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	j.entries = append(j.entries, entry)
+	return j.saveLocked()
+}
+
+// Apply records the change before making it with apply, so that a crash in
+// between still leaves it in the journal. A failed change is dropped again.
+func (j *changeJournal) Apply(entry journalEntry, apply func() error) error {
+	if err := j.Record(entry); err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		j.mu.Lock()
+		j.entries = j.entries[:len(j.entries)-1]
+		if saveErr := j.saveLocked(); saveErr != nil {
+			logger.Warn("Failed to update change journal", zap.Error(saveErr))
+		}
+		j.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Revert undoes one recorded change, e.g. a route that is no longer needed,
+// and drops it from the journal
+func (j *changeJournal) Revert(entry journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.undo(entry); err != nil {
+		return fmt.Errorf("failed to revert %s: %w", entry, err)
+	}
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		if j.entries[i].String() == entry.String() {
+			j.entries = append(j.entries[:i], j.entries[i+1:]...)
+			break
+		}
+	}
+	return j.saveLocked()
+}
+
+// Rollback undoes the recorded changes newest first. Changes that could not be
+// undone stay in the journal and are retried on the next rollback.
+func (j *changeJournal) Rollback() error {
+	return j.rollback(false)
+}
+
+// RollbackSession undoes the changes of a session like Rollback but keeps the
+// persistent ones, which stay in place across reconnects
+func (j *changeJournal) RollbackSession() error {
+	return j.rollback(true)
+}
+
+func (j *changeJournal) rollback(keepPersistent bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var kept []journalEntry
+	var errs []error
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		entry := j.entries[i]
+		if keepPersistent && entry.Persistent {
+			kept = append([]journalEntry{entry}, kept...)
+			continue
+		}
+		err := j.undo(entry)
+		switch {
+		case err == nil:
+			logger.Info("Reverted network change", zap.Stringer("change", entry))
+		case errors.Is(err, common.ErrNotSupported):
+			// Nothing more can be done about it on this platform
+			logger.Warn("Cannot revert network change", zap.Stringer("change", entry), zap.Error(err))
+		default:
+			kept = append([]journalEntry{entry}, kept...)
+			errs = append(errs, fmt.Errorf("failed to revert %s: %w", entry, err))
+		}
+	}
+
+	j.entries = kept
+	if err := j.saveLocked(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// saveLocked writes the journal file, or removes it once the journal is empty
+func (j *changeJournal) saveLocked() error {
+	if len(j.entries) == 0 {
+		if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove journal %s: %w", j.path, err)
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(j.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode journal: %w", err)
+	}
+	return common.WriteFileAtomic(j.path, data, 0600)
+}
+
+// undoChange reverts one host network change
+func undoChange(entry journalEntry) error {
+	switch entry.Kind {
+	case changeAddress:
+		return common.RemoveInterfaceIP(entry.Interface, entry.Address)
+	case changeRoute:
+		return common.RemoveInterfaceRoute(entry.Interface, *entry.Route)
+	case changeRule:
+		return common.RemoveRoutingRule(*entry.Rule)
+	case changeDNS:
+		if entry.DNS.Link != "" {
+			return revertResolvedDNS(entry.DNS.Link)
+		}
+		return restoreResolvConf(entry.DNS)
+	case changeFirewall:
+		return removeFirewallTable(entry.Table)
+	}
+	return fmt.Errorf("unknown change kind %q", entry.Kind)
+}
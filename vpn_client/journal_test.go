@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestJournal(t *testing.T, path string, undone *[]string, fail map[string]error) *changeJournal {
+	t.Helper()
+	logger = zap.NewNop()
+	j := newChangeJournal(path)
+	j.undo = func(entry journalEntry) error {
+		if err := fail[entry.String()]; err != nil {
+			return err
+		}
+		*undone = append(*undone, entry.String())
+		return nil
+	}
+	return j
+}
+
+func TestChangeJournal_RecoverAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.journal")
+	var undone []string
+
+	j := newTestJournal(t, path, &undone, nil)
+	require.NoError(t, j.Record(journalEntry{Kind: changeAddress, Interface: "tun0", Address: netip.MustParsePrefix("10.0.0.2/32")}))
+	route := common.Route{Destination: netip.MustParsePrefix("0.0.0.0/0")}
+	require.NoError(t, j.Apply(journalEntry{Kind: changeRoute, Interface: "tun0", Route: &route}, func() error { return nil }))
+	rule := common.RoutingRule{Priority: 100, Table: 51820}
+	require.NoError(t, j.Record(journalEntry{Kind: changeRule, Rule: &rule}))
+
+	// A failed change is not left in the journal
+	applyErr := errors.New("boom")
+	extra := common.Route{Destination: netip.MustParsePrefix("192.168.0.0/16")}
+	assert.ErrorIs(t, j.Apply(journalEntry{Kind: changeRoute, Interface: "tun0", Route: &extra}, func() error { return applyErr }), applyErr)
+
+	// The process dies here; the next start finds the journal and rolls it back
+	restarted := newTestJournal(t, path, &undone, nil)
+	require.NoError(t, restarted.Recover())
+	assert.Equal(t, []string{
+		"rule to table 51820 priority 100",
+		"route 0.0.0.0/0 dev tun0",
+		"address 10.0.0.2/32 on tun0",
+	}, undone)
+	assert.NoFileExists(t, path)
+
+	// Nothing to do without a journal
+	require.NoError(t, restarted.Recover())
+}
+
+func TestChangeJournal_RollbackKeepsFailures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.journal")
+	var undone []string
+	route := common.Route{Destination: netip.MustParsePrefix("0.0.0.0/0")}
+	fail := map[string]error{
+		"route 0.0.0.0/0 dev tun0":    errors.New("busy"),
+		"address 10.0.0.2/32 on tun0": common.ErrNotSupported,
+	}
+
+	j := newTestJournal(t, path, &undone, fail)
+	require.NoError(t, j.Record(journalEntry{Kind: changeAddress, Interface: "tun0", Address: netip.MustParsePrefix("10.0.0.2/32")}))
+	require.NoError(t, j.Record(journalEntry{Kind: changeRoute, Interface: "tun0", Route: &route}))
+	require.NoError(t, j.Record(journalEntry{Kind: changeRule, Rule: &common.RoutingRule{Table: 7}}))
+
+	assert.Error(t, j.Rollback())
+	assert.Equal(t, []string{"rule to table 7 priority 0"}, undone)
+	// Only the change that may succeed later is retried
+	require.Len(t, j.entries, 1)
+	assert.Equal(t, changeRoute, j.entries[0].Kind)
+	assert.FileExists(t, path)
+
+	delete(fail, "route 0.0.0.0/0 dev tun0")
+	require.NoError(t, j.Rollback())
+	assert.NoFileExists(t, path)
+}
+
+func TestUndoChange_DNS(t *testing.T) {
+	dir := t.TempDir()
+	resolvConf := filepath.Join(dir, "resolv.conf")
+	require.NoError(t, os.WriteFile(resolvConf, []byte("nameserver 10.0.0.1\n"), 0644))
+
+	require.NoError(t, undoChange(journalEntry{Kind: changeDNS, DNS: &dnsChange{
+		Path: resolvConf, Previous: []byte("nameserver 192.168.1.1\n"), Existed: true,
+	}}))
+	data, err := os.ReadFile(resolvConf)
+	require.NoError(t, err)
+	assert.Equal(t, "nameserver 192.168.1.1\n", string(data))
+
+	require.NoError(t, undoChange(journalEntry{Kind: changeDNS, DNS: &dnsChange{Path: resolvConf}}))
+	assert.NoFileExists(t, resolvConf)
+}
+
+func TestChangeJournal_RollbackSessionKeepsPersistent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.journal")
+	var undone []string
+	j := newTestJournal(t, path, &undone, nil)
+
+	require.NoError(t, j.Record(journalEntry{Kind: changeFirewall, Table: "masque_vpn_killswitch", Persistent: true}))
+	require.NoError(t, j.Record(journalEntry{Kind: changeAddress, Interface: "tun0", Address: netip.MustParsePrefix("10.0.0.2/32")}))
+
+	require.NoError(t, j.RollbackSession())
+	assert.Equal(t, []string{"address 10.0.0.2/32 on tun0"}, undone)
+	require.Len(t, j.entries, 1)
+	assert.FileExists(t, path)
+
+	require.NoError(t, j.Rollback())
+	assert.Equal(t, "nftables table inet masque_vpn_killswitch", undone[1])
+	assert.NoFileExists(t, path)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// lanBroadcastPrefixes are reachable with kill_switch_allow_lan besides the
+// local networks, e.g. for DHCP and service discovery
+var lanBroadcastPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("255.255.255.255/32"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// killSwitchServers are the addresses the kill switch lets through, by the
+// server address of the profile. Behind the kill switch the server names may
+// not resolve, so these are dialled instead.
+var killSwitchServers map[string][]netip.AddrPort
+
+// setupKillSwitch resolves the servers and blocks everything else outside the tunnel
+func setupKillSwitch(ctx context.Context) error {
+	resolved := make(map[string][]netip.AddrPort)
+	var servers []netip.AddrPort
+	for _, server := range configuredServers(clientConfig) {
+		addrs, err := resolveServerAddrs(ctx, server.Addr)
+		if err != nil {
+			return err
+		}
+		resolved[server.Addr] = addrs
+		servers = append(servers, addrs...)
+	}
+
+	var lan []netip.Prefix
+	if clientConfig.KillSwitchAllowLAN {
+		lan = append(lan, localNetworks(clientConfig.TunName)...)
+		lan = append(lan, linkLocalPrefixes...)
+		lan = append(lan, lanBroadcastPrefixes...)
+	}
+
+	if err := enableKillSwitch(clientConfig.TunName, servers, lan); err != nil {
+		return err
+	}
+	killSwitchServers = resolved
+	status.setKillSwitch(true)
+	return nil
+}
+
+// allKillSwitchServers returns the addresses the kill switch lets through
+func allKillSwitchServers() []netip.AddrPort {
+	var servers []netip.AddrPort
+	for _, server := range configuredServers(clientConfig) {
+		servers = append(servers, killSwitchServers[server.Addr]...)
+	}
+	return servers
+}
+
+// resolveServerAddrs returns every address of a host:port server address
+func resolveServerAddrs(ctx context.Context, serverAddr string) ([]netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address %s: %w", serverAddr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server port in %s: %w", serverAddr, err)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve server address %s: %w", serverAddr, err)
+	}
+
+	servers := make([]netip.AddrPort, len(addrs))
+	for i, addr := range addrs {
+		servers[i] = netip.AddrPortFrom(addr.Unmap(), uint16(port))
+	}
+	return servers, nil
+}
@@ -0,0 +1,128 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	common "github.com/iselt/masque-vpn/common"
+	"golang.org/x/sys/unix"
+)
+
+// killSwitchTable is the nftables table of the kill switch
+const killSwitchTable = "masque_vpn_killswitch"
+
+// enableKillSwitch drops all outgoing traffic except loopback, the TUN device,
+// the QUIC flow to the servers and optionally the local networks. It is
+// recorded as a persistent change: reconnects keep it, stopping the client
+// removes it.
+func enableKillSwitch(tunName string, servers []netip.AddrPort, lan []netip.Prefix) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables netlink connection: %w", err)
+	}
+	table := &nftables.Table{Name: killSwitchTable, Family: nftables.TableFamilyINet}
+
+	entry := journalEntry{Kind: changeFirewall, Table: killSwitchTable, Persistent: true}
+	return journal.Apply(entry, func() error {
+		if existing, err := conn.ListTableOfFamily(table.Name, table.Family); err == nil && existing != nil {
+			conn.DelTable(table)
+		}
+
+		policy := nftables.ChainPolicyDrop
+		conn.AddTable(table)
+		chain := conn.AddChain(&nftables.Chain{
+			Name:     "output",
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookOutput,
+			Priority: nftables.ChainPriorityFilter,
+			Policy:   &policy,
+		})
+		for _, rule := range killSwitchRules(tunName, servers, lan) {
+			rule.Table, rule.Chain = table, chain
+			conn.AddRule(rule)
+		}
+
+		if err := conn.Flush(); err != nil {
+			return fmt.Errorf("%w: failed to install nftables kill switch: %v", common.ErrSystemCall, err)
+		}
+		return nil
+	})
+}
+
+// killSwitchRules builds the accept rules in front of the drop policy:
+//
+//	oifname "lo" accept
+//	oifname <tun> accept
+//	icmpv6 type 133-137 accept
+//	meta l4proto udp <ip|ip6> daddr <server> udp dport <port> accept
+//	<ip|ip6> daddr <lan> accept
+//
+// Neighbor discovery stays open, as IPv6 cannot reach even the server without it.
+func killSwitchRules(tunName string, servers []netip.AddrPort, lan []netip.Prefix) []*nftables.Rule {
+	rules := []*nftables.Rule{{
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData("lo")},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	}}
+	if tunName != "" {
+		rules = append(rules, &nftables.Rule{
+			Exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData(tunName)},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			},
+		})
+	}
+	rules = append(rules, &nftables.Rule{
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+			&expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: []byte{133}, ToData: []byte{137}},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+
+	for _, server := range servers {
+		exprs := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		}
+		exprs = append(exprs, daddrExprs(server.Addr())...)
+		exprs = append(exprs,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(server.Port())},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		)
+		rules = append(rules, &nftables.Rule{Exprs: exprs})
+	}
+
+	for _, prefix := range lan {
+		rules = append(rules, &nftables.Rule{
+			Exprs: append(daddrPrefixExprs(prefix), &expr.Verdict{Kind: expr.VerdictAccept}),
+		})
+	}
+	return rules
+}
+
+// daddrPrefixExprs matches "meta nfproto <ip|ip6> <ip|ip6> daddr <prefix>"
+func daddrPrefixExprs(prefix netip.Prefix) []expr.Any {
+	prefix = prefix.Masked()
+	exprs := daddrExprs(prefix.Addr())
+	addrLen := uint32(prefix.Addr().BitLen() / 8)
+	mask := net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen())
+	// Mask the loaded address before comparing it with the network address
+	return append(exprs[:3:3],
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: addrLen, Mask: mask, Xor: make([]byte, addrLen)},
+		exprs[3],
+	)
+}
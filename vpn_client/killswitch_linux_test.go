@@ -0,0 +1,42 @@
+//go:build linux
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestKillSwitchRules(t *testing.T) {
+	servers := []netip.AddrPort{netip.MustParseAddrPort("203.0.113.10:4433"), netip.MustParseAddrPort("[2001:db8::10]:4433")}
+	lan := []netip.Prefix{netip.MustParsePrefix("192.168.1.17/24")}
+	rules := killSwitchRules("tun0", servers, lan)
+	// loopback, tun, neighbor discovery, two servers, one network
+	require.Len(t, rules, 6)
+
+	assert.Equal(t, ifnameData("lo"), rules[0].Exprs[1].(*expr.Cmp).Data)
+	assert.Equal(t, ifnameData("tun0"), rules[1].Exprs[1].(*expr.Cmp).Data)
+	assert.Equal(t, []byte{unix.IPPROTO_ICMPV6}, rules[2].Exprs[1].(*expr.Cmp).Data)
+
+	server := rules[3].Exprs
+	require.Len(t, server, 9)
+	assert.Equal(t, []byte{unix.IPPROTO_UDP}, server[1].(*expr.Cmp).Data)
+	assert.Equal(t, []byte{203, 0, 113, 10}, server[5].(*expr.Cmp).Data)
+	assert.Equal(t, []byte{0x11, 0x51}, server[7].(*expr.Cmp).Data)
+	assert.Equal(t, expr.VerdictAccept, server[8].(*expr.Verdict).Kind)
+	assert.Equal(t, uint32(24), rules[4].Exprs[4].(*expr.Payload).Offset)
+
+	network := rules[5].Exprs
+	require.Len(t, network, 6)
+	assert.Equal(t, []byte{255, 255, 255, 0}, network[3].(*expr.Bitwise).Mask)
+	// The network address is normalized
+	assert.Equal(t, []byte{192, 168, 1, 0}, network[4].(*expr.Cmp).Data)
+
+	// Without a TUN device only the tunnel rule is missing
+	assert.Len(t, killSwitchRules("", servers, nil), 4)
+}
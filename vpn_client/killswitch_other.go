@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// enableKillSwitch reports that the kill switch is not supported on this platform
+func enableKillSwitch(tunName string, servers []netip.AddrPort, lan []netip.Prefix) error {
+	return fmt.Errorf("%w: kill_switch on %s", common.ErrNotSupported, runtime.GOOS)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveServerAddrs(t *testing.T) {
+	servers, err := resolveServerAddrs(t.Context(), "[::ffff:203.0.113.10]:4433")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("203.0.113.10:4433")}, servers)
+
+	_, err = resolveServerAddrs(t.Context(), "203.0.113.10")
+	assert.Error(t, err)
+	_, err = resolveServerAddrs(t.Context(), "203.0.113.10:quic")
+	assert.Error(t, err)
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"runtime/pprof"
@@ -28,6 +30,8 @@ import (
 var (
 	clientConfig common.ClientConfig
 	logger       *zap.Logger
+	// journal records host network changes so they can be undone on exit or after a crash
+	journal *changeJournal
 
 	// Enhanced metrics with additional labels and histograms
 	bytesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -71,6 +75,37 @@ var (
 		Name: "vpn_client_tun_interface_status",
 		Help: "TUN interface status (1 = up, 0 = down)",
 	}, []string{"interface_name"})
+
+	dnsLeaksBlocked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vpn_client_dns_leaks_blocked_total",
+		Help: "DNS queries dropped because they would have left outside the tunnel",
+	}, []string{"protocol"})
+
+	reconnectsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vpn_client_reconnects_total",
+		Help: "Reconnect attempts after a failed or lost connection",
+	}, []string{"strategy"})
+
+	pathMigrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vpn_client_path_migrations_total",
+		Help: "QUIC connection migrations after host network changes",
+	}, []string{"result"})
+
+	serverRTT = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vpn_client_server_rtt_seconds",
+		Help: "RTT to each server of the profile at the last probe (-1 = unreachable)",
+	}, []string{"server_addr"})
+
+	serverFailovers = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vpn_client_server_failovers_total",
+		Help: "Switches to the next server after a failed connection or lost session",
+	})
+
+	connectLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vpn_client_connect_latency_seconds",
+		Help:    "Time from dialing the server to an established CONNECT-IP session",
+		Buckets: []float64{0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"handshake"})
 )
 
 func init() {
@@ -83,6 +118,12 @@ func init() {
 	prometheus.MustRegister(packetLatency)
 	prometheus.MustRegister(activeConnections)
 	prometheus.MustRegister(tunInterfaceStatus)
+	prometheus.MustRegister(dnsLeaksBlocked)
+	prometheus.MustRegister(reconnectsTotal)
+	prometheus.MustRegister(pathMigrations)
+	prometheus.MustRegister(connectLatency)
+	prometheus.MustRegister(serverRTT)
+	prometheus.MustRegister(serverFailovers)
 }
 
 func initLogger(logLevel string) error {
@@ -116,6 +157,12 @@ func initLogger(logLevel string) error {
 }
 
 func main() {
+	// Subcommands (e.g. `vpn-client import masque://...`) run instead of connecting
+	if handled, err := runSubcommand(os.Args[1:]); handled {
+		exitOnSubcommandError(err)
+		return
+	}
+
 	// Parse command line flags first
 	configFile := flag.String("c", "config.client.toml", "Config file path")
 	flag.Parse()
@@ -131,11 +178,16 @@ func main() {
 	}
 	defer logger.Sync()
 
+	// Undo network changes left behind by a previous run before making new ones
+	journal = newChangeJournal(clientConfig.JournalFile)
+	if err := journal.Recover(); err != nil {
+		logger.Warn("Failed to roll back network changes from a previous run", zap.Error(err))
+	}
+
 	logger.Info("Starting MASQUE VPN Client",
 		zap.String("config_file", *configFile),
 		zap.String("log_level", clientConfig.LogLevel),
-		zap.String("server_addr", clientConfig.ServerAddr),
-		zap.String("server_name", clientConfig.ServerName),
+		zap.Int("servers", len(configuredServers(clientConfig))),
 		zap.Int("mtu", clientConfig.MTU),
 	)
 
@@ -151,6 +203,7 @@ func main() {
 	go func() {
 		mux := http.NewServeMux()
 		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/status", status)
 		
 		// Add health check endpoint
 		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -165,129 +218,283 @@ func main() {
 	}()
 
 	// Validate required configuration
-	if clientConfig.ServerAddr == "" || clientConfig.ServerName == "" {
-		logger.Fatal("Missing required configuration values",
-			zap.String("server_addr", clientConfig.ServerAddr),
-			zap.String("server_name", clientConfig.ServerName),
-		)
+	if err := validateServers(configuredServers(clientConfig)); err != nil {
+		logger.Fatal("Missing required configuration values", zap.Error(err))
 	}
 
 	if clientConfig.InsecureSkipVerify {
 		logger.Warn("TLS server verification disabled - this is insecure for production use")
 	}
 
-	// Create graceful shutdown context
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	// Create graceful shutdown context. A signal is an explicit disconnect; stop
+	// also ends the client when it gives up on the connection.
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	ctx, stop := context.WithCancel(signalCtx)
 	defer stop()
 
+	// Block traffic outside the tunnel for as long as the client runs
+	if clientConfig.KillSwitch {
+		if err := setupKillSwitch(ctx); err != nil {
+			logger.Fatal("Failed to enable kill switch", zap.Error(err))
+		}
+		logger.Info("Kill switch enabled, only the VPN server is reachable outside the tunnel",
+			zap.Stringers("servers", allKillSwitchServers()),
+			zap.Bool("allow_lan", clientConfig.KillSwitchAllowLAN))
+	}
+
 	var wg sync.WaitGroup
-	var tunDev *common.TUNDevice
-	var masqueConn *common.MASQUEConn
-	
-	// Track connection start time for duration metric
-	connectionStart := time.Now()
 
-	// Establish connection and configure TUN device
+	// Keep the VPN connected, reconnecting after failures and certificate renewals
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		var err error
-		
-		logger.Info("Establishing VPN connection...")
-		tunDev, masqueConn, err = establishAndConfigure(ctx)
-		if err != nil {
+		runClient(ctx, stop, *configFile)
+	}()
+
+	// Wait for the main goroutine to finish or be signaled
+	wg.Wait()
+
+	// Without an explicit disconnect the kill switch stays until the client is
+	// started again or `vpn-client disconnect` runs
+	if clientConfig.KillSwitch && signalCtx.Err() == nil {
+		logger.Warn("VPN connection lost, kill switch keeps traffic outside the VPN blocked",
+			zap.String("unblock", "vpn-client disconnect -c "+*configFile))
+	} else if err := journal.Rollback(); err != nil {
+		logger.Warn("Failed to revert network changes", zap.Error(err))
+	}
+	logger.Info("MASQUE VPN Client shutdown complete")
+}
+
+// runClient keeps the VPN connected until shutdown. A lost connection is
+// established again with backoff while the TUN device, routes and DNS
+// settings stay in place, so applications only see a brief stall.
+func runClient(ctx context.Context, stop context.CancelFunc, configFile string) {
+	defer stop()
+
+	var link *tunnelLink
+	defer func() {
+		if link != nil {
+			link.Close()
+		}
+	}()
+
+	delays := newReconnectBackoff(clientConfig.ReconnectMaxDelaySeconds)
+	servers := newServerSelector(configuredServers(clientConfig))
+	failures := 0
+	for {
+		var dev *common.TUNDevice
+		if link != nil {
+			dev = link.dev
+		}
+
+		activeServer = servers.Next(ctx)
+		status.setActiveServer(activeServer.Addr)
+		logger.Info("Establishing VPN connection...", zap.String("server_addr", activeServer.Addr))
+		tunDev, masqueConn, quicConn, err := establishAndConfigure(ctx, dev, activeServer)
+		if err == nil {
+			if link == nil {
+				link = setupTunnelLink(ctx, tunDev, quicConn, masqueConn)
+			} else {
+				link.Update(ctx, masqueConn)
+			}
+			started := time.Now()
+			err = runSession(ctx, link, masqueConn, quicConn, configFile)
+			if time.Since(started) >= reconnectBackoffReset {
+				delays.Reset()
+				failures = 0
+				servers.Reprobe()
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, errCertificateRenewed) {
+			if err := reloadClientConfig(configFile); err != nil {
+				logger.Error("Failed to reload config after certificate renewal", zap.Error(err))
+				return
+			}
+			logger.Info("Reconnecting with renewed client certificate")
+			continue
+		}
+
+		// A draining server lets the session run until its deadline, so
+		// there is time to connect elsewhere without waiting
+		var moved *serverMovedError
+		if errors.As(err, &moved) {
+			servers.Moved(activeServer, moved.Endpoints)
+			reconnectsTotal.WithLabelValues("move").Inc()
+			status.setReconnecting(true)
+			continue
+		}
+
+		strategy := recoveryStrategy(err)
+		var rejected *common.ConnectRejectedError
+		switch {
+		case strategy == common.RecoveryNone && errors.As(err, &rejected):
+			logger.Error("Server rejected the VPN session",
+				zap.Int("status", rejected.StatusCode),
+				zap.String("reason", rejected.Reason))
+			errorsTotal.WithLabelValues("session_rejected").Inc()
+			return
+		case strategy == common.RecoveryNone:
 			logger.Error("Failed to establish connection", zap.Error(err))
 			errorsTotal.WithLabelValues("connection_failed").Inc()
-			stop() // Signal main goroutine to exit if setup fails
 			return
-		}
-		
-		logger.Info("Connection established and TUN device configured")
-		connectionStatus.WithLabelValues(clientConfig.ServerAddr, clientConfig.ServerName).Set(1)
-		activeConnections.Set(1)
-		
-		if tunDev != nil {
-			tunInterfaceStatus.WithLabelValues(tunDev.Name()).Set(1)
+		case strategy == common.RecoveryRestart && link != nil:
+			// Start over with a new TUN device and network configuration
+			link.Close()
+			link = nil
 		}
 
-		// Start proxy goroutines with enhanced error handling
-		errChan := make(chan error, 2)
-		var proxyWg sync.WaitGroup
-
-		if tunDev != nil {
-			proxyWg.Add(2)
-			go func() {
-				defer proxyWg.Done()
-				logger.Debug("Starting TUN to VPN proxy")
-				common.ProxyFromTunToMASQUE(tunDev, masqueConn, errChan, &clientConfig.FEC)
-			}()
-			go func() {
-				defer proxyWg.Done()
-				logger.Debug("Starting VPN to TUN proxy")
-				common.ProxyFromMASQUEToTun(tunDev, masqueConn, errChan, &clientConfig.FEC)
-			}()
+		// A draining server names the servers to try instead
+		if errors.As(err, &rejected) && len(rejected.Alternatives) > 0 {
+			servers.Moved(activeServer, rejected.Alternatives)
 		} else {
-			logger.Info("TUN device disabled, proxy goroutines not started")
-			// Просто ждем сигнала завершения
-			proxyWg.Add(1)
-			go func() {
-				defer proxyWg.Done()
-				<-ctx.Done()
-				logger.Info("Test mode: received shutdown signal")
-			}()
+			servers.Failed()
+		}
+		failures++
+		if clientConfig.ReconnectMaxAttempts > 0 && failures > clientConfig.ReconnectMaxAttempts {
+			logger.Error("Giving up after failed reconnects",
+				zap.Int("attempts", clientConfig.ReconnectMaxAttempts), zap.Error(err))
+			errorsTotal.WithLabelValues("connection_failed").Inc()
+			return
 		}
 
-		// Wait for error or shutdown signal
+		delay := delays.Next()
+		logger.Warn("VPN connection failed, reconnecting",
+			zap.Error(err),
+			zap.String("strategy", recoveryStrategyName(strategy)),
+			zap.Int("attempt", failures),
+			zap.Duration("delay", delay))
+		reconnectsTotal.WithLabelValues(recoveryStrategyName(strategy)).Inc()
+		status.setReconnecting(true)
+
 		select {
-		case err := <-errChan:
-			logger.Error("Proxy error occurred", zap.Error(err))
-			errorsTotal.WithLabelValues("proxy_error").Inc()
 		case <-ctx.Done():
-			logger.Info("Shutdown signal received, stopping proxy")
+			return
+		case <-time.After(delay):
 		}
+	}
+}
 
-		// Record connection duration
-		connectionDuration.Observe(time.Since(connectionStart).Seconds())
-		
-		// Update connection status
-		connectionStatus.WithLabelValues(clientConfig.ServerAddr, clientConfig.ServerName).Set(0)
-		activeConnections.Set(0)
-		
-		if tunDev != nil {
-			tunInterfaceStatus.WithLabelValues(tunDev.Name()).Set(0)
-		}
+// runSession proxies packets over one connection until it fails, the client
+// certificate is renewed or the client shuts down, and returns why it ended
+func runSession(ctx context.Context, link *tunnelLink, masqueConn *common.MASQUEConn, quicConn *quic.Conn, configFile string) error {
+	// Track connection start time for duration metric
+	connectionStart := time.Now()
 
-		// Cleanup resources
-		logger.Info("Cleaning up resources...")
-		if masqueConn != nil {
-			if err := masqueConn.Close(); err != nil {
-				logger.Warn("Error closing MASQUE connection", zap.Error(err))
-			}
-		}
-		if tunDev != nil {
-			if err := tunDev.Close(); err != nil {
-				logger.Warn("Error closing TUN device", zap.Error(err))
+	logger.Info("Connection established and TUN device configured")
+	connectionStatus.WithLabelValues(activeServer.Addr, activeServer.Name).Set(1)
+	activeConnections.Set(1)
+	status.setReconnecting(false)
+
+	// Renew the client certificate over this connection before it expires
+	sessionCtx, cancelSession := context.WithCancel(ctx)
+	defer cancelSession()
+
+	renewed := make(chan struct{})
+	if cert, err := currentClientCertificate(); err != nil {
+		logger.Warn("Cannot schedule certificate renewal", zap.Error(err))
+	} else {
+		go func() {
+			if watchCertificateRenewal(sessionCtx, quicConn, configFile, cert) == nil {
+				close(renewed)
 			}
+		}()
+	}
+
+	// Follow the host to a new network without a new handshake
+	if !clientConfig.DisableMigration {
+		go newPathMigrator(quicConn, link).Run(sessionCtx)
+	}
+
+	// Start proxy goroutines with enhanced error handling
+	errChan := make(chan error, 2)
+	var proxyWg sync.WaitGroup
+
+	if link.dev != nil {
+		// The TUN reader may be blocked until the next packet, which it then
+		// fails to send; the link waits for it when the device closes
+		link.readers.Add(1)
+		go func() {
+			defer link.readers.Done()
+			logger.Debug("Starting TUN to VPN proxy")
+			common.ProxyFromTunToMASQUE(link.dev, masqueConn, errChan, &clientConfig.FEC)
+		}()
+		proxyWg.Add(1)
+		go func() {
+			defer proxyWg.Done()
+			logger.Debug("Starting VPN to TUN proxy")
+			common.ProxyFromMASQUEToTun(link.dev, masqueConn, errChan, &clientConfig.FEC)
+		}()
+	} else {
+		logger.Info("TUN device disabled, proxy goroutines not started")
+		// Просто ждем сигнала завершения
+		proxyWg.Add(1)
+		go func() {
+			defer proxyWg.Done()
+			<-sessionCtx.Done()
+			logger.Info("Test mode: received shutdown signal")
+		}()
+	}
+
+	// Wait for error, renewal or shutdown signal
+	var err error
+	select {
+	case err = <-errChan:
+		if err == nil {
+			err = common.ErrConnectionLost
 		}
+		logger.Error("Proxy error occurred", zap.Error(err))
+		errorsTotal.WithLabelValues("proxy_error").Inc()
+	case <-renewed:
+		logger.Info("Client certificate renewed, restarting session")
+		err = errCertificateRenewed
+	case move := <-masqueConn.Moves():
+		logger.Info("Server is draining, moving to another server",
+			zap.Strings("endpoints", move.Endpoints),
+			zap.Time("deadline", move.Deadline))
+		err = &serverMovedError{Endpoints: move.Endpoints}
+	case <-ctx.Done():
+		logger.Info("Shutdown signal received, stopping proxy")
+		err = ctx.Err()
+	}
+	cancelSession()
 
-		// Wait for proxy goroutines to finish
-		logger.Debug("Waiting for proxy goroutines to finish")
-		proxyWg.Wait()
-		logger.Info("All proxy goroutines finished")
-	}()
+	// Record connection duration
+	connectionDuration.Observe(time.Since(connectionStart).Seconds())
+	
+	// Update connection status
+	connectionStatus.WithLabelValues(activeServer.Addr, activeServer.Name).Set(0)
+	activeConnections.Set(0)
 
-	// Wait for the main goroutine to finish or be signaled
-	wg.Wait()
-	logger.Info("MASQUE VPN Client shutdown complete")
+	if err := masqueConn.Close(); err != nil {
+		logger.Warn("Error closing MASQUE connection", zap.Error(err))
+	}
+	quicConn.CloseWithError(0, "client shutdown")
+
+	// Wait for proxy goroutines to finish
+	logger.Debug("Waiting for proxy goroutines to finish")
+	proxyWg.Wait()
+	return err
 }
 
-// establishAndConfigure establishes connection to server, sets up TUN device and routing
-func establishAndConfigure(ctx context.Context) (*common.TUNDevice, *common.MASQUEConn, error) {
-	logger.Info("Configuring TLS settings")
-	
-	// TLS configuration
+// reloadClientConfig re-reads the config file, e.g. after renewed credentials were written
+func reloadClientConfig(configFile string) error {
+	var config common.ClientConfig
+	if _, err := toml.DecodeFile(configFile, &config); err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", configFile, err)
+	}
+	clientConfig = config
+	return nil
+}
+
+// newClientTLSConfig builds the TLS configuration with the trusted CA and the
+// client certificate; the server name is set per server
+func newClientTLSConfig() (*tls.Config, error) {
 	tlsConfig := &tls.Config{
-		ServerName:         clientConfig.ServerName,
 		InsecureSkipVerify: clientConfig.InsecureSkipVerify,
 		NextProtos:         []string{http3.NextProtoH3}, // Required for http3
 	}
@@ -296,44 +503,51 @@ func establishAndConfigure(ctx context.Context) (*common.TUNDevice, *common.MASQ
 	if clientConfig.CAPEM != "" {
 		caCertPool := x509.NewCertPool()
 		if !caCertPool.AppendCertsFromPEM([]byte(clientConfig.CAPEM)) {
-			return nil, nil, fmt.Errorf("failed to append CA cert from config ca_pem")
+			return nil, fmt.Errorf("%w: failed to append CA cert from config ca_pem", common.ErrInvalidCertificate)
 		}
 		tlsConfig.RootCAs = caCertPool
 		tlsConfig.InsecureSkipVerify = false
-		logger.Info("Using custom CA from config PEM")
 	} else if clientConfig.CAFile != "" {
 		caCert, err := os.ReadFile(clientConfig.CAFile)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to read CA file %s: %w", clientConfig.CAFile, err)
+			return nil, fmt.Errorf("%w: failed to read CA file %s: %v", common.ErrInvalidCertificate, clientConfig.CAFile, err)
 		}
 		caCertPool := x509.NewCertPool()
 		if !caCertPool.AppendCertsFromPEM(caCert) {
-			return nil, nil, fmt.Errorf("failed to append CA cert from %s", clientConfig.CAFile)
+			return nil, fmt.Errorf("%w: failed to append CA cert from %s", common.ErrInvalidCertificate, clientConfig.CAFile)
 		}
 		tlsConfig.RootCAs = caCertPool
 		tlsConfig.InsecureSkipVerify = false
-		logger.Info("Using custom CA from file", zap.String("ca_file", clientConfig.CAFile))
 	}
 	
 	// Load client certificate and key - prioritize PEM strings from config
-	if clientConfig.CertPEM != "" && clientConfig.KeyPEM != "" {
-		cert, err := tls.X509KeyPair([]byte(clientConfig.CertPEM), []byte(clientConfig.KeyPEM))
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to load client certificate/key from config PEM: %w", err)
-		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
-		logger.Info("Loaded client certificate from config PEM")
-	} else if clientConfig.TLSCert != "" && clientConfig.TLSKey != "" {
-		cert, err := tls.LoadX509KeyPair(clientConfig.TLSCert, clientConfig.TLSKey)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to load client certificate/key: %w", err)
-		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
-		logger.Info("Loaded client certificate from files", 
-			zap.String("cert_file", clientConfig.TLSCert),
-			zap.String("key_file", clientConfig.TLSKey))
+	cert, err := loadClientCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", common.ErrInvalidCertificate, err)
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return tlsConfig, nil
+}
+
+// establishAndConfigure establishes connection to server and sets up the TUN
+// device, unless dev is the one kept from the previous connection
+func establishAndConfigure(ctx context.Context, dev *common.TUNDevice, server common.ServerEndpoint) (*common.TUNDevice, *common.MASQUEConn, *quic.Conn, error) {
+	logger.Info("Configuring TLS settings")
+	
+	tlsConfig, err := newClientTLSConfig()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tlsConfig.ServerName = server.Name
+	cert := tlsConfig.Certificates[0]
+	logger.Info("Loaded client certificate")
+
+	// Resume the TLS session on reconnects and restarts, skipping the certificate exchange
+	sessionCache, err := newSessionCache(clientConfig.SessionCacheFile, cert)
+	if err != nil {
+		logger.Warn("TLS session resumption disabled", zap.Error(err))
 	} else {
-		return nil, nil, fmt.Errorf("tls_cert and tls_key or cert_pem and key_pem must be set in config for mutual TLS authentication")
+		tlsConfig.ClientSessionCache = sessionCache
 	}
 	
 	// Configure TLS key logging if specified
@@ -357,27 +571,44 @@ func establishAndConfigure(ctx context.Context) (*common.TUNDevice, *common.MASQ
 		KeepAlivePeriod: 30 * time.Second,
 	}
 
-	logger.Info("Establishing QUIC connection", zap.String("server_addr", clientConfig.ServerAddr))
+	logger.Info("Establishing QUIC connection", zap.String("server_addr", server.Addr))
 	
 	// Create UDP socket for dialing
 	udpConn, err := net.ListenUDP("udp", nil) // Let OS choose source IP/port
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to listen on UDP: %w", err)
+		return nil, nil, nil, fmt.Errorf("failed to listen on UDP: %w", err)
 	}
 
-	serverUdpAddr, err := net.ResolveUDPAddr("udp", clientConfig.ServerAddr)
+	serverUdpAddr, err := resolveServer(server)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to resolve server address %s: %w", clientConfig.ServerAddr, err)
+		udpConn.Close()
+		return nil, nil, nil, err
 	}
 
 	// Dial with timeout
 	dialCtx, dialCancel := context.WithTimeout(ctx, 15*time.Second)
 	defer dialCancel()
 
-	quicConn, err := quic.Dial(dialCtx, udpConn, serverUdpAddr, tlsConfig, quicConf)
+	// A transport of our own uses non-empty connection IDs, which the
+	// connection needs to migrate to another socket on network changes
+	transport := &quic.Transport{Conn: udpConn}
+	// With a resumed session the CONNECT-IP request goes out as 0-RTT early data
+	dial := transport.DialEarly
+	if clientConfig.Disable0RTT {
+		dial = transport.Dial
+	}
+	dialStart := time.Now()
+	quicConn, err := dial(dialCtx, serverUdpAddr, tlsConfig, quicConf)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to dial QUIC connection to %s: %w", clientConfig.ServerAddr, err)
+		transport.Close()
+		udpConn.Close()
+		return nil, nil, nil, fmt.Errorf("%w: failed to dial QUIC connection to %s: %w", common.ErrConnectionFailed, server.Addr, err)
 	}
+	// The socket is ours to close once the connection is gone (e.g. on reconnect)
+	context.AfterFunc(quicConn.Context(), func() {
+		transport.Close()
+		udpConn.Close()
+	})
 	logger.Info("QUIC connection established", 
 		zap.String("remote_addr", quicConn.RemoteAddr().String()),
 		zap.String("local_addr", quicConn.LocalAddr().String()))
@@ -385,23 +616,54 @@ func establishAndConfigure(ctx context.Context) (*common.TUNDevice, *common.MASQ
 	// Create MASQUE client
 	masqueClient := common.NewMASQUEClient(quicConn, logger)
 
+	// Optional second factor: bearer token checked by the server after mTLS
+	authToken, err := loadAuthToken(clientConfig)
+	if err != nil {
+		quicConn.CloseWithError(0, "auth token unavailable")
+		return nil, nil, nil, fmt.Errorf("%w: %v", common.ErrInvalidConfig, err)
+	}
+	if authToken != "" {
+		masqueClient.Header.Set("Authorization", "Bearer "+authToken)
+		logger.Info("Sending bearer token with CONNECT-IP request")
+	}
+
 	// Establish MASQUE CONNECT-IP session
 	logger.Info("Establishing MASQUE CONNECT-IP session")
 	connectCtx, connectCancel := context.WithTimeout(ctx, 10*time.Second)
 	defer connectCancel()
 
 	masqueConn, err := masqueClient.ConnectIP(connectCtx)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// Early data was discarded: send the request again once the handshake completes
+		logger.Info("Server rejected 0-RTT, repeating CONNECT-IP after the handshake")
+		var next *quic.Conn
+		if next, err = quicConn.NextConnection(connectCtx); err == nil {
+			quicConn = next
+			retryClient := common.NewMASQUEClient(quicConn, logger)
+			retryClient.Header = masqueClient.Header
+			masqueConn, err = retryClient.ConnectIP(connectCtx)
+		}
+	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to establish MASQUE CONNECT-IP session: %w", err)
+		quicConn.CloseWithError(0, "connect-ip failed")
+		return nil, nil, nil, fmt.Errorf("%w: failed to establish MASQUE CONNECT-IP session: %w", common.ErrMASQUEProtocol, err)
 	}
-	logger.Info("MASQUE CONNECT-IP session established successfully")
+	select {
+	case <-quicConn.HandshakeComplete():
+	case <-connectCtx.Done():
+	}
+	handshake := handshakeKind(quicConn.ConnectionState())
+	latency := time.Since(dialStart)
+	connectLatency.WithLabelValues(handshake).Observe(latency.Seconds())
+	logger.Info("MASQUE CONNECT-IP session established successfully",
+		zap.String("handshake", handshake), zap.Duration("latency", latency))
 
 	// Get assigned IP from server (this would be implemented in masque-go)
 	// For now, we'll use a default assignment
 	assignedIP := "10.0.0.2/32"
 	_, assignedPrefix, err := net.ParseCIDR(assignedIP)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse assigned IP: %w", err)
+		return nil, nil, nil, fmt.Errorf("failed to parse assigned IP: %w", err)
 	}
 
 	logger.Info("Configuring TUN device", 
@@ -409,28 +671,27 @@ func establishAndConfigure(ctx context.Context) (*common.TUNDevice, *common.MASQ
 		zap.String("tun_name", clientConfig.TunName),
 		zap.Int("mtu", clientConfig.MTU))
 
-	var dev *common.TUNDevice
-	if clientConfig.TunName != "" {
+	if dev != nil {
+		logger.Info("Reusing TUN device from the previous connection", zap.String("device_name", dev.Name()))
+	} else if clientConfig.TunName != "" {
 		dev, err = common.CreateTunDevice(clientConfig.TunName, *assignedPrefix, clientConfig.MTU)
 		if err != nil {
 			masqueConn.Close()
-			return nil, nil, fmt.Errorf("failed to create and configure TUN device: %w", err)
+			quicConn.CloseWithError(0, "tun setup failed")
+			return nil, nil, nil, fmt.Errorf("%w: %w", common.ErrTUNDeviceCreation, err)
 		}
 		logger.Info("TUN device configured successfully", 
 			zap.String("device_name", dev.Name()),
 			zap.String("assigned_ip", assignedIP))
 
-		// Add default route through VPN
-		defaultRoute := "0.0.0.0/0"
-		_, defaultNet, _ := net.ParseCIDR(defaultRoute)
-		if err := dev.AddRoute(*defaultNet); err != nil {
-			logger.Warn("Failed to add default route", zap.Error(err))
-		} else {
-			logger.Info("Added default route through VPN")
+		address, _ := netip.ParsePrefix(assignedIP)
+		if err := journal.Record(journalEntry{Kind: changeAddress, Interface: dev.Name(), Address: address}); err != nil {
+			logger.Warn("Failed to record TUN address in change journal", zap.Error(err))
 		}
+
 	} else {
 		logger.Info("TUN device disabled (empty tun_name)")
 	}
 
-	return dev, masqueConn, nil
+	return dev, masqueConn, quicConn, nil
 }
\ No newline at end of file
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+const (
+	// migrationSettleDelay lets a burst of network events settle before the path is checked
+	migrationSettleDelay = time.Second
+	// migrationProbeTimeout bounds the validation of a new path
+	migrationProbeTimeout = 5 * time.Second
+	// maxMigrationTransports bounds the sockets a connection keeps for migrated
+	// paths. quic-go does not retire the connection ID of a validated path
+	// either, and a connection holds only a few, so later probes would time out.
+	maxMigrationTransports = 2
+)
+
+// errMigrationLimit is returned once the connection holds maxMigrationTransports sockets
+var errMigrationLimit = errors.New("too many migrated paths on this connection")
+
+// pathMigrator moves the QUIC connection to a new local socket when the host
+// network changes, e.g. from Wi-Fi to Ethernet. The connection keeps its
+// keys and streams, so CONNECT-IP is not negotiated again.
+type pathMigrator struct {
+	conn    *quic.Conn
+	server  *net.UDPAddr
+	tunName string
+	// routes re-pins the route to the server; nil without a TUN device
+	routes *routeManager
+	// source is the local address the connection currently uses
+	source netip.Addr
+	// sourceAddr returns the local address for the server; replaced in tests
+	sourceAddr func(*net.UDPAddr) (netip.Addr, error)
+	// transports are the sockets of the paths this migrator added. quic-go
+	// registers the connection with every transport a path was probed on and
+	// closing any of them closes the connection, so they are only released
+	// when the connection ends.
+	transports []*quic.Transport
+}
+
+// newPathMigrator creates the migrator for one connection
+func newPathMigrator(conn *quic.Conn, link *tunnelLink) *pathMigrator {
+	m := &pathMigrator{
+		conn:       conn,
+		server:     conn.RemoteAddr().(*net.UDPAddr),
+		routes:     link.routes,
+		sourceAddr: localSourceAddr,
+	}
+	if link.dev != nil {
+		m.tunName = link.dev.Name()
+	}
+	return m
+}
+
+// Run follows network changes until ctx is done
+func (m *pathMigrator) Run(ctx context.Context) {
+	changes, err := common.WatchNetworkChanges(ctx, m.tunName)
+	if err != nil {
+		logger.Info("Connection migration on network changes unavailable", zap.Error(err))
+		return
+	}
+	if m.source, err = m.sourceAddr(m.server); err != nil {
+		logger.Debug("Cannot determine local address for VPN server", zap.Error(err))
+	}
+
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			logger.Debug("Host network changed", zap.String("kind", change.Kind), zap.String("interface", change.Interface))
+			if settle == nil {
+				settle = time.After(migrationSettleDelay)
+			}
+		case <-settle:
+			settle = nil
+			m.check(ctx)
+		}
+	}
+}
+
+// check moves the route to the server and the connection if the host now
+// reaches the server from another local address
+func (m *pathMigrator) check(ctx context.Context) {
+	if m.routes != nil {
+		if err := m.routes.Repin(); err != nil {
+			logger.Warn("Failed to move route to VPN server", zap.Error(err))
+		}
+	}
+
+	source, err := m.sourceAddr(m.server)
+	if err != nil {
+		logger.Warn("VPN server unreachable after network change", zap.Error(err))
+		return
+	}
+	if source == m.source {
+		return
+	}
+
+	logger.Info("Local address changed, migrating connection",
+		zap.Stringer("from", m.source), zap.Stringer("to", source))
+	if err := m.migrate(ctx); err != nil {
+		if errors.Is(err, errMigrationLimit) {
+			// Reconnecting starts over with the dial socket alone
+			logger.Info("Path migration limit reached, reconnecting", zap.Int("sockets", len(m.transports)))
+			pathMigrations.WithLabelValues("reconnect").Inc()
+			m.conn.CloseWithError(0, "path migration limit reached")
+			return
+		}
+		logger.Warn("Connection migration failed", zap.Error(err))
+		pathMigrations.WithLabelValues("failed").Inc()
+		return
+	}
+	m.source = source
+	pathMigrations.WithLabelValues("migrated").Inc()
+	logger.Info("Connection migrated to new path", zap.Stringer("local_addr", source))
+}
+
+// migrate validates a path over a new socket and switches the connection to it
+func (m *pathMigrator) migrate(ctx context.Context) error {
+	if len(m.transports) >= maxMigrationTransports {
+		return errMigrationLimit
+	}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return fmt.Errorf("failed to listen on UDP: %w", err)
+	}
+	tr := &quic.Transport{Conn: udpConn}
+
+	path, err := m.conn.AddPath(tr)
+	if err != nil {
+		udpConn.Close()
+		return fmt.Errorf("%w: %v", common.ErrQUICProtocol, err)
+	}
+	m.track(tr, udpConn)
+
+	probeCtx, cancel := context.WithTimeout(ctx, migrationProbeTimeout)
+	defer cancel()
+	if err := path.Probe(probeCtx); err != nil {
+		path.Close()
+		return fmt.Errorf("failed to validate new path: %w", err)
+	}
+	if err := path.Switch(); err != nil {
+		path.Close()
+		return fmt.Errorf("failed to switch to new path: %w", err)
+	}
+	return nil
+}
+
+// track keeps the socket of a new path open until the connection ends
+func (m *pathMigrator) track(tr *quic.Transport, udpConn *net.UDPConn) {
+	m.transports = append(m.transports, tr)
+	context.AfterFunc(m.conn.Context(), func() {
+		tr.Close()
+		udpConn.Close()
+	})
+}
+
+// localSourceAddr returns the local address the host uses to reach server;
+// connecting a UDP socket sends no packet
+func localSourceAddr(server *net.UDPAddr) (netip.Addr, error) {
+	conn, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestTLSConfigs returns TLS configs of a local test server and a client trusting it
+func newTestTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"masque-test"},
+	}
+	client = &tls.Config{
+		ServerName: "localhost",
+		RootCAs:    roots,
+		NextProtos: []string{"masque-test"},
+	}
+	return server, client
+}
+
+// serveEcho echoes every stream of the connections accepted by ln
+func serveEcho(ln *quic.EarlyListener, accepted chan<- *quic.Conn) {
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		if accepted != nil {
+			accepted <- conn
+		}
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go io.Copy(stream, stream)
+			}
+		}()
+	}
+}
+
+// newTestQUICPair connects a QUIC client to a local echo server and returns
+// the client connection and the server's view of it
+func newTestQUICPair(t *testing.T) (*quic.Conn, <-chan *quic.Conn) {
+	t.Helper()
+	serverTLS, clientTLS := newTestTLSConfigs(t)
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", serverTLS, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := make(chan *quic.Conn, 1)
+	go serveEcho(ln, accepted)
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { udpConn.Close() })
+	// Dialed like the client does, with a transport of its own
+	tr := &quic.Transport{Conn: udpConn}
+	t.Cleanup(func() { tr.Close() })
+	conn, err := tr.Dial(t.Context(), ln.Addr(), clientTLS, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.CloseWithError(0, "") })
+	return conn, accepted
+}
+
+func echo(t *testing.T, stream *quic.Stream, msg string) {
+	t.Helper()
+	_, err := stream.Write([]byte(msg))
+	require.NoError(t, err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(buf))
+}
+
+func TestPathMigrator_Migrate(t *testing.T) {
+	logger = zap.NewNop()
+	conn, accepted := newTestQUICPair(t)
+	stream, err := conn.OpenStreamSync(t.Context())
+	require.NoError(t, err)
+	echo(t, stream, "before")
+	serverConn := <-accepted
+	oldPort := serverConn.RemoteAddr().(*net.UDPAddr).Port
+
+	m := &pathMigrator{conn: conn, server: conn.RemoteAddr().(*net.UDPAddr)}
+	require.NoError(t, m.migrate(t.Context()))
+
+	// The same stream keeps working and the server follows the new socket
+	echo(t, stream, "after")
+	assert.NotEqual(t, oldPort, serverConn.RemoteAddr().(*net.UDPAddr).Port)
+}
+
+func TestPathMigrator_CheckOnlyMigratesOnNewAddress(t *testing.T) {
+	logger = zap.NewNop()
+	conn, _ := newTestQUICPair(t)
+	source := netip.MustParseAddr("127.0.0.1")
+	m := &pathMigrator{
+		conn:       conn,
+		server:     conn.RemoteAddr().(*net.UDPAddr),
+		source:     source,
+		sourceAddr: func(*net.UDPAddr) (netip.Addr, error) { return source, nil },
+	}
+
+	migrated := testutil.ToFloat64(pathMigrations.WithLabelValues("migrated"))
+	m.check(t.Context())
+	assert.Equal(t, migrated, testutil.ToFloat64(pathMigrations.WithLabelValues("migrated")))
+
+	source = netip.MustParseAddr("127.0.0.2")
+	m.check(t.Context())
+	assert.Equal(t, migrated+1, testutil.ToFloat64(pathMigrations.WithLabelValues("migrated")))
+	assert.Equal(t, source, m.source)
+}
+
+func TestPathMigrator_ReconnectsAtMigrationLimit(t *testing.T) {
+	logger = zap.NewNop()
+	conn, _ := newTestQUICPair(t)
+	stream, err := conn.OpenStreamSync(t.Context())
+	require.NoError(t, err)
+	source := netip.MustParseAddr("127.0.0.1")
+	m := &pathMigrator{
+		conn:       conn,
+		server:     conn.RemoteAddr().(*net.UDPAddr),
+		source:     source,
+		sourceAddr: func(*net.UDPAddr) (netip.Addr, error) { return source, nil },
+	}
+
+	// Going back and forth between two networks
+	for i := 0; i < maxMigrationTransports; i++ {
+		source = netip.AddrFrom4([4]byte{127, 0, 0, byte(2 + i%2)})
+		m.check(t.Context())
+		require.Equal(t, source, m.source)
+		echo(t, stream, "migrated")
+	}
+	assert.Len(t, m.transports, maxMigrationTransports)
+
+	// One more migration would add a socket; the connection is closed instead
+	reconnects := testutil.ToFloat64(pathMigrations.WithLabelValues("reconnect"))
+	source = netip.MustParseAddr("127.0.0.1")
+	m.check(t.Context())
+	assert.Len(t, m.transports, maxMigrationTransports)
+	assert.Equal(t, reconnects+1, testutil.ToFloat64(pathMigrations.WithLabelValues("reconnect")))
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection was not closed at the migration limit")
+	}
+}
+
+func TestLocalSourceAddr(t *testing.T) {
+	source, err := localSourceAddr(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4433})
+	require.NoError(t, err)
+	assert.True(t, source.IsLoopback())
+}
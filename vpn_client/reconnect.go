@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+const (
+	// reconnectInitialDelay is the first reconnect delay, doubled after every failure
+	reconnectInitialDelay = time.Second
+	// defaultReconnectMaxDelay is used when reconnect_max_delay_seconds is not configured
+	defaultReconnectMaxDelay = 60 * time.Second
+	// reconnectBackoffReset is how long a connection must last to start over with short delays
+	reconnectBackoffReset = time.Minute
+	// reconnectJitter spreads the delays of clients that lost the same server
+	reconnectJitter = 0.2
+)
+
+// errCertificateRenewed ends a session to reconnect with the renewed client certificate
+var errCertificateRenewed = errors.New("client certificate renewed")
+
+// serverMovedError ends a session the server asked to leave because it is draining
+type serverMovedError struct {
+	Endpoints []string
+}
+
+func (e *serverMovedError) Error() string {
+	return "server is draining and asked the client to move"
+}
+
+// reconnectBackoff yields exponentially growing reconnect delays with jitter
+type reconnectBackoff struct {
+	max  time.Duration
+	next time.Duration
+	// jitter returns a random factor in [0, 1); replaced in tests
+	jitter func() float64
+}
+
+// newReconnectBackoff returns the backoff capped at maxSeconds (60 if not set)
+func newReconnectBackoff(maxSeconds int) *reconnectBackoff {
+	max := defaultReconnectMaxDelay
+	if maxSeconds > 0 {
+		max = time.Duration(maxSeconds) * time.Second
+	}
+	return &reconnectBackoff{max: max, next: reconnectInitialDelay, jitter: rand.Float64}
+}
+
+// Next returns the delay before the next attempt, within ±20% of the nominal one
+func (b *reconnectBackoff) Next() time.Duration {
+	delay := min(b.next, b.max)
+	b.next = min(b.next*2, b.max)
+	factor := 1 + reconnectJitter*(2*b.jitter()-1)
+	return time.Duration(float64(delay) * factor)
+}
+
+// Reset starts over with the initial delay
+func (b *reconnectBackoff) Reset() {
+	b.next = reconnectInitialDelay
+}
+
+// recoveryStrategy decides how to recover from the error that ended a
+// connection attempt or session. The server turning the session down stops
+// the client, unless it is only busy for now.
+func recoveryStrategy(err error) common.RecoveryStrategy {
+	var rejected *common.ConnectRejectedError
+	if errors.As(err, &rejected) {
+		if rejected.StatusCode == http.StatusTooManyRequests || rejected.StatusCode >= 500 {
+			return common.RecoveryReconnect
+		}
+		return common.RecoveryNone
+	}
+	return common.GetRecoveryStrategy(err)
+}
+
+// recoveryStrategyName names a strategy for logs and metrics
+func recoveryStrategyName(strategy common.RecoveryStrategy) string {
+	switch strategy {
+	case common.RecoveryNone:
+		return "none"
+	case common.RecoveryRetry:
+		return "retry"
+	case common.RecoveryReconnect:
+		return "reconnect"
+	case common.RecoveryRestart:
+		return "restart"
+	case common.RecoveryFallback:
+		return "fallback"
+	}
+	return "unknown"
+}
+
+// tunnelLink is the TUN device and the host network configuration around it:
+// routes, DNS settings and the DNS leak guard. It outlives single connections
+// to the server, so reconnecting leaves the host network untouched.
+type tunnelLink struct {
+	dev    *common.TUNDevice
+	routes *routeManager
+	cancel context.CancelFunc
+	// background route refresh and leak counters
+	wg sync.WaitGroup
+	// TUN readers of past and current sessions
+	readers sync.WaitGroup
+}
+
+// setupTunnelLink applies the routes and DNS settings pushed with the first connection
+func setupTunnelLink(ctx context.Context, dev *common.TUNDevice, quicConn *quic.Conn, masqueConn *common.MASQUEConn) *tunnelLink {
+	linkCtx, cancel := context.WithCancel(ctx)
+	link := &tunnelLink{dev: dev, cancel: cancel}
+
+	tunName := ""
+	if dev != nil {
+		tunName = dev.Name()
+		tunInterfaceStatus.WithLabelValues(tunName).Set(1)
+	}
+	status.setConnected(true, activeServer.Addr, tunName)
+	if dev == nil {
+		return link
+	}
+
+	// Route the planned networks through VPN, keeping the path to the servers
+	// themselves, including those a failover may switch to
+	serverAddr := quicConn.RemoteAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+	servers := []netip.Addr{serverAddr}
+	for _, addr := range profileServerAddrs(linkCtx) {
+		if !slices.Contains(servers, addr) {
+			servers = append(servers, addr)
+		}
+	}
+	link.routes = newRouteManager(dev, servers, masqueConn.Routes)
+	if err := link.routes.Sync(linkCtx); err != nil {
+		logger.Warn("Failed to set up routes through VPN", zap.Error(err))
+	} else {
+		logger.Info("Routes through VPN configured")
+	}
+	link.wg.Add(1)
+	go func() {
+		defer link.wg.Done()
+		link.routes.Run(linkCtx)
+	}()
+
+	// Resolve through the DNS servers pushed by the server
+	if len(masqueConn.DNSServers) > 0 {
+		mode, err := applyDNS(tunName, masqueConn.DNSServers, masqueConn.SearchDomains)
+		if err != nil {
+			logger.Warn("Failed to apply DNS settings from server", zap.String("dns_mode", mode), zap.Error(err))
+		} else if mode != dnsModeOff {
+			logger.Info("Applied DNS settings from server",
+				zap.String("dns_mode", mode),
+				zap.Stringers("servers", masqueConn.DNSServers),
+				zap.Strings("search_domains", masqueConn.SearchDomains))
+			status.setDNS(masqueConn.DNSServers, masqueConn.SearchDomains, mode)
+		}
+	}
+
+	// Keep queries from reaching resolvers outside the tunnel
+	if clientConfig.DNSLeakProtection {
+		if len(masqueConn.DNSServers) == 0 {
+			logger.Warn("DNS leak protection needs DNS servers from the server, not enabled")
+		} else if guard, err := newDNSLeakGuard(tunName, masqueConn.DNSServers); err != nil {
+			logger.Warn("Failed to enable DNS leak protection", zap.Error(err))
+		} else {
+			logger.Info("DNS leak protection enabled", zap.Stringers("allowed_servers", masqueConn.DNSServers))
+			link.wg.Add(1)
+			go func() {
+				defer link.wg.Done()
+				guard.Run(linkCtx)
+			}()
+		}
+	}
+	return link
+}
+
+// Update follows routes the server advertises differently after a reconnect
+func (l *tunnelLink) Update(ctx context.Context, masqueConn *common.MASQUEConn) {
+	if l.routes == nil || !l.routes.SetAdvertised(masqueConn.Routes) {
+		return
+	}
+	logger.Info("Server advertises different routes after reconnect", zap.Stringers("routes", masqueConn.Routes))
+	if err := l.routes.Sync(ctx); err != nil {
+		logger.Warn("Failed to update routes through VPN", zap.Error(err))
+	}
+}
+
+// Close undoes the network configuration of the session and closes the TUN device
+func (l *tunnelLink) Close() {
+	l.cancel()
+	l.wg.Wait()
+	status.setConnected(false, activeServer.Addr, "")
+
+	logger.Info("Cleaning up resources...")
+	if err := journal.RollbackSession(); err != nil {
+		logger.Warn("Failed to revert network changes", zap.Error(err))
+	}
+	if l.dev != nil {
+		tunInterfaceStatus.WithLabelValues(l.dev.Name()).Set(0)
+		if err := l.dev.Close(); err != nil {
+			logger.Warn("Error closing TUN device", zap.Error(err))
+		}
+	}
+	l.readers.Wait()
+	logger.Info("All proxy goroutines finished")
+}
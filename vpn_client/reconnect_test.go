@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	b := newReconnectBackoff(5)
+	b.jitter = func() float64 { return 0.5 }
+
+	var delays []time.Duration
+	for range 5 {
+		delays = append(delays, b.Next())
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, delays)
+
+	b.Reset()
+	assert.Equal(t, time.Second, b.Next())
+
+	// Jitter stays within ±20%
+	b.Reset()
+	b.jitter = func() float64 { return 0 }
+	assert.Equal(t, 800*time.Millisecond, b.Next())
+	b.jitter = func() float64 { return 0.999999 }
+	assert.InDelta(t, float64(2400*time.Millisecond), float64(b.Next()), float64(time.Millisecond))
+
+	assert.Equal(t, defaultReconnectMaxDelay, newReconnectBackoff(0).max)
+}
+
+func TestRecoveryStrategy(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want common.RecoveryStrategy
+	}{
+		{"connection lost", common.ErrConnectionLost, common.RecoveryReconnect},
+		{"dial failed", fmt.Errorf("%w: failed to dial QUIC connection: %w", common.ErrConnectionFailed, fmt.Errorf("no route")), common.RecoveryReconnect},
+		{"bad certificate", fmt.Errorf("%w: failed to load client certificate/key", common.ErrInvalidCertificate), common.RecoveryNone},
+		{"tun device", fmt.Errorf("%w: busy", common.ErrTUNDeviceCreation), common.RecoveryRetry},
+		{"unauthorized", fmt.Errorf("%w: %w", common.ErrMASQUEProtocol, &common.ConnectRejectedError{StatusCode: 401}), common.RecoveryNone},
+		{"session limit", fmt.Errorf("%w: %w", common.ErrMASQUEProtocol, &common.ConnectRejectedError{StatusCode: 429}), common.RecoveryReconnect},
+		{"server unavailable", &common.ConnectRejectedError{StatusCode: 503}, common.RecoveryReconnect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, recoveryStrategy(tt.err))
+		})
+	}
+	assert.Equal(t, "reconnect", recoveryStrategyName(common.RecoveryReconnect))
+}
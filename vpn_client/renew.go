@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultRenewFraction renews once two thirds of the certificate lifetime have passed
+	defaultRenewFraction = 2.0 / 3
+	// maxRenewRetryInterval caps the delay between failed renewal attempts
+	maxRenewRetryInterval = 5 * time.Minute
+	minRenewRetryInterval = 10 * time.Second
+)
+
+// renewalTime returns when cert should be renewed; ok is false if renewal is disabled
+func renewalTime(cert *x509.Certificate, fraction float64) (at time.Time, ok bool) {
+	if fraction == 0 {
+		fraction = defaultRenewFraction
+	}
+	if fraction < 0 || fraction >= 1 {
+		return time.Time{}, false
+	}
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(time.Duration(float64(lifetime) * fraction)), true
+}
+
+// renewRetryDelay spaces out retries so several attempts fit before expiry
+func renewRetryDelay(notAfter time.Time) time.Duration {
+	delay := time.Until(notAfter) / 4
+	if delay > maxRenewRetryInterval {
+		delay = maxRenewRetryInterval
+	}
+	if delay < minRenewRetryInterval {
+		delay = minRenewRetryInterval
+	}
+	return delay
+}
+
+// watchCertificateRenewal waits until cert is due for renewal and renews it
+// over quicConn. It returns nil once new credentials are stored in configPath,
+// so the caller can reconnect with them, or ctx.Err() when ctx is done first.
+func watchCertificateRenewal(ctx context.Context, quicConn *quic.Conn, configPath string, cert *x509.Certificate) error {
+	at, ok := renewalTime(cert, clientConfig.RenewFraction)
+	if !ok {
+		logger.Info("Automatic certificate renewal disabled")
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	logger.Info("Client certificate renewal scheduled",
+		zap.Time("not_after", cert.NotAfter),
+		zap.Time("renew_at", at))
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		renewed, err := renewCertificate(ctx, quicConn, configPath, cert)
+		if err == nil {
+			logger.Info("Client certificate renewed",
+				zap.String("serial", fmt.Sprintf("%x", renewed.SerialNumber)),
+				zap.Time("not_after", renewed.NotAfter))
+			return nil
+		}
+
+		errorsTotal.WithLabelValues("certificate_renewal").Inc()
+		delay := renewRetryDelay(cert.NotAfter)
+		logger.Warn("Certificate renewal failed, will retry",
+			zap.Error(err),
+			zap.Duration("retry_in", delay),
+			zap.Time("not_after", cert.NotAfter))
+		timer.Reset(delay)
+	}
+}
+
+// renewCertificate sends a CSR for a fresh key over the authenticated QUIC
+// connection and atomically stores the new key and certificate.
+func renewCertificate(ctx context.Context, quicConn *quic.Conn, configPath string, current *x509.Certificate) (*x509.Certificate, error) {
+	key, keyPEM, err := generateClientKey()
+	if err != nil {
+		return nil, err
+	}
+	csrPEM, err := createCSR(key, current.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http3.Transport{}
+	resp, err := postRenewRequest(ctx, transport.NewClientConn(quicConn), activeServer.Name,
+		common.RenewRequest{CSR: string(csrPEM)})
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := verifyIssuedCertificate([]byte(resp.CertPEM), []byte(resp.CAPEM), key)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Subject.CommonName != current.Subject.CommonName {
+		return nil, fmt.Errorf("%w: renewed certificate is for %q, expected %q",
+			common.ErrInvalidCertificate, cert.Subject.CommonName, current.Subject.CommonName)
+	}
+
+	// The configured CA stays authoritative; only the client credentials change
+	if err := saveClientCredentials(configPath, []byte(resp.CertPEM), keyPEM, nil); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// postRenewRequest posts a renewal request through rt and decodes the response
+func postRenewRequest(ctx context.Context, rt http.RoundTripper, serverName string, req common.RenewRequest) (*common.EnrollResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+serverName+common.RenewPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := rt.RoundTrip(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("%w: renewal request failed: %v", common.ErrConnectionFailed, err)
+	}
+	return decodeEnrollResponse(httpResp, "renewal")
+}
+
+// currentClientCertificate returns the parsed leaf of the configured client certificate
+func currentClientCertificate() (*x509.Certificate, error) {
+	cert, err := loadClientCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// loadClientCertificate loads the client key pair, preferring PEM strings from the config
+func loadClientCertificate() (tls.Certificate, error) {
+	if clientConfig.CertPEM != "" && clientConfig.KeyPEM != "" {
+		cert, err := tls.X509KeyPair([]byte(clientConfig.CertPEM), []byte(clientConfig.KeyPEM))
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to load client certificate/key from config PEM: %w", err)
+		}
+		return cert, nil
+	}
+	if clientConfig.TLSCert != "" && clientConfig.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(clientConfig.TLSCert, clientConfig.TLSKey)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to load client certificate/key: %w", err)
+		}
+		return cert, nil
+	}
+	return tls.Certificate{}, fmt.Errorf("tls_cert and tls_key or cert_pem and key_pem must be set in config for mutual TLS authentication")
+}
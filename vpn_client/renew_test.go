@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenewalTime(t *testing.T) {
+	notBefore := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(90 * 24 * time.Hour)}
+
+	at, ok := renewalTime(cert, 0)
+	require.True(t, ok)
+	assert.Equal(t, notBefore.Add(60*24*time.Hour), at)
+
+	at, ok = renewalTime(cert, 0.5)
+	require.True(t, ok)
+	assert.Equal(t, notBefore.Add(45*24*time.Hour), at)
+
+	_, ok = renewalTime(cert, -1)
+	assert.False(t, ok)
+	_, ok = renewalTime(cert, 1)
+	assert.False(t, ok)
+}
+
+func TestRenewRetryDelay(t *testing.T) {
+	assert.Equal(t, maxRenewRetryInterval, renewRetryDelay(time.Now().Add(24*time.Hour)))
+	assert.Equal(t, minRenewRetryInterval, renewRetryDelay(time.Now().Add(-time.Hour)))
+	assert.InDelta(t, float64(5*time.Minute/4), float64(renewRetryDelay(time.Now().Add(5*time.Minute))), float64(time.Second))
+}
+
+func TestPostRenewRequest(t *testing.T) {
+	// The enrollment test server signs any CSR; renewal shares its response format
+	srv, caPEM := newTestEnrollServer(t, "")
+	key, keyPEM, err := generateClientKey()
+	require.NoError(t, err)
+	csrPEM, err := createCSR(key, "alice")
+	require.NoError(t, err)
+
+	rewrite := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		assert.Equal(t, common.RenewPath, req.URL.Path)
+		assert.Equal(t, "vpn.example.com", req.URL.Host)
+		// The test server only accepts the enrollment path and an empty token
+		req.URL.Scheme, req.URL.Host, req.URL.Path = "http", srv.Listener.Addr().String(), common.EnrollPath
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	resp, err := postRenewRequest(context.Background(), rewrite, "vpn.example.com", common.RenewRequest{CSR: string(csrPEM)})
+	require.NoError(t, err)
+	cert, err := verifyIssuedCertificate([]byte(resp.CertPEM), caPEM, key)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", cert.Subject.CommonName)
+
+	// Renewed credentials replace the old ones without touching the configured CA
+	configPath := filepath.Join(t.TempDir(), "config.client.toml")
+	require.NoError(t, os.WriteFile(configPath, []byte("server_addr = \"vpn:4433\"\nca_pem = \"old-ca\"\ncert_pem = \"old\"\nkey_pem = \"old\"\n"), 0600))
+	require.NoError(t, saveClientCredentials(configPath, []byte(resp.CertPEM), keyPEM, nil))
+
+	var config common.ClientConfig
+	_, err = toml.DecodeFile(configPath, &config)
+	require.NoError(t, err)
+	assert.Equal(t, "old-ca", config.CAPEM)
+	assert.Equal(t, resp.CertPEM, config.CertPEM)
+	assert.Equal(t, string(keyPEM), config.KeyPEM)
+}
+
+func TestPostRenewRequestRejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Certificate was not issued by the built-in CA", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	rewrite := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req.URL.Scheme, req.URL.Host = "http", srv.Listener.Addr().String()
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	_, err := postRenewRequest(context.Background(), rewrite, "vpn.example.com", common.RenewRequest{CSR: "csr"})
+	assert.ErrorIs(t, err, common.ErrAuthenticationFailed)
+	assert.Contains(t, err.Error(), "not issued by the built-in CA")
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+const defaultDomainRefresh = 5 * time.Minute
+
+// defaultRouteHalves cover each address family with two halves. Being more
+// specific than the host's default route they take precedence over it
+// without replacing it, so the original default route survives a crash.
+var defaultRouteHalves = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/1"),
+	netip.MustParsePrefix("128.0.0.0/1"),
+	netip.MustParsePrefix("::/1"),
+	netip.MustParsePrefix("8000::/1"),
+}
+
+// linkLocalPrefixes are never useful through the tunnel with exclude_local_lan
+var linkLocalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// plannedRoute is a network sent through the tunnel and where it came from:
+// default, server, include, or domain:<name>
+type plannedRoute struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Source string       `json:"source"`
+}
+
+// planRoutes merges the server-advertised routes with the split tunnelling
+// settings. Without include_routes or include_domains the client tunnels what
+// the server advertises, or everything if it advertises nothing. With them it
+// tunnels only the included networks plus the server's specific (non-default)
+// routes. Excluded networks always win over included ones.
+func planRoutes(config common.ClientConfig, advertised []netip.Prefix, domains map[string][]netip.Addr, lan []netip.Prefix) ([]plannedRoute, error) {
+	includes, err := parsePrefixes("include_routes", config.IncludeRoutes)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := parsePrefixes("exclude_routes", config.ExcludeRoutes)
+	if err != nil {
+		return nil, err
+	}
+	if config.ExcludeLocalLAN {
+		excludes = append(excludes, lan...)
+		excludes = append(excludes, linkLocalPrefixes...)
+	}
+
+	var routes []plannedRoute
+	if len(config.IncludeRoutes) == 0 && len(config.IncludeDomains) == 0 {
+		for _, prefix := range advertised {
+			routes = append(routes, plannedRoute{Prefix: prefix, Source: "server"})
+		}
+		if len(routes) == 0 {
+			for _, prefix := range defaultRouteHalves {
+				routes = append(routes, plannedRoute{Prefix: prefix, Source: "default"})
+			}
+		}
+	} else {
+		for _, prefix := range includes {
+			routes = append(routes, plannedRoute{Prefix: prefix, Source: "include"})
+		}
+		for _, name := range config.IncludeDomains {
+			for _, addr := range domains[name] {
+				routes = append(routes, plannedRoute{Prefix: netip.PrefixFrom(addr, addr.BitLen()), Source: "domain:" + name})
+			}
+		}
+		for _, prefix := range advertised {
+			if prefix.Bits() > 0 {
+				routes = append(routes, plannedRoute{Prefix: prefix, Source: "server"})
+			}
+		}
+	}
+
+	// A default route would replace the host's own; use the two halves instead
+	var expanded []plannedRoute
+	for _, route := range routes {
+		if route.Prefix.Bits() != 0 {
+			expanded = append(expanded, route)
+			continue
+		}
+		for _, half := range defaultRouteHalves {
+			if half.Addr().Is4() == route.Prefix.Addr().Is4() {
+				expanded = append(expanded, plannedRoute{Prefix: half, Source: route.Source})
+			}
+		}
+	}
+
+	for _, exclude := range excludes {
+		var kept []plannedRoute
+		for _, route := range expanded {
+			for _, prefix := range subtractPrefix(route.Prefix, exclude) {
+				kept = append(kept, plannedRoute{Prefix: prefix, Source: route.Source})
+			}
+		}
+		expanded = kept
+	}
+
+	// Widest first, so that networks covered by an earlier route are dropped
+	slices.SortStableFunc(expanded, func(a, b plannedRoute) int {
+		if a.Prefix.Bits() != b.Prefix.Bits() {
+			return a.Prefix.Bits() - b.Prefix.Bits()
+		}
+		return a.Prefix.Addr().Compare(b.Prefix.Addr())
+	})
+	var result []plannedRoute
+	for _, route := range expanded {
+		if !slices.ContainsFunc(result, func(r plannedRoute) bool { return r.Prefix.Overlaps(route.Prefix) }) {
+			result = append(result, route)
+		}
+	}
+	slices.SortFunc(result, func(a, b plannedRoute) int {
+		if c := a.Prefix.Addr().Compare(b.Prefix.Addr()); c != 0 {
+			return c
+		}
+		return a.Prefix.Bits() - b.Prefix.Bits()
+	})
+	return result, nil
+}
+
+// subtractPrefix returns the parts of p not covered by exclude
+func subtractPrefix(p, exclude netip.Prefix) []netip.Prefix {
+	if !p.Overlaps(exclude) {
+		return []netip.Prefix{p}
+	}
+	if exclude.Bits() <= p.Bits() {
+		return nil
+	}
+
+	// p contains exclude: split p in halves and subtract from each
+	bits := p.Bits() + 1
+	low := netip.PrefixFrom(p.Addr(), bits)
+	high := netip.PrefixFrom(highHalfAddr(p), bits)
+	return append(subtractPrefix(low, exclude), subtractPrefix(high, exclude)...)
+}
+
+// highHalfAddr returns the first address of the upper half of p
+func highHalfAddr(p netip.Prefix) netip.Addr {
+	addr := p.Masked().Addr().AsSlice()
+	bit := p.Bits()
+	addr[bit/8] |= 0x80 >> (bit % 8)
+	result, _ := netip.AddrFromSlice(addr)
+	return result
+}
+
+// parsePrefixes parses a list of networks from the config
+func parsePrefixes(option string, values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			// A bare address means just that host
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				return nil, fmt.Errorf("%w: %s: %q is not a network", common.ErrInvalidConfig, option, value)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// localNetworks returns the networks of the host's interfaces, except loopback and the TUN device
+func localNetworks(tunName string) []netip.Prefix {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		logger.Warn("Failed to list network interfaces", zap.Error(err))
+		return nil
+	}
+
+	var networks []netip.Prefix
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Name == tunName {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipNet.IP)
+			if !ok {
+				continue
+			}
+			bits, _ := ipNet.Mask.Size()
+			networks = append(networks, netip.PrefixFrom(ip.Unmap(), bits).Masked())
+		}
+	}
+	return networks
+}
+
+// routeManager applies the planned route set to the TUN device of one session
+// and keeps it current as include_domains resolve to new addresses
+type routeManager struct {
+	dev *common.TUNDevice
+	// servers of the profile, all kept reachable outside the tunnel for failover
+	servers    []netip.Addr
+	advertised []netip.Prefix
+
+	mu      sync.Mutex
+	domains map[string][]netip.Addr
+	applied []plannedRoute
+	pins    map[netip.Addr]*journalEntry // host routes to the servers outside the tunnel
+}
+
+// newRouteManager creates the route manager for a session
+func newRouteManager(dev *common.TUNDevice, servers []netip.Addr, advertised []netip.Prefix) *routeManager {
+	return &routeManager{
+		dev:        dev,
+		servers:    servers,
+		advertised: advertised,
+		domains:    make(map[string][]netip.Addr),
+		pins:       make(map[netip.Addr]*journalEntry),
+	}
+}
+
+// SetAdvertised replaces the server-advertised routes and reports whether they changed
+func (m *routeManager) SetAdvertised(advertised []netip.Prefix) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if slices.Equal(m.advertised, advertised) {
+		return false
+	}
+	m.advertised = advertised
+	return true
+}
+
+// Sync resolves include_domains, plans the route set and brings the TUN
+// device routes in line with it
+func (m *routeManager) Sync(ctx context.Context) error {
+	m.resolveDomains(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var lan []netip.Prefix
+	if clientConfig.ExcludeLocalLAN {
+		lan = localNetworks(m.dev.Name())
+	}
+	planned, err := planRoutes(clientConfig, m.advertised, m.domains, lan)
+	if err != nil {
+		return err
+	}
+
+	// The path to the servers must not be captured by the tunnel
+	for _, server := range m.servers {
+		if _, pinned := m.pins[server]; pinned {
+			continue
+		}
+		if !slices.ContainsFunc(planned, func(r plannedRoute) bool { return r.Prefix.Contains(server) }) {
+			continue
+		}
+		pin, err := pinServerRoute(m.dev, server, nil)
+		if err != nil {
+			return err
+		}
+		m.pins[server] = pin
+	}
+
+	var errs []error
+	for _, route := range m.applied {
+		if slices.ContainsFunc(planned, func(r plannedRoute) bool { return r.Prefix == route.Prefix }) {
+			continue
+		}
+		if err := removeTunnelRoute(m.dev, common.Route{Destination: route.Prefix}); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		logger.Info("Removed route through VPN", zap.Stringer("prefix", route.Prefix), zap.String("source", route.Source))
+	}
+
+	applied := make([]plannedRoute, 0, len(planned))
+	for _, route := range planned {
+		if !slices.ContainsFunc(m.applied, func(r plannedRoute) bool { return r.Prefix == route.Prefix }) {
+			if err := addTunnelRoute(m.dev, common.Route{Destination: route.Prefix}); err != nil {
+				// IPv6 may be disabled on the host or the TUN device
+				if route.Prefix.Addr().Is6() {
+					logger.Warn("Failed to add IPv6 route through VPN", zap.Stringer("prefix", route.Prefix), zap.Error(err))
+				} else {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			logger.Debug("Added route through VPN", zap.Stringer("prefix", route.Prefix), zap.String("source", route.Source))
+		}
+		applied = append(applied, route)
+	}
+	m.applied = applied
+
+	status.setRoutes(applied, m.domains)
+	return errors.Join(errs...)
+}
+
+// resolveDomains looks up include_domains; a failed lookup keeps the previous addresses
+func (m *routeManager) resolveDomains(ctx context.Context) {
+	for _, name := range clientConfig.IncludeDomains {
+		lookupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		addrs, err := net.DefaultResolver.LookupNetIP(lookupCtx, "ip", name)
+		cancel()
+		if err != nil {
+			logger.Warn("Failed to resolve included domain", zap.String("domain", name), zap.Error(err))
+			continue
+		}
+		for i := range addrs {
+			addrs[i] = addrs[i].Unmap()
+		}
+		slices.SortFunc(addrs, netip.Addr.Compare)
+
+		m.mu.Lock()
+		m.domains[name] = slices.Compact(addrs)
+		m.mu.Unlock()
+	}
+}
+
+// Run re-resolves include_domains periodically until ctx is done
+func (m *routeManager) Run(ctx context.Context) {
+	if len(clientConfig.IncludeDomains) == 0 {
+		return
+	}
+	interval := defaultDomainRefresh
+	if clientConfig.DomainRefreshSeconds > 0 {
+		interval = time.Duration(clientConfig.DomainRefreshSeconds) * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Sync(ctx); err != nil {
+				logger.Warn("Failed to update routes through VPN", zap.Error(err))
+			}
+		}
+	}
+}
+
+// pinServerRoute adds a host route to the VPN server via the interface and
+// gateway the host would use without the tunnel, so that routes through the
+// tunnel cannot capture the QUIC connection itself. The route replaces
+// previous, the pin made before the host network changed, if it differs.
+func pinServerRoute(dev *common.TUNDevice, server netip.Addr, previous *journalEntry) (*journalEntry, error) {
+	if server.IsLoopback() {
+		return nil, nil
+	}
+
+	current, ifname, err := common.LookupRouteExcluding(server, func(route common.Route, ifname string) bool {
+		if ifname == dev.Name() {
+			return true
+		}
+		// The old pin would keep the path on an interface the host moved away from
+		return previous != nil && ifname == previous.Interface && route == *previous.Route
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot keep the path to VPN server %s: %w", server, err)
+	}
+
+	hostRoute := common.Route{
+		Destination: netip.PrefixFrom(server, server.BitLen()),
+		Gateway:     current.Gateway,
+	}
+	if previous != nil {
+		if ifname == previous.Interface && hostRoute == *previous.Route {
+			return previous, nil
+		}
+		if err := journal.Revert(*previous); err != nil {
+			logger.Warn("Failed to remove previous route to VPN server", zap.Error(err))
+		}
+	}
+
+	entry := journalEntry{Kind: changeRoute, Interface: ifname, Route: &hostRoute}
+	err = journal.Apply(entry, func() error {
+		return common.AddInterfaceRoute(ifname, hostRoute)
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Pinned route to VPN server",
+		zap.Stringer("route", hostRoute),
+		zap.String("interface", ifname))
+	return &entry, nil
+}
+
+// Repin moves the routes to the VPN servers to the interface the host uses
+// now, e.g. after switching from Wi-Fi to Ethernet
+func (m *routeManager) Repin() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	for server, previous := range m.pins {
+		if previous == nil {
+			continue
+		}
+		pin, err := pinServerRoute(m.dev, server, previous)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.pins[server] = pin
+	}
+	return errors.Join(errs...)
+}
+
+// addTunnelRoute adds a route through the TUN device and records it in the journal
+func addTunnelRoute(dev *common.TUNDevice, route common.Route) error {
+	return journal.Apply(journalEntry{Kind: changeRoute, Interface: dev.Name(), Route: &route}, func() error {
+		return dev.AddRouteEntry(route)
+	})
+}
+
+// removeTunnelRoute deletes a route through the TUN device and drops it from the journal
+func removeTunnelRoute(dev *common.TUNDevice, route common.Route) error {
+	return journal.Revert(journalEntry{Kind: changeRoute, Interface: dev.Name(), Route: &route})
+}
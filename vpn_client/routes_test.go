@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultRouteHalves(t *testing.T) {
+	addrs := []string{"0.0.0.0", "10.0.0.1", "127.255.255.255", "128.0.0.0", "255.255.255.255", "::", "2001:db8::1", "8000::", "ffff::1"}
+	for _, s := range addrs {
+		addr := netip.MustParseAddr(s)
+		matches := 0
+		for _, prefix := range defaultRouteHalves {
+			assert.Equal(t, 1, prefix.Bits(), "halves must be more specific than a default route")
+			if prefix.Contains(addr) {
+				matches++
+			}
+		}
+		assert.Equal(t, 1, matches, s)
+	}
+}
+
+func TestPinServerRoute_Loopback(t *testing.T) {
+	// A local server needs no host route and no route lookup
+	for _, server := range []string{"127.0.0.1", "::1"} {
+		pin, err := pinServerRoute(nil, netip.MustParseAddr(server), nil)
+		assert.NoError(t, err)
+		assert.Nil(t, pin)
+	}
+}
+
+func TestSubtractPrefix(t *testing.T) {
+	p := netip.MustParsePrefix
+	assert.Equal(t, []netip.Prefix{p("10.0.0.0/8")}, subtractPrefix(p("10.0.0.0/8"), p("192.168.0.0/16")))
+	assert.Empty(t, subtractPrefix(p("10.1.0.0/16"), p("10.0.0.0/8")))
+	assert.Equal(t, []netip.Prefix{p("0.0.0.0/2"), p("64.0.0.0/3"), p("96.0.0.0/4"), p("112.0.0.0/5"), p("120.0.0.0/6"), p("124.0.0.0/7"), p("126.0.0.0/8")},
+		subtractPrefix(p("0.0.0.0/1"), p("127.0.0.0/8")))
+	assert.Equal(t, []netip.Prefix{p("8000::/2"), p("c000::/3"), p("e000::/4"), p("f000::/5"), p("f800::/6"), p("fc00::/7")},
+		subtractPrefix(p("8000::/1"), p("fe00::/7")))
+}
+
+func TestPlanRoutes(t *testing.T) {
+	p := netip.MustParsePrefix
+	prefixes := func(routes []plannedRoute) []string {
+		var out []string
+		for _, route := range routes {
+			out = append(out, route.Prefix.String()+" "+route.Source)
+		}
+		return out
+	}
+
+	// Nothing configured and nothing advertised: everything goes through VPN
+	routes, err := planRoutes(common.ClientConfig{}, nil, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0.0.0.0/1 default", "128.0.0.0/1 default", "::/1 default", "8000::/1 default"}, prefixes(routes))
+
+	// Server routes are used as advertised, a default route becomes two halves
+	advertised := []netip.Prefix{p("0.0.0.0/0"), p("10.99.0.0/24")}
+	routes, err = planRoutes(common.ClientConfig{}, advertised, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0.0.0.0/1 server", "128.0.0.0/1 server"}, prefixes(routes))
+
+	// Includes replace the server's default route but keep its specific routes
+	config := common.ClientConfig{
+		IncludeRoutes:  []string{"172.16.0.0/12", "10.99.0.5"},
+		IncludeDomains: []string{"intranet.example.com"},
+		ExcludeRoutes:  []string{"172.16.8.0/22"},
+	}
+	domains := map[string][]netip.Addr{"intranet.example.com": {netip.MustParseAddr("198.51.100.7")}}
+	routes, err = planRoutes(config, advertised, domains, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"10.99.0.0/24 server",
+		"172.16.0.0/21 include",
+		"172.16.12.0/22 include",
+		"172.16.16.0/20 include",
+		"172.16.32.0/19 include",
+		"172.16.64.0/18 include",
+		"172.16.128.0/17 include",
+		"172.17.0.0/16 include",
+		"172.18.0.0/15 include",
+		"172.20.0.0/14 include",
+		"172.24.0.0/13 include",
+		"198.51.100.7/32 domain:intranet.example.com",
+	}, prefixes(routes))
+
+	// Local networks and link-local ranges stay off the tunnel
+	config = common.ClientConfig{IncludeRoutes: []string{"192.168.0.0/16", "169.254.0.0/16"}, ExcludeLocalLAN: true}
+	routes, err = planRoutes(config, nil, nil, []netip.Prefix{p("192.168.0.0/17")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.168.128.0/17 include"}, prefixes(routes))
+
+	_, err = planRoutes(common.ClientConfig{ExcludeRoutes: []string{"not-a-network"}}, nil, nil, nil)
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+}
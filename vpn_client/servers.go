@@ -0,0 +1,273 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+)
+
+// serverProbeTimeout bounds the probe of one server
+const serverProbeTimeout = 3 * time.Second
+
+// activeServer is the server of the current or next connection. It only
+// changes between sessions.
+var activeServer common.ServerEndpoint
+
+// configuredServers returns the servers of the profile with defaults filled
+// in; a config with only server_addr is a profile of one server
+func configuredServers(config common.ClientConfig) []common.ServerEndpoint {
+	if len(config.Servers) == 0 {
+		return []common.ServerEndpoint{{Addr: config.ServerAddr, Name: config.ServerName, Weight: 1}}
+	}
+	servers := make([]common.ServerEndpoint, len(config.Servers))
+	for i, server := range config.Servers {
+		if server.Name == "" {
+			server.Name = config.ServerName
+		}
+		if server.Weight <= 0 {
+			server.Weight = 1
+		}
+		servers[i] = server
+	}
+	return servers
+}
+
+// validateServers reports servers without an address or TLS server name
+func validateServers(servers []common.ServerEndpoint) error {
+	for i, server := range servers {
+		if server.Addr == "" || server.Name == "" {
+			return fmt.Errorf("%w: server %d needs an address and a server name", common.ErrMissingConfig, i+1)
+		}
+	}
+	return nil
+}
+
+// resolveServer returns the UDP address to dial for a server. Behind the kill
+// switch the name may not resolve, so the address it lets through is used.
+func resolveServer(server common.ServerEndpoint) (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp", server.Addr)
+	if err != nil && len(killSwitchServers[server.Addr]) > 0 {
+		fallback := killSwitchServers[server.Addr][0]
+		logger.Warn("Cannot resolve server address, using the address allowed by the kill switch",
+			zap.String("server", server.Addr), zap.Stringer("address", fallback), zap.Error(err))
+		return net.UDPAddrFromAddrPort(fallback), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to resolve server address %s: %w", common.ErrConnectionFailed, server.Addr, err)
+	}
+	return addr, nil
+}
+
+// profileServerAddrs returns the addresses of all servers of the profile that resolve
+func profileServerAddrs(ctx context.Context) []netip.Addr {
+	var addrs []netip.Addr
+	for _, server := range configuredServers(clientConfig) {
+		resolved, err := resolveServerAddrs(ctx, server.Addr)
+		if err != nil {
+			resolved = killSwitchServers[server.Addr]
+		}
+		for _, addr := range resolved {
+			addrs = append(addrs, addr.Addr())
+		}
+	}
+	return addrs
+}
+
+// serverProbe is the outcome of probing one server
+type serverProbe struct {
+	Server common.ServerEndpoint
+	RTT    time.Duration
+	Err    error
+}
+
+// probeServers probes all servers concurrently
+func probeServers(ctx context.Context, servers []common.ServerEndpoint, tlsConfig *tls.Config) []serverProbe {
+	probes := make([]serverProbe, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rtt, err := probeServer(ctx, server, tlsConfig)
+			probes[i] = serverProbe{Server: server, RTT: rtt, Err: err}
+		}()
+	}
+	wg.Wait()
+	return probes
+}
+
+// probeServer completes a QUIC handshake with the server, asks it for its
+// info over HTTP/3 and returns the smoothed RTT of the connection
+func probeServer(ctx context.Context, server common.ServerEndpoint, tlsConfig *tls.Config) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, serverProbeTimeout)
+	defer cancel()
+
+	addr, err := resolveServer(server)
+	if err != nil {
+		return 0, err
+	}
+	config := tlsConfig.Clone()
+	config.ServerName = server.Name
+	conn, err := quic.DialAddr(ctx, addr.String(), config, &quic.Config{HandshakeIdleTimeout: serverProbeTimeout})
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", common.ErrConnectionFailed, err)
+	}
+	defer conn.CloseWithError(0, "probe done")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+server.Name+"/", nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := (&http3.Transport{}).NewClientConn(conn).RoundTrip(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: server info request failed: %v", common.ErrConnectionFailed, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%w: server info request failed: %s", common.ErrConnectionFailed, resp.Status)
+	}
+	return conn.ConnectionStats().SmoothedRTT, nil
+}
+
+// rankServers orders the reachable servers by priority and then by RTT
+// divided by weight. Unreachable servers follow in config order, so they are
+// still tried when the probes themselves were blocked.
+func rankServers(probes []serverProbe) []common.ServerEndpoint {
+	var reachable, unreachable []serverProbe
+	for _, probe := range probes {
+		if probe.Err != nil {
+			unreachable = append(unreachable, probe)
+		} else {
+			reachable = append(reachable, probe)
+		}
+	}
+	slices.SortStableFunc(reachable, func(a, b serverProbe) int {
+		if c := cmp.Compare(a.Server.Priority, b.Server.Priority); c != 0 {
+			return c
+		}
+		return cmp.Compare(float64(a.RTT)/float64(a.Server.Weight), float64(b.RTT)/float64(b.Server.Weight))
+	})
+
+	ranked := make([]common.ServerEndpoint, 0, len(probes))
+	for _, probe := range append(reachable, unreachable...) {
+		ranked = append(ranked, probe.Server)
+	}
+	return ranked
+}
+
+// serverSelector picks the server of each connection attempt. Servers are
+// probed and ranked first; a failed connection or lost session fails over to
+// the next one, and the servers are probed again once all were tried.
+type serverSelector struct {
+	servers []common.ServerEndpoint
+	// probe measures the servers; replaced in tests
+	probe func(ctx context.Context, servers []common.ServerEndpoint) []serverProbe
+
+	ranked []common.ServerEndpoint
+	next   int
+}
+
+// newServerSelector creates the selector for the servers of the profile
+func newServerSelector(servers []common.ServerEndpoint) *serverSelector {
+	s := &serverSelector{servers: servers}
+	s.probe = func(ctx context.Context, servers []common.ServerEndpoint) []serverProbe {
+		tlsConfig, err := newClientTLSConfig()
+		if err != nil {
+			probes := make([]serverProbe, len(servers))
+			for i, server := range servers {
+				probes[i] = serverProbe{Server: server, Err: err}
+			}
+			return probes
+		}
+		return probeServers(ctx, servers, tlsConfig)
+	}
+	return s
+}
+
+// Next returns the server for the next connection attempt
+func (s *serverSelector) Next(ctx context.Context) common.ServerEndpoint {
+	if len(s.servers) == 1 {
+		return s.servers[0]
+	}
+	if s.next >= len(s.ranked) {
+		probes := s.probe(ctx, s.servers)
+		for _, probe := range probes {
+			if probe.Err != nil {
+				logger.Info("VPN server unreachable", zap.String("server", probe.Server.Addr), zap.Error(probe.Err))
+				serverRTT.WithLabelValues(probe.Server.Addr).Set(-1)
+			} else {
+				logger.Debug("Probed VPN server", zap.String("server", probe.Server.Addr), zap.Duration("rtt", probe.RTT))
+				serverRTT.WithLabelValues(probe.Server.Addr).Set(probe.RTT.Seconds())
+			}
+		}
+		status.setServers(probes)
+		s.ranked = rankServers(probes)
+		s.next = 0
+	}
+	return s.ranked[s.next]
+}
+
+// Failed fails over to the next ranked server
+func (s *serverSelector) Failed() {
+	if len(s.servers) == 1 {
+		return
+	}
+	s.next++
+	if s.next < len(s.ranked) {
+		serverFailovers.Inc()
+	}
+}
+
+// Moved reorders the servers after the current one asked clients to leave:
+// the profile servers among endpoints come first, in their order, then the
+// other ranked servers, and the server being left comes last. Endpoints
+// outside the profile are skipped, since routes and the kill switch only
+// exempt the profile servers.
+func (s *serverSelector) Moved(from common.ServerEndpoint, endpoints []string) {
+	if len(s.servers) == 1 {
+		return
+	}
+	var moved []common.ServerEndpoint
+	for _, addr := range endpoints {
+		i := slices.IndexFunc(s.servers, func(server common.ServerEndpoint) bool { return server.Addr == addr })
+		if i < 0 {
+			logger.Debug("Skipping suggested server outside the profile", zap.String("server", addr))
+			continue
+		}
+		if s.servers[i] != from && !slices.Contains(moved, s.servers[i]) {
+			moved = append(moved, s.servers[i])
+		}
+	}
+	ranked := s.ranked
+	if len(ranked) == 0 {
+		ranked = s.servers
+	}
+	for _, server := range ranked {
+		if server != from && !slices.Contains(moved, server) {
+			moved = append(moved, server)
+		}
+	}
+	s.ranked = append(moved, from)
+	s.next = 0
+	serverFailovers.Inc()
+}
+
+// Reprobe ranks the servers anew before the next attempt, e.g. after a long
+// session when the network may have changed
+func (s *serverSelector) Reprobe() {
+	s.next = len(s.ranked)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConfiguredServers(t *testing.T) {
+	single := configuredServers(common.ClientConfig{ServerAddr: "vpn.example.com:4433", ServerName: "vpn.example.com"})
+	assert.Equal(t, []common.ServerEndpoint{{Addr: "vpn.example.com:4433", Name: "vpn.example.com", Weight: 1}}, single)
+
+	profile := configuredServers(common.ClientConfig{
+		ServerName: "vpn.example.com",
+		Servers: []common.ServerEndpoint{
+			{Addr: "eu.example.com:4433"},
+			{Addr: "us.example.com:4433", Name: "us.example.com", Priority: 1, Weight: 3},
+		},
+	})
+	assert.Equal(t, []common.ServerEndpoint{
+		{Addr: "eu.example.com:4433", Name: "vpn.example.com", Weight: 1},
+		{Addr: "us.example.com:4433", Name: "us.example.com", Priority: 1, Weight: 3},
+	}, profile)
+
+	assert.NoError(t, validateServers(profile))
+	assert.ErrorIs(t, validateServers([]common.ServerEndpoint{{Addr: "eu.example.com:4433"}}), common.ErrMissingConfig)
+}
+
+func TestRankServers(t *testing.T) {
+	unreachable := errors.New("timeout")
+	ranked := rankServers([]serverProbe{
+		{Server: common.ServerEndpoint{Addr: "backup", Priority: 1, Weight: 1}, RTT: 5 * time.Millisecond},
+		{Server: common.ServerEndpoint{Addr: "down", Weight: 1}, Err: unreachable},
+		{Server: common.ServerEndpoint{Addr: "slow", Weight: 1}, RTT: 40 * time.Millisecond},
+		// Twice the weight makes 60ms count as 30ms
+		{Server: common.ServerEndpoint{Addr: "big", Weight: 2}, RTT: 60 * time.Millisecond},
+	})
+
+	addrs := make([]string, len(ranked))
+	for i, server := range ranked {
+		addrs[i] = server.Addr
+	}
+	assert.Equal(t, []string{"big", "slow", "backup", "down"}, addrs)
+}
+
+func TestServerSelector(t *testing.T) {
+	logger = zap.NewNop()
+	servers := []common.ServerEndpoint{
+		{Addr: "a", Weight: 1},
+		{Addr: "b", Weight: 1},
+	}
+	probes := 0
+	s := newServerSelector(servers)
+	s.probe = func(ctx context.Context, servers []common.ServerEndpoint) []serverProbe {
+		probes++
+		return []serverProbe{
+			{Server: servers[0], RTT: 30 * time.Millisecond},
+			{Server: servers[1], RTT: 10 * time.Millisecond},
+		}
+	}
+
+	assert.Equal(t, "b", s.Next(t.Context()).Addr)
+	assert.Equal(t, "b", s.Next(t.Context()).Addr)
+	assert.Equal(t, 1, probes)
+
+	// Fail over to the next server, then probe again once all were tried
+	s.Failed()
+	assert.Equal(t, "a", s.Next(t.Context()).Addr)
+	s.Failed()
+	assert.Equal(t, "b", s.Next(t.Context()).Addr)
+	assert.Equal(t, 2, probes)
+
+	s.Reprobe()
+	s.Next(t.Context())
+	assert.Equal(t, 3, probes)
+}
+
+func TestServerSelector_Moved(t *testing.T) {
+	logger = zap.NewNop()
+	servers := []common.ServerEndpoint{
+		{Addr: "a", Weight: 1},
+		{Addr: "b", Weight: 1},
+		{Addr: "c", Weight: 1},
+	}
+	s := newServerSelector(servers)
+	s.probe = func(ctx context.Context, servers []common.ServerEndpoint) []serverProbe {
+		return []serverProbe{
+			{Server: servers[0], RTT: 10 * time.Millisecond},
+			{Server: servers[1], RTT: 20 * time.Millisecond},
+			{Server: servers[2], RTT: 30 * time.Millisecond},
+		}
+	}
+	assert.Equal(t, "a", s.Next(t.Context()).Addr)
+
+	// The suggested profile server comes first, unknown ones are skipped,
+	// and the draining server is tried last
+	s.Moved(servers[0], []string{"elsewhere:4433", "c"})
+	var order []string
+	for range servers {
+		order = append(order, s.Next(t.Context()).Addr)
+		s.Failed()
+	}
+	assert.Equal(t, []string{"c", "b", "a"}, order)
+}
+
+func TestServerSelector_SingleServerIsNotProbed(t *testing.T) {
+	s := newServerSelector([]common.ServerEndpoint{{Addr: "only", Weight: 1}})
+	s.probe = func(ctx context.Context, servers []common.ServerEndpoint) []serverProbe {
+		t.Fatal("single server probed")
+		return nil
+	}
+	s.Failed()
+	assert.Equal(t, "only", s.Next(t.Context()).Addr)
+}
+
+func TestProbeServer(t *testing.T) {
+	logger = zap.NewNop()
+	serverTLS, clientTLS := newTestTLSConfigs(t)
+	serverTLS.NextProtos = []string{http3.NextProtoH3}
+	clientTLS.NextProtos = []string{http3.NextProtoH3}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	server := &http3.Server{
+		TLSConfig: serverTLS,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"service":"masque-vpn-server"}`))
+		}),
+	}
+	go server.Serve(udpConn)
+	t.Cleanup(func() { server.Close() })
+
+	rtt, err := probeServer(t.Context(), common.ServerEndpoint{Addr: udpConn.LocalAddr().String(), Name: "localhost"}, clientTLS)
+	require.NoError(t, err)
+	assert.Positive(t, rtt)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 200*time.Millisecond)
+	defer cancel()
+	_, err = probeServer(ctx, common.ServerEndpoint{Addr: "127.0.0.1:1", Name: "localhost"}, clientTLS)
+	assert.ErrorIs(t, err, common.ErrConnectionFailed)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+// defaultSessionCacheFile is used when session_cache_file is not configured
+var defaultSessionCacheFile = filepath.Join(os.TempDir(), "masque-vpn-client.sessions")
+
+// sessionCacheSize bounds the number of servers with a cached session
+const sessionCacheSize = 16
+
+// sessionCache is a TLS client session cache kept in an encrypted file, so
+// reconnects and restarts resume the session (and may send 0-RTT) instead
+// of a full handshake with the client certificate. The file key is derived
+// from the client key and certificate: tickets of a replaced or renewed
+// certificate cannot be read and are dropped.
+type sessionCache struct {
+	path string
+	aead cipher.AEAD
+
+	mu       sync.Mutex
+	sessions map[string]*tls.ClientSessionState
+	// order of insertion, oldest first, for eviction
+	order []string
+}
+
+// cachedSession is a session as stored in the cache file
+type cachedSession struct {
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+// newSessionCache opens the cache file for the client certificate. A missing
+// or unreadable file starts an empty cache.
+func newSessionCache(path string, cert tls.Certificate) (*sessionCache, error) {
+	if path == "" {
+		path = defaultSessionCacheFile
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("%w: no client certificate for the session cache key", common.ErrInvalidCertificate)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot derive session cache key: %v", common.ErrInvalidCertificate, err)
+	}
+	salt := sha256.Sum256(cert.Certificate[0])
+	key, err := hkdf.Key(sha256.New, keyDER, salt[:], "masque-vpn session cache", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &sessionCache{path: path, aead: aead, sessions: make(map[string]*tls.ClientSessionState)}
+	if err := c.load(); err != nil {
+		logger.Info("Starting with an empty TLS session cache", zap.String("session_cache_file", path), zap.Error(err))
+	}
+	return c, nil
+}
+
+// Get returns the cached session for a server
+func (c *sessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	session, ok := c.sessions[sessionKey]
+	return session, ok
+}
+
+// Put stores a new session ticket, or removes the session if cs is nil,
+// and writes the cache file
+func (c *sessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order = slices.DeleteFunc(c.order, func(key string) bool { return key == sessionKey })
+	if cs == nil {
+		delete(c.sessions, sessionKey)
+	} else {
+		c.sessions[sessionKey] = cs
+		c.order = append(c.order, sessionKey)
+		for len(c.order) > sessionCacheSize {
+			delete(c.sessions, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+
+	if err := c.save(); err != nil {
+		logger.Warn("Failed to write TLS session cache", zap.String("session_cache_file", c.path), zap.Error(err))
+	}
+}
+
+// load reads and decrypts the cache file
+func (c *sessionCache) load() error {
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(data) < nonceSize {
+		return errors.New("session cache file is truncated")
+	}
+	plain, err := c.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return errors.New("session cache file was written for another client certificate or is corrupt")
+	}
+
+	var stored map[string]cachedSession
+	if err := json.Unmarshal(plain, &stored); err != nil {
+		return fmt.Errorf("malformed session cache: %w", err)
+	}
+	for key, session := range stored {
+		state, err := tls.ParseSessionState(session.State)
+		if err != nil {
+			continue
+		}
+		cs, err := tls.NewResumptionState(session.Ticket, state)
+		if err != nil {
+			continue
+		}
+		c.sessions[key] = cs
+		c.order = append(c.order, key)
+	}
+	return nil
+}
+
+// save encrypts the sessions into the cache file; called with mu held
+func (c *sessionCache) save() error {
+	stored := make(map[string]cachedSession, len(c.sessions))
+	for key, cs := range c.sessions {
+		ticket, state, err := cs.ResumptionState()
+		if err != nil || state == nil {
+			continue
+		}
+		stateBytes, err := state.Bytes()
+		if err != nil {
+			continue
+		}
+		stored[key] = cachedSession{Ticket: ticket, State: stateBytes}
+	}
+	plain, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return common.WriteFileAtomic(c.path, c.aead.Seal(nonce, nonce, plain, nil), 0600)
+}
+
+// handshakeKind classifies the handshake of an established connection for
+// metrics and logs: full, resumed or 0rtt
+func handshakeKind(state quic.ConnectionState) string {
+	switch {
+	case state.Used0RTT:
+		return "0rtt"
+	case state.TLS.DidResume:
+		return "resumed"
+	default:
+		return "full"
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestClientCert returns a self-signed client certificate with its key
+func newTestClientCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSessionCache(t *testing.T) {
+	logger = zap.NewNop()
+	serverTLS, clientTLS := newTestTLSConfigs(t)
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", serverTLS, &quic.Config{Allow0RTT: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go serveEcho(ln, nil)
+
+	path := filepath.Join(t.TempDir(), "sessions")
+	cert := newTestClientCert(t)
+
+	// dial connects with a cache freshly loaded from the file, like a restarted client
+	dial := func(t *testing.T) (*quic.Conn, *sessionCache) {
+		cache, err := newSessionCache(path, cert)
+		require.NoError(t, err)
+		config := clientTLS.Clone()
+		config.ClientSessionCache = cache
+		conn, err := quic.DialAddrEarly(t.Context(), ln.Addr().String(), config, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.CloseWithError(0, "") })
+
+		stream, err := conn.OpenStreamSync(t.Context())
+		require.NoError(t, err)
+		echo(t, stream, "hello")
+		<-conn.HandshakeComplete()
+		return conn, cache
+	}
+
+	conn, _ := dial(t)
+	assert.Equal(t, "full", handshakeKind(conn.ConnectionState()))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "session ticket not written to cache file")
+
+	var cache *sessionCache
+	t.Run("resumes from file with 0-RTT", func(t *testing.T) {
+		conn, resumed := dial(t)
+		assert.Equal(t, "0rtt", handshakeKind(conn.ConnectionState()))
+		cache = resumed
+	})
+
+	t.Run("file is encrypted", func(t *testing.T) {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "ticket")
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	})
+
+	t.Run("other certificate cannot read it", func(t *testing.T) {
+		other, err := newSessionCache(path, newTestClientCert(t))
+		require.NoError(t, err)
+		assert.Empty(t, other.sessions)
+	})
+
+	t.Run("evicts oldest servers", func(t *testing.T) {
+		require.NotNil(t, cache)
+		var session *tls.ClientSessionState
+		for _, s := range cache.sessions {
+			session = s
+		}
+		require.NotNil(t, session)
+		for i := range sessionCacheSize + 2 {
+			cache.Put(fmt.Sprintf("server-%d", i), session)
+		}
+		assert.Len(t, cache.sessions, sessionCacheSize)
+		_, ok := cache.Get("server-0")
+		assert.False(t, ok)
+		_, ok = cache.Get(fmt.Sprintf("server-%d", sessionCacheSize+1))
+		assert.True(t, ok)
+
+		cache.Put("server-5", nil)
+		_, ok = cache.Get("server-5")
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// status is the client state served at /status on the metrics listener
+var status = &clientStatus{}
+
+// clientStatus tracks the current session for the status output
+type clientStatus struct {
+	mu       sync.RWMutex
+	snapshot statusSnapshot
+}
+
+// statusSnapshot is the JSON document served at /status
+type statusSnapshot struct {
+	Connected    bool                    `json:"connected"`
+	ServerAddr   string                  `json:"server_addr"`
+	TunName      string                  `json:"tun_name,omitempty"`
+	ConnectedAt  *time.Time              `json:"connected_at,omitempty"`
+	Routes       []plannedRoute          `json:"routes"`
+	Domains      map[string][]netip.Addr `json:"domains,omitempty"`
+	DNSServers   []netip.Addr            `json:"dns_servers,omitempty"`
+	DNSSearch    []string                `json:"dns_search,omitempty"`
+	DNSMode      string                  `json:"dns_mode,omitempty"`
+	KillSwitch   bool                    `json:"kill_switch,omitempty"`
+	Reconnecting bool                    `json:"reconnecting,omitempty"` // a lost connection is being re-established
+	Reconnects   int                     `json:"reconnects,omitempty"`
+	Servers      []serverStatus          `json:"servers,omitempty"` // servers of a multi-server profile at the last probe
+}
+
+// serverStatus is a server of the profile as last probed
+type serverStatus struct {
+	Addr     string  `json:"addr"`
+	Priority int     `json:"priority"`
+	Weight   int     `json:"weight"`
+	RTTMs    float64 `json:"rtt_ms,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// setConnected records the start or end of a session
+func (s *clientStatus) setConnected(connected bool, serverAddr, tunName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshot = statusSnapshot{
+		Connected:  connected,
+		ServerAddr: serverAddr,
+		TunName:    tunName,
+		KillSwitch: s.snapshot.KillSwitch,
+		Servers:    s.snapshot.Servers,
+	}
+	if connected {
+		now := time.Now()
+		s.snapshot.ConnectedAt = &now
+	}
+}
+
+// setRoutes records the route set applied to the TUN device
+func (s *clientStatus) setRoutes(routes []plannedRoute, domains map[string][]netip.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshot.Routes = append([]plannedRoute(nil), routes...)
+	s.snapshot.Domains = make(map[string][]netip.Addr, len(domains))
+	for name, addrs := range domains {
+		s.snapshot.Domains[name] = append([]netip.Addr(nil), addrs...)
+	}
+}
+
+// setDNS records the DNS settings applied from the server
+func (s *clientStatus) setDNS(servers []netip.Addr, search []string, mode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshot.DNSServers = append([]netip.Addr(nil), servers...)
+	s.snapshot.DNSSearch = append([]string(nil), search...)
+	s.snapshot.DNSMode = mode
+}
+
+// setReconnecting records a lost connection, or its return with reconnecting
+// false; the routes and DNS settings stay in place in between
+func (s *clientStatus) setReconnecting(reconnecting bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.snapshot.Reconnecting && !reconnecting {
+		now := time.Now()
+		s.snapshot.ConnectedAt = &now
+		s.snapshot.Reconnects++
+	}
+	s.snapshot.Reconnecting = reconnecting
+	s.snapshot.Connected = !reconnecting
+}
+
+// setActiveServer records the server of the current or next connection
+func (s *clientStatus) setActiveServer(serverAddr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshot.ServerAddr = serverAddr
+}
+
+// setServers records the outcome of probing the servers of the profile
+func (s *clientStatus) setServers(probes []serverProbe) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshot.Servers = make([]serverStatus, len(probes))
+	for i, probe := range probes {
+		server := serverStatus{Addr: probe.Server.Addr, Priority: probe.Server.Priority, Weight: probe.Server.Weight}
+		if probe.Err != nil {
+			server.Error = probe.Err.Error()
+		} else {
+			server.RTTMs = float64(probe.RTT.Microseconds()) / 1000
+		}
+		s.snapshot.Servers[i] = server
+	}
+}
+
+// setKillSwitch records whether the kill switch is active; it outlives sessions
+func (s *clientStatus) setKillSwitch(active bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshot.KillSwitch = active
+}
+
+// ServeHTTP serves the status as JSON
+func (s *clientStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.snapshot)
+}
+
+// runStatusCommand prints the status of a running client
+func runStatusCommand(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9092", "Metrics listener of the running client")
+	asJSON := fs.Bool("json", false, "Print the raw JSON status")
+	fs.Parse(args)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + *addr + "/status")
+	if err != nil {
+		return fmt.Errorf("client is not running or not reachable at %s: %w", *addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status request failed: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read status: %w", err)
+	}
+	if *asJSON {
+		fmt.Println(string(data))
+		return nil
+	}
+
+	var snapshot statusSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to parse status: %w", err)
+	}
+	fmt.Print(formatStatus(snapshot))
+	return nil
+}
+
+// formatStatus renders the status for a terminal
+func formatStatus(snapshot statusSnapshot) string {
+	var b strings.Builder
+	if snapshot.Reconnecting {
+		fmt.Fprintf(&b, "Status:  reconnecting to %s\n", snapshot.ServerAddr)
+	} else if !snapshot.Connected {
+		fmt.Fprintf(&b, "Status:  disconnected\n")
+	} else {
+		fmt.Fprintf(&b, "Status:  connected to %s", snapshot.ServerAddr)
+		if snapshot.ConnectedAt != nil {
+			fmt.Fprintf(&b, " for %s", time.Since(*snapshot.ConnectedAt).Truncate(time.Second))
+		}
+		if snapshot.Reconnects > 0 {
+			fmt.Fprintf(&b, ", %d reconnects", snapshot.Reconnects)
+		}
+		b.WriteString("\n")
+	}
+	if snapshot.TunName != "" {
+		fmt.Fprintf(&b, "Device:  %s\n", snapshot.TunName)
+	}
+	if snapshot.KillSwitch {
+		b.WriteString("Kill switch: on, traffic outside the VPN is blocked\n")
+	}
+
+	if len(snapshot.Servers) > 0 {
+		b.WriteString("Servers:\n")
+		for _, server := range snapshot.Servers {
+			marker := " "
+			if server.Addr == snapshot.ServerAddr {
+				marker = "*"
+			}
+			rtt := fmt.Sprintf("%.1f ms", server.RTTMs)
+			if server.Error != "" {
+				rtt = "unreachable"
+			}
+			fmt.Fprintf(&b, "%s %-40s priority %d, weight %d, %s\n", marker, server.Addr, server.Priority, server.Weight, rtt)
+		}
+	}
+
+	if len(snapshot.Routes) > 0 {
+		b.WriteString("Routes through VPN:\n")
+		for _, route := range snapshot.Routes {
+			fmt.Fprintf(&b, "  %-43s %s\n", route.Prefix, route.Source)
+		}
+	}
+
+	if len(snapshot.DNSServers) > 0 {
+		servers := make([]string, len(snapshot.DNSServers))
+		for i, server := range snapshot.DNSServers {
+			servers[i] = server.String()
+		}
+		fmt.Fprintf(&b, "DNS:     %s via %s", strings.Join(servers, ", "), snapshot.DNSMode)
+		if len(snapshot.DNSSearch) > 0 {
+			fmt.Fprintf(&b, ", search %s", strings.Join(snapshot.DNSSearch, " "))
+		}
+		b.WriteString("\n")
+	}
+
+	names := make([]string, 0, len(snapshot.Domains))
+	for name := range snapshot.Domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		addrs := make([]string, len(snapshot.Domains[name]))
+		for i, addr := range snapshot.Domains[name] {
+			addrs[i] = addr.String()
+		}
+		fmt.Fprintf(&b, "Domain %s: %s\n", name, strings.Join(addrs, ", "))
+	}
+	return b.String()
+}
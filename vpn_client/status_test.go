@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientStatus(t *testing.T) {
+	s := &clientStatus{}
+	s.setConnected(true, "vpn.example.com:4433", "tun0")
+	s.setRoutes([]plannedRoute{
+		{Prefix: netip.MustParsePrefix("10.99.0.0/24"), Source: "server"},
+		{Prefix: netip.MustParsePrefix("198.51.100.7/32"), Source: "domain:intranet.example.com"},
+	}, map[string][]netip.Addr{"intranet.example.com": {netip.MustParseAddr("198.51.100.7")}})
+
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest("GET", "/status", nil))
+	var snapshot statusSnapshot
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &snapshot))
+	assert.True(t, snapshot.Connected)
+	assert.Equal(t, "tun0", snapshot.TunName)
+	require.Len(t, snapshot.Routes, 2)
+
+	out := formatStatus(snapshot)
+	assert.Contains(t, out, "connected to vpn.example.com:4433")
+	assert.Contains(t, out, "10.99.0.0/24")
+	assert.Contains(t, out, "Domain intranet.example.com: 198.51.100.7")
+
+	s.setConnected(false, "vpn.example.com:4433", "")
+	assert.Equal(t, "Status:  disconnected\n", formatStatus(s.snapshot))
+}
+
+func TestClientStatus_KillSwitchOutlivesSession(t *testing.T) {
+	s := &clientStatus{}
+	s.setKillSwitch(true)
+	s.setConnected(true, "vpn.example.com:4433", "tun0")
+	s.setConnected(false, "vpn.example.com:4433", "")
+	assert.True(t, s.snapshot.KillSwitch)
+	assert.Contains(t, formatStatus(s.snapshot), "Kill switch: on")
+}
+
+func TestClientStatus_Reconnecting(t *testing.T) {
+	s := &clientStatus{}
+	s.setConnected(true, "vpn.example.com:4433", "tun0")
+	s.setRoutes([]plannedRoute{{Prefix: netip.MustParsePrefix("10.99.0.0/24"), Source: "server"}}, nil)
+
+	s.setReconnecting(true)
+	assert.False(t, s.snapshot.Connected)
+	assert.Contains(t, formatStatus(s.snapshot), "reconnecting to vpn.example.com:4433")
+	// Routes stay in place while reconnecting
+	assert.Len(t, s.snapshot.Routes, 1)
+
+	s.setReconnecting(false)
+	assert.True(t, s.snapshot.Connected)
+	assert.Equal(t, 1, s.snapshot.Reconnects)
+	assert.Contains(t, formatStatus(s.snapshot), ", 1 reconnects")
+}
+
+func TestClientStatus_Servers(t *testing.T) {
+	s := &clientStatus{}
+	s.setServers([]serverProbe{
+		{Server: common.ServerEndpoint{Addr: "vpn1.example.com:4433", Weight: 1}, RTT: 23 * time.Millisecond},
+		{Server: common.ServerEndpoint{Addr: "vpn2.example.com:4433", Priority: 1, Weight: 2}, Err: errors.New("timeout")},
+	})
+	s.setActiveServer("vpn1.example.com:4433")
+	s.setConnected(true, "vpn1.example.com:4433", "tun0")
+	require.Len(t, s.snapshot.Servers, 2)
+
+	out := formatStatus(s.snapshot)
+	assert.Contains(t, out, "* vpn1.example.com:4433")
+	assert.Contains(t, out, "23.0 ms")
+	assert.Contains(t, out, "  vpn2.example.com:4433")
+	assert.Contains(t, out, "priority 1, weight 2, unreachable")
+}
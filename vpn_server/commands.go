@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"vpn-server/internal/server"
+
+	"github.com/BurntSushi/toml"
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// runSubcommand dispatches administrative subcommands. It reports whether
+// args named a subcommand, so main can fall through to running the server.
+func runSubcommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	switch args[0] {
+	case "bundle":
+		return true, runBundleCommand(args[1:])
+	default:
+		return false, nil
+	}
+}
+
+// cliActor identifies the operator in audit records written by CLI commands
+func cliActor() string {
+	if user := os.Getenv("USER"); user != "" {
+		return "cli:" + user
+	}
+	return "cli"
+}
+
+// cliLogger reports warnings of CLI commands on stderr; informational lines
+// would only clutter the command output
+func cliLogger() *zap.Logger {
+	config := zap.NewDevelopmentConfig()
+	config.Level = zap.NewAtomicLevelAt(zapcore.WarnLevel)
+	config.DisableStacktrace = true
+	logger, err := config.Build()
+	if err != nil {
+		return zap.NewNop()
+	}
+	return logger
+}
+
+// loadServerConfig reads the server TOML configuration
+func loadServerConfig(path string) (common.ServerConfig, error) {
+	var config common.ServerConfig
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		return config, fmt.Errorf("error loading config file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// runBundleCommand prints a ready-to-use client configuration for a client ID
+func runBundleCommand(args []string) error {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	configFile := fs.String("c", "config.server.toml", "Server config file path")
+	clientID := fs.String("client", "", "Client ID (certificate common name)")
+	serial := fs.String("serial", "", "Certificate serial to embed (default: newest valid one)")
+	issue := fs.Bool("issue", false, "Issue a new certificate if the client has none")
+	groups := fs.String("groups", "", "Comma-separated groups for a newly issued certificate")
+	tunName := fs.String("tun", "", "TUN device name in the generated config")
+	output := fs.String("o", "", "Write the result to this file instead of stdout")
+	uri := fs.Bool("uri", false, "Print a masque:// import URI instead of TOML")
+	fs.Parse(args)
+
+	if *clientID == "" {
+		return fmt.Errorf("-client is required")
+	}
+
+	config, err := loadServerConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	logger := cliLogger()
+	defer logger.Sync()
+	audit, err := server.OpenAuditLog(config, logger)
+	if err != nil {
+		return err
+	}
+	ca, err := server.NewCertificateAuthority(config, audit, logger)
+	if err != nil {
+		return err
+	}
+
+	req := server.BundleRequest{
+		Serial:  *serial,
+		Issue:   *issue,
+		TunName: *tunName,
+	}
+	if *groups != "" {
+		req.Groups = strings.Split(*groups, ",")
+	}
+
+	bundle, err := server.BuildClientBundle(config, ca, *clientID, req, cliActor())
+	if err != nil {
+		return err
+	}
+	audit.Record(cliActor(), "bundle.export", bundle.ClientID, "serial="+bundle.Serial)
+
+	result := bundle.Config
+	if *uri {
+		result = []byte(bundle.URI + "\n")
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(result)
+		return err
+	}
+	// The config embeds the client private key
+	return os.WriteFile(*output, result, 0600)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// loadAdminToken читает токен администратора API; пустая строка - токен не задан
+func loadAdminToken(config common.APIServerConfig) (string, error) {
+	if config.AdminTokenFile != "" {
+		data, err := os.ReadFile(config.AdminTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read api_server admin_token_file: %w", err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("%w: api_server admin_token_file %s is empty", common.ErrInvalidConfig, config.AdminTokenFile)
+		}
+		return token, nil
+	}
+	if config.AdminTokenEnv != "" {
+		token := strings.TrimSpace(os.Getenv(config.AdminTokenEnv))
+		if token == "" {
+			return "", fmt.Errorf("%w: environment variable %s for api_server admin_token_env is empty", common.ErrInvalidConfig, config.AdminTokenEnv)
+		}
+		return token, nil
+	}
+	return "", nil
+}
+
+// isLoopbackPeer сообщает, что запрос пришел с loopback адреса. Используется адрес
+// соединения, а не X-Forwarded-For: заголовок задает сам клиент.
+func isLoopbackPeer(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.Unmap().IsLoopback()
+}
+
+// requireAdmin пропускает к административным маршрутам только администратора:
+// запрос с токеном из api_server, а если токен не задан - запрос с loopback адреса
+func (api *APIServer) requireAdmin(c *gin.Context) {
+	if api.adminToken == "" {
+		if isLoopbackPeer(c.Request) {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "Admin API is only available from localhost unless api_server.admin_token_file is set",
+		})
+		return
+	}
+
+	token := bearerToken(c.Request)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(api.adminToken)) != 1 {
+		c.Header("WWW-Authenticate", `Bearer realm="masque-vpn-admin"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Admin token required"})
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAdminRequest формирует запрос к API с loopback адреса, которому доступны
+// административные маршруты сервера без токена
+func newAdminRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	req.RemoteAddr = "127.0.0.1:40000"
+	return req
+}
+
+func TestRequireAdmin(t *testing.T) {
+	s := newTestDrainServer(t)
+	api, err := NewAPIServer(s)
+	require.NoError(t, err)
+
+	// Без токена: только loopback, X-Forwarded-For не учитывается
+	rec := httptest.NewRecorder()
+	api.router.ServeHTTP(rec, newAdminRequest(http.MethodGet, "/api/v1/audit", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil)
+	req.Header.Set("X-Forwarded-For", "127.0.0.1")
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// Публичные маршруты доступны всем
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// С токеном loopback больше не дает доступа
+	t.Setenv("TEST_MASQUE_ADMIN_TOKEN", "s3cret\n")
+	s.Config.APIServer.AdminTokenEnv = "TEST_MASQUE_ADMIN_TOKEN"
+	api, err = NewAPIServer(s)
+	require.NoError(t, err)
+
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, newAdminRequest(http.MethodGet, "/api/v1/audit", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "Bearer")
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestLoadAdminToken(t *testing.T) {
+	token, err := loadAdminToken(common.APIServerConfig{})
+	require.NoError(t, err)
+	assert.Empty(t, token)
+
+	path := filepath.Join(t.TempDir(), "admin.token")
+	require.NoError(t, os.WriteFile(path, []byte("  file-token\n"), 0600))
+	token, err = loadAdminToken(common.APIServerConfig{AdminTokenFile: path})
+	require.NoError(t, err)
+	assert.Equal(t, "file-token", token)
+
+	require.NoError(t, os.WriteFile(path, []byte("\n"), 0600))
+	_, err = loadAdminToken(common.APIServerConfig{AdminTokenFile: path})
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+
+	_, err = loadAdminToken(common.APIServerConfig{AdminTokenEnv: "TEST_MASQUE_ADMIN_TOKEN_UNSET"})
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+}
@@ -1,23 +1,34 @@
 package server
 
 import (
-	"log"
+	"errors"
 	"net/http"
+	"net/netip"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
 )
 
 // APIServer представляет HTTP API сервер для управления VPN
 type APIServer struct {
 	server *Server
 	router *gin.Engine
+	logger *zap.Logger
+	// Токен администратора; пусто - административные маршруты доступны только с loopback
+	adminToken string
+	// HTTP сервер API; закрывается при перезапуске, чтобы новый процесс занял порт
+	httpServer *http.Server
 	// Временное хранение в памяти вместо SQLite
 	connectionLogs []ConnectionLog
 	logsMutex      sync.RWMutex
+	// Одноразовые токены скачивания клиентских конфигураций
+	bundles      map[string]*pendingBundle
+	bundlesMutex sync.Mutex
 }
 
 // ConnectionLog представляет лог соединения
@@ -31,12 +42,19 @@ type ConnectionLog struct {
 
 // ClientInfo информация о клиенте для API
 type ClientInfo struct {
-	ID          string    `json:"id"`
-	AssignedIP  string    `json:"assigned_ip"`
-	ConnectedAt time.Time `json:"connected_at"`
-	BytesSent   int64     `json:"bytes_sent"`
-	BytesRecv   int64     `json:"bytes_received"`
-	Status      string    `json:"status"`
+	ID          string           `json:"id"`
+	SessionID   string           `json:"session_id,omitempty"` // поле session_id журнала сессии
+	User        string           `json:"user,omitempty"`
+	Device      string           `json:"device,omitempty"`
+	Groups      []string         `json:"groups,omitempty"`
+	AssignedIP  string           `json:"assigned_ip"`
+	ConnectedAt time.Time        `json:"connected_at"`
+	BytesSent   int64            `json:"bytes_sent"`
+	BytesRecv   int64            `json:"bytes_received"`
+	Status      string           `json:"status"`
+	Node        string           `json:"node,omitempty"` // узел кластера с сессией
+	RateLimit   *ClientRateLimit `json:"rate_limit,omitempty"`
+	Quota       *QuotaStatus     `json:"quota,omitempty"`
 }
 
 // ServerStats статистика сервера
@@ -55,12 +73,25 @@ func NewAPIServer(server *Server) (*APIServer, error) {
 	// Настраиваем Gin в production режиме
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
-	router.Use(gin.Logger(), gin.Recovery())
+	logger := server.Logger.Named("api")
+	router.Use(requestLogger(logger), gin.Recovery())
+
+	adminToken, err := loadAdminToken(server.Config.APIServer)
+	if err != nil {
+		return nil, err
+	}
+	if adminToken == "" {
+		logger.Warn("api_server.admin_token_file is not set, admin API is only available from localhost")
+	}
 
 	apiServer := &APIServer{
 		server:         server,
 		router:         router,
+		logger:         logger,
+		adminToken:     adminToken,
+		httpServer:     &http.Server{Addr: server.Config.APIServer.ListenAddr, Handler: router},
 		connectionLogs: make([]ConnectionLog, 0),
+		bundles:        make(map[string]*pendingBundle),
 	}
 
 	// Настраиваем маршруты
@@ -79,21 +110,57 @@ func (api *APIServer) setupRoutes() {
 
 	// API маршруты
 	v1 := api.router.Group("/api/v1")
+	// Административные маршруты выпускают ключи и меняют состояние сервера
+	admin := v1.Group("", api.requireAdmin)
 	{
 		// Информация о сервере
 		v1.GET("/status", api.getServerStatus)
 		v1.GET("/stats", api.getServerStats)
 
-		// Управление клиентами
-		v1.GET("/clients", api.getClients)
-		v1.GET("/clients/:id", api.getClient)
-		v1.DELETE("/clients/:id", api.disconnectClient)
+		// Управление клиентами: список раскрывает пользователей, устройства, группы и
+		// квоты, а отключение освобождает аренды на всех узлах кластера
+		admin.GET("/clients", api.getClients)
+		admin.GET("/clients/:id", api.getClient)
+		admin.DELETE("/clients/:id", api.disconnectClient)
+		admin.POST("/clients/:id/bundle", api.createClientBundle)
+		admin.PUT("/clients/:id/rate-limit", api.setClientRateLimit)
+		admin.DELETE("/clients/:id/rate-limit", api.clearClientRateLimit)
+		admin.GET("/bundles/:token", api.downloadClientBundle)
 
 		// Логи соединений
 		v1.GET("/logs", api.getConnectionLogs)
 
 		// Конфигурация
 		v1.GET("/config", api.getConfig)
+
+		// Встроенный центр сертификации
+		v1.GET("/ca/certificate", api.getCACertificate)
+		v1.GET("/ca/crl", api.getCRL)
+		admin.POST("/certificates", api.issueCertificate)
+		admin.GET("/certificates", api.listCertificates)
+		admin.GET("/certificates/:serial", api.getCertificate)
+		admin.GET("/certificates/:serial/download", api.downloadCertificate)
+		admin.POST("/certificates/:serial/revoke", api.revokeCertificate)
+
+		// Регистрация клиентов по CSR и одноразовым токенам
+		admin.POST("/enrollment/tokens", api.createEnrollmentToken)
+		admin.GET("/enrollment/tokens", api.listEnrollmentTokens)
+		admin.DELETE("/enrollment/tokens/:id", api.revokeEnrollmentToken)
+		v1.POST("/enroll", api.enroll)
+
+		// Журнал аудита
+		admin.GET("/audit", api.getAuditLog)
+
+		// Кластер серверов
+		v1.GET("/cluster", api.getClusterStatus)
+
+		// Плавное завершение и перезапуск
+		v1.GET("/drain", api.getDrainStatus)
+		admin.POST("/drain", api.startDrain)
+
+		// Уровень журнала сервера
+		v1.GET("/log-level", api.getLogLevel)
+		admin.PUT("/log-level", api.setLogLevel)
 	}
 
 	// Health check
@@ -105,8 +172,11 @@ func (api *APIServer) setupRoutes() {
 
 // Start запускает API сервер
 func (api *APIServer) Start() error {
-	log.Printf("Starting API server on %s", api.server.Config.APIServer.ListenAddr)
-	return api.router.Run(api.server.Config.APIServer.ListenAddr)
+	api.logger.Info("Starting API server", zap.String("addr", api.server.Config.APIServer.ListenAddr))
+	if err := api.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
 // Close закрывает API сервер
@@ -115,11 +185,20 @@ func (api *APIServer) Close() error {
 	api.logsMutex.Lock()
 	api.connectionLogs = nil
 	api.logsMutex.Unlock()
-	return nil
+	return api.httpServer.Close()
 }
 
 // healthCheck обработчик проверки здоровья
 func (api *APIServer) healthCheck(c *gin.Context) {
+	// Балансировщик перестает направлять клиентов на сервер в режиме drain
+	if api.server.Draining() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "draining",
+			"service": "masque-vpn-server",
+			"time":    time.Now().UTC(),
+		})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"status":  "healthy",
 		"service": "masque-vpn-server",
@@ -138,14 +217,21 @@ func (api *APIServer) getServerStatus(c *gin.Context) {
 		tunDevice = api.server.TunDev.Name()
 	}
 
+	state := "running"
+	if api.server.Draining() {
+		state = "draining"
+	}
 	status := gin.H{
-		"status":             "running",
+		"status":             state,
 		"active_connections": activeConnections,
 		"network_cidr":       api.server.Config.AssignCIDR,
 		"tun_device":         tunDevice,
 		"listen_addr":        api.server.Config.ListenAddr,
 		"server_name":        api.server.Config.ServerName,
 	}
+	if api.server.State != nil {
+		status["cluster"] = api.server.State.Status()
+	}
 
 	c.JSON(http.StatusOK, status)
 }
@@ -175,7 +261,7 @@ func (api *APIServer) getServerStats(c *gin.Context) {
 	c.JSON(http.StatusOK, stats)
 }
 
-// getClients возвращает список подключенных клиентов
+// getClients возвращает список подключенных клиентов, в кластере - клиентов всех узлов
 func (api *APIServer) getClients(c *gin.Context) {
 	api.server.IPPoolMu.RLock()
 	defer api.server.IPPoolMu.RUnlock()
@@ -183,21 +269,10 @@ func (api *APIServer) getClients(c *gin.Context) {
 	clients := make([]ClientInfo, 0, len(api.server.ClientIPMap))
 
 	for clientID, assignedIP := range api.server.ClientIPMap {
-		status := "disconnected"
-		if _, exists := api.server.IPConnMap[assignedIP]; exists {
-			status = "connected"
-		}
-
-		client := ClientInfo{
-			ID:         clientID,
-			AssignedIP: assignedIP.String(),
-			Status:     status,
-			// TODO: Добавить реальные метрики
-			ConnectedAt: time.Now(),
-			BytesSent:   0,
-			BytesRecv:   0,
-		}
-		clients = append(clients, client)
+		clients = append(clients, api.clientInfoLocked(clientID, assignedIP))
+	}
+	for _, lease := range api.remoteLeases() {
+		clients = append(clients, remoteClientInfo(lease))
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -214,64 +289,125 @@ func (api *APIServer) getClient(c *gin.Context) {
 	assignedIP, exists := api.server.ClientIPMap[clientID]
 	if !exists {
 		api.server.IPPoolMu.RUnlock()
+		for _, lease := range api.remoteLeases() {
+			if lease.SessionID == clientID {
+				c.JSON(http.StatusOK, remoteClientInfo(lease))
+				return
+			}
+		}
 		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
 		return
 	}
 
-	status := "disconnected"
-	if _, connected := api.server.IPConnMap[assignedIP]; connected {
-		status = "connected"
-	}
+	client := api.clientInfoLocked(clientID, assignedIP)
 	api.server.IPPoolMu.RUnlock()
 
+	c.JSON(http.StatusOK, client)
+}
+
+// clientInfoLocked формирует описание сессии клиента; вызывается под IPPoolMu
+func (api *APIServer) clientInfoLocked(clientID string, assignedIP netip.Addr) ClientInfo {
 	client := ClientInfo{
-		ID:         clientID,
-		AssignedIP: assignedIP.String(),
-		Status:     status,
-		// TODO: Добавить реальные метрики
+		ID:          clientID,
+		AssignedIP:  assignedIP.String(),
+		Status:      "disconnected",
 		ConnectedAt: time.Now(),
-		BytesSent:   0,
-		BytesRecv:   0,
 	}
-
-	c.JSON(http.StatusOK, client)
+	if api.server.State != nil {
+		client.Node = api.server.State.NodeID()
+	}
+	if session, connected := api.server.IPConnMap[assignedIP]; connected {
+		client.Status = "connected"
+		client.SessionID = session.ConnID
+		client.User = session.Identity.User
+		client.Device = session.Identity.Device
+		client.Groups = session.Identity.Groups
+		client.ConnectedAt = session.StartedAt
+		client.BytesSent = session.BytesSent.Load()
+		client.BytesRecv = session.BytesReceived.Load()
+		client.RateLimit = clientRateLimit(session.Shaper)
+		if api.server.Quotas != nil {
+			quota := api.server.Quotas.Status(session.Identity)
+			client.Quota = &quota
+		}
+	}
+	return client
 }
 
-// disconnectClient отключает клиента
+// disconnectClient отключает клиента. Сессии других узлов кластера закрываются
+// этими узлами после освобождения аренды.
 func (api *APIServer) disconnectClient(c *gin.Context) {
 	clientID := c.Param("id")
 
 	api.server.IPPoolMu.Lock()
-	assignedIP, exists := api.server.ClientIPMap[clientID]
-	if !exists {
+	// id - ключ сессии (user:device) либо имя пользователя, тогда отключаются все его устройства
+	sessionIDs := api.sessionIDsLocked(clientID)
+	var remote []Lease
+	for _, lease := range api.remoteLeases() {
+		if lease.SessionID == clientID || lease.User == clientID {
+			remote = append(remote, lease)
+		}
+	}
+	if len(sessionIDs) == 0 && len(remote) == 0 {
 		api.server.IPPoolMu.Unlock()
 		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
 		return
 	}
 
-	// Закрываем соединение если оно активно
-	if session, connected := api.server.IPConnMap[assignedIP]; connected {
-		if session.Conn != nil {
-			session.Conn.Close()
+	var releases []func()
+	for _, sessionID := range sessionIDs {
+		assignedIP := api.server.ClientIPMap[sessionID]
+
+		// Закрываем соединение если оно активно
+		if session, connected := api.server.IPConnMap[assignedIP]; connected {
+			if session.Conn != nil {
+				session.Conn.Close()
+			}
 		}
-		delete(api.server.IPConnMap, assignedIP)
-	}
 
-	// Удаляем клиента из карты
-	delete(api.server.ClientIPMap, clientID)
+		// Удаляем клиента из карт и освобождаем IP
+		releases = append(releases, api.server.removeSessionLocked(sessionID, assignedIP))
+		api.logger.Info("Disconnected client", zap.String("client_id", sessionID), zap.Stringer("assigned_ip", assignedIP))
+	}
 	api.server.IPPoolMu.Unlock()
 
-	// Освобождаем IP
-	api.server.IPPool.Release(assignedIP)
+	for _, release := range releases {
+		release()
+	}
 
-	log.Printf("API: Disconnected client %s (IP: %s)", clientID, assignedIP)
+	for _, lease := range remote {
+		if err := api.server.State.Release(c.Request.Context(), lease.SessionID, lease.Generation); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to disconnect client on node " + lease.Node + ": " + err.Error()})
+			return
+		}
+		sessionIDs = append(sessionIDs, lease.SessionID)
+		api.logger.Info("Disconnected client",
+			zap.String("client_id", lease.SessionID), zap.Stringer("assigned_ip", lease.Addr), zap.String("node", lease.Node))
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":   "Client disconnected",
 		"client_id": clientID,
+		"sessions":  sessionIDs,
 	})
 }
 
+// sessionIDsLocked возвращает ключи сессий по ключу сессии или имени пользователя; вызывается под IPPoolMu
+func (api *APIServer) sessionIDsLocked(id string) []string {
+	if _, exists := api.server.ClientIPMap[id]; exists {
+		return []string{id}
+	}
+
+	var sessionIDs []string
+	for sessionID, assignedIP := range api.server.ClientIPMap {
+		if session, connected := api.server.IPConnMap[assignedIP]; connected && session.Identity.User == id {
+			sessionIDs = append(sessionIDs, sessionID)
+		}
+	}
+	sort.Strings(sessionIDs)
+	return sessionIDs
+}
+
 // getConnectionLogs возвращает логи соединений
 func (api *APIServer) getConnectionLogs(c *gin.Context) {
 	api.logsMutex.RLock()
@@ -322,6 +458,7 @@ func (api *APIServer) getConfig(c *gin.Context) {
 		"enable_ipv6":       api.server.Config.EnableIPv6,
 		"fec_enabled":       api.server.Config.FEC.Enabled,
 		"metrics_enabled":   api.server.Config.Metrics.Enabled,
+		"cluster_enabled":   api.server.Config.Cluster.Enabled,
 	}
 
 	c.JSON(http.StatusOK, config)
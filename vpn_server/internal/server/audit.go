@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+// AuditEvent запись журнала аудита административных операций
+type AuditEvent struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Subject   string    `json:"subject"`
+	Details   string    `json:"details,omitempty"`
+}
+
+// AuditLog хранит события аудита в памяти и, если задан путь, дописывает их в JSONL файл
+type AuditLog struct {
+	path   string
+	events []AuditEvent
+	logger *zap.Logger
+	mu     sync.RWMutex
+}
+
+// maxAuditEventsInMemory ограничивает количество событий, хранимых в памяти
+const maxAuditEventsInMemory = 1000
+
+// maxAuditLineSize ограничивает длину строки JSONL файла при загрузке
+const maxAuditLineSize = 1 << 20
+
+// NewAuditLog создает журнал аудита. Пустой path означает хранение только в памяти.
+// События, уже записанные в файл, загружаются: нумерация продолжается после последнего.
+func NewAuditLog(path string, logger *zap.Logger) (*AuditLog, error) {
+	a := &AuditLog{
+		path:   path,
+		events: make([]AuditEvent, 0),
+		logger: logger,
+	}
+	if path == "" {
+		return a, nil
+	}
+
+	terminated, err := a.load()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file %s: %w", path, err)
+	}
+	defer f.Close()
+	// Новые события не должны продолжать недописанную строку
+	if !terminated {
+		if _, err := f.Write([]byte{'\n'}); err != nil {
+			return nil, fmt.Errorf("failed to write audit file %s: %w", path, err)
+		}
+	}
+	return a, nil
+}
+
+// load читает последние события из JSONL файла. Поврежденные строки, например
+// недописанная при аварийном завершении последняя, пропускаются. terminated
+// сообщает, что файл пуст или заканчивается переводом строки.
+func (a *AuditLog) load() (terminated bool, err error) {
+	f, err := os.Open(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open audit file %s: %w", a.path, err)
+	}
+	defer f.Close()
+
+	terminated = true
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil {
+			terminated = last[0] == '\n'
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxAuditLineSize)
+	skipped := 0
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			skipped++
+			continue
+		}
+		a.events = append(a.events, event)
+		if len(a.events) > 2*maxAuditEventsInMemory {
+			a.events = append(a.events[:0], a.events[len(a.events)-maxAuditEventsInMemory:]...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("failed to read audit file %s: %w", a.path, err)
+	}
+	if len(a.events) > maxAuditEventsInMemory {
+		a.events = a.events[len(a.events)-maxAuditEventsInMemory:]
+	}
+	if skipped > 0 {
+		a.logger.Warn("Skipped malformed audit events", zap.String("path", a.path), zap.Int("lines", skipped))
+	}
+	return terminated, nil
+}
+
+// OpenAuditLog создает журнал аудита по конфигурации сервера: audit_file или <store_dir>/audit.jsonl
+func OpenAuditLog(config common.ServerConfig, logger *zap.Logger) (*AuditLog, error) {
+	path := config.CA.AuditFile
+	if path == "" && config.CA.StoreDir != "" {
+		if err := os.MkdirAll(config.CA.StoreDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create CA store dir: %w", err)
+		}
+		path = filepath.Join(config.CA.StoreDir, caAuditFileName)
+	}
+	return NewAuditLog(path, logger)
+}
+
+// Record добавляет событие в журнал
+func (a *AuditLog) Record(actor, action, subject, details string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	event := AuditEvent{
+		ID:        len(a.events) + 1,
+		Timestamp: time.Now().UTC(),
+		Actor:     actor,
+		Action:    action,
+		Subject:   subject,
+		Details:   details,
+	}
+	if len(a.events) > 0 {
+		event.ID = a.events[len(a.events)-1].ID + 1
+	}
+
+	a.events = append(a.events, event)
+	if len(a.events) > maxAuditEventsInMemory {
+		a.events = a.events[len(a.events)-maxAuditEventsInMemory:]
+	}
+
+	a.logger.Info("Audit event",
+		zap.String("action", action),
+		zap.String("subject", subject),
+		zap.String("details", details),
+		zap.String("actor", actor))
+
+	if a.path == "" {
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		a.logger.Error("Failed to encode audit event", zap.Error(err))
+		return
+	}
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		a.logger.Error("Failed to open audit file", zap.String("path", a.path), zap.Error(err))
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		a.logger.Error("Failed to write audit event", zap.Error(err))
+	}
+}
+
+// List возвращает последние limit событий (все, если limit <= 0)
+func (a *AuditLog) List(limit int) []AuditEvent {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	events := a.events
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+
+	result := make([]AuditEvent, len(events))
+	copy(result, events)
+	return result
+}
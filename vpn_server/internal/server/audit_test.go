@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAuditLog_ReloadsEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := NewAuditLog(path, zap.NewNop())
+	require.NoError(t, err)
+	audit.Record("admin", "certificate.issue", "01", "cn=alice")
+	audit.Record("admin", "certificate.revoke", "01", "reason=lost")
+
+	// Недописанная строка после аварийного завершения
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"id":3,"acti`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// После перезапуска история доступна, нумерация продолжается
+	reopened, err := NewAuditLog(path, zap.NewNop())
+	require.NoError(t, err)
+	events := reopened.List(0)
+	require.Len(t, events, 2)
+	assert.Equal(t, "certificate.revoke", events[1].Action)
+
+	reopened.Record("admin", "certificate.download", "01", "format=pem")
+	events = reopened.List(0)
+	require.Len(t, events, 3)
+	assert.Equal(t, 3, events[2].ID)
+
+	// В файле идентификаторы не повторяются
+	f, err = os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	seen := make(map[int]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event AuditEvent
+		if json.Unmarshal(scanner.Bytes(), &event) != nil {
+			continue
+		}
+		assert.False(t, seen[event.ID], "duplicate audit event id %d", event.ID)
+		seen[event.ID] = true
+	}
+	assert.Len(t, seen, 3)
+}
+
+func TestAuditLog_ReloadKeepsLatestEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := NewAuditLog(path, zap.NewNop())
+	require.NoError(t, err)
+	for i := 0; i < maxAuditEventsInMemory+5; i++ {
+		audit.Record("admin", "certificate.issue", "01", "")
+	}
+
+	reopened, err := NewAuditLog(path, zap.NewNop())
+	require.NoError(t, err)
+	events := reopened.List(0)
+	require.Len(t, events, maxAuditEventsInMemory)
+	assert.Equal(t, 6, events[0].ID)
+	assert.Equal(t, maxAuditEventsInMemory+5, events[len(events)-1].ID)
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	common "github.com/iselt/masque-vpn/common"
+)
+
+const defaultJWTLeeway = 60 * time.Second
+
+var defaultJWTAlgorithms = []string{"RS256", "ES256", "EdDSA"}
+
+// ErrBearerTokenMissing запрос не содержит заголовка Authorization: Bearer
+var ErrBearerTokenMissing = errors.New("bearer token is required")
+
+// BearerAuthenticator второй фактор аутентификации после mTLS
+type BearerAuthenticator interface {
+	// Authenticate проверяет токен и его привязку к идентичности из сертификата
+	Authenticate(token string, identity ClientIdentity) error
+}
+
+// JWTAuthenticator проверяет JWT по ключам из локального JWKS файла
+type JWTAuthenticator struct {
+	config common.JWTConfig
+	parser *jwt.Parser
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // kid -> ключ
+	modTime time.Time
+}
+
+// NewJWTAuthenticator создает проверку JWT и загружает JWKS
+func NewJWTAuthenticator(config common.JWTConfig) (*JWTAuthenticator, error) {
+	if config.JWKSFile == "" {
+		return nil, fmt.Errorf("%w: jwt.jwks_file is required", common.ErrMissingConfig)
+	}
+	if config.Audience == "" {
+		return nil, fmt.Errorf("%w: jwt.audience is required", common.ErrMissingConfig)
+	}
+	if config.SubjectClaim == "" {
+		config.SubjectClaim = "sub"
+	}
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = defaultJWTAlgorithms
+	}
+	leeway := defaultJWTLeeway
+	if config.LeewaySeconds > 0 {
+		leeway = time.Duration(config.LeewaySeconds) * time.Second
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(config.Algorithms),
+		jwt.WithAudience(config.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(leeway),
+	}
+	if config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(config.Issuer))
+	}
+
+	a := &JWTAuthenticator{
+		config: config,
+		parser: jwt.NewParser(options...),
+	}
+	if err := a.reloadKeys(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Authenticate проверяет подпись, aud, iss и срок действия токена, а также
+// совпадение claim subject_claim с пользователем клиентского сертификата
+func (a *JWTAuthenticator) Authenticate(token string, identity ClientIdentity) error {
+	if token == "" {
+		return ErrBearerTokenMissing
+	}
+	if err := a.reloadKeys(); err != nil {
+		return err
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.keyFunc); err != nil {
+		return fmt.Errorf("%w: invalid bearer token: %v", common.ErrAuthenticationFailed, err)
+	}
+
+	subject, _ := claims[a.config.SubjectClaim].(string)
+	if subject == "" {
+		return fmt.Errorf("%w: bearer token has no %q claim", common.ErrAuthenticationFailed, a.config.SubjectClaim)
+	}
+	if subject != identity.User {
+		return fmt.Errorf("%w: bearer token %s %q does not match certificate user %q",
+			common.ErrAuthenticationFailed, a.config.SubjectClaim, subject, identity.User)
+	}
+	return nil
+}
+
+// keyFunc выбирает ключ по kid; без kid допускается единственный ключ в JWKS
+func (a *JWTAuthenticator) keyFunc(token *jwt.Token) (interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// reloadKeys перечитывает JWKS, если файл изменился
+func (a *JWTAuthenticator) reloadKeys() error {
+	info, err := os.Stat(a.config.JWKSFile)
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.keys != nil && info.ModTime().Equal(a.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.config.JWKSFile)
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", common.ErrInvalidConfig, a.config.JWKSFile, err)
+	}
+
+	a.keys = keys
+	a.modTime = info.ModTime()
+	return nil
+}
+
+// jsonWebKey открытый ключ в формате JWK (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS разбирает набор ключей RSA, EC (P-256/384/521) и OKP (Ed25519)
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS contains no signing keys")
+	}
+	return keys, nil
+}
+
+// publicKey декодирует открытый ключ из JWK
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// decodeJWKInt декодирует целое число base64url из JWK
+func decodeJWKInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// bearerToken извлекает токен из заголовка Authorization
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
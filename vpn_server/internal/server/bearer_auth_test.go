@@ -0,0 +1,174 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockIssuer локальный издатель JWT для тестов
+type mockIssuer struct {
+	t        *testing.T
+	jwksPath string
+	ecKey    *ecdsa.PrivateKey
+	rsaKey   *rsa.PrivateKey
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	issuer := &mockIssuer{
+		t:        t,
+		jwksPath: filepath.Join(t.TempDir(), "jwks.json"),
+		ecKey:    ecKey,
+		rsaKey:   rsaKey,
+	}
+	issuer.writeJWKS(ecKey, rsaKey)
+	return issuer
+}
+
+// writeJWKS публикует открытые ключи в JWKS файл
+func (m *mockIssuer) writeJWKS(ecKey *ecdsa.PrivateKey, rsaKey *rsa.PrivateKey) {
+	b64 := func(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
+	keys := []map[string]string{{
+		"kty": "EC", "kid": "ec-1", "crv": "P-256", "use": "sig",
+		"x": b64(ecKey.X.FillBytes(make([]byte, 32))),
+		"y": b64(ecKey.Y.FillBytes(make([]byte, 32))),
+	}}
+	if rsaKey != nil {
+		keys = append(keys, map[string]string{
+			"kty": "RSA", "kid": "rsa-1",
+			"n": b64(rsaKey.N.Bytes()),
+			"e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+		})
+	}
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	require.NoError(m.t, err)
+	require.NoError(m.t, os.WriteFile(m.jwksPath, data, 0644))
+}
+
+// sign выпускает токен с указанными claims, подписанный ключом kid
+func (m *mockIssuer) sign(kid string, claims jwt.MapClaims) string {
+	var token *jwt.Token
+	var key interface{}
+	if kid == "rsa-1" {
+		token, key = jwt.NewWithClaims(jwt.SigningMethodRS256, claims), m.rsaKey
+	} else {
+		token, key = jwt.NewWithClaims(jwt.SigningMethodES256, claims), m.ecKey
+	}
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	require.NoError(m.t, err)
+	return signed
+}
+
+func validClaims(subject string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": "https://idp.example.com",
+		"aud": "masque-vpn",
+		"sub": subject,
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	issuer := newMockIssuer(t)
+	auth, err := NewJWTAuthenticator(common.JWTConfig{
+		Enabled:  true,
+		JWKSFile: issuer.jwksPath,
+		Issuer:   "https://idp.example.com",
+		Audience: "masque-vpn",
+	})
+	require.NoError(t, err)
+	alice := ClientIdentity{User: "alice"}
+
+	assert.NoError(t, auth.Authenticate(issuer.sign("ec-1", validClaims("alice")), alice))
+	assert.NoError(t, auth.Authenticate(issuer.sign("rsa-1", validClaims("alice")), alice))
+
+	assert.ErrorIs(t, auth.Authenticate("", alice), ErrBearerTokenMissing)
+
+	rejected := map[string]jwt.MapClaims{}
+	rejected["other subject"] = validClaims("bob")
+	claims := validClaims("alice")
+	claims["aud"] = "another-service"
+	rejected["wrong audience"] = claims
+	claims = validClaims("alice")
+	claims["iss"] = "https://evil.example.com"
+	rejected["wrong issuer"] = claims
+	claims = validClaims("alice")
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	rejected["expired"] = claims
+	claims = validClaims("alice")
+	delete(claims, "exp")
+	rejected["no expiry"] = claims
+
+	for name, claims := range rejected {
+		err := auth.Authenticate(issuer.sign("ec-1", claims), alice)
+		assert.ErrorIs(t, err, common.ErrAuthenticationFailed, name)
+	}
+
+	// Токен, подписанный ключом не из JWKS
+	stranger := newMockIssuer(t)
+	err = auth.Authenticate(stranger.sign("ec-1", validClaims("alice")), alice)
+	assert.ErrorIs(t, err, common.ErrAuthenticationFailed)
+}
+
+func TestJWTAuthenticator_SubjectClaimAndRotation(t *testing.T) {
+	issuer := newMockIssuer(t)
+	auth, err := NewJWTAuthenticator(common.JWTConfig{
+		JWKSFile:     issuer.jwksPath,
+		Audience:     "masque-vpn",
+		SubjectClaim: "email",
+	})
+	require.NoError(t, err)
+	identity := ClientIdentity{User: "alice@example.com"}
+
+	claims := validClaims("00u1abcd")
+	claims["email"] = "alice@example.com"
+	assert.NoError(t, auth.Authenticate(issuer.sign("ec-1", claims), identity))
+
+	// Удаленный из JWKS ключ перестает приниматься после перезаписи файла
+	issuer.writeJWKS(issuer.ecKey, nil)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(issuer.jwksPath, future, future))
+	err = auth.Authenticate(issuer.sign("rsa-1", claims), identity)
+	assert.ErrorIs(t, err, common.ErrAuthenticationFailed)
+}
+
+func TestNewJWTAuthenticator_InvalidConfig(t *testing.T) {
+	_, err := NewJWTAuthenticator(common.JWTConfig{Audience: "masque-vpn"})
+	assert.ErrorIs(t, err, common.ErrMissingConfig)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"keys":[{"kty":"EC","crv":"P-256","x":"AA","y":"AA"}]}`), 0644))
+	_, err = NewJWTAuthenticator(common.JWTConfig{JWKSFile: path, Audience: "masque-vpn"})
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+}
+
+func TestBearerToken(t *testing.T) {
+	r := httptest.NewRequest("CONNECT", "/", nil)
+	assert.Empty(t, bearerToken(r))
+	r.Header.Set("Authorization", "bearer abc.def.ghi")
+	assert.Equal(t, "abc.def.ghi", bearerToken(r))
+	r.Header.Set("Authorization", "Basic YWxpY2U6c2VjcmV0")
+	assert.Empty(t, bearerToken(r))
+}
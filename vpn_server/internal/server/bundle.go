@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+const (
+	defaultBundleTunName = "tun0"
+	defaultBundleMTU     = 1413
+)
+
+// clientConfigTemplate шаблон клиентской конфигурации; повторяет config.client.toml.example
+const clientConfigTemplate = `# MASQUE VPN client configuration for {{client_id}}
+# Generated by {{server_name}} at {{generated_at}}, certificate serial {{serial}}
+
+# VPN server address and port
+server_addr = "{{server_addr}}"
+
+# Expected server name for TLS verification
+server_name = "{{server_name}}"
+
+# MTU
+mtu = {{mtu}}
+
+# Embedded mTLS material
+ca_pem = '''
+{{ca_pem}}
+'''
+
+cert_pem = '''
+{{cert_pem}}
+'''
+
+key_pem = '''
+{{key_pem}}
+'''
+
+insecure_skip_verify = false
+
+# TUN device name
+tun_name = "{{tun_name}}"
+
+# Log level: debug, info, warn, error
+log_level = "info"
+`
+
+// BundleRequest параметры формирования клиентского пакета конфигурации
+type BundleRequest struct {
+	Serial     string   `json:"serial,omitempty"`      // конкретный сертификат; по умолчанию самый новый действующий
+	Issue      bool     `json:"issue,omitempty"`       // выпустить сертификат, если подходящего нет
+	Groups     []string `json:"groups,omitempty"`      // группы для нового сертификата
+	TunName    string   `json:"tun_name,omitempty"`    // имя TUN устройства в конфигурации клиента
+	TTLMinutes int      `json:"ttl_minutes,omitempty"` // время жизни токена скачивания
+}
+
+// ClientBundle готовая конфигурация клиента
+type ClientBundle struct {
+	ClientID string
+	Serial   string
+	Config   []byte
+	URI      string
+}
+
+// BuildClientBundle формирует клиентский TOML со встроенными PEM и masque:// URI для импорта
+func BuildClientBundle(config common.ServerConfig, ca *CertificateAuthority, clientID string, req BundleRequest, actor string) (*ClientBundle, error) {
+	if ca == nil {
+		return nil, fmt.Errorf("%w: certificate authority is not configured", common.ErrMissingConfig)
+	}
+	if strings.TrimSpace(clientID) == "" {
+		return nil, fmt.Errorf("%w: client id is required", common.ErrInvalidConfig)
+	}
+
+	issued, err := selectBundleCertificate(ca, clientID, req.Serial)
+	if err == ErrCertificateNotFound && req.Serial == "" && req.Issue {
+		issued, err = ca.Issue(IssueRequest{CommonName: clientID, Groups: req.Groups}, actor)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tunName := req.TunName
+	if tunName == "" {
+		tunName = defaultBundleTunName
+	}
+	mtu := config.MTU
+	if mtu <= 0 {
+		mtu = defaultBundleMTU
+	}
+
+	replacer := strings.NewReplacer(
+		"{{client_id}}", clientID,
+		"{{generated_at}}", time.Now().UTC().Format(time.RFC3339),
+		"{{serial}}", issued.Serial,
+		"{{server_addr}}", ClientServerAddr(config),
+		"{{server_name}}", config.ServerName,
+		"{{mtu}}", strconv.Itoa(mtu),
+		"{{ca_pem}}", strings.TrimSpace(string(ca.CACertPEM())),
+		"{{cert_pem}}", strings.TrimSpace(issued.CertPEM),
+		"{{key_pem}}", strings.TrimSpace(issued.KeyPEM),
+		"{{tun_name}}", tunName,
+	)
+	configTOML := []byte(replacer.Replace(clientConfigTemplate))
+
+	uri, err := common.EncodeConfigURI(configTOML)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ClientBundle{
+		ClientID: clientID,
+		Serial:   issued.Serial,
+		Config:   configTOML,
+		URI:      uri,
+	}, nil
+}
+
+// selectBundleCertificate выбирает сертификат клиента с ключом, хранящимся на сервере
+func selectBundleCertificate(ca *CertificateAuthority, clientID, serial string) (*IssuedCertificate, error) {
+	if serial != "" {
+		issued, err := ca.Get(serial)
+		if err != nil {
+			return nil, err
+		}
+		if issued.CommonName != clientID {
+			return nil, fmt.Errorf("%w: certificate %s belongs to %s", common.ErrInvalidConfig, issued.Serial, issued.CommonName)
+		}
+		if issued.Revoked || time.Now().After(issued.NotAfter) {
+			return nil, fmt.Errorf("%w: certificate %s is not valid", common.ErrInvalidCertificate, issued.Serial)
+		}
+		if issued.KeyPEM == "" {
+			return nil, ErrPrivateKeyNotHeld
+		}
+		return issued, nil
+	}
+
+	var newest *IssuedCertificate
+	for _, issued := range ca.List() {
+		if issued.CommonName != clientID || issued.Revoked || issued.KeyPEM == "" || time.Now().After(issued.NotAfter) {
+			continue
+		}
+		if newest == nil || issued.IssuedAt.After(newest.IssuedAt) {
+			newest = issued
+		}
+	}
+	if newest == nil {
+		return nil, ErrCertificateNotFound
+	}
+	return newest, nil
+}
+
+// ClientServerAddr возвращает адрес сервера для клиентов: public_addr или server_name с портом listen_addr
+func ClientServerAddr(config common.ServerConfig) string {
+	if config.PublicAddr != "" {
+		return config.PublicAddr
+	}
+	_, port, err := net.SplitHostPort(config.ListenAddr)
+	if err != nil {
+		return config.ListenAddr
+	}
+	return net.JoinHostPort(config.ServerName, port)
+}
+
+// generateToken создает случайный токен для одноразовых ссылок
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iselt/masque-vpn/common"
+)
+
+const (
+	defaultBundleTokenTTL = 60 * time.Minute
+	maxBundleTokenTTL     = 7 * 24 * time.Hour
+)
+
+// pendingBundle пакет конфигурации, ожидающий одноразового скачивания
+type pendingBundle struct {
+	bundle    *ClientBundle
+	expiresAt time.Time
+}
+
+// createClientBundle формирует конфигурацию клиента и выдает одноразовый токен скачивания и masque:// URI
+func (api *APIServer) createClientBundle(c *gin.Context) {
+	ca := api.requireCA(c)
+	if ca == nil {
+		return
+	}
+
+	var req BundleRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+	}
+
+	ttl := defaultBundleTokenTTL
+	if req.TTLMinutes > 0 {
+		ttl = time.Duration(req.TTLMinutes) * time.Minute
+	}
+	if ttl > maxBundleTokenTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl_minutes exceeds 7 days"})
+		return
+	}
+
+	clientID := c.Param("id")
+	bundle, err := BuildClientBundle(api.server.Config, ca, clientID, req, c.ClientIP())
+	if err != nil {
+		if errors.Is(err, common.ErrInvalidCertificate) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, ErrCertificateNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No valid certificate with server-held key for client " + clientID})
+			return
+		}
+		writeCAError(c, err)
+		return
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	expiresAt := time.Now().Add(ttl).UTC()
+
+	api.bundlesMutex.Lock()
+	api.pruneBundlesLocked()
+	api.bundles[token] = &pendingBundle{bundle: bundle, expiresAt: expiresAt}
+	api.bundlesMutex.Unlock()
+
+	api.server.Audit.Record(c.ClientIP(), "bundle.create", clientID,
+		fmt.Sprintf("serial=%s expires_at=%s", bundle.Serial, expiresAt.Format(time.RFC3339)))
+
+	c.JSON(http.StatusCreated, gin.H{
+		"client_id":    clientID,
+		"serial":       bundle.Serial,
+		"token":        token,
+		"download_url": "/api/v1/bundles/" + token,
+		"uri":          bundle.URI,
+		"expires_at":   expiresAt,
+	})
+}
+
+// downloadClientBundle отдает конфигурацию клиента по одноразовому токену
+func (api *APIServer) downloadClientBundle(c *gin.Context) {
+	token := c.Param("token")
+
+	api.bundlesMutex.Lock()
+	api.pruneBundlesLocked()
+	pending, ok := api.bundles[token]
+	delete(api.bundles, token)
+	api.bundlesMutex.Unlock()
+
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bundle token not found, expired or already used"})
+		return
+	}
+
+	api.server.Audit.Record(c.ClientIP(), "bundle.download", pending.bundle.ClientID,
+		"serial="+pending.bundle.Serial)
+
+	c.Header("Content-Disposition", `attachment; filename="config.client.toml"`)
+	c.Data(http.StatusOK, "application/toml", pending.bundle.Config)
+}
+
+// pruneBundlesLocked удаляет просроченные токены; вызывается под bundlesMutex
+func (api *APIServer) pruneBundlesLocked() {
+	now := time.Now()
+	for token, pending := range api.bundles {
+		if now.After(pending.expiresAt) {
+			delete(api.bundles, token)
+		}
+	}
+}
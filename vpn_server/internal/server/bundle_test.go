@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBuildClientBundle(t *testing.T) {
+	config := newTestCAConfig(t, "")
+	config.ListenAddr = "0.0.0.0:4433"
+	config.ServerName = "vpn.example.com"
+	config.MTU = 1400
+
+	ca, err := NewCertificateAuthority(config, nil, zap.NewNop())
+	require.NoError(t, err)
+
+	// Без сертификата и без issue пакет не формируется
+	_, err = BuildClientBundle(config, ca, "alice", BundleRequest{}, "tester")
+	assert.ErrorIs(t, err, ErrCertificateNotFound)
+
+	bundle, err := BuildClientBundle(config, ca, "alice", BundleRequest{Issue: true}, "tester")
+	require.NoError(t, err)
+
+	decoded, err := common.DecodeConfigURI(bundle.URI)
+	require.NoError(t, err)
+	assert.Equal(t, bundle.Config, decoded)
+
+	var clientConfig common.ClientConfig
+	_, err = toml.Decode(string(bundle.Config), &clientConfig)
+	require.NoError(t, err)
+	assert.Equal(t, "vpn.example.com:4433", clientConfig.ServerAddr)
+	assert.Equal(t, "vpn.example.com", clientConfig.ServerName)
+	assert.Equal(t, 1400, clientConfig.MTU)
+	assert.Equal(t, "tun0", clientConfig.TunName)
+
+	_, err = tls.X509KeyPair([]byte(clientConfig.CertPEM), []byte(clientConfig.KeyPEM))
+	assert.NoError(t, err)
+	assert.Equal(t, strings.TrimSpace(string(ca.CACertPEM())), strings.TrimSpace(clientConfig.CAPEM))
+
+	// Повторный запрос использует уже выпущенный сертификат
+	again, err := BuildClientBundle(config, ca, "alice", BundleRequest{Issue: true}, "tester")
+	require.NoError(t, err)
+	assert.Equal(t, bundle.Serial, again.Serial)
+
+	_, err = ca.Revoke(bundle.Serial, "", "tester")
+	require.NoError(t, err)
+	_, err = BuildClientBundle(config, ca, "alice", BundleRequest{Serial: bundle.Serial}, "tester")
+	assert.ErrorIs(t, err, common.ErrInvalidCertificate)
+}
+
+func TestClientServerAddr(t *testing.T) {
+	assert.Equal(t, "vpn.example.com:4433", ClientServerAddr(common.ServerConfig{
+		ListenAddr: "0.0.0.0:4433", ServerName: "vpn.example.com",
+	}))
+	assert.Equal(t, "203.0.113.1:443", ClientServerAddr(common.ServerConfig{
+		ListenAddr: "0.0.0.0:4433", ServerName: "vpn.example.com", PublicAddr: "203.0.113.1:443",
+	}))
+}
@@ -0,0 +1,621 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// OIDClientGroups OID расширения клиентского сертификата со списком групп (SEQUENCE OF UTF8String)
+var OIDClientGroups = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 59453, 1, 1}
+
+// OIDClientDevice OID расширения продленного сертификата с идентификатором устройства
+// (UTF8String): серийный номер первого сертификата в цепочке продлений
+var OIDClientDevice = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 59453, 1, 2}
+
+const (
+	defaultCertValidityDays = 365
+	caIndexFileName         = "index.json"
+	caAuditFileName         = "audit.jsonl"
+)
+
+var (
+	// ErrCertificateNotFound сертификат с указанным серийным номером не выпускался
+	ErrCertificateNotFound = errors.New("certificate not found")
+	// ErrPrivateKeyNotHeld закрытый ключ сертификата не хранится на сервере
+	ErrPrivateKeyNotHeld = errors.New("private key is not held by the server")
+)
+
+// IssueRequest параметры выпуска клиентского сертификата
+type IssueRequest struct {
+	CommonName     string   `json:"common_name"`
+	DNSNames       []string `json:"dns_names,omitempty"`
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+	IPAddresses    []string `json:"ip_addresses,omitempty"`
+	Groups         []string `json:"groups,omitempty"`
+	ValidityDays   int      `json:"validity_days,omitempty"`
+
+	device  string // идентификатор устройства продлеваемого сертификата
+	renewal bool   // выпуск при продлении: событие аудита пишет Renew
+}
+
+// IssuedCertificate запись о выпущенном сертификате
+type IssuedCertificate struct {
+	Serial         string    `json:"serial"`
+	CommonName     string    `json:"common_name"`
+	DNSNames       []string  `json:"dns_names,omitempty"`
+	EmailAddresses []string  `json:"email_addresses,omitempty"`
+	URIs           []string  `json:"uris,omitempty"`
+	IPAddresses    []string  `json:"ip_addresses,omitempty"`
+	Groups         []string  `json:"groups,omitempty"`
+	Device         string    `json:"device,omitempty"` // серийный номер первого сертификата устройства, если сертификат продлен
+	NotBefore      time.Time `json:"not_before"`
+	NotAfter       time.Time `json:"not_after"`
+	IssuedAt       time.Time `json:"issued_at"`
+	IssuedBy       string    `json:"issued_by"`
+	Revoked        bool      `json:"revoked"`
+	RevokedAt      time.Time `json:"revoked_at,omitempty"`
+	RevokeReason   string    `json:"revoke_reason,omitempty"`
+	CertPEM        string    `json:"cert_pem"`
+	KeyPEM         string    `json:"key_pem,omitempty"`
+}
+
+// CertificateInfo представление выпущенного сертификата для API (без закрытого ключа)
+type CertificateInfo struct {
+	Serial         string    `json:"serial"`
+	CommonName     string    `json:"common_name"`
+	DNSNames       []string  `json:"dns_names,omitempty"`
+	EmailAddresses []string  `json:"email_addresses,omitempty"`
+	URIs           []string  `json:"uris,omitempty"`
+	IPAddresses    []string  `json:"ip_addresses,omitempty"`
+	Groups         []string  `json:"groups,omitempty"`
+	Device         string    `json:"device,omitempty"`
+	NotBefore      time.Time `json:"not_before"`
+	NotAfter       time.Time `json:"not_after"`
+	IssuedAt       time.Time `json:"issued_at"`
+	IssuedBy       string    `json:"issued_by"`
+	Status         string    `json:"status"`
+	RevokedAt      time.Time `json:"revoked_at,omitempty"`
+	RevokeReason   string    `json:"revoke_reason,omitempty"`
+	HasPrivateKey  bool      `json:"has_private_key"`
+}
+
+// clone копирует запись, чтобы ее можно было читать без блокировки CA.
+// Срезы не копируются: после выпуска они не изменяются.
+func (c *IssuedCertificate) clone() *IssuedCertificate {
+	copied := *c
+	return &copied
+}
+
+// Info возвращает представление сертификата для API
+func (c *IssuedCertificate) Info() CertificateInfo {
+	status := "valid"
+	if c.Revoked {
+		status = "revoked"
+	} else if time.Now().After(c.NotAfter) {
+		status = "expired"
+	}
+
+	return CertificateInfo{
+		Serial:         c.Serial,
+		CommonName:     c.CommonName,
+		DNSNames:       c.DNSNames,
+		EmailAddresses: c.EmailAddresses,
+		URIs:           c.URIs,
+		IPAddresses:    c.IPAddresses,
+		Groups:         c.Groups,
+		Device:         c.Device,
+		NotBefore:      c.NotBefore,
+		NotAfter:       c.NotAfter,
+		IssuedAt:       c.IssuedAt,
+		IssuedBy:       c.IssuedBy,
+		Status:         status,
+		RevokedAt:      c.RevokedAt,
+		RevokeReason:   c.RevokeReason,
+		HasPrivateKey:  c.KeyPEM != "",
+	}
+}
+
+// CertificateAuthority встроенный центр сертификации клиентов
+type CertificateAuthority struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	signer  crypto.Signer
+	config  common.CAConfig
+	audit   *AuditLog
+	logger  *zap.Logger
+
+	issued map[string]*IssuedCertificate // serial (hex) -> запись
+	mu     sync.RWMutex
+}
+
+// NewCertificateAuthority загружает ключ и сертификат CA из конфигурации сервера
+func NewCertificateAuthority(config common.ServerConfig, audit *AuditLog, logger *zap.Logger) (*CertificateAuthority, error) {
+	certPEM, err := loadPEMSource(config.CACertPEM, config.CACertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA certificate: %w", err)
+	}
+	keyPEM, err := loadPEMSource(config.CAKeyPEM, config.CAKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA key: %w", err)
+	}
+
+	// tls.X509KeyPair проверяет соответствие ключа сертификату и поддерживает PKCS#1/PKCS#8/EC
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA key pair: %w", err)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("CA private key does not support signing")
+	}
+	caCert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	if !caCert.IsCA {
+		return nil, fmt.Errorf("certificate %q is not a CA certificate", caCert.Subject.CommonName)
+	}
+
+	ca := &CertificateAuthority{
+		cert:    caCert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}),
+		signer:  signer,
+		config:  config.CA,
+		audit:   audit,
+		logger:  logger,
+		issued:  make(map[string]*IssuedCertificate),
+	}
+
+	if ca.config.StoreDir != "" {
+		if err := os.MkdirAll(ca.config.StoreDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create CA store dir %s: %w", ca.config.StoreDir, err)
+		}
+		if err := ca.loadIndex(); err != nil {
+			return nil, err
+		}
+	} else {
+		logger.Warn("CA store_dir is not set, issued certificates are kept in memory only")
+	}
+
+	logger.Info("Certificate authority initialized",
+		zap.String("ca", caCert.Subject.CommonName), zap.Int("issued", len(ca.issued)))
+	return ca, nil
+}
+
+// CACertPEM возвращает сертификат CA в формате PEM
+func (ca *CertificateAuthority) CACertPEM() []byte {
+	return ca.certPEM
+}
+
+// Issue генерирует ключевую пару и выпускает для нее клиентский сертификат
+func (ca *CertificateAuthority) Issue(req IssueRequest, actor string) (*IssuedCertificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate client key: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode client key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	return ca.sign(req, key.Public(), string(keyPEM), actor)
+}
+
+// sign выпускает сертификат для открытого ключа, сохраняет его и пишет событие аудита
+func (ca *CertificateAuthority) sign(req IssueRequest, pub crypto.PublicKey, keyPEM, actor string) (*IssuedCertificate, error) {
+	template, err := ca.buildTemplate(req)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+
+	issued := &IssuedCertificate{
+		Serial:         formatSerial(template.SerialNumber),
+		CommonName:     req.CommonName,
+		DNSNames:       req.DNSNames,
+		EmailAddresses: req.EmailAddresses,
+		URIs:           req.URIs,
+		IPAddresses:    req.IPAddresses,
+		Groups:         req.Groups,
+		Device:         req.device,
+		NotBefore:      template.NotBefore,
+		NotAfter:       template.NotAfter,
+		IssuedAt:       time.Now().UTC(),
+		IssuedBy:       actor,
+		CertPEM:        string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyPEM:         keyPEM,
+	}
+
+	ca.mu.Lock()
+	ca.issued[issued.Serial] = issued
+	issued = issued.clone()
+	err = ca.saveIndexLocked()
+	ca.mu.Unlock()
+	if err != nil {
+		ca.logger.Error("Failed to persist CA index", zap.Error(err))
+	}
+
+	if !req.renewal {
+		ca.recordAudit(actor, "certificate.issue", issued.Serial,
+			fmt.Sprintf("cn=%s groups=%s not_after=%s", issued.CommonName,
+				strings.Join(issued.Groups, ","), issued.NotAfter.Format(time.RFC3339)))
+	}
+
+	return issued, nil
+}
+
+// Renew выпускает для нового ключа сертификат с теми же атрибутами и сроком действия,
+// что у действующего сертификата current, выпущенного этим CA
+func (ca *CertificateAuthority) Renew(current *x509.Certificate, pub crypto.PublicKey, actor string) (*IssuedCertificate, error) {
+	// Get возвращает копию: состояние отзыва прочитано под блокировкой
+	previous, err := ca.Get(formatSerial(current.SerialNumber))
+	if err != nil {
+		return nil, err
+	}
+	if previous.Revoked {
+		return nil, fmt.Errorf("%w: certificate %s has been revoked", common.ErrAuthenticationFailed, previous.Serial)
+	}
+	if time.Now().After(previous.NotAfter) {
+		return nil, fmt.Errorf("%w: certificate %s has expired", common.ErrAuthenticationFailed, previous.Serial)
+	}
+
+	validityDays := int(previous.NotAfter.Sub(previous.NotBefore).Round(24*time.Hour) / (24 * time.Hour))
+	if validityDays < 1 {
+		validityDays = 1
+	}
+	if ca.config.MaxValidityDays > 0 && validityDays > ca.config.MaxValidityDays {
+		validityDays = ca.config.MaxValidityDays
+	}
+
+	// Устройство сохраняет идентификатор при продлении: с ключом сессии по серийному
+	// номеру иначе терялись бы закрепленный адрес и место в пределе сессий
+	device := previous.Device
+	if device == "" {
+		device = previous.Serial
+	}
+
+	issued, err := ca.sign(IssueRequest{
+		CommonName:     previous.CommonName,
+		DNSNames:       previous.DNSNames,
+		EmailAddresses: previous.EmailAddresses,
+		URIs:           previous.URIs,
+		IPAddresses:    previous.IPAddresses,
+		Groups:         previous.Groups,
+		ValidityDays:   validityDays,
+		device:         device,
+		renewal:        true,
+	}, pub, "", actor)
+	if err != nil {
+		return nil, err
+	}
+
+	ca.recordAudit(actor, "certificate.renew", issued.Serial,
+		fmt.Sprintf("cn=%s previous=%s not_after=%s", issued.CommonName, previous.Serial,
+			issued.NotAfter.Format(time.RFC3339)))
+	return issued, nil
+}
+
+// buildTemplate проверяет запрос и формирует шаблон клиентского сертификата
+func (ca *CertificateAuthority) buildTemplate(req IssueRequest) (*x509.Certificate, error) {
+	if strings.TrimSpace(req.CommonName) == "" {
+		return nil, fmt.Errorf("%w: common_name is required", common.ErrInvalidConfig)
+	}
+
+	validityDays := req.ValidityDays
+	if validityDays <= 0 {
+		validityDays = ca.config.DefaultValidityDays
+	}
+	if validityDays <= 0 {
+		validityDays = defaultCertValidityDays
+	}
+	if ca.config.MaxValidityDays > 0 && validityDays > ca.config.MaxValidityDays {
+		return nil, fmt.Errorf("%w: validity_days %d exceeds maximum %d",
+			common.ErrInvalidConfig, validityDays, ca.config.MaxValidityDays)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	notAfter := now.Add(time.Duration(validityDays) * 24 * time.Hour)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         req.CommonName,
+			OrganizationalUnit: req.Groups,
+		},
+		NotBefore:             now.Add(-5 * time.Minute), // допускаем небольшой рассинхрон часов
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              req.DNSNames,
+		EmailAddresses:        req.EmailAddresses,
+	}
+
+	for _, raw := range req.URIs {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme == "" {
+			return nil, fmt.Errorf("%w: invalid URI SAN %q", common.ErrInvalidConfig, raw)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	for _, raw := range req.IPAddresses {
+		ip := net.ParseIP(raw)
+		if ip == nil {
+			return nil, fmt.Errorf("%w: invalid IP SAN %q", common.ErrInvalidConfig, raw)
+		}
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+
+	if len(req.Groups) > 0 {
+		value, err := asn1.Marshal(req.Groups)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode groups extension: %w", err)
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{
+			Id:    OIDClientGroups,
+			Value: value,
+		})
+	}
+	if req.device != "" {
+		value, err := asn1.MarshalWithParams(req.device, "utf8")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode device extension: %w", err)
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{
+			Id:    OIDClientDevice,
+			Value: value,
+		})
+	}
+
+	return template, nil
+}
+
+// Get возвращает копию выпущенного сертификата по серийному номеру
+func (ca *CertificateAuthority) Get(serial string) (*IssuedCertificate, error) {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+
+	issued, ok := ca.issued[normalizeSerial(serial)]
+	if !ok {
+		return nil, ErrCertificateNotFound
+	}
+	return issued.clone(), nil
+}
+
+// List возвращает копии всех выпущенных сертификатов, отсортированные по времени выпуска
+func (ca *CertificateAuthority) List() []*IssuedCertificate {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+
+	result := make([]*IssuedCertificate, 0, len(ca.issued))
+	for _, issued := range ca.issued {
+		result = append(result, issued.clone())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].IssuedAt.Before(result[j].IssuedAt)
+	})
+	return result
+}
+
+// Revoke отзывает сертификат
+func (ca *CertificateAuthority) Revoke(serial, reason, actor string) (*IssuedCertificate, error) {
+	ca.mu.Lock()
+	stored, ok := ca.issued[normalizeSerial(serial)]
+	if !ok {
+		ca.mu.Unlock()
+		return nil, ErrCertificateNotFound
+	}
+	if stored.Revoked {
+		issued := stored.clone()
+		ca.mu.Unlock()
+		return issued, nil
+	}
+	stored.Revoked = true
+	stored.RevokedAt = time.Now().UTC()
+	stored.RevokeReason = reason
+	issued := stored.clone()
+	err := ca.saveIndexLocked()
+	ca.mu.Unlock()
+	if err != nil {
+		ca.logger.Error("Failed to persist CA index", zap.Error(err))
+	}
+
+	ca.recordAudit(actor, "certificate.revoke", issued.Serial,
+		fmt.Sprintf("cn=%s reason=%s", issued.CommonName, reason))
+	return issued, nil
+}
+
+// IsRevoked проверяет, отозван ли сертификат с указанным серийным номером
+func (ca *CertificateAuthority) IsRevoked(serial *big.Int) bool {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+
+	issued, ok := ca.issued[formatSerial(serial)]
+	return ok && issued.Revoked
+}
+
+// CRL формирует подписанный список отзыва сертификатов в формате DER
+func (ca *CertificateAuthority) CRL() ([]byte, error) {
+	ca.mu.RLock()
+	entries := make([]x509.RevocationListEntry, 0)
+	for _, issued := range ca.issued {
+		if !issued.Revoked {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(issued.Serial, 16)
+		if !ok {
+			continue
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: issued.RevokedAt,
+		})
+	}
+	ca.mu.RUnlock()
+
+	now := time.Now()
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(24 * time.Hour),
+	}
+	return x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.signer)
+}
+
+// ExportPEM возвращает сертификат клиента, его ключ (если хранится) и сертификат CA в PEM
+func (ca *CertificateAuthority) ExportPEM(serial, actor string) ([]byte, error) {
+	issued, err := ca.Get(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	var bundle []byte
+	bundle = append(bundle, issued.CertPEM...)
+	bundle = append(bundle, issued.KeyPEM...)
+	bundle = append(bundle, ca.certPEM...)
+
+	ca.recordAudit(actor, "certificate.download", issued.Serial, "format=pem")
+	return bundle, nil
+}
+
+// ExportPKCS12 упаковывает сертификат клиента, его ключ и сертификат CA в PKCS#12
+func (ca *CertificateAuthority) ExportPKCS12(serial, password, actor string) ([]byte, error) {
+	issued, err := ca.Get(serial)
+	if err != nil {
+		return nil, err
+	}
+	if issued.KeyPEM == "" {
+		return nil, ErrPrivateKeyNotHeld
+	}
+
+	certBlock, _ := pem.Decode([]byte(issued.CertPEM))
+	keyBlock, _ := pem.Decode([]byte(issued.KeyPEM))
+	if certBlock == nil || keyBlock == nil {
+		return nil, fmt.Errorf("stored certificate %s is corrupted", issued.Serial)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse stored certificate: %w", err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse stored key: %w", err)
+	}
+
+	data, err := pkcs12.Modern.Encode(key, cert, []*x509.Certificate{ca.cert}, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode PKCS#12: %w", err)
+	}
+
+	ca.recordAudit(actor, "certificate.download", issued.Serial, "format=pkcs12")
+	return data, nil
+}
+
+// recordAudit пишет событие в журнал аудита, если он настроен
+func (ca *CertificateAuthority) recordAudit(actor, action, subject, details string) {
+	if ca.audit != nil {
+		ca.audit.Record(actor, action, subject, details)
+	}
+}
+
+// loadIndex загружает индекс выпущенных сертификатов из store_dir
+func (ca *CertificateAuthority) loadIndex() error {
+	data, err := os.ReadFile(filepath.Join(ca.config.StoreDir, caIndexFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read CA index: %w", err)
+	}
+
+	var records []*IssuedCertificate
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("failed to parse CA index: %w", err)
+	}
+	for _, record := range records {
+		ca.issued[record.Serial] = record
+	}
+	return nil
+}
+
+// saveIndexLocked сохраняет индекс выпущенных сертификатов; вызывается под ca.mu
+func (ca *CertificateAuthority) saveIndexLocked() error {
+	if ca.config.StoreDir == "" {
+		return nil
+	}
+
+	records := make([]*IssuedCertificate, 0, len(ca.issued))
+	for _, record := range ca.issued {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].IssuedAt.Before(records[j].IssuedAt)
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode CA index: %w", err)
+	}
+	return common.WriteFileAtomic(filepath.Join(ca.config.StoreDir, caIndexFileName), data, 0600)
+}
+
+// loadPEMSource возвращает PEM из конфигурации или читает его из файла
+func loadPEMSource(pemValue, file string) ([]byte, error) {
+	if pemValue != "" {
+		return []byte(pemValue), nil
+	}
+	if file == "" {
+		return nil, fmt.Errorf("%w: neither PEM nor file is set", common.ErrMissingConfig)
+	}
+	return os.ReadFile(file)
+}
+
+// formatSerial форматирует серийный номер сертификата в нижнем регистре hex
+func formatSerial(serial *big.Int) string {
+	return strings.ToLower(serial.Text(16))
+}
+
+// normalizeSerial приводит серийный номер из запроса к формату formatSerial
+func normalizeSerial(serial string) string {
+	serial = strings.ToLower(strings.TrimSpace(serial))
+	serial = strings.ReplaceAll(serial, ":", "")
+	return strings.TrimLeft(serial, "0")
+}
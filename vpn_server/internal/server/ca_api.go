@@ -0,0 +1,204 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+// RevokeRequest тело запроса на отзыв сертификата
+type RevokeRequest struct {
+	Reason string `json:"reason"`
+}
+
+// requireCA возвращает CA или отвечает 503, если встроенный CA не настроен
+func (api *APIServer) requireCA(c *gin.Context) *CertificateAuthority {
+	if api.server.CA == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Certificate authority is not configured"})
+		return nil
+	}
+	return api.server.CA
+}
+
+// writeCAError отвечает статусом, соответствующим ошибке CA
+func writeCAError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrCertificateNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrPrivateKeyNotHeld):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, common.ErrInvalidConfig):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// issueCertificate выпускает новый клиентский сертификат
+func (api *APIServer) issueCertificate(c *gin.Context) {
+	ca := api.requireCA(c)
+	if ca == nil {
+		return
+	}
+
+	var req IssueRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	issued, err := ca.Issue(req, c.ClientIP())
+	if err != nil {
+		writeCAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, issued.Info())
+}
+
+// listCertificates возвращает список выпущенных сертификатов
+func (api *APIServer) listCertificates(c *gin.Context) {
+	ca := api.requireCA(c)
+	if ca == nil {
+		return
+	}
+
+	issued := ca.List()
+	certificates := make([]CertificateInfo, 0, len(issued))
+	for _, cert := range issued {
+		certificates = append(certificates, cert.Info())
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"certificates": certificates,
+		"total":        len(certificates),
+	})
+}
+
+// getCertificate возвращает информацию о выпущенном сертификате
+func (api *APIServer) getCertificate(c *gin.Context) {
+	ca := api.requireCA(c)
+	if ca == nil {
+		return
+	}
+
+	issued, err := ca.Get(c.Param("serial"))
+	if err != nil {
+		writeCAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, issued.Info())
+}
+
+// downloadCertificate отдает сертификат в формате PEM (по умолчанию) или PKCS#12.
+// Пароль PKCS#12 передается в заголовке X-PKCS12-Password, чтобы не попадать в логи запросов.
+func (api *APIServer) downloadCertificate(c *gin.Context) {
+	ca := api.requireCA(c)
+	if ca == nil {
+		return
+	}
+
+	serial := c.Param("serial")
+	switch format := c.DefaultQuery("format", "pem"); format {
+	case "pem":
+		data, err := ca.ExportPEM(serial, c.ClientIP())
+		if err != nil {
+			writeCAError(c, err)
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pem"`, serial))
+		c.Data(http.StatusOK, "application/x-pem-file", data)
+	case "p12", "pkcs12":
+		data, err := ca.ExportPKCS12(serial, c.GetHeader("X-PKCS12-Password"), c.ClientIP())
+		if err != nil {
+			writeCAError(c, err)
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.p12"`, serial))
+		c.Data(http.StatusOK, "application/x-pkcs12", data)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format: " + format})
+	}
+}
+
+// revokeCertificate отзывает сертификат и разрывает сессии, установленные с ним
+func (api *APIServer) revokeCertificate(c *gin.Context) {
+	ca := api.requireCA(c)
+	if ca == nil {
+		return
+	}
+
+	var req RevokeRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+	}
+
+	issued, err := ca.Revoke(c.Param("serial"), req.Reason, c.ClientIP())
+	if err != nil {
+		writeCAError(c, err)
+		return
+	}
+
+	if n := api.server.DisconnectCertificate(issued.Serial); n > 0 {
+		api.logger.Info("Closed sessions using revoked certificate", zap.String("cert_serial", issued.Serial), zap.Int("sessions", n))
+	}
+
+	// Остальные узлы кластера отклоняют сертификат и закрывают его сессии; повторный отзыв
+	// снова передает его кластеру
+	if err := api.server.shareRevocation(issued.Serial); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Certificate revoked on this node only: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, issued.Info())
+}
+
+// getCRL отдает список отзыва сертификатов в формате DER
+func (api *APIServer) getCRL(c *gin.Context) {
+	ca := api.requireCA(c)
+	if ca == nil {
+		return
+	}
+
+	crl, err := ca.CRL()
+	if err != nil {
+		writeCAError(c, err)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/pkix-crl", crl)
+}
+
+// getCACertificate отдает сертификат CA в формате PEM
+func (api *APIServer) getCACertificate(c *gin.Context) {
+	ca := api.requireCA(c)
+	if ca == nil {
+		return
+	}
+
+	c.Data(http.StatusOK, "application/x-pem-file", ca.CACertPEM())
+}
+
+// getAuditLog возвращает последние события журнала аудита
+func (api *APIServer) getAuditLog(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	events := api.server.Audit.List(limit)
+	c.JSON(http.StatusOK, gin.H{
+		"events": events,
+		"total":  len(events),
+	})
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// newTestCAConfig создает самоподписанный CA и возвращает конфигурацию сервера с ним
+func newTestCAConfig(t *testing.T, storeDir string) common.ServerConfig {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test-CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return common.ServerConfig{
+		CACertPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		CAKeyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		CA:        common.CAConfig{StoreDir: storeDir},
+	}
+}
+
+func parseIssued(t *testing.T, issued *IssuedCertificate) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode([]byte(issued.CertPEM))
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestCertificateAuthority_Issue(t *testing.T) {
+	audit, err := NewAuditLog("", zap.NewNop())
+	require.NoError(t, err)
+	ca, err := NewCertificateAuthority(newTestCAConfig(t, ""), audit, zap.NewNop())
+	require.NoError(t, err)
+
+	issued, err := ca.Issue(IssueRequest{
+		CommonName:     "alice",
+		EmailAddresses: []string{"alice@example.com"},
+		URIs:           []string{"spiffe://example.com/user/alice"},
+		Groups:         []string{"engineering", "admins"},
+		ValidityDays:   30,
+	}, "tester")
+	require.NoError(t, err)
+
+	cert := parseIssued(t, issued)
+	assert.Equal(t, "alice", cert.Subject.CommonName)
+	assert.Equal(t, []string{"alice@example.com"}, cert.EmailAddresses)
+	require.Len(t, cert.URIs, 1)
+	assert.Equal(t, "spiffe://example.com/user/alice", cert.URIs[0].String())
+	assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, cert.ExtKeyUsage)
+	assert.WithinDuration(t, time.Now().Add(30*24*time.Hour), cert.NotAfter, time.Minute)
+
+	var groups []string
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(OIDClientGroups) {
+			_, err := asn1.Unmarshal(ext.Value, &groups)
+			require.NoError(t, err)
+		}
+	}
+	assert.Equal(t, []string{"engineering", "admins"}, groups)
+
+	// Сертификат должен проверяться цепочкой CA
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	assert.NoError(t, err)
+
+	events := audit.List(0)
+	require.Len(t, events, 1)
+	assert.Equal(t, "certificate.issue", events[0].Action)
+	assert.Equal(t, issued.Serial, events[0].Subject)
+	assert.Equal(t, "tester", events[0].Actor)
+}
+
+func TestCertificateAuthority_IssueValidation(t *testing.T) {
+	config := newTestCAConfig(t, "")
+	config.CA.MaxValidityDays = 90
+	ca, err := NewCertificateAuthority(config, nil, zap.NewNop())
+	require.NoError(t, err)
+
+	_, err = ca.Issue(IssueRequest{}, "tester")
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+
+	_, err = ca.Issue(IssueRequest{CommonName: "bob", ValidityDays: 365}, "tester")
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+
+	_, err = ca.Issue(IssueRequest{CommonName: "bob", IPAddresses: []string{"not-an-ip"}}, "tester")
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+}
+
+func TestCertificateAuthority_RevokeAndCRL(t *testing.T) {
+	ca, err := NewCertificateAuthority(newTestCAConfig(t, ""), nil, zap.NewNop())
+	require.NoError(t, err)
+
+	issued, err := ca.Issue(IssueRequest{CommonName: "carol"}, "tester")
+	require.NoError(t, err)
+	cert := parseIssued(t, issued)
+	assert.False(t, ca.IsRevoked(cert.SerialNumber))
+
+	revoked, err := ca.Revoke(issued.Serial, "lost laptop", "tester")
+	require.NoError(t, err)
+	assert.True(t, ca.IsRevoked(cert.SerialNumber))
+	assert.Equal(t, "revoked", revoked.Info().Status)
+	// Выданные ранее записи - копии, отзыв их не меняет
+	assert.Equal(t, "valid", issued.Info().Status)
+
+	der, err := ca.CRL()
+	require.NoError(t, err)
+	crl, err := x509.ParseRevocationList(der)
+	require.NoError(t, err)
+	require.NoError(t, crl.CheckSignatureFrom(ca.cert))
+	require.Len(t, crl.RevokedCertificateEntries, 1)
+	assert.Equal(t, 0, crl.RevokedCertificateEntries[0].SerialNumber.Cmp(cert.SerialNumber))
+
+	_, err = ca.Revoke("deadbeef", "", "tester")
+	assert.ErrorIs(t, err, ErrCertificateNotFound)
+}
+
+func TestCertificateAuthority_ConcurrentRevoke(t *testing.T) {
+	ca, err := NewCertificateAuthority(newTestCAConfig(t, ""), nil, zap.NewNop())
+	require.NoError(t, err)
+
+	issued, err := ca.Issue(IssueRequest{CommonName: "dave"}, "tester")
+	require.NoError(t, err)
+	cert := parseIssued(t, issued)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	// Запускается с -race: чтение записей не должно пересекаться с отзывом
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		_, err := ca.Revoke(issued.Serial, "lost", "tester")
+		assert.NoError(t, err)
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if current, err := ca.Get(issued.Serial); assert.NoError(t, err) {
+				_ = current.Info()
+			}
+			for _, listed := range ca.List() {
+				_ = listed.Info()
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// До отзыва продление удается, после - отклоняется
+		if _, err := ca.Renew(cert, key.Public(), "tester"); err != nil {
+			assert.ErrorIs(t, err, common.ErrAuthenticationFailed)
+		}
+	}()
+	wg.Wait()
+
+	current, err := ca.Get(issued.Serial)
+	require.NoError(t, err)
+	assert.True(t, current.Revoked)
+}
+
+func TestCertificateAuthority_ExportPKCS12(t *testing.T) {
+	ca, err := NewCertificateAuthority(newTestCAConfig(t, ""), nil, zap.NewNop())
+	require.NoError(t, err)
+
+	issued, err := ca.Issue(IssueRequest{CommonName: "dave"}, "tester")
+	require.NoError(t, err)
+
+	data, err := ca.ExportPKCS12(issued.Serial, "secret", "tester")
+	require.NoError(t, err)
+
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, "secret")
+	require.NoError(t, err)
+	assert.NotNil(t, key)
+	assert.Equal(t, "dave", cert.Subject.CommonName)
+	require.Len(t, caCerts, 1)
+	assert.Equal(t, "Test-CA", caCerts[0].Subject.CommonName)
+}
+
+func TestCertificateAuthority_Persistence(t *testing.T) {
+	config := newTestCAConfig(t, t.TempDir())
+
+	ca, err := NewCertificateAuthority(config, nil, zap.NewNop())
+	require.NoError(t, err)
+	issued, err := ca.Issue(IssueRequest{CommonName: "erin"}, "tester")
+	require.NoError(t, err)
+	_, err = ca.Revoke(issued.Serial, "rotated", "tester")
+	require.NoError(t, err)
+
+	reloaded, err := NewCertificateAuthority(config, nil, zap.NewNop())
+	require.NoError(t, err)
+	stored, err := reloaded.Get(issued.Serial)
+	require.NoError(t, err)
+	assert.Equal(t, "erin", stored.CommonName)
+	assert.True(t, stored.Revoked)
+	assert.Equal(t, "rotated", stored.RevokeReason)
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+// ErrClusterUnavailable команда не применена: нет лидера или кворума
+var ErrClusterUnavailable = errors.New("cluster unavailable")
+
+// clusterApplyTimeout ограничивает ожидание применения команды кластером
+const clusterApplyTimeout = 5 * time.Second
+
+// defaultLeaseTTL время жизни аренды, которую узел перестал продлевать
+const defaultLeaseTTL = 60 * time.Second
+
+// Lease аренда адреса VPN сети сессией клиента на одном из узлов кластера
+type Lease struct {
+	SessionID     string     `json:"session_id"`
+	Addr          netip.Addr `json:"addr"`
+	Node          string     `json:"node"`
+	Incarnation   string     `json:"incarnation"` // запуск узла, выдавшего аренду
+	Generation    uint64     `json:"generation"`  // индекс команды, выдавшей аренду; меняется при каждом подключении
+	User          string     `json:"user"`
+	Device        string     `json:"device"`
+	Groups        []string   `json:"groups,omitempty"`
+	CertSerial    string     `json:"cert_serial"`
+	StartedAt     time.Time  `json:"started_at"`
+	RenewedAt     time.Time  `json:"renewed_at"`
+	BytesSent     int64      `json:"bytes_sent"`
+	BytesReceived int64      `json:"bytes_received"`
+}
+
+// LeaseUsage счетчики трафика сессии, с которыми узел продлевает ее аренду
+type LeaseUsage struct {
+	Generation    uint64 `json:"generation"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+}
+
+// ClusterMember узел из конфигурации кластера
+type ClusterMember struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// ClusterStatus состояние узла кластера для API
+type ClusterStatus struct {
+	NodeID  string          `json:"node_id"`
+	State   string          `json:"state"`
+	Leader  string          `json:"leader"`
+	Members []ClusterMember `json:"members"`
+	Leases  int             `json:"leases"`
+}
+
+// StateBackend состояние, общее для узлов кластера: аренды адресов (они же
+// список клиентов всех узлов), отозванные сертификаты и ограничения полосы,
+// заданные через API. Изменения применяются всеми узлами; чтение локальное и
+// может немного отставать.
+type StateBackend interface {
+	// NodeID возвращает имя этого узла
+	NodeID() string
+	// Acquire выдает адрес сессии lease.SessionID. Сессия, уже имеющая аренду
+	// на этом или другом узле, сохраняет адрес и переходит на этот узел.
+	Acquire(ctx context.Context, lease Lease) (Lease, error)
+	// Release освобождает аренду сессии, если ее поколение равно generation; 0 - любое
+	Release(ctx context.Context, sessionID string, generation uint64) error
+	// Report продлевает аренды сессий этого узла и обновляет их счетчики
+	Report(ctx context.Context, usage map[string]LeaseUsage) error
+	// Leases возвращает аренды всех узлов
+	Leases() []Lease
+	// Revoke добавляет сертификат в общий список отзыва
+	Revoke(ctx context.Context, serial string) error
+	// IsRevoked проверяет сертификат по общему списку отзыва
+	IsRevoked(serial string) bool
+	// SetRateLimit задает (limit != nil) или удаляет ограничение полосы для ключа сессии или пользователя
+	SetRateLimit(ctx context.Context, id string, limit *common.RateLimit) error
+	// RateLimits возвращает ограничения полосы, заданные через API
+	RateLimits() map[string]common.RateLimit
+	// Changes сигнализирует об изменении состояния; несколько изменений могут дать один сигнал
+	Changes() <-chan struct{}
+	// Status описывает узел и кластер
+	Status() ClusterStatus
+	Close() error
+}
+
+// clusterLeaseTTL время жизни аренды из конфигурации
+func clusterLeaseTTL(config common.ClusterConfig) time.Duration {
+	if config.LeaseTTLSeconds > 0 {
+		return time.Duration(config.LeaseTTLSeconds) * time.Second
+	}
+	return defaultLeaseTTL
+}
+
+// runCluster продлевает аренды локальных сессий и применяет изменения общего состояния.
+// Узел, который дольше времени жизни аренды не может ее продлить, отключает свои сессии:
+// их адреса уже могут быть выданы другими узлами.
+func (s *Server) runCluster(done <-chan struct{}) {
+	leaseTTL := clusterLeaseTTL(s.Config.Cluster)
+	ticker := time.NewTicker(leaseTTL / 4)
+	defer ticker.Stop()
+
+	s.syncClusterState()
+	lastRenewal := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.State.Changes():
+			s.syncClusterState()
+			continue
+		case <-ticker.C:
+		}
+
+		if err := s.reportLeases(); err != nil {
+			s.Logger.Warn("Failed to renew cluster leases", zap.Error(err))
+			if time.Since(lastRenewal) > leaseTTL {
+				if n := s.closeLocalSessions(); n > 0 {
+					s.Logger.Error("Closed sessions: leases could not be renewed",
+						zap.Int("sessions", n), zap.Duration("lease_ttl", leaseTTL))
+				}
+			}
+			continue
+		}
+		lastRenewal = time.Now()
+	}
+}
+
+// reportLeases продлевает аренды активных сессий узла
+func (s *Server) reportLeases() error {
+	s.IPPoolMu.RLock()
+	usage := make(map[string]LeaseUsage, len(s.IPConnMap))
+	for _, session := range s.IPConnMap {
+		usage[session.ID] = LeaseUsage{
+			Generation:    session.LeaseGeneration,
+			BytesSent:     session.BytesSent.Load(),
+			BytesReceived: session.BytesReceived.Load(),
+		}
+	}
+	s.IPPoolMu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterApplyTimeout)
+	defer cancel()
+	return s.State.Report(ctx, usage)
+}
+
+// syncClusterState применяет общее состояние к узлу: ограничения полосы из API и
+// отключение сессий, аренда которых освобождена, перешла на другой узел или чей
+// сертификат отозван
+func (s *Server) syncClusterState() {
+	s.Shaping.ReplaceOverrides(s.State.RateLimits())
+	s.applyRateLimits()
+
+	leases := make(map[string]Lease)
+	for _, lease := range s.State.Leases() {
+		leases[lease.SessionID] = lease
+	}
+
+	s.IPPoolMu.RLock()
+	var stale []*ClientSession
+	for _, session := range s.IPConnMap {
+		lease, ok := leases[session.ID]
+		if !ok || lease.Generation != session.LeaseGeneration || s.State.IsRevoked(session.CertSerial) {
+			stale = append(stale, session)
+		}
+	}
+	s.IPPoolMu.RUnlock()
+
+	// Закрытие соединения завершает прокси-горутины, они сами очищают сессию
+	for _, session := range stale {
+		s.sessionLogger(session).Info("Closing session: lease released or moved by the cluster")
+		if session.Conn != nil {
+			session.Conn.Close()
+		}
+	}
+}
+
+// closeLocalSessions закрывает все активные сессии узла
+func (s *Server) closeLocalSessions() int {
+	s.IPPoolMu.RLock()
+	sessions := make([]*ClientSession, 0, len(s.IPConnMap))
+	for _, session := range s.IPConnMap {
+		sessions = append(sessions, session)
+	}
+	s.IPPoolMu.RUnlock()
+
+	for _, session := range sessions {
+		if session.Conn != nil {
+			session.Conn.Close()
+		}
+	}
+	return len(sessions)
+}
+
+// acquireLease выдает адрес сессии через общее состояние кластера
+func (s *Server) acquireLease(session *ClientSession) (netip.Prefix, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterApplyTimeout)
+	defer cancel()
+	lease, err := s.State.Acquire(ctx, Lease{
+		SessionID:  session.ID,
+		User:       session.Identity.User,
+		Device:     session.Identity.Device,
+		Groups:     session.Identity.Groups,
+		CertSerial: session.CertSerial,
+		StartedAt:  session.StartedAt,
+	})
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	session.LeaseGeneration = lease.Generation
+	return netip.PrefixFrom(lease.Addr, lease.Addr.BitLen()), nil
+}
+
+// releaseLease освобождает аренду сессии; ошибка не фатальна - аренда истечет сама
+func (s *Server) releaseLease(sessionID string, generation uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterApplyTimeout)
+	defer cancel()
+	if err := s.State.Release(ctx, sessionID, generation); err != nil {
+		s.Logger.Warn("Failed to release cluster lease", zap.String("client_id", sessionID), zap.Error(err))
+	}
+}
+
+// remoteSessions возвращает сессии пользователя на других узлах кластера;
+// у них нет соединения, только поля аренды
+func (s *Server) remoteSessions(user string) []*ClientSession {
+	if s.State == nil {
+		return nil
+	}
+	var sessions []*ClientSession
+	for _, lease := range s.State.Leases() {
+		if lease.Node != s.State.NodeID() && lease.User == user {
+			sessions = append(sessions, remoteSession(lease))
+		}
+	}
+	return sessions
+}
+
+// remoteSession описывает аренду другого узла как сессию без соединения
+func remoteSession(lease Lease) *ClientSession {
+	return &ClientSession{
+		ID:              lease.SessionID,
+		AssignedIP:      lease.Addr,
+		StartedAt:       lease.StartedAt,
+		CertSerial:      lease.CertSerial,
+		Identity:        ClientIdentity{User: lease.User, Device: lease.Device, Groups: lease.Groups, Serial: lease.CertSerial},
+		Node:            lease.Node,
+		LeaseGeneration: lease.Generation,
+	}
+}
+
+// shareRevocation добавляет отозванный сертификат в общий список отзыва
+func (s *Server) shareRevocation(serial string) error {
+	if s.State == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterApplyTimeout)
+	defer cancel()
+	return s.State.Revoke(ctx, serial)
+}
+
+// shareRateLimit передает ограничение полосы из API остальным узлам; nil - удаление
+func (s *Server) shareRateLimit(id string, limit *common.RateLimit) error {
+	if s.State == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterApplyTimeout)
+	defer cancel()
+	return s.State.SetRateLimit(ctx, id, limit)
+}
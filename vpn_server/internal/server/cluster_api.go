@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getClusterStatus возвращает состояние узла и состав кластера
+func (api *APIServer) getClusterStatus(c *gin.Context) {
+	if api.server.State == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Clustering is not enabled"})
+		return
+	}
+	c.JSON(http.StatusOK, api.server.State.Status())
+}
+
+// remoteLeases возвращает аренды сессий других узлов кластера
+func (api *APIServer) remoteLeases() []Lease {
+	if api.server.State == nil {
+		return nil
+	}
+	var leases []Lease
+	for _, lease := range api.server.State.Leases() {
+		if lease.Node != api.server.State.NodeID() {
+			leases = append(leases, lease)
+		}
+	}
+	return leases
+}
+
+// remoteClientInfo описывает сессию другого узла по ее аренде; счетчики
+// трафика - на момент последнего продления аренды
+func remoteClientInfo(lease Lease) ClientInfo {
+	return ClientInfo{
+		ID:          lease.SessionID,
+		User:        lease.User,
+		Device:      lease.Device,
+		Groups:      lease.Groups,
+		AssignedIP:  lease.Addr.String(),
+		ConnectedAt: lease.StartedAt,
+		BytesSent:   lease.BytesSent,
+		BytesRecv:   lease.BytesReceived,
+		Status:      "connected",
+		Node:        lease.Node,
+	}
+}
@@ -0,0 +1,687 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+// Команды, реплицируемые через журнал Raft
+const (
+	clusterCmdAcquire      = "acquire"
+	clusterCmdRelease      = "release"
+	clusterCmdReport       = "report"
+	clusterCmdExpire       = "expire"
+	clusterCmdResetNode    = "reset_node"
+	clusterCmdRevoke       = "revoke"
+	clusterCmdSetRateLimit = "set_rate_limit"
+)
+
+// clusterCommand запись журнала Raft. Время задает узел, предложивший команду,
+// чтобы все узлы применили ее одинаково.
+type clusterCommand struct {
+	Type        string                `json:"type"`
+	Time        time.Time             `json:"time"`
+	Node        string                `json:"node,omitempty"`
+	Incarnation string                `json:"incarnation,omitempty"`
+	Lease       *Lease                `json:"lease,omitempty"`
+	SessionID   string                `json:"session_id,omitempty"`
+	Generation  uint64                `json:"generation,omitempty"`
+	Usage       map[string]LeaseUsage `json:"usage,omitempty"`
+	Before      time.Time             `json:"before,omitempty"`
+	Serial      string                `json:"serial,omitempty"`
+	Key         string                `json:"key,omitempty"`
+	RateLimit   *common.RateLimit     `json:"rate_limit,omitempty"`
+}
+
+// clusterResult результат применения команды
+type clusterResult struct {
+	Lease *Lease `json:"lease,omitempty"`
+	Err   string `json:"error,omitempty"`
+	Index uint64 `json:"index"` // индекс записи журнала с командой
+}
+
+// clusterData реплицируемое состояние
+type clusterData struct {
+	Leases     map[string]*Lease           `json:"leases"`  // ключ сессии -> аренда
+	Revoked    map[string]time.Time        `json:"revoked"` // серийный номер -> время отзыва
+	RateLimits map[string]common.RateLimit `json:"rate_limits"`
+}
+
+func newClusterData() clusterData {
+	return clusterData{
+		Leases:     make(map[string]*Lease),
+		Revoked:    make(map[string]time.Time),
+		RateLimits: make(map[string]common.RateLimit),
+	}
+}
+
+// clusterFSM конечный автомат Raft над clusterData. Адреса выдаются
+// детерминированно (наименьший свободный), поэтому все узлы приходят к
+// одинаковому состоянию.
+type clusterFSM struct {
+	pool    netip.Prefix
+	gateway netip.Addr
+
+	mu      sync.RWMutex
+	data    clusterData
+	changes chan struct{}
+}
+
+func newClusterFSM(pool netip.Prefix, gateway netip.Addr) *clusterFSM {
+	return &clusterFSM{
+		pool:    pool.Masked(),
+		gateway: gateway,
+		data:    newClusterData(),
+		changes: make(chan struct{}, 1),
+	}
+}
+
+// Apply применяет запись журнала
+func (f *clusterFSM) Apply(entry *raft.Log) interface{} {
+	var cmd clusterCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return clusterResult{Err: fmt.Sprintf("malformed cluster command: %v", err)}
+	}
+
+	f.mu.Lock()
+	result := f.applyLocked(cmd, entry.Index)
+	f.mu.Unlock()
+
+	select {
+	case f.changes <- struct{}{}:
+	default:
+	}
+	return result
+}
+
+func (f *clusterFSM) applyLocked(cmd clusterCommand, index uint64) clusterResult {
+	switch cmd.Type {
+	case clusterCmdAcquire:
+		if cmd.Lease == nil {
+			return clusterResult{Err: "acquire without lease"}
+		}
+		lease := *cmd.Lease
+		if existing, ok := f.data.Leases[lease.SessionID]; ok {
+			// Переподключение на этот или другой узел сохраняет адрес
+			lease.Addr = existing.Addr
+		} else {
+			addr, ok := f.freeAddrLocked()
+			if !ok {
+				return clusterResult{Err: "no available IP addresses"}
+			}
+			lease.Addr = addr
+		}
+		lease.Generation = index
+		lease.RenewedAt = cmd.Time
+		f.data.Leases[lease.SessionID] = &lease
+		return clusterResult{Lease: &lease}
+
+	case clusterCmdRelease:
+		if lease, ok := f.data.Leases[cmd.SessionID]; ok && (cmd.Generation == 0 || lease.Generation == cmd.Generation) {
+			delete(f.data.Leases, cmd.SessionID)
+		}
+
+	case clusterCmdReport:
+		for sessionID, usage := range cmd.Usage {
+			lease, ok := f.data.Leases[sessionID]
+			if !ok || lease.Node != cmd.Node || lease.Generation != usage.Generation {
+				continue
+			}
+			lease.BytesSent = usage.BytesSent
+			lease.BytesReceived = usage.BytesReceived
+			lease.RenewedAt = cmd.Time
+		}
+
+	case clusterCmdExpire:
+		for sessionID, lease := range f.data.Leases {
+			if lease.RenewedAt.Before(cmd.Before) {
+				delete(f.data.Leases, sessionID)
+			}
+		}
+
+	case clusterCmdResetNode:
+		// Аренды прошлого запуска узла: их сессии оборвались вместе с процессом
+		for sessionID, lease := range f.data.Leases {
+			if lease.Node == cmd.Node && lease.Incarnation != cmd.Incarnation {
+				delete(f.data.Leases, sessionID)
+			}
+		}
+
+	case clusterCmdRevoke:
+		if _, ok := f.data.Revoked[cmd.Serial]; !ok {
+			f.data.Revoked[cmd.Serial] = cmd.Time
+		}
+
+	case clusterCmdSetRateLimit:
+		if cmd.RateLimit == nil {
+			delete(f.data.RateLimits, cmd.Key)
+		} else {
+			f.data.RateLimits[cmd.Key] = *cmd.RateLimit
+		}
+
+	default:
+		return clusterResult{Err: fmt.Sprintf("unknown cluster command %q", cmd.Type)}
+	}
+	return clusterResult{}
+}
+
+// freeAddrLocked возвращает наименьший свободный адрес пула, пропуская адрес сети и шлюз
+func (f *clusterFSM) freeAddrLocked() (netip.Addr, bool) {
+	used := make(map[netip.Addr]bool, len(f.data.Leases))
+	for _, lease := range f.data.Leases {
+		used[lease.Addr] = true
+	}
+	for addr := f.pool.Addr().Next(); addr.IsValid() && f.pool.Contains(addr); addr = addr.Next() {
+		if addr != f.gateway && !used[addr] {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// Snapshot сохраняет копию состояния для сжатия журнала
+func (f *clusterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	data, err := json.Marshal(f.data)
+	if err != nil {
+		return nil, err
+	}
+	return clusterSnapshot(data), nil
+}
+
+// Restore заменяет состояние снимком
+func (f *clusterFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	data := newClusterData()
+	if err := json.NewDecoder(snapshot).Decode(&data); err != nil {
+		return fmt.Errorf("malformed cluster snapshot: %w", err)
+	}
+
+	f.mu.Lock()
+	f.data = data
+	f.mu.Unlock()
+
+	select {
+	case f.changes <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// clusterSnapshot снимок состояния в JSON
+type clusterSnapshot []byte
+
+func (s clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s clusterSnapshot) Release() {}
+
+// clusterRetryInterval пауза перед повтором команды, не дошедшей до лидера
+const clusterRetryInterval = 100 * time.Millisecond
+
+// raftStorage журнал, постоянное состояние и снимки узла
+type raftStorage struct {
+	logs   raft.LogStore
+	stable raft.StableStore
+	snaps  raft.SnapshotStore
+	closer io.Closer // закрывается вместе с узлом; nil - нечего закрывать
+}
+
+// RaftState StateBackend на встроенном Raft. Узлы перечислены в конфигурации;
+// команды с последователей пересылаются лидеру по тому же транспорту.
+type RaftState struct {
+	nodeID      string
+	incarnation string
+	leaseTTL    time.Duration
+
+	raft    *raft.Raft
+	fsm     *clusterFSM
+	layer   *clusterStreamLayer
+	storage raftStorage
+	logger  *zap.Logger
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRaftState запускает узел кластера: mTLS транспорт на bind_addr, журнал в
+// data_dir. Пустой кластер создается со всеми узлами из peers.
+func NewRaftState(config common.ClusterConfig, pool netip.Prefix, gateway netip.Addr, logger *zap.Logger) (*RaftState, error) {
+	advertise, err := validateClusterConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.DataDir == "" {
+		return nil, fmt.Errorf("%w: cluster requires data_dir", common.ErrMissingConfig)
+	}
+	tlsConfig, err := loadClusterTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cluster data_dir: %w", err)
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(config.DataDir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cluster log: %w", err)
+	}
+	snaps, err := raft.NewFileSnapshotStore(config.DataDir, 2, raftLogWriter(logger))
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to open cluster snapshots: %w", err)
+	}
+
+	bindAddr := config.BindAddr
+	if bindAddr == "" {
+		bindAddr = advertise
+	}
+	ln, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to listen for cluster peers on %s: %w", bindAddr, err)
+	}
+
+	layer := newClusterStreamLayer(ln, advertise, tlsConfig, logger)
+	storage := raftStorage{logs: store, stable: store, snaps: snaps, closer: store}
+	state, err := startRaftState(config, newRaftConfig(config.NodeID, logger), pool, gateway, layer, storage, logger)
+	if err != nil {
+		layer.Close()
+		store.Close()
+		return nil, err
+	}
+	logger.Info("Cluster node listening for peers", zap.String("node", config.NodeID), zap.String("addr", bindAddr))
+	return state, nil
+}
+
+// validateClusterConfig проверяет список узлов и возвращает адрес этого узла
+func validateClusterConfig(config common.ClusterConfig) (string, error) {
+	if config.NodeID == "" {
+		return "", fmt.Errorf("%w: cluster requires node_id", common.ErrMissingConfig)
+	}
+	if config.LeaseTTLSeconds < 0 {
+		return "", fmt.Errorf("%w: negative cluster lease_ttl_seconds", common.ErrInvalidConfig)
+	}
+	var advertise string
+	seen := make(map[string]bool)
+	for _, peer := range config.Peers {
+		if peer.ID == "" || peer.Addr == "" {
+			return "", fmt.Errorf("%w: cluster peer needs id and addr", common.ErrInvalidConfig)
+		}
+		if seen[peer.ID] {
+			return "", fmt.Errorf("%w: duplicate cluster peer %s", common.ErrInvalidConfig, peer.ID)
+		}
+		seen[peer.ID] = true
+		if peer.ID == config.NodeID {
+			advertise = peer.Addr
+		}
+	}
+	if advertise == "" {
+		return "", fmt.Errorf("%w: node_id %s is not listed in cluster peers", common.ErrInvalidConfig, config.NodeID)
+	}
+	return advertise, nil
+}
+
+// newRaftConfig настройки Raft узла; журнал Raft пишется в журнал сервера
+func newRaftConfig(nodeID string, logger *zap.Logger) *raft.Config {
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(nodeID)
+	conf.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:        "raft",
+		Level:       hclog.Warn,
+		Output:      raftLogWriter(logger),
+		DisableTime: true,
+	})
+	return conf
+}
+
+// raftLogWriter направляет строки библиотеки Raft в журнал сервера
+func raftLogWriter(logger *zap.Logger) io.Writer {
+	return zap.NewStdLog(logger.Named("raft")).Writer()
+}
+
+// startRaftState создает кластер при первом запуске и запускает узел
+func startRaftState(config common.ClusterConfig, conf *raft.Config, pool netip.Prefix, gateway netip.Addr,
+	layer *clusterStreamLayer, storage raftStorage, logger *zap.Logger) (*RaftState, error) {
+	transport := raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+		Stream:  layer,
+		MaxPool: 3,
+		Timeout: 10 * time.Second,
+		Logger:  conf.Logger,
+	})
+
+	existing, err := raft.HasExistingState(storage.logs, storage.stable, storage.snaps)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster state: %w", err)
+	}
+	if !existing {
+		// Все узлы создают кластер с одинаковым составом, поэтому порядок запуска не важен
+		var servers []raft.Server
+		for _, peer := range config.Peers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(peer.ID), Address: raft.ServerAddress(peer.Addr)})
+		}
+		if err := raft.BootstrapCluster(conf, storage.logs, storage.stable, storage.snaps, transport,
+			raft.Configuration{Servers: servers}); err != nil {
+			return nil, fmt.Errorf("failed to bootstrap cluster: %w", err)
+		}
+	}
+
+	fsm := newClusterFSM(pool, gateway)
+	r, err := raft.NewRaft(conf, fsm, storage.logs, storage.stable, storage.snaps, transport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start cluster node: %w", err)
+	}
+
+	incarnation := make([]byte, 8)
+	rand.Read(incarnation)
+	s := &RaftState{
+		nodeID:      config.NodeID,
+		incarnation: hex.EncodeToString(incarnation),
+		leaseTTL:    clusterLeaseTTL(config),
+		raft:        r,
+		fsm:         fsm,
+		layer:       layer,
+		storage:     storage,
+		logger:      logger,
+		done:        make(chan struct{}),
+	}
+	layer.serve(s.handleForward)
+	go s.run()
+	return s, nil
+}
+
+// run освобождает аренды прошлого запуска узла, а на лидере - аренды, которые
+// не продлевались дольше их времени жизни
+func (s *RaftState) run() {
+	ticker := time.NewTicker(s.leaseTTL / 4)
+	defer ticker.Stop()
+
+	reset := false
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), clusterApplyTimeout)
+		if !reset {
+			_, err := s.apply(ctx, clusterCommand{Type: clusterCmdResetNode, Node: s.nodeID, Incarnation: s.incarnation})
+			reset = err == nil
+		}
+		if s.raft.State() == raft.Leader {
+			if _, err := s.apply(ctx, clusterCommand{Type: clusterCmdExpire, Before: time.Now().UTC().Add(-s.leaseTTL)}); err != nil {
+				s.logger.Warn("Failed to expire cluster leases", zap.Error(err))
+			}
+		}
+		cancel()
+
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// NodeID возвращает имя этого узла
+func (s *RaftState) NodeID() string {
+	return s.nodeID
+}
+
+// Acquire выдает адрес сессии
+func (s *RaftState) Acquire(ctx context.Context, lease Lease) (Lease, error) {
+	lease.Node = s.nodeID
+	lease.Incarnation = s.incarnation
+	result, err := s.apply(ctx, clusterCommand{Type: clusterCmdAcquire, Lease: &lease})
+	if err != nil {
+		return Lease{}, err
+	}
+	if result.Err != "" {
+		return Lease{}, fmt.Errorf("%w: %s", common.ErrIPAllocation, result.Err)
+	}
+	return *result.Lease, nil
+}
+
+// Release освобождает аренду сессии
+func (s *RaftState) Release(ctx context.Context, sessionID string, generation uint64) error {
+	_, err := s.apply(ctx, clusterCommand{Type: clusterCmdRelease, SessionID: sessionID, Generation: generation})
+	return err
+}
+
+// Report продлевает аренды сессий этого узла
+func (s *RaftState) Report(ctx context.Context, usage map[string]LeaseUsage) error {
+	_, err := s.apply(ctx, clusterCommand{Type: clusterCmdReport, Node: s.nodeID, Usage: usage})
+	return err
+}
+
+// Leases возвращает аренды всех узлов, упорядоченные по ключу сессии
+func (s *RaftState) Leases() []Lease {
+	s.fsm.mu.RLock()
+	leases := make([]Lease, 0, len(s.fsm.data.Leases))
+	for _, lease := range s.fsm.data.Leases {
+		leases = append(leases, *lease)
+	}
+	s.fsm.mu.RUnlock()
+
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].SessionID < leases[j].SessionID
+	})
+	return leases
+}
+
+// Revoke добавляет сертификат в общий список отзыва
+func (s *RaftState) Revoke(ctx context.Context, serial string) error {
+	_, err := s.apply(ctx, clusterCommand{Type: clusterCmdRevoke, Serial: normalizeSerial(serial)})
+	return err
+}
+
+// IsRevoked проверяет сертификат по общему списку отзыва
+func (s *RaftState) IsRevoked(serial string) bool {
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+	_, revoked := s.fsm.data.Revoked[normalizeSerial(serial)]
+	return revoked
+}
+
+// SetRateLimit задает или удаляет ограничение полосы из API
+func (s *RaftState) SetRateLimit(ctx context.Context, id string, limit *common.RateLimit) error {
+	_, err := s.apply(ctx, clusterCommand{Type: clusterCmdSetRateLimit, Key: id, RateLimit: limit})
+	return err
+}
+
+// RateLimits возвращает ограничения полосы, заданные через API
+func (s *RaftState) RateLimits() map[string]common.RateLimit {
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+	limits := make(map[string]common.RateLimit, len(s.fsm.data.RateLimits))
+	for id, limit := range s.fsm.data.RateLimits {
+		limits[id] = limit
+	}
+	return limits
+}
+
+// Changes сигнализирует о примененных командах
+func (s *RaftState) Changes() <-chan struct{} {
+	return s.fsm.changes
+}
+
+// Status описывает узел и состав кластера
+func (s *RaftState) Status() ClusterStatus {
+	_, leader := s.raft.LeaderWithID()
+	status := ClusterStatus{
+		NodeID: s.nodeID,
+		State:  s.raft.State().String(),
+		Leader: string(leader),
+	}
+	if future := s.raft.GetConfiguration(); future.Error() == nil {
+		for _, server := range future.Configuration().Servers {
+			status.Members = append(status.Members, ClusterMember{ID: string(server.ID), Addr: string(server.Address)})
+		}
+	}
+	s.fsm.mu.RLock()
+	status.Leases = len(s.fsm.data.Leases)
+	s.fsm.mu.RUnlock()
+	return status
+}
+
+// Close останавливает узел
+func (s *RaftState) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.raft.Shutdown().Error()
+		s.layer.Close()
+		if s.storage.closer != nil {
+			if closeErr := s.storage.closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+// apply применяет команду на лидере и ждет, пока ее применит этот узел: сессия,
+// получившая аренду, не должна оказаться без нее в локальном состоянии.
+// Команды идемпотентны, поэтому при смене лидера или потере связи с ним
+// команда повторяется до истечения ctx.
+func (s *RaftState) apply(ctx context.Context, cmd clusterCommand) (clusterResult, error) {
+	cmd.Time = time.Now().UTC()
+	for {
+		result, err := s.applyOnce(ctx, cmd)
+		if err == nil {
+			return result, s.waitApplied(ctx, result.Index)
+		}
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-s.done:
+			return result, err
+		case <-time.After(clusterRetryInterval):
+		}
+	}
+}
+
+// waitApplied ждет, пока этот узел применит запись журнала index
+func (s *RaftState) waitApplied(ctx context.Context, index uint64) error {
+	for s.raft.AppliedIndex() < index {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: command committed but not yet applied on node %s", ErrClusterUnavailable, s.nodeID)
+		case <-s.done:
+			return fmt.Errorf("%w: node %s stopped", ErrClusterUnavailable, s.nodeID)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// applyOnce применяет команду локально на лидере или пересылает ее лидеру
+func (s *RaftState) applyOnce(ctx context.Context, cmd clusterCommand) (clusterResult, error) {
+	if s.raft.State() == raft.Leader {
+		return s.applyLocal(ctx, cmd)
+	}
+	leaderAddr, _ := s.raft.LeaderWithID()
+	if leaderAddr == "" {
+		return clusterResult{}, fmt.Errorf("%w: no leader", ErrClusterUnavailable)
+	}
+	return s.forward(ctx, string(leaderAddr), cmd)
+}
+
+// applyLocal записывает команду в журнал; вызывается на лидере
+func (s *RaftState) applyLocal(ctx context.Context, cmd clusterCommand) (clusterResult, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return clusterResult{}, err
+	}
+	timeout := clusterApplyTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if timeout <= 0 {
+		return clusterResult{}, fmt.Errorf("%w: %v", ErrClusterUnavailable, context.DeadlineExceeded)
+	}
+	future := s.raft.Apply(data, timeout)
+	if err := future.Error(); err != nil {
+		return clusterResult{}, fmt.Errorf("%w: %v", ErrClusterUnavailable, err)
+	}
+	result := future.Response().(clusterResult)
+	result.Index = future.Index()
+	return result, nil
+}
+
+// clusterForwardResponse ответ лидера на пересланную команду
+type clusterForwardResponse struct {
+	Result clusterResult `json:"result"`
+	Err    string        `json:"error,omitempty"`
+}
+
+// forward пересылает команду лидеру
+func (s *RaftState) forward(ctx context.Context, leaderAddr string, cmd clusterCommand) (clusterResult, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(clusterApplyTimeout)
+	}
+	conn, err := s.layer.dial(leaderAddr, time.Until(deadline), clusterStreamForward)
+	if err != nil {
+		return clusterResult{}, fmt.Errorf("%w: cannot reach leader %s: %v", ErrClusterUnavailable, leaderAddr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if err := json.NewEncoder(conn).Encode(cmd); err != nil {
+		return clusterResult{}, fmt.Errorf("%w: %v", ErrClusterUnavailable, err)
+	}
+	var resp clusterForwardResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return clusterResult{}, fmt.Errorf("%w: no response from leader %s: %v", ErrClusterUnavailable, leaderAddr, err)
+	}
+	if resp.Err != "" {
+		return clusterResult{}, fmt.Errorf("%w: %s", ErrClusterUnavailable, resp.Err)
+	}
+	return resp.Result, nil
+}
+
+// handleForward применяет команду, пересланную последователем
+func (s *RaftState) handleForward(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clusterApplyTimeout + clusterHandshakeTimeout))
+
+	var cmd clusterCommand
+	if err := json.NewDecoder(conn).Decode(&cmd); err != nil {
+		return
+	}
+	var resp clusterForwardResponse
+	if s.raft.State() != raft.Leader {
+		resp.Err = "not the leader"
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), clusterApplyTimeout)
+		result, err := s.applyLocal(ctx, cmd)
+		cancel()
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		resp.Result = result
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Warn("Failed to answer forwarded cluster command", zap.Error(err))
+	}
+}
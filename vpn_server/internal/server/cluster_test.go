@@ -0,0 +1,465 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var testClusterPool = netip.MustParsePrefix("10.0.0.0/24")
+
+// testClusterCA выпускает сертификаты узлов кластера
+type testClusterCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestClusterCA(t *testing.T) *testClusterCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Cluster-CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testClusterCA{cert: cert, key: key, pool: pool}
+}
+
+// issue выпускает сертификат узла с DNS именами names
+func (ca *testClusterCA) issue(t *testing.T, names ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "node"},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTestCluster запускает n узлов в процессе: настоящий mTLS транспорт на
+// loopback, журнал в памяти и короткие таймауты Raft
+func newTestCluster(t *testing.T, n int) []*RaftState {
+	t.Helper()
+	ca := newTestClusterCA(t)
+
+	config := common.ClusterConfig{LeaseTTLSeconds: 60}
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[i] = ln
+		config.Peers = append(config.Peers, common.ClusterPeer{ID: fmt.Sprintf("node%d", i), Addr: ln.Addr().String()})
+	}
+
+	nodes := make([]*RaftState, n)
+	for i, ln := range listeners {
+		nodeConfig := config
+		nodeConfig.NodeID = config.Peers[i].ID
+		tlsConfig := newClusterTLSConfig(ca.issue(t, defaultClusterServerName), ca.pool, defaultClusterServerName)
+
+		conf := raft.DefaultConfig()
+		conf.LocalID = raft.ServerID(nodeConfig.NodeID)
+		conf.HeartbeatTimeout = 100 * time.Millisecond
+		conf.ElectionTimeout = 100 * time.Millisecond
+		conf.LeaderLeaseTimeout = 50 * time.Millisecond
+		conf.CommitTimeout = 5 * time.Millisecond
+		conf.Logger = hclog.New(&hclog.LoggerOptions{Name: nodeConfig.NodeID, Level: hclog.Error, Output: io.Discard})
+
+		store := raft.NewInmemStore()
+		node, err := startRaftState(nodeConfig, conf, testClusterPool, netip.MustParseAddr("10.0.0.1"),
+			newClusterStreamLayer(ln, config.Peers[i].Addr, tlsConfig, zap.NewNop()),
+			raftStorage{logs: store, stable: store, snaps: raft.NewInmemSnapshotStore()}, zap.NewNop())
+		require.NoError(t, err)
+		nodes[i] = node
+		t.Cleanup(func() { node.Close() })
+	}
+
+	require.Eventually(t, func() bool {
+		for _, node := range nodes {
+			if node.Status().Leader == "" {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 20*time.Millisecond, "cluster elected no leader")
+	return nodes
+}
+
+// follower возвращает узел, который не является лидером
+func follower(nodes []*RaftState) *RaftState {
+	for _, node := range nodes {
+		if node.raft.State() != raft.Leader {
+			return node
+		}
+	}
+	return nil
+}
+
+func TestClusterFSM_Leases(t *testing.T) {
+	fsm := newClusterFSM(testClusterPool, netip.MustParseAddr("10.0.0.1"))
+	index := uint64(0)
+	apply := func(cmd clusterCommand) clusterResult {
+		t.Helper()
+		index++
+		data, err := json.Marshal(cmd)
+		require.NoError(t, err)
+		return fsm.Apply(&raft.Log{Index: index, Data: data}).(clusterResult)
+	}
+	now := time.Now().UTC()
+
+	// Наименьший свободный адрес, шлюз пропускается
+	first := apply(clusterCommand{Type: clusterCmdAcquire, Time: now, Lease: &Lease{SessionID: "alice:laptop", Node: "a"}})
+	require.Empty(t, first.Err)
+	assert.Equal(t, netip.MustParseAddr("10.0.0.2"), first.Lease.Addr)
+	second := apply(clusterCommand{Type: clusterCmdAcquire, Time: now, Lease: &Lease{SessionID: "bob:phone", Node: "a"}})
+	assert.Equal(t, netip.MustParseAddr("10.0.0.3"), second.Lease.Addr)
+
+	// Переподключение на другой узел сохраняет адрес, поколение меняется
+	moved := apply(clusterCommand{Type: clusterCmdAcquire, Time: now, Lease: &Lease{SessionID: "alice:laptop", Node: "b"}})
+	assert.Equal(t, first.Lease.Addr, moved.Lease.Addr)
+	assert.Equal(t, "b", moved.Lease.Node)
+	assert.NotEqual(t, first.Lease.Generation, moved.Lease.Generation)
+
+	// Освобождение старого поколения не трогает новую аренду
+	apply(clusterCommand{Type: clusterCmdRelease, SessionID: "alice:laptop", Generation: first.Lease.Generation})
+	assert.Len(t, fsm.data.Leases, 2)
+	apply(clusterCommand{Type: clusterCmdRelease, SessionID: "alice:laptop", Generation: moved.Lease.Generation})
+	assert.Len(t, fsm.data.Leases, 1)
+
+	// Освобожденный адрес выдается снова
+	again := apply(clusterCommand{Type: clusterCmdAcquire, Time: now, Lease: &Lease{SessionID: "carol:laptop", Node: "a"}})
+	assert.Equal(t, netip.MustParseAddr("10.0.0.2"), again.Lease.Addr)
+
+	// Продленная аренда переживает истечение, непродленная - нет
+	later := now.Add(time.Minute)
+	apply(clusterCommand{Type: clusterCmdReport, Time: later, Node: "a", Usage: map[string]LeaseUsage{
+		"carol:laptop": {Generation: again.Lease.Generation, BytesSent: 100, BytesReceived: 200},
+	}})
+	apply(clusterCommand{Type: clusterCmdExpire, Before: later})
+	require.Len(t, fsm.data.Leases, 1)
+	assert.Equal(t, int64(100), fsm.data.Leases["carol:laptop"].BytesSent)
+
+	// Снимок восстанавливает то же состояние
+	snapshot, err := fsm.Snapshot()
+	require.NoError(t, err)
+	restored := newClusterFSM(testClusterPool, netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, restored.Restore(io.NopCloser(bytes.NewReader(snapshot.(clusterSnapshot)))))
+	assert.Equal(t, fsm.data, restored.data)
+}
+
+func TestClusterFSM_ResetNode(t *testing.T) {
+	fsm := newClusterFSM(testClusterPool, netip.MustParseAddr("10.0.0.1"))
+	fsm.data.Leases["old"] = &Lease{SessionID: "old", Node: "a", Incarnation: "1"}
+	fsm.data.Leases["current"] = &Lease{SessionID: "current", Node: "a", Incarnation: "2"}
+	fsm.data.Leases["other"] = &Lease{SessionID: "other", Node: "b", Incarnation: "1"}
+
+	data, err := json.Marshal(clusterCommand{Type: clusterCmdResetNode, Node: "a", Incarnation: "2"})
+	require.NoError(t, err)
+	fsm.Apply(&raft.Log{Index: 1, Data: data})
+
+	assert.NotContains(t, fsm.data.Leases, "old")
+	assert.Contains(t, fsm.data.Leases, "current")
+	assert.Contains(t, fsm.data.Leases, "other")
+}
+
+func TestRaftState_SharedState(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	ctx := context.Background()
+
+	// Аренды выдаются со всех узлов одновременно; последователи пересылают команды лидеру
+	var wg sync.WaitGroup
+	leases := make([]Lease, 12)
+	errs := make([]error, len(leases))
+	for i := range leases {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			leases[i], errs[i] = nodes[i%len(nodes)].Acquire(ctx, Lease{SessionID: fmt.Sprintf("user%d:laptop", i), User: fmt.Sprintf("user%d", i)})
+		}()
+	}
+	wg.Wait()
+
+	addrs := make(map[netip.Addr]bool)
+	for i, lease := range leases {
+		require.NoError(t, errs[i])
+		assert.Equal(t, nodes[i%len(nodes)].NodeID(), lease.Node)
+		assert.False(t, addrs[lease.Addr], "address %s leased twice", lease.Addr)
+		addrs[lease.Addr] = true
+	}
+	for _, node := range nodes {
+		require.Eventually(t, func() bool { return len(node.Leases()) == len(leases) }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// Сессия переходит на другой узел со своим адресом
+	moved, err := nodes[1].Acquire(ctx, Lease{SessionID: "user0:laptop", User: "user0"})
+	require.NoError(t, err)
+	assert.Equal(t, leases[0].Addr, moved.Addr)
+	assert.Equal(t, nodes[1].NodeID(), moved.Node)
+
+	// Отзыв и ограничения полосы с последователя видны на всех узлах
+	require.NoError(t, follower(nodes).Revoke(ctx, "0A:1B"))
+	limit := common.RateLimit{DownloadKbps: 512}
+	require.NoError(t, follower(nodes).SetRateLimit(ctx, "user1", &limit))
+	for _, node := range nodes {
+		require.Eventually(t, func() bool { return node.IsRevoked("a1b") }, 5*time.Second, 10*time.Millisecond)
+		require.Eventually(t, func() bool { return node.RateLimits()["user1"] == limit }, 5*time.Second, 10*time.Millisecond)
+		assert.False(t, node.IsRevoked("a1c"))
+	}
+	require.NoError(t, nodes[0].SetRateLimit(ctx, "user1", nil))
+	for _, node := range nodes {
+		require.Eventually(t, func() bool { return len(node.RateLimits()) == 0 }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	status := nodes[2].Status()
+	assert.Equal(t, "node2", status.NodeID)
+	assert.Len(t, status.Members, 3)
+	assert.NotEmpty(t, status.Leader)
+}
+
+func TestRaftState_NoQuorum(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	survivor := follower(nodes)
+	for _, node := range nodes {
+		if node != survivor {
+			node.Close()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := survivor.Acquire(ctx, Lease{SessionID: "alice:laptop"})
+	assert.ErrorIs(t, err, ErrClusterUnavailable)
+}
+
+func TestClusterStreamLayer_RejectsForeignCertificates(t *testing.T) {
+	ca := newTestClusterCA(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	layer := newClusterStreamLayer(ln, ln.Addr().String(),
+		newClusterTLSConfig(ca.issue(t, defaultClusterServerName), ca.pool, defaultClusterServerName), zap.NewNop())
+	forwarded := make(chan struct{}, 1)
+	layer.serve(func(conn net.Conn) {
+		forwarded <- struct{}{}
+		conn.Close()
+	})
+	defer layer.Close()
+
+	// Сертификат того же CA без имени кластера, например клиентский сертификат VPN
+	foreign := newClusterTLSConfig(ca.issue(t, "alice"), ca.pool, defaultClusterServerName)
+	foreign.VerifyConnection = nil
+	foreignConn, err := tls.Dial("tcp", ln.Addr().String(), foreign)
+	if err == nil {
+		foreignConn.Write([]byte{clusterStreamForward})
+		foreignConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = foreignConn.Read(make([]byte, 1))
+		foreignConn.Close()
+	}
+	assert.Error(t, err)
+	select {
+	case <-forwarded:
+		t.Fatal("connection with a foreign certificate was accepted")
+	default:
+	}
+
+	// Сертификат узла принимается
+	peer := newClusterStreamLayer(nil, "", newClusterTLSConfig(ca.issue(t, defaultClusterServerName), ca.pool, defaultClusterServerName), zap.NewNop())
+	conn, err := peer.dial(ln.Addr().String(), time.Second, clusterStreamForward)
+	require.NoError(t, err)
+	defer conn.Close()
+	select {
+	case <-forwarded:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection with a node certificate was not accepted")
+	}
+}
+
+// newTestClusterServer создает сервер, использующий узел кластера
+func newTestClusterServer(node *RaftState, config common.SessionConfig) *Server {
+	s := newTestSessionServer(config)
+	s.State = node
+	return s
+}
+
+func TestCluster_SessionsAcrossNodes(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	a := newTestClusterServer(nodes[0], common.SessionConfig{Policy: SessionPolicyReject})
+	b := newTestClusterServer(nodes[1], common.SessionConfig{Policy: SessionPolicyReject})
+
+	laptop, _, err := openTestSession(t, a, ClientIdentity{User: "alice", Device: "laptop"})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(nodes[1].Leases()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Политика считает сессии пользователя на всех узлах
+	_, _, err = openTestSession(t, b, ClientIdentity{User: "alice", Device: "phone"})
+	assert.ErrorIs(t, err, ErrSessionLimit)
+
+	// Другой пользователь на втором узле получает другой адрес
+	bob, _, err := openTestSession(t, b, ClientIdentity{User: "bob", Device: "phone"})
+	require.NoError(t, err)
+	assert.NotEqual(t, laptop.AssignedIP, bob.AssignedIP)
+
+	// Список клиентов любого узла содержит клиентов всех узлов
+	require.Eventually(t, func() bool { return len(nodes[1].Leases()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	api, err := NewAPIServer(b)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	api.router.ServeHTTP(rec, newAdminRequest(http.MethodGet, "/api/v1/clients", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Clients []ClientInfo `json:"clients"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	nodesByClient := make(map[string]string)
+	for _, client := range resp.Clients {
+		nodesByClient[client.ID] = client.Node
+	}
+	assert.Equal(t, map[string]string{laptop.ID: "node0", bob.ID: "node1"}, nodesByClient)
+
+	// Отключение доступно только администратору
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/v1/clients/alice", nil))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Len(t, nodes[1].Leases(), 2)
+
+	// Отключение через второй узел освобождает аренду первого
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, newAdminRequest(http.MethodDelete, "/api/v1/clients/alice", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	for _, node := range nodes {
+		require.Eventually(t, func() bool { return len(node.Leases()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// Теперь вторая сессия alice разрешена
+	_, _, err = openTestSession(t, b, ClientIdentity{User: "alice", Device: "phone"})
+	assert.NoError(t, err)
+}
+
+func TestCluster_ReplaceEvictsRemoteSession(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	a := newTestClusterServer(nodes[0], common.SessionConfig{Policy: SessionPolicyReplace})
+	b := newTestClusterServer(nodes[1], common.SessionConfig{Policy: SessionPolicyReplace})
+
+	old, _, err := openTestSession(t, a, ClientIdentity{User: "alice", Device: "laptop"})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(nodes[1].Leases()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	_, evicted, err := openTestSession(t, b, ClientIdentity{User: "alice", Device: "phone"})
+	require.NoError(t, err)
+	require.Len(t, evicted, 1)
+	assert.Equal(t, old.ID, evicted[0].ID)
+	assert.Equal(t, "node0", evicted[0].Node)
+
+	// Первый узел видит, что аренда его сессии освобождена
+	require.Eventually(t, func() bool {
+		for _, lease := range nodes[0].Leases() {
+			if lease.SessionID == old.ID {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// lockCheckingState отмечает записи в кластер, выполненные под IPPoolMu
+type lockCheckingState struct {
+	StateBackend
+	mu     *sync.RWMutex
+	locked atomic.Int32
+}
+
+func (s *lockCheckingState) check() {
+	if !s.mu.TryLock() {
+		s.locked.Add(1)
+		return
+	}
+	s.mu.Unlock()
+}
+
+func (s *lockCheckingState) Acquire(ctx context.Context, lease Lease) (Lease, error) {
+	s.check()
+	return s.StateBackend.Acquire(ctx, lease)
+}
+
+func (s *lockCheckingState) Release(ctx context.Context, sessionID string, generation uint64) error {
+	s.check()
+	return s.StateBackend.Release(ctx, sessionID, generation)
+}
+
+func TestCluster_LeasesAppliedOutsideSessionLock(t *testing.T) {
+	nodes := newTestCluster(t, 1)
+	s := newTestSessionServer(common.SessionConfig{Policy: SessionPolicyReplace})
+	state := &lockCheckingState{StateBackend: nodes[0], mu: &s.IPPoolMu}
+	s.State = state
+
+	first, _, err := openTestSession(t, s, ClientIdentity{User: "alice", Device: "laptop"})
+	require.NoError(t, err)
+	// Вытеснение старой сессии того же пользователя освобождает ее аренду
+	second, _, err := openTestSession(t, s, ClientIdentity{User: "alice", Device: "phone"})
+	require.NoError(t, err)
+	s.cleanupClientSession(second)
+
+	assert.NotEqual(t, first.ID, second.ID)
+	assert.Empty(t, nodes[0].Leases())
+	assert.Zero(t, state.locked.Load(), "cluster writes must not hold IPPoolMu")
+}
+
+func TestValidateClusterConfig(t *testing.T) {
+	peers := []common.ClusterPeer{{ID: "a", Addr: "10.1.0.1:7946"}, {ID: "b", Addr: "10.1.0.2:7946"}}
+
+	addr, err := validateClusterConfig(common.ClusterConfig{NodeID: "b", Peers: peers})
+	require.NoError(t, err)
+	assert.Equal(t, "10.1.0.2:7946", addr)
+
+	_, err = validateClusterConfig(common.ClusterConfig{NodeID: "c", Peers: peers})
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+	_, err = validateClusterConfig(common.ClusterConfig{Peers: peers})
+	assert.ErrorIs(t, err, common.ErrMissingConfig)
+	_, err = validateClusterConfig(common.ClusterConfig{NodeID: "a", Peers: append(peers, common.ClusterPeer{ID: "a", Addr: "x:1"})})
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+}
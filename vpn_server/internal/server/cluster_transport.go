@@ -0,0 +1,192 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+// Первый байт соединения между узлами выбирает его назначение
+const (
+	clusterStreamRaft    byte = 'R'
+	clusterStreamForward byte = 'F'
+)
+
+// clusterHandshakeTimeout ограничивает TLS рукопожатие и выбор назначения входящего соединения
+const clusterHandshakeTimeout = 10 * time.Second
+
+// defaultClusterServerName DNS имя в сертификатах узлов по умолчанию
+const defaultClusterServerName = "masque-vpn-cluster"
+
+// clusterAddr адрес узла, под которым его знают остальные узлы
+type clusterAddr string
+
+func (a clusterAddr) Network() string { return "tcp" }
+func (a clusterAddr) String() string  { return string(a) }
+
+// clusterStreamLayer транспорт узлов кластера поверх mTLS. Соединения Raft и
+// пересылки команд лидеру делят один порт и различаются первым байтом.
+type clusterStreamLayer struct {
+	ln        net.Listener
+	advertise clusterAddr
+	tlsConfig *tls.Config
+	logger    *zap.Logger
+
+	raftConns chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newClusterStreamLayer создает транспорт на слушающем сокете ln; соединения
+// принимаются после serve
+func newClusterStreamLayer(ln net.Listener, advertise string, tlsConfig *tls.Config, logger *zap.Logger) *clusterStreamLayer {
+	return &clusterStreamLayer{
+		ln:        ln,
+		advertise: clusterAddr(advertise),
+		tlsConfig: tlsConfig,
+		logger:    logger,
+		raftConns: make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+}
+
+// loadClusterTLSConfig загружает сертификат узла и CA узлов. Сертификат
+// другого узла должен содержать tls_server_name, поэтому клиентские
+// сертификаты VPN не подходят, даже если выпущены тем же CA.
+func loadClusterTLSConfig(config common.ClusterConfig) (*tls.Config, error) {
+	if config.CertFile == "" || config.KeyFile == "" || config.CAFile == "" {
+		return nil, fmt.Errorf("%w: cluster requires cert_file, key_file and ca_file", common.ErrMissingConfig)
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to load cluster node certificate: %v", common.ErrInvalidCertificate, err)
+	}
+	caPEM, err := os.ReadFile(config.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster CA file %s: %w", config.CAFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("%w: no certificates in cluster CA file %s", common.ErrInvalidCertificate, config.CAFile)
+	}
+	serverName := config.TLSServerName
+	if serverName == "" {
+		serverName = defaultClusterServerName
+	}
+	return newClusterTLSConfig(cert, pool, serverName), nil
+}
+
+// newClusterTLSConfig общая конфигурация TLS для входящих и исходящих соединений узла
+func newClusterTLSConfig(cert tls.Certificate, pool *x509.CertPool, serverName string) *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ServerName:   serverName,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("cluster peer presented no certificate")
+			}
+			return cs.PeerCertificates[0].VerifyHostname(serverName)
+		},
+	}
+}
+
+// serve принимает соединения: Raft получает их через Accept, пересылка
+// команд обрабатывается forward
+func (l *clusterStreamLayer) serve(forward func(net.Conn)) {
+	go func() {
+		for {
+			conn, err := l.ln.Accept()
+			if err != nil {
+				select {
+				case <-l.closed:
+				default:
+					l.logger.Error("Cluster transport stopped accepting connections", zap.Error(err))
+				}
+				return
+			}
+			go l.route(conn, forward)
+		}
+	}()
+}
+
+// route завершает рукопожатие и передает соединение по первому байту
+func (l *clusterStreamLayer) route(conn net.Conn, forward func(net.Conn)) {
+	tlsConn := tls.Server(conn, l.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(clusterHandshakeTimeout))
+	kind := make([]byte, 1)
+	if _, err := tlsConn.Read(kind); err != nil {
+		l.logger.Warn("Rejected cluster connection", zap.Stringer("remote_addr", conn.RemoteAddr()), zap.Error(err))
+		tlsConn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	switch kind[0] {
+	case clusterStreamRaft:
+		select {
+		case l.raftConns <- tlsConn:
+		case <-l.closed:
+			tlsConn.Close()
+		}
+	case clusterStreamForward:
+		forward(tlsConn)
+	default:
+		tlsConn.Close()
+	}
+}
+
+// Accept возвращает следующее входящее соединение Raft
+func (l *clusterStreamLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.raftConns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close закрывает слушающий сокет
+func (l *clusterStreamLayer) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.ln.Close()
+	})
+	return err
+}
+
+// Addr возвращает адрес узла для остальных узлов
+func (l *clusterStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+// Dial открывает соединение Raft к узлу
+func (l *clusterStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return l.dial(string(address), timeout, clusterStreamRaft)
+}
+
+// dial открывает соединение к узлу с назначением kind
+func (l *clusterStreamLayer) dial(address string, timeout time.Duration, kind byte) (net.Conn, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, l.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{kind}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// validateDNSConfig проверяет DNS серверы и домены поиска из секции [dns]
+func validateDNSConfig(config common.DNSConfig) error {
+	for _, server := range config.Servers {
+		if _, err := netip.ParseAddr(server); err != nil {
+			return fmt.Errorf("%w: dns.servers: %q is not an IP address", common.ErrInvalidConfig, server)
+		}
+	}
+	for _, domain := range config.SearchDomains {
+		if domain == "" || strings.ContainsAny(domain, ", \t") {
+			return fmt.Errorf("%w: dns.search_domains: invalid domain %q", common.ErrInvalidConfig, domain)
+		}
+	}
+	return nil
+}
+
+// setNetworkHeaders добавляет в ответ CONNECT-IP маршруты и DNS настройки для клиента
+func (s *Server) setNetworkHeaders(header http.Header) {
+	routes := append(append([]string(nil), s.Config.AdvertiseRoutes...), s.Config.AdvertiseRoutesv6...)
+	if len(routes) > 0 {
+		header.Set(common.RoutesHeader, common.FormatListHeader(routes))
+	}
+
+	// Встроенный DNS сервер используется, если серверы и домены поиска не заданы явно
+	servers, search := s.Config.DNS.Servers, s.Config.DNS.SearchDomains
+	if s.DNS != nil {
+		if len(servers) == 0 {
+			servers = []string{s.DNS.Addr().String()}
+		}
+		if len(search) == 0 {
+			search = []string{s.DNS.Zone()}
+		}
+	}
+	if len(servers) > 0 {
+		header.Set(common.DNSHeader, common.FormatListHeader(servers))
+	}
+	if len(search) > 0 {
+		header.Set(common.DNSSearchHeader, common.FormatListHeader(search))
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDNSConfig(t *testing.T) {
+	assert.NoError(t, validateDNSConfig(common.DNSConfig{
+		Servers:       []string{"10.0.0.1", "fd00::1"},
+		SearchDomains: []string{"corp.example.com"},
+	}))
+	assert.ErrorIs(t, validateDNSConfig(common.DNSConfig{Servers: []string{"dns.example.com"}}), common.ErrInvalidConfig)
+	assert.ErrorIs(t, validateDNSConfig(common.DNSConfig{SearchDomains: []string{"a.example, b.example"}}), common.ErrInvalidConfig)
+}
+
+func TestSetNetworkHeaders(t *testing.T) {
+	s := &Server{Config: common.ServerConfig{
+		AdvertiseRoutes:   []string{"10.99.0.0/24"},
+		AdvertiseRoutesv6: []string{"fd00:99::/64"},
+		DNS: common.DNSConfig{
+			Servers:       []string{"10.0.0.1"},
+			SearchDomains: []string{"corp.example.com", "example.com"},
+		},
+	}}
+	header := http.Header{}
+	s.setNetworkHeaders(header)
+	assert.Equal(t, "10.99.0.0/24, fd00:99::/64", header.Get(common.RoutesHeader))
+	assert.Equal(t, "10.0.0.1", header.Get(common.DNSHeader))
+	assert.Equal(t, []string{"corp.example.com", "example.com"}, common.ParseListHeader(header.Get(common.DNSSearchHeader)))
+
+	// Без настроек заголовки не добавляются
+	header = http.Header{}
+	(&Server{}).setNetworkHeaders(header)
+	assert.Empty(t, header)
+}
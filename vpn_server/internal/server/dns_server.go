@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSZone = "vpn.internal"
+	// dnsTTL TTL ответов о клиентах и статических записей: адреса клиентов меняются при переподключении
+	dnsTTL = 60
+	// dnsUpstreamTimeout время ожидания ответа вышестоящего сервера
+	dnsUpstreamTimeout = 3 * time.Second
+	// maxDNSMessage размер UDP сообщения DNS с EDNS0
+	maxDNSMessage = 4096
+)
+
+// resolvConfPath источник вышестоящих серверов по умолчанию; подменяется в тестах
+var resolvConfPath = "/etc/resolv.conf"
+
+// ClientLookup возвращает адреса клиента по его DNS метке (alice-laptop)
+type ClientLookup func(label string) []netip.Addr
+
+// DNSServer встроенный DNS сервер на адресе шлюза VPN сети. Отвечает на
+// <client-id>.<zone> по активным сессиям, на имена split-horizon зон из
+// конфигурации и пересылает остальные запросы вышестоящим серверам.
+type DNSServer struct {
+	addr      netip.Addr
+	zone      string // каноническое имя с точкой на конце: vpn.internal.
+	zones     map[string]dnsZone
+	upstreams []string
+	lookup    ClientLookup
+	logger    *zap.Logger
+
+	mu   sync.Mutex
+	conn net.PacketConn
+}
+
+// dnsZone split-horizon зона с каноническими именами записей
+type dnsZone struct {
+	records   map[string][]netip.Addr
+	upstreams []string
+}
+
+// NewDNSServer проверяет конфигурацию и создает DNS сервер для адреса addr
+func NewDNSServer(config common.DNSConfig, addr netip.Addr, lookup ClientLookup, logger *zap.Logger) (*DNSServer, error) {
+	zone := config.Zone
+	if zone == "" {
+		zone = defaultDNSZone
+	}
+	s := &DNSServer{
+		addr:   addr,
+		zone:   canonicalName(zone),
+		zones:  make(map[string]dnsZone),
+		lookup: lookup,
+		logger: logger,
+	}
+
+	var err error
+	if len(config.Upstreams) > 0 {
+		s.upstreams, err = parseUpstreams("dns.upstreams", config.Upstreams)
+	} else {
+		s.upstreams, err = systemUpstreams(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for name, zoneConfig := range config.Zones {
+		origin := canonicalName(name)
+		zone := dnsZone{records: make(map[string][]netip.Addr)}
+		for record, values := range zoneConfig.Records {
+			fqdn := origin
+			if record != "@" {
+				fqdn = canonicalName(record + "." + origin)
+			}
+			for _, value := range values {
+				ip, err := netip.ParseAddr(value)
+				if err != nil {
+					return nil, fmt.Errorf("%w: dns.zones.%s.records.%s: %q is not an IP address", common.ErrInvalidConfig, name, record, value)
+				}
+				zone.records[fqdn] = append(zone.records[fqdn], ip.Unmap())
+			}
+		}
+		if zone.upstreams, err = parseUpstreams("dns.zones."+name+".upstreams", zoneConfig.Upstreams); err != nil {
+			return nil, err
+		}
+		s.zones[origin] = zone
+	}
+	return s, nil
+}
+
+// Addr возвращает адрес, на котором отвечает сервер
+func (s *DNSServer) Addr() netip.Addr {
+	return s.addr
+}
+
+// Zone возвращает зону имен клиентов без точки на конце
+func (s *DNSServer) Zone() string {
+	return strings.TrimSuffix(s.zone, ".")
+}
+
+// Listen открывает UDP сокет на адресе шлюза, порт 53
+func (s *DNSServer) Listen() error {
+	conn, err := net.ListenPacket("udp", netip.AddrPortFrom(s.addr, 53).String())
+	if err != nil {
+		return fmt.Errorf("failed to listen for DNS on %s: %w", s.addr, err)
+	}
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	s.logger.Info("DNS server listening",
+		zap.Stringer("addr", netip.AddrPortFrom(s.addr, 53)),
+		zap.String("zone", s.Zone()),
+		zap.Strings("upstreams", s.upstreams))
+	return nil
+}
+
+// Serve обрабатывает запросы до закрытия сокета
+func (s *DNSServer) Serve() {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return
+	}
+
+	buf := make([]byte, maxDNSMessage)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("DNS server stopped", zap.Error(err))
+			}
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			response, err := s.handle(query)
+			if err != nil {
+				s.logger.Debug("Invalid DNS query", zap.Stringer("client", client), zap.Error(err))
+				return
+			}
+			if _, err := conn.WriteTo(response, client); err != nil {
+				s.logger.Warn("Failed to send DNS response", zap.Stringer("client", client), zap.Error(err))
+			}
+		}()
+	}
+}
+
+// Close останавливает сервер
+func (s *DNSServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// handle отвечает на один запрос
+func (s *DNSServer) handle(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, fmt.Errorf("malformed query: %w", err)
+	}
+	if header.Response {
+		return nil, errors.New("unexpected response message")
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return s.reply(header, nil, dnsmessage.RCodeFormatError, nil, false)
+	}
+	name := strings.ToLower(question.Name.String())
+
+	// Клиенты VPN: <client-id>.<zone>
+	if name == s.zone || strings.HasSuffix(name, "."+s.zone) {
+		label := strings.TrimSuffix(strings.TrimSuffix(name, s.zone), ".")
+		if label == "" {
+			return s.reply(header, &question, dnsmessage.RCodeSuccess, nil, true)
+		}
+		addrs := s.lookup(label)
+		if len(addrs) == 0 {
+			return s.reply(header, &question, dnsmessage.RCodeNameError, nil, true)
+		}
+		return s.reply(header, &question, dnsmessage.RCodeSuccess, addrs, true)
+	}
+
+	// Split-horizon зоны: побеждает самая длинная подходящая зона
+	if origin, zone, ok := s.matchZone(name); ok {
+		if addrs, found := zone.records[name]; found {
+			return s.reply(header, &question, dnsmessage.RCodeSuccess, addrs, true)
+		}
+		if len(zone.upstreams) == 0 {
+			rcode := dnsmessage.RCodeNameError
+			if name == origin {
+				rcode = dnsmessage.RCodeSuccess
+			}
+			return s.reply(header, &question, rcode, nil, true)
+		}
+		return s.forward(header, &question, query, zone.upstreams)
+	}
+
+	return s.forward(header, &question, query, s.upstreams)
+}
+
+// matchZone ищет split-horizon зону, которой принадлежит имя
+func (s *DNSServer) matchZone(name string) (string, dnsZone, bool) {
+	best := ""
+	for origin := range s.zones {
+		if (name == origin || strings.HasSuffix(name, "."+origin)) && len(origin) > len(best) {
+			best = origin
+		}
+	}
+	zone, ok := s.zones[best]
+	return best, zone, ok
+}
+
+// reply собирает ответ: для A и AAAA - записи подходящего семейства, для остальных типов - пустой ответ
+func (s *DNSServer) reply(query dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode, addrs []netip.Addr, authoritative bool) ([]byte, error) {
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		OpCode:             query.OpCode,
+		Authoritative:      authoritative,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.EnableCompression()
+	if question == nil {
+		return builder.Finish()
+	}
+
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(*question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+		switch {
+		case question.Type == dnsmessage.TypeA && addr.Is4():
+			if err := builder.AResource(resource, dnsmessage.AResource{A: addr.As4()}); err != nil {
+				return nil, err
+			}
+		case question.Type == dnsmessage.TypeAAAA && addr.Is6():
+			if err := builder.AAAAResource(resource, dnsmessage.AAAAResource{AAAA: addr.As16()}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return builder.Finish()
+}
+
+// forward пересылает запрос вышестоящим серверам по очереди; SERVFAIL, если ни один не ответил
+func (s *DNSServer) forward(header dnsmessage.Header, question *dnsmessage.Question, query []byte, upstreams []string) ([]byte, error) {
+	for _, upstream := range upstreams {
+		response, err := exchangeDNS(upstream, query)
+		if err == nil {
+			return response, nil
+		}
+		s.logger.Warn("DNS upstream failed",
+			zap.String("upstream", upstream), zap.String("name", question.Name.String()), zap.Error(err))
+	}
+	return s.reply(header, question, dnsmessage.RCodeServerFailure, nil, false)
+}
+
+// exchangeDNS отправляет запрос по UDP и ждет ответ с тем же ID
+func exchangeDNS(upstream string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", upstream, dnsUpstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsUpstreamTimeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSMessage)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ответы на чужие ID (например, запоздавшие) пропускаем
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// lookupClientName находит адреса активных сессий по DNS метке
+func (s *Server) lookupClientName(label string) []netip.Addr {
+	s.IPPoolMu.RLock()
+	defer s.IPPoolMu.RUnlock()
+
+	var addrs []netip.Addr
+	for sessionID, ip := range s.ClientIPMap {
+		if clientDNSLabel(sessionID) == label {
+			addrs = append(addrs, ip)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+	return addrs
+}
+
+// clientDNSLabel превращает ключ сессии (alice:laptop) в DNS метку (alice-laptop)
+func clientDNSLabel(sessionID string) string {
+	label := []byte(strings.ToLower(sessionID))
+	for i, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			label[i] = '-'
+		}
+	}
+	return strings.Trim(string(label), "-")
+}
+
+// canonicalName приводит имя к нижнему регистру с точкой на конце
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+// parseUpstreams проверяет адреса вышестоящих серверов; порт по умолчанию 53
+func parseUpstreams(option string, values []string) ([]string, error) {
+	upstreams := make([]string, 0, len(values))
+	for _, value := range values {
+		if addrPort, err := netip.ParseAddrPort(value); err == nil {
+			upstreams = append(upstreams, addrPort.String())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %q is not an IP address or IP:port", common.ErrInvalidConfig, option, value)
+		}
+		upstreams = append(upstreams, netip.AddrPortFrom(addr, 53).String())
+	}
+	return upstreams, nil
+}
+
+// systemUpstreams читает nameserver из resolv.conf хоста, пропуская собственный адрес
+func systemUpstreams(self netip.Addr) ([]string, error) {
+	file, err := os.Open(resolvConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: dns.upstreams not set and %s unreadable: %v", common.ErrInvalidConfig, resolvConfPath, err)
+	}
+	defer file.Close()
+
+	var upstreams []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		// Адрес IPv6 может содержать зону: fe80::1%eth0
+		addr, err := netip.ParseAddr(fields[1])
+		if err != nil || addr == self {
+			continue
+		}
+		upstreams = append(upstreams, netip.AddrPortFrom(addr, 53).String())
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("%w: dns.upstreams not set and no nameserver in %s", common.ErrInvalidConfig, resolvConfPath)
+	}
+	return upstreams, nil
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsQuery собирает запрос name/qtype
+func dnsQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x1234, RecursionDesired: true})
+	require.NoError(t, builder.StartQuestions())
+	require.NoError(t, builder.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}))
+	query, err := builder.Finish()
+	require.NoError(t, err)
+	return query
+}
+
+// dnsAnswer разбирает ответ: код и адреса из A/AAAA записей
+func dnsAnswer(t *testing.T, response []byte) (dnsmessage.RCode, []netip.Addr) {
+	t.Helper()
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(response))
+	assert.Equal(t, uint16(0x1234), msg.Header.ID)
+	var addrs []netip.Addr
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(body.A))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+		}
+	}
+	return msg.Header.RCode, addrs
+}
+
+// startTestUpstream отвечает на любой A запрос адресом 192.0.2.53
+func startTestUpstream(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxDNSMessage)
+		for {
+			n, client, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if msg.Unpack(buf[:n]) != nil {
+				continue
+			}
+			msg.Header.Response = true
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 30},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 53}},
+			}}
+			response, _ := msg.Pack()
+			conn.WriteTo(response, client)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func newTestDNSServer(t *testing.T, config common.DNSConfig) *DNSServer {
+	t.Helper()
+	s := newTestSessionServer(common.SessionConfig{})
+	s.ClientIPMap["alice:laptop"] = netip.MustParseAddr("10.0.0.2")
+	s.ClientIPMap["Bob"] = netip.MustParseAddr("10.0.0.3")
+
+	dnsServer, err := NewDNSServer(config, netip.MustParseAddr("10.0.0.1"), s.lookupClientName, zap.NewNop())
+	require.NoError(t, err)
+	return dnsServer
+}
+
+func TestDNSServer_ClientNames(t *testing.T) {
+	s := newTestDNSServer(t, common.DNSConfig{Upstreams: []string{startTestUpstream(t)}})
+
+	response, err := s.handle(dnsQuery(t, "alice-laptop.vpn.internal.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	rcode, addrs := dnsAnswer(t, response)
+	assert.Equal(t, dnsmessage.RCodeSuccess, rcode)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.2")}, addrs)
+
+	// Регистр имени не важен
+	response, err = s.handle(dnsQuery(t, "BOB.VPN.Internal.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	_, addrs = dnsAnswer(t, response)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.3")}, addrs)
+
+	// Клиент есть, но без IPv6 адреса: пустой ответ, а не NXDOMAIN
+	response, err = s.handle(dnsQuery(t, "alice-laptop.vpn.internal.", dnsmessage.TypeAAAA))
+	require.NoError(t, err)
+	rcode, addrs = dnsAnswer(t, response)
+	assert.Equal(t, dnsmessage.RCodeSuccess, rcode)
+	assert.Empty(t, addrs)
+
+	response, err = s.handle(dnsQuery(t, "carol.vpn.internal.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	rcode, _ = dnsAnswer(t, response)
+	assert.Equal(t, dnsmessage.RCodeNameError, rcode)
+
+	// Остальные имена пересылаются вышестоящему серверу
+	response, err = s.handle(dnsQuery(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	_, addrs = dnsAnswer(t, response)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.53")}, addrs)
+}
+
+func TestDNSServer_SplitHorizon(t *testing.T) {
+	upstream := startTestUpstream(t)
+	s := newTestDNSServer(t, common.DNSConfig{
+		Zone:      "corp.vpn",
+		Upstreams: []string{"127.0.0.1:1"},
+		Zones: map[string]common.DNSZone{
+			"example.com": {Records: map[string][]string{
+				"git": {"10.10.0.5", "fd00:10::5"},
+				"@":   {"10.10.0.1"},
+			}},
+			"lab.example.com": {Upstreams: []string{upstream}},
+		},
+	})
+
+	response, err := s.handle(dnsQuery(t, "git.example.com.", dnsmessage.TypeAAAA))
+	require.NoError(t, err)
+	_, addrs := dnsAnswer(t, response)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("fd00:10::5")}, addrs)
+
+	response, err = s.handle(dnsQuery(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	_, addrs = dnsAnswer(t, response)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.10.0.1")}, addrs)
+
+	// Неизвестное имя зоны без upstreams не уходит наружу
+	response, err = s.handle(dnsQuery(t, "www.example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	rcode, _ := dnsAnswer(t, response)
+	assert.Equal(t, dnsmessage.RCodeNameError, rcode)
+
+	// Более узкая зона пересылается своим серверам
+	response, err = s.handle(dnsQuery(t, "host.lab.example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	_, addrs = dnsAnswer(t, response)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.53")}, addrs)
+
+	// Своя зона клиентов
+	response, err = s.handle(dnsQuery(t, "alice-laptop.corp.vpn.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	_, addrs = dnsAnswer(t, response)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.2")}, addrs)
+}
+
+func TestDNSServer_UpstreamFailure(t *testing.T) {
+	// Порт 1 на localhost не отвечает: SERVFAIL
+	s := newTestDNSServer(t, common.DNSConfig{Upstreams: []string{"127.0.0.1:1"}})
+	response, err := s.handle(dnsQuery(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	rcode, _ := dnsAnswer(t, response)
+	assert.Equal(t, dnsmessage.RCodeServerFailure, rcode)
+}
+
+func TestNewDNSServer_Config(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(path, []byte("# comment\nnameserver 10.0.0.1\nnameserver 192.168.1.1\noptions edns0\n"), 0644))
+	previous := resolvConfPath
+	resolvConfPath = path
+	t.Cleanup(func() { resolvConfPath = previous })
+
+	// Собственный адрес не используется как upstream
+	s, err := NewDNSServer(common.DNSConfig{}, netip.MustParseAddr("10.0.0.1"), nil, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.168.1.1:53"}, s.upstreams)
+	assert.Equal(t, "vpn.internal", s.Zone())
+
+	_, err = NewDNSServer(common.DNSConfig{Upstreams: []string{"dns.example.com"}}, netip.MustParseAddr("10.0.0.1"), nil, zap.NewNop())
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+	_, err = NewDNSServer(common.DNSConfig{
+		Upstreams: []string{"1.1.1.1"},
+		Zones:     map[string]common.DNSZone{"example.com": {Records: map[string][]string{"git": {"nope"}}}},
+	}, netip.MustParseAddr("10.0.0.1"), nil, zap.NewNop())
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+}
+
+func TestClientDNSLabel(t *testing.T) {
+	assert.Equal(t, "alice-laptop", clientDNSLabel("alice:laptop"))
+	assert.Equal(t, "bob-example-com", clientDNSLabel("bob@example.com"))
+	assert.Equal(t, "carol", clientDNSLabel("_Carol_"))
+}
+
+func TestSetNetworkHeaders_EmbeddedDNS(t *testing.T) {
+	s := &Server{DNS: &DNSServer{addr: netip.MustParseAddr("10.0.0.1"), zone: "vpn.internal."}}
+	header := http.Header{}
+	s.setNetworkHeaders(header)
+	assert.Equal(t, "10.0.0.1", header.Get(common.DNSHeader))
+	assert.Equal(t, "vpn.internal", header.Get(common.DNSSearchHeader))
+}
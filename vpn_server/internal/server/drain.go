@@ -0,0 +1,297 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+)
+
+// ErrDraining сервер уже в режиме drain
+var ErrDraining = errors.New("server is draining")
+
+// defaultDrainTimeout время ожидания ухода клиентов, если timeout_seconds не задан
+const defaultDrainTimeout = 30 * time.Second
+
+// drainState режим drain сервера; нулевое значение - сервер работает
+type drainState struct {
+	mu        sync.Mutex
+	requested chan struct{} // закрывается, когда начинается drain
+	deadline  time.Time
+	reason    string
+	restart   bool // передать UDP сокет новому процессу
+}
+
+// DrainStatus состояние drain для API
+type DrainStatus struct {
+	Draining             bool       `json:"draining"`
+	Reason               string     `json:"reason,omitempty"`
+	Deadline             *time.Time `json:"deadline,omitempty"`
+	Restart              bool       `json:"restart,omitempty"`
+	Sessions             int        `json:"sessions"`
+	AlternativeEndpoints []string   `json:"alternative_endpoints,omitempty"`
+}
+
+// drainTimeout время ожидания ухода клиентов из конфигурации
+func drainTimeout(config common.DrainConfig) time.Duration {
+	if config.TimeoutSeconds > 0 {
+		return time.Duration(config.TimeoutSeconds) * time.Second
+	}
+	return defaultDrainTimeout
+}
+
+// requestedLocked канал начала drain; создается при первом обращении
+func (d *drainState) requestedLocked() chan struct{} {
+	if d.requested == nil {
+		d.requested = make(chan struct{})
+	}
+	return d.requested
+}
+
+// Drain переводит сервер в режим drain: новые CONNECT-IP отклоняются, клиенты
+// активных сессий получают капсулу перехода на другие серверы. Run закрывает
+// сервер, когда клиенты уйдут или наступит возвращаемый срок. Повторный вызов
+// не меняет срок первого.
+func (s *Server) Drain(reason string) time.Time {
+	s.drain.mu.Lock()
+	requested := s.drain.requestedLocked()
+	select {
+	case <-requested:
+		deadline := s.drain.deadline
+		s.drain.mu.Unlock()
+		return deadline
+	default:
+	}
+	s.drain.deadline = time.Now().Add(drainTimeout(s.Config.Drain))
+	s.drain.reason = reason
+	deadline := s.drain.deadline
+	close(requested)
+	s.drain.mu.Unlock()
+
+	s.Logger.Info("Draining server: refusing new sessions",
+		zap.String("reason", reason), zap.Time("deadline", deadline))
+	sent := s.notifyMove(deadline)
+	s.Logger.Info("Asked clients to move",
+		zap.Int("sessions", sent), zap.Strings("endpoints", s.Config.Drain.AlternativeEndpoints))
+	return deadline
+}
+
+// Draining сообщает, что сервер в режиме drain
+func (s *Server) Draining() bool {
+	select {
+	case <-s.drainRequested():
+		return true
+	default:
+		return false
+	}
+}
+
+// drainRequested закрывается, когда начинается drain
+func (s *Server) drainRequested() <-chan struct{} {
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	return s.drain.requestedLocked()
+}
+
+// DrainStatus описывает режим drain
+func (s *Server) DrainStatus() DrainStatus {
+	s.IPPoolMu.RLock()
+	sessions := len(s.IPConnMap)
+	s.IPPoolMu.RUnlock()
+
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	status := DrainStatus{Sessions: sessions, AlternativeEndpoints: s.Config.Drain.AlternativeEndpoints}
+	select {
+	case <-s.drain.requestedLocked():
+		deadline := s.drain.deadline
+		status.Draining = true
+		status.Reason = s.drain.reason
+		status.Deadline = &deadline
+		status.Restart = s.drain.restart
+	default:
+	}
+	return status
+}
+
+// notifyMove просит клиентов всех сессий узла перейти на другие серверы
+func (s *Server) notifyMove(deadline time.Time) int {
+	s.IPPoolMu.RLock()
+	sessions := make([]*ClientSession, 0, len(s.IPConnMap))
+	for _, session := range s.IPConnMap {
+		sessions = append(sessions, session)
+	}
+	s.IPPoolMu.RUnlock()
+
+	move := common.MoveCapsule{Endpoints: s.Config.Drain.AlternativeEndpoints, Deadline: deadline}
+	sent := 0
+	for _, session := range sessions {
+		if err := session.sendMove(move); err != nil {
+			s.sessionLogger(session).Warn("Failed to ask client to move", zap.Error(err))
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+// attachCapsules подключает поток ответа CONNECT-IP к сессии. Сессия, открытая
+// уже после начала drain, сразу получает капсулу перехода.
+func (s *Server) attachCapsules(session *ClientSession, w http.ResponseWriter) {
+	session.Mu.Lock()
+	session.Capsules = w
+	session.Mu.Unlock()
+
+	if !s.Draining() {
+		return
+	}
+	s.drain.mu.Lock()
+	deadline := s.drain.deadline
+	s.drain.mu.Unlock()
+	move := common.MoveCapsule{Endpoints: s.Config.Drain.AlternativeEndpoints, Deadline: deadline}
+	if err := session.sendMove(move); err != nil {
+		s.sessionLogger(session).Warn("Failed to ask client to move", zap.Error(err))
+	}
+}
+
+// detachCapsules отключает поток ответа; после возврата из обработчика он недоступен
+func (session *ClientSession) detachCapsules() {
+	session.Mu.Lock()
+	session.Capsules = nil
+	session.Mu.Unlock()
+}
+
+// sendMove отправляет клиенту капсулу перехода
+func (session *ClientSession) sendMove(move common.MoveCapsule) error {
+	session.Mu.Lock()
+	defer session.Mu.Unlock()
+	if session.Capsules == nil {
+		return errors.New("session has no CONNECT-IP stream")
+	}
+	if err := common.WriteMoveCapsule(session.Capsules, move); err != nil {
+		return err
+	}
+	if flusher, ok := session.Capsules.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// rejectDraining отклоняет CONNECT-IP во время drain и называет серверы, к
+// которым клиенту стоит подключиться
+func (s *Server) rejectDraining(w http.ResponseWriter) {
+	s.drain.mu.Lock()
+	retryAfter := int(time.Until(s.drain.deadline).Seconds()) + 1
+	s.drain.mu.Unlock()
+
+	if endpoints := s.Config.Drain.AlternativeEndpoints; len(endpoints) > 0 {
+		w.Header().Set(common.AlternativesHeader, common.FormatListHeader(endpoints))
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	s.Metrics.RecordError("draining")
+	http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+}
+
+// shutdown завершает drain: сервер отправляет GOAWAY и ждет, пока клиенты
+// закроют соединения; сессии, оставшиеся к сроку, закрываются
+func (s *Server) shutdown(server *http3.Server, conn net.PacketConn) error {
+	deadline := s.Drain("shutdown")
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// Обработчики CONNECT-IP работают до конца сессии и иначе держали бы сервер
+	stop := context.AfterFunc(ctx, func() {
+		if n := s.closeLocalSessions(); n > 0 {
+			s.Logger.Warn("Drain deadline reached, closing remaining sessions", zap.Int("sessions", n))
+		}
+	})
+	defer stop()
+
+	err := server.Shutdown(ctx)
+	conn.Close()
+	// Правила NAT, DNS, TUN устройство, учет трафика и узел кластера
+	s.Close()
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	s.Logger.Info("Server drained")
+	return nil
+}
+
+// Restart перезапускает сервер без закрытия порта (только Unix): сразу
+// запускается новый процесс того же исполняемого файла с унаследованным UDP
+// сокетом, клиенты получают капсулу перехода, а после drain процесс освобождает
+// TUN устройство, API, DNS и узел кластера, и новый процесс начинает принимать
+// соединения. Клиенты, переподключаясь к тому же адресу, попадают в него.
+func (s *Server) Restart() error {
+	if !handoffSupported {
+		return fmt.Errorf("restart with socket handoff: %w", errors.ErrUnsupported)
+	}
+	s.drain.mu.Lock()
+	select {
+	case <-s.drain.requestedLocked():
+		s.drain.mu.Unlock()
+		return ErrDraining
+	default:
+	}
+	s.drain.restart = true
+	s.drain.mu.Unlock()
+	s.Drain("restart")
+	return nil
+}
+
+// restartRequested сообщает, что drain начат для перезапуска
+func (s *Server) restartRequested() bool {
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	return s.drain.restart
+}
+
+// successor новый процесс сервера, ожидающий освобождения ресурсов этим процессом
+type successor struct {
+	pid     int
+	release *os.File     // закрытие разрешает новому процессу открыть TUN, API, DNS и узел кластера
+	exited  <-chan error // получает результат, если новый процесс завершился
+}
+
+// handOff передает UDP сокет новому процессу сервера. Новый процесс запускается
+// до drain: если запустить его не удалось, сервер завершается как при обычной
+// остановке. Пока клиенты уходят, новый процесс ждет и не читает сокет; после
+// drain этот процесс освобождает ресурсы и разрешает новому начать работу.
+func (s *Server) handOff(server *http3.Server, conn net.PacketConn) error {
+	file, err := packetConnFile(conn)
+	if err != nil {
+		s.Logger.Error("Cannot hand the UDP socket over, shutting down instead", zap.Error(err))
+		return s.shutdown(server, conn)
+	}
+	next, err := startSuccessor(file)
+	file.Close()
+	if err != nil {
+		s.Logger.Error("Failed to start new server process, shutting down instead", zap.Error(err))
+		return s.shutdown(server, conn)
+	}
+	s.Logger.Info("Started new server process, draining before handing over", zap.Int("pid", next.pid))
+
+	// shutdown закрывает сессии к сроку drain и освобождает ресурсы этого процесса
+	err = s.shutdown(server, conn)
+	next.release.Close()
+	select {
+	case exitErr := <-next.exited:
+		return fmt.Errorf("new server process %d exited before taking over: %v", next.pid, exitErr)
+	default:
+	}
+	if err != nil {
+		return err
+	}
+	s.Logger.Info("Handed the UDP socket over to new server process", zap.Int("pid", next.pid))
+	return nil
+}
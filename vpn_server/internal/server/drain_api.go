@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DrainRequest запрос перевода сервера в режим drain
+type DrainRequest struct {
+	Reason  string `json:"reason"`
+	Restart bool   `json:"restart"` // передать UDP сокет новому процессу (только Unix)
+}
+
+// getDrainStatus возвращает состояние режима drain
+func (api *APIServer) getDrainStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, api.server.DrainStatus())
+}
+
+// startDrain переводит сервер в режим drain; сервер завершится, когда клиенты
+// уйдут или истечет timeout_seconds, а при restart его сменит новый процесс
+func (api *APIServer) startDrain(c *gin.Context) {
+	var req DrainRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = "api"
+	}
+
+	if req.Restart {
+		if err := api.server.Restart(); err != nil {
+			status := http.StatusConflict
+			if errors.Is(err, errors.ErrUnsupported) {
+				status = http.StatusNotImplemented
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		api.server.Drain(req.Reason)
+	}
+
+	action := "server.drain"
+	if req.Restart {
+		action = "server.restart"
+	}
+	api.server.Audit.Record(c.ClientIP(), action, api.server.Config.ServerName, req.Reason)
+	c.JSON(http.StatusAccepted, api.server.DrainStatus())
+}
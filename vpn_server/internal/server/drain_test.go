@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestDrainServer создает сервер с настройками drain и счетчиком ошибок
+func newTestDrainServer(t *testing.T) *Server {
+	s := newTestSessionServer(common.SessionConfig{})
+	s.Config.Drain = common.DrainConfig{
+		TimeoutSeconds:       60,
+		AlternativeEndpoints: []string{"vpn2.example.com:4433", "vpn3.example.com:4433"},
+	}
+	s.Metrics = &Metrics{ErrorsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_errors"}, []string{"type"})}
+	audit, err := NewAuditLog("", zap.NewNop())
+	require.NoError(t, err)
+	s.Audit = audit
+	return s
+}
+
+// readMoveCapsule разбирает капсулу перехода из потока ответа CONNECT-IP
+func readMoveCapsule(t *testing.T, stream []byte) common.MoveCapsule {
+	t.Helper()
+	capsuleType, r, err := http3.ParseCapsule(quicvarint.NewReader(bytes.NewReader(stream)))
+	require.NoError(t, err)
+	require.Equal(t, common.CapsuleTypeMove, capsuleType)
+	value, err := io.ReadAll(r)
+	require.NoError(t, err)
+	var move common.MoveCapsule
+	require.NoError(t, json.Unmarshal(value, &move))
+	return move
+}
+
+func TestDrain(t *testing.T) {
+	s := newTestDrainServer(t)
+	session, _, err := openTestSession(t, s, ClientIdentity{User: "alice", Device: "laptop"})
+	require.NoError(t, err)
+	stream := httptest.NewRecorder()
+	s.attachCapsules(session, stream)
+	assert.False(t, s.Draining())
+	assert.Zero(t, stream.Body.Len())
+
+	deadline := s.Drain("maintenance")
+	assert.True(t, s.Draining())
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, 5*time.Second)
+	// Повторный вызов не продлевает срок
+	assert.Equal(t, deadline, s.Drain("again"))
+
+	// Клиент активной сессии получает капсулу перехода
+	move := readMoveCapsule(t, stream.Body.Bytes())
+	assert.Equal(t, s.Config.Drain.AlternativeEndpoints, move.Endpoints)
+	assert.True(t, deadline.Equal(move.Deadline))
+
+	// Новые CONNECT-IP отклоняются со списком серверов
+	req := httptest.NewRequest(http.MethodConnect, "/", nil)
+	req.Header.Set("Capsule-Protocol", "?masque")
+	rec := httptest.NewRecorder()
+	s.handleMASQUERequest(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "vpn2.example.com:4433, vpn3.example.com:4433", rec.Header().Get(common.AlternativesHeader))
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 60, retryAfter, 5)
+
+	// Сессия, открытая уже во время drain, получает капсулу сразу
+	late, _, err := openTestSession(t, s, ClientIdentity{User: "bob", Device: "phone"})
+	require.NoError(t, err)
+	lateStream := httptest.NewRecorder()
+	s.attachCapsules(late, lateStream)
+	assert.Equal(t, s.Config.Drain.AlternativeEndpoints, readMoveCapsule(t, lateStream.Body.Bytes()).Endpoints)
+
+	// После обработчика поток ответа не используется
+	late.detachCapsules()
+	assert.Error(t, late.sendMove(move))
+
+	status := s.DrainStatus()
+	assert.True(t, status.Draining)
+	assert.Equal(t, "maintenance", status.Reason)
+	assert.Equal(t, 2, status.Sessions)
+}
+
+func TestDrainAPI(t *testing.T) {
+	s := newTestDrainServer(t)
+	api, err := NewAPIServer(s)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	api.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/drain", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var status DrainStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.False(t, status.Draining)
+
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Перевести сервер в drain может только администратор
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/drain", strings.NewReader(`{"reason":"kernel upgrade"}`)))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.False(t, s.Draining())
+
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, newAdminRequest(http.MethodPost, "/api/v1/drain", strings.NewReader(`{"reason":"kernel upgrade"}`)))
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.True(t, status.Draining)
+	assert.Equal(t, "kernel upgrade", status.Reason)
+	require.NotNil(t, status.Deadline)
+
+	// Балансировщик видит, что сервер уходит
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// Перезапуск во время drain уже невозможен
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, newAdminRequest(http.MethodPost, "/api/v1/drain", strings.NewReader(`{"restart":true}`)))
+	if handoffSupported {
+		assert.Equal(t, http.StatusConflict, rec.Code)
+	} else {
+		assert.Equal(t, http.StatusNotImplemented, rec.Code)
+	}
+
+	events := s.Audit.List(0)
+	require.NotEmpty(t, events)
+	assert.Equal(t, "server.drain", events[len(events)-1].Action)
+}
+
+// startTestHTTP3Server запускает HTTP/3 сервер без обработчиков на локальном UDP сокете
+func startTestHTTP3Server(t *testing.T) (*http3.Server, net.PacketConn, <-chan error) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cert := newTestClusterCA(t).issue(t, "localhost")
+	server := &http3.Server{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(conn) }()
+	require.Eventually(t, func() bool { return server.SetQUICHeaders(http.Header{}) == nil }, 2*time.Second, 10*time.Millisecond)
+	return server, conn, served
+}
+
+func TestShutdown(t *testing.T) {
+	s := newTestDrainServer(t)
+	server, conn, served := startTestHTTP3Server(t)
+
+	require.NoError(t, s.shutdown(server, conn))
+	assert.True(t, s.Draining())
+	assert.ErrorIs(t, <-served, http.ErrServerClosed)
+	// Сокет закрыт после drain
+	_, err := conn.WriteTo([]byte{0}, conn.LocalAddr())
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+)
+
+// earlyDataTimeout ограничивает ожидание завершения рукопожатия для запроса из 0-RTT
+const earlyDataTimeout = 5 * time.Second
+
+// isEarlyData сообщает, что запрос пришел в 0-RTT, до завершения рукопожатия
+func isEarlyData(r *http.Request) bool {
+	return r.TLS != nil && !r.TLS.HandshakeComplete
+}
+
+// confirmEarlyData защищает CONNECT-IP из 0-RTT от повторного воспроизведения:
+// злоумышленник может повторить перехваченные 0-RTT пакеты, но не завершить
+// рукопожатие, поэтому запрос выполняется только после него. Возвращает false,
+// если ответ уже отправлен и запрос выполнять нельзя.
+func (s *Server) confirmEarlyData(w http.ResponseWriter, r *http.Request) bool {
+	if !isEarlyData(r) {
+		return true
+	}
+	hijacker, ok := w.(http3.Hijacker)
+	if !ok {
+		s.Metrics.RecordEarlyData("too_early")
+		http.Error(w, "Request sent in 0-RTT", http.StatusTooEarly)
+		return false
+	}
+	conn := hijacker.Connection()
+
+	timer := time.NewTimer(earlyDataTimeout)
+	defer timer.Stop()
+	select {
+	case <-conn.HandshakeComplete():
+	case <-timer.C:
+		s.Logger.Warn("Dropped 0-RTT request: handshake not completed, possible replay",
+			zap.String("remote_addr", r.RemoteAddr))
+		s.Metrics.RecordEarlyData("replay_rejected")
+		http.Error(w, "Handshake not completed", http.StatusTooEarly)
+		return false
+	case <-r.Context().Done():
+		s.Metrics.RecordEarlyData("replay_rejected")
+		return false
+	}
+
+	// Состояние TLS запроса снято до завершения рукопожатия
+	state := conn.ConnectionState().TLS
+	r.TLS = &state
+	s.Metrics.RecordEarlyData("accepted")
+	return true
+}
+
+// rejectEarlyData отвечает 425 Too Early (RFC 8470) на запросы из 0-RTT,
+// меняющие состояние; клиент повторяет их после рукопожатия
+func (s *Server) rejectEarlyData(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isEarlyData(r) && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.Metrics.RecordEarlyData("too_early")
+			http.Error(w, "Request sent in 0-RTT", http.StatusTooEarly)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handshakeKind классифицирует рукопожатие соединения запроса для метрик
+func handshakeKind(r *http.Request, earlyData bool) string {
+	switch {
+	case earlyData:
+		return "0rtt"
+	case r.TLS != nil && r.TLS.DidResume:
+		return "resumed"
+	default:
+		return "full"
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// newEarlyDataServer создает сервер только с метриками 0-RTT, без глобальной регистрации
+func newEarlyDataServer() *Server {
+	return &Server{Logger: zap.NewNop(), Metrics: &Metrics{
+		EarlyDataRequests: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_early_data"}, []string{"result"}),
+	}}
+}
+
+// earlyRequest формирует запрос, пришедший до завершения рукопожатия
+func earlyRequest(method string, handshakeComplete bool) *http.Request {
+	req := httptest.NewRequest(method, "/", nil)
+	req.TLS = &tls.ConnectionState{HandshakeComplete: handshakeComplete, DidResume: true}
+	return req
+}
+
+func TestRejectEarlyData(t *testing.T) {
+	s := newEarlyDataServer()
+	called := 0
+	handler := s.rejectEarlyData(func(w http.ResponseWriter, r *http.Request) { called++ })
+
+	rec := httptest.NewRecorder()
+	handler(rec, earlyRequest(http.MethodPost, false))
+	assert.Equal(t, http.StatusTooEarly, rec.Code)
+	assert.Zero(t, called)
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.Metrics.EarlyDataRequests.WithLabelValues("too_early")))
+
+	// Безопасные методы и запросы после рукопожатия проходят
+	handler(httptest.NewRecorder(), earlyRequest(http.MethodGet, false))
+	handler(httptest.NewRecorder(), earlyRequest(http.MethodPost, true))
+	assert.Equal(t, 2, called)
+}
+
+func TestConfirmEarlyData(t *testing.T) {
+	s := newEarlyDataServer()
+
+	t.Run("completed handshake", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		assert.True(t, s.confirmEarlyData(rec, earlyRequest(http.MethodConnect, true)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("without QUIC connection", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		assert.False(t, s.confirmEarlyData(rec, earlyRequest(http.MethodConnect, false)))
+		assert.Equal(t, http.StatusTooEarly, rec.Code)
+	})
+}
+
+func TestHandshakeKind(t *testing.T) {
+	assert.Equal(t, "0rtt", handshakeKind(earlyRequest(http.MethodConnect, false), true))
+	assert.Equal(t, "resumed", handshakeKind(earlyRequest(http.MethodConnect, true), false))
+	assert.Equal(t, "full", handshakeKind(httptest.NewRequest(http.MethodConnect, "/", nil), false))
+}
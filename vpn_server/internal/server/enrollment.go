@@ -0,0 +1,346 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+const (
+	enrollmentFileName         = "enrollment_tokens.json"
+	defaultEnrollmentTokenTTL  = 24 * time.Hour
+	maxEnrollmentTokenTTL      = 30 * 24 * time.Hour
+	enrollmentTokenIDHexLength = 12
+)
+
+var (
+	// ErrEnrollmentTokenInvalid токен не существует, просрочен, отозван или уже использован
+	ErrEnrollmentTokenInvalid = errors.New("enrollment token is invalid, expired or already used")
+	// ErrInvalidCSR запрос на подпись сертификата некорректен
+	ErrInvalidCSR = errors.New("invalid certificate signing request")
+)
+
+// EnrollmentTokenRequest параметры создания токена регистрации
+type EnrollmentTokenRequest struct {
+	ClientID       string   `json:"client_id"`
+	Groups         []string `json:"groups,omitempty"`
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+	ValidityDays   int      `json:"validity_days,omitempty"`
+	TTLMinutes     int      `json:"ttl_minutes,omitempty"`
+}
+
+// EnrollmentToken запись о токене регистрации; сам токен хранится только в виде SHA-256
+type EnrollmentToken struct {
+	ID        string       `json:"id"`
+	TokenHash string       `json:"token_hash"`
+	Template  IssueRequest `json:"template"`
+	CreatedAt time.Time    `json:"created_at"`
+	CreatedBy string       `json:"created_by"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	Revoked   bool         `json:"revoked"`
+	UsedAt    time.Time    `json:"used_at,omitempty"`
+	UsedBy    string       `json:"used_by,omitempty"`
+	Serial    string       `json:"serial,omitempty"` // сертификат, выпущенный по токену
+}
+
+// Status возвращает состояние токена
+func (t *EnrollmentToken) Status() string {
+	switch {
+	case t.Revoked:
+		return "revoked"
+	case !t.UsedAt.IsZero():
+		return "used"
+	case time.Now().After(t.ExpiresAt):
+		return "expired"
+	default:
+		return "active"
+	}
+}
+
+// EnrollmentTokenInfo представление токена для API (без хеша)
+type EnrollmentTokenInfo struct {
+	ID        string    `json:"id"`
+	ClientID  string    `json:"client_id"`
+	Groups    []string  `json:"groups,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Status    string    `json:"status"`
+	UsedAt    time.Time `json:"used_at,omitempty"`
+	UsedBy    string    `json:"used_by,omitempty"`
+	Serial    string    `json:"serial,omitempty"`
+}
+
+// clone копирует запись, чтобы ее можно было читать без блокировки менеджера.
+// Срезы шаблона не копируются: после создания токена они не изменяются.
+func (t *EnrollmentToken) clone() *EnrollmentToken {
+	copied := *t
+	return &copied
+}
+
+// Info возвращает представление токена для API
+func (t *EnrollmentToken) Info() EnrollmentTokenInfo {
+	return EnrollmentTokenInfo{
+		ID:        t.ID,
+		ClientID:  t.Template.CommonName,
+		Groups:    t.Template.Groups,
+		CreatedAt: t.CreatedAt,
+		CreatedBy: t.CreatedBy,
+		ExpiresAt: t.ExpiresAt,
+		Status:    t.Status(),
+		UsedAt:    t.UsedAt,
+		UsedBy:    t.UsedBy,
+		Serial:    t.Serial,
+	}
+}
+
+// EnrollmentManager выдает одноразовые токены и подписывает по ним CSR клиентов
+type EnrollmentManager struct {
+	ca     *CertificateAuthority
+	audit  *AuditLog
+	logger *zap.Logger
+	path   string
+	tokens map[string]*EnrollmentToken // token hash -> запись
+	mu     sync.Mutex
+}
+
+// NewEnrollmentManager создает менеджер регистрации; токены сохраняются в store_dir CA, если он задан
+func NewEnrollmentManager(ca *CertificateAuthority, audit *AuditLog, logger *zap.Logger) (*EnrollmentManager, error) {
+	m := &EnrollmentManager{
+		ca:     ca,
+		audit:  audit,
+		logger: logger,
+		tokens: make(map[string]*EnrollmentToken),
+	}
+
+	if ca.config.StoreDir != "" {
+		m.path = filepath.Join(ca.config.StoreDir, enrollmentFileName)
+		data, err := os.ReadFile(m.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read enrollment tokens: %w", err)
+		}
+		if err == nil {
+			var records []*EnrollmentToken
+			if err := json.Unmarshal(data, &records); err != nil {
+				return nil, fmt.Errorf("failed to parse enrollment tokens: %w", err)
+			}
+			for _, record := range records {
+				m.tokens[record.TokenHash] = record
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// CreateToken создает одноразовый токен регистрации и возвращает его открытое значение
+func (m *EnrollmentManager) CreateToken(req EnrollmentTokenRequest, actor string) (string, *EnrollmentToken, error) {
+	template := IssueRequest{
+		CommonName:     req.ClientID,
+		Groups:         req.Groups,
+		EmailAddresses: req.EmailAddresses,
+		URIs:           req.URIs,
+		ValidityDays:   req.ValidityDays,
+	}
+	// Проверяем параметры сертификата заранее, чтобы не выдавать заведомо неработающий токен
+	if _, err := m.ca.buildTemplate(template); err != nil {
+		return "", nil, err
+	}
+
+	ttl := defaultEnrollmentTokenTTL
+	if req.TTLMinutes > 0 {
+		ttl = time.Duration(req.TTLMinutes) * time.Minute
+	}
+	if ttl > maxEnrollmentTokenTTL {
+		return "", nil, fmt.Errorf("%w: ttl_minutes exceeds 30 days", common.ErrInvalidConfig)
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	hash := hashEnrollmentToken(token)
+	now := time.Now().UTC()
+
+	record := &EnrollmentToken{
+		ID:        hash[:enrollmentTokenIDHexLength],
+		TokenHash: hash,
+		Template:  template,
+		CreatedAt: now,
+		CreatedBy: actor,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	m.mu.Lock()
+	m.tokens[hash] = record
+	record = record.clone()
+	err = m.saveLocked()
+	m.mu.Unlock()
+	if err != nil {
+		m.logger.Error("Failed to persist enrollment tokens", zap.Error(err))
+	}
+
+	m.recordAudit(actor, "enrollment.token.create", record.ID,
+		fmt.Sprintf("client=%s expires_at=%s", req.ClientID, record.ExpiresAt.Format(time.RFC3339)))
+	return token, record, nil
+}
+
+// List возвращает копии всех токенов, отсортированные по времени создания
+func (m *EnrollmentManager) List() []*EnrollmentToken {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]*EnrollmentToken, 0, len(m.tokens))
+	for _, record := range m.tokens {
+		result = append(result, record.clone())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result
+}
+
+// RevokeToken отзывает неиспользованный токен по идентификатору
+func (m *EnrollmentManager) RevokeToken(id, actor string) (*EnrollmentToken, error) {
+	m.mu.Lock()
+	var record *EnrollmentToken
+	for _, candidate := range m.tokens {
+		if candidate.ID == id {
+			record = candidate
+			break
+		}
+	}
+	if record == nil {
+		m.mu.Unlock()
+		return nil, ErrEnrollmentTokenInvalid
+	}
+	record.Revoked = true
+	record = record.clone()
+	err := m.saveLocked()
+	m.mu.Unlock()
+	if err != nil {
+		m.logger.Error("Failed to persist enrollment tokens", zap.Error(err))
+	}
+
+	m.recordAudit(actor, "enrollment.token.revoke", record.ID, "client="+record.Template.CommonName)
+	return record, nil
+}
+
+// Enroll проверяет токен и CSR и выпускает сертификат; токен становится использованным
+func (m *EnrollmentManager) Enroll(token string, csrPEM []byte, actor string) (*IssuedCertificate, error) {
+	csr, err := parseCSR(csrPEM)
+	if err != nil {
+		m.recordAudit(actor, "enrollment.reject", "-", err.Error())
+		return nil, err
+	}
+
+	hash := hashEnrollmentToken(token)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, ok := m.tokens[hash]
+	if !ok || record.Status() != "active" {
+		details := "unknown token"
+		if ok {
+			details = "token " + record.Status()
+		}
+		m.recordAudit(actor, "enrollment.reject", tokenAuditID(record), details)
+		return nil, ErrEnrollmentTokenInvalid
+	}
+
+	// Идентичность задается токеном; CN в CSR, если указан, должен совпадать
+	if csr.Subject.CommonName != "" && csr.Subject.CommonName != record.Template.CommonName {
+		m.recordAudit(actor, "enrollment.reject", record.ID,
+			fmt.Sprintf("csr common name %q does not match %q", csr.Subject.CommonName, record.Template.CommonName))
+		return nil, fmt.Errorf("%w: common name must be %q", ErrInvalidCSR, record.Template.CommonName)
+	}
+
+	issued, err := m.ca.sign(record.Template, csr.PublicKey, "", "enrollment:"+record.ID)
+	if err != nil {
+		m.recordAudit(actor, "enrollment.reject", record.ID, err.Error())
+		return nil, err
+	}
+
+	record.UsedAt = time.Now().UTC()
+	record.UsedBy = actor
+	record.Serial = issued.Serial
+	if err := m.saveLocked(); err != nil {
+		m.logger.Error("Failed to persist enrollment tokens", zap.Error(err))
+	}
+
+	m.recordAudit(actor, "enrollment.redeem", record.ID,
+		fmt.Sprintf("client=%s serial=%s", record.Template.CommonName, issued.Serial))
+	return issued, nil
+}
+
+// saveLocked сохраняет токены на диск; вызывается под m.mu
+func (m *EnrollmentManager) saveLocked() error {
+	if m.path == "" {
+		return nil
+	}
+
+	records := make([]*EnrollmentToken, 0, len(m.tokens))
+	for _, record := range m.tokens {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode enrollment tokens: %w", err)
+	}
+	return common.WriteFileAtomic(m.path, data, 0600)
+}
+
+// recordAudit пишет событие в журнал аудита, если он настроен
+func (m *EnrollmentManager) recordAudit(actor, action, subject, details string) {
+	if m.audit != nil {
+		m.audit.Record(actor, action, subject, details)
+	}
+}
+
+// parseCSR разбирает PEM CSR и проверяет его подпись
+func parseCSR(csrPEM []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("%w: expected PEM CERTIFICATE REQUEST", ErrInvalidCSR)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCSR, err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%w: bad signature: %v", ErrInvalidCSR, err)
+	}
+	return csr, nil
+}
+
+// hashEnrollmentToken возвращает SHA-256 токена в hex
+func hashEnrollmentToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenAuditID возвращает идентификатор токена для аудита или "-" для неизвестного
+func tokenAuditID(record *EnrollmentToken) string {
+	if record == nil {
+		return "-"
+	}
+	return record.ID
+}
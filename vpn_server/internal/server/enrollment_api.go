@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// requireEnrollment возвращает менеджер регистрации или отвечает 503, если CA не настроен
+func (api *APIServer) requireEnrollment(c *gin.Context) *EnrollmentManager {
+	if api.server.Enrollment == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Certificate authority is not configured"})
+		return nil
+	}
+	return api.server.Enrollment
+}
+
+// createEnrollmentToken создает одноразовый токен регистрации клиента
+func (api *APIServer) createEnrollmentToken(c *gin.Context) {
+	enrollment := api.requireEnrollment(c)
+	if enrollment == nil {
+		return
+	}
+
+	var req EnrollmentTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	token, record, err := enrollment.CreateToken(req, c.ClientIP())
+	if err != nil {
+		writeCAError(c, err)
+		return
+	}
+
+	// Открытое значение токена возвращается только один раз
+	c.JSON(http.StatusCreated, gin.H{
+		"token":      token,
+		"id":         record.ID,
+		"client_id":  record.Template.CommonName,
+		"expires_at": record.ExpiresAt,
+	})
+}
+
+// listEnrollmentTokens возвращает список токенов регистрации
+func (api *APIServer) listEnrollmentTokens(c *gin.Context) {
+	enrollment := api.requireEnrollment(c)
+	if enrollment == nil {
+		return
+	}
+
+	records := enrollment.List()
+	tokens := make([]EnrollmentTokenInfo, 0, len(records))
+	for _, record := range records {
+		tokens = append(tokens, record.Info())
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tokens": tokens,
+		"total":  len(tokens),
+	})
+}
+
+// revokeEnrollmentToken отзывает токен регистрации
+func (api *APIServer) revokeEnrollmentToken(c *gin.Context) {
+	enrollment := api.requireEnrollment(c)
+	if enrollment == nil {
+		return
+	}
+
+	record, err := enrollment.RevokeToken(c.Param("id"), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Enrollment token not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, record.Info())
+}
+
+// enroll подписывает CSR клиента по одноразовому токену.
+// Закрытый ключ генерируется на машине клиента и никогда не передается серверу.
+func (api *APIServer) enroll(c *gin.Context) {
+	enrollment := api.requireEnrollment(c)
+	if enrollment == nil {
+		return
+	}
+
+	var req common.EnrollRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	issued, err := enrollment.Enroll(req.Token, []byte(req.CSR), c.ClientIP())
+	switch {
+	case errors.Is(err, ErrEnrollmentTokenInvalid):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, ErrInvalidCSR):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		writeCAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.server.enrollResponse(issued))
+}
+
+// enrollResponse формирует ответ с сертификатом и параметрами подключения
+func (s *Server) enrollResponse(issued *IssuedCertificate) common.EnrollResponse {
+	return common.EnrollResponse{
+		ClientID:   issued.CommonName,
+		Serial:     issued.Serial,
+		CertPEM:    issued.CertPEM,
+		CAPEM:      string(s.CA.CACertPEM()),
+		NotAfter:   issued.NotAfter,
+		ServerAddr: ClientServerAddr(s.Config),
+		ServerName: s.Config.ServerName,
+		MTU:        s.Config.MTU,
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestCSR создает CSR с новым ключом и указанным CN
+func newTestCSR(t *testing.T, commonName string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func newTestEnrollment(t *testing.T, storeDir string) (*EnrollmentManager, *AuditLog) {
+	t.Helper()
+	audit, err := NewAuditLog("", zap.NewNop())
+	require.NoError(t, err)
+	ca, err := NewCertificateAuthority(newTestCAConfig(t, storeDir), audit, zap.NewNop())
+	require.NoError(t, err)
+	enrollment, err := NewEnrollmentManager(ca, audit, zap.NewNop())
+	require.NoError(t, err)
+	return enrollment, audit
+}
+
+func TestEnrollment_SingleUse(t *testing.T) {
+	enrollment, audit := newTestEnrollment(t, "")
+
+	token, record, err := enrollment.CreateToken(EnrollmentTokenRequest{
+		ClientID: "alice",
+		Groups:   []string{"engineering"},
+	}, "admin")
+	require.NoError(t, err)
+	assert.Equal(t, "active", record.Status())
+	assert.NotContains(t, record.TokenHash, token)
+
+	issued, err := enrollment.Enroll(token, newTestCSR(t, ""), "198.51.100.7")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", issued.CommonName)
+	assert.Equal(t, []string{"engineering"}, issued.Groups)
+	assert.Empty(t, issued.KeyPEM, "server must not hold the enrolled key")
+	// Возвращенные записи - копии; состояние токена читается заново
+	assert.Equal(t, "active", record.Status())
+	records := enrollment.List()
+	require.Len(t, records, 1)
+	assert.Equal(t, "used", records[0].Status())
+	assert.Equal(t, issued.Serial, records[0].Serial)
+	assert.Equal(t, "198.51.100.7", records[0].UsedBy)
+
+	_, err = enrollment.Enroll(token, newTestCSR(t, ""), "198.51.100.7")
+	assert.ErrorIs(t, err, ErrEnrollmentTokenInvalid)
+
+	var actions []string
+	for _, event := range audit.List(0) {
+		actions = append(actions, event.Action)
+	}
+	assert.Equal(t, []string{
+		"enrollment.token.create",
+		"certificate.issue",
+		"enrollment.redeem",
+		"enrollment.reject",
+	}, actions)
+}
+
+func TestEnrollment_ConcurrentList(t *testing.T) {
+	enrollment, _ := newTestEnrollment(t, "")
+
+	token, _, err := enrollment.CreateToken(EnrollmentTokenRequest{ClientID: "alice"}, "admin")
+	require.NoError(t, err)
+	_, other, err := enrollment.CreateToken(EnrollmentTokenRequest{ClientID: "bob"}, "admin")
+	require.NoError(t, err)
+
+	// Запускается с -race: список читается, пока токены используются и отзываются
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		_, err := enrollment.Enroll(token, newTestCSR(t, ""), "198.51.100.7")
+		assert.NoError(t, err)
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := enrollment.RevokeToken(other.ID, "admin")
+		assert.NoError(t, err)
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			for _, record := range enrollment.List() {
+				_ = record.Info()
+			}
+		}
+	}()
+	wg.Wait()
+
+	statuses := make(map[string]string)
+	for _, record := range enrollment.List() {
+		statuses[record.Template.CommonName] = record.Status()
+	}
+	assert.Equal(t, map[string]string{"alice": "used", "bob": "revoked"}, statuses)
+}
+
+func TestEnrollment_Rejections(t *testing.T) {
+	enrollment, _ := newTestEnrollment(t, "")
+
+	token, record, err := enrollment.CreateToken(EnrollmentTokenRequest{ClientID: "bob"}, "admin")
+	require.NoError(t, err)
+
+	_, err = enrollment.Enroll(token, []byte("not a csr"), "client")
+	assert.ErrorIs(t, err, ErrInvalidCSR)
+
+	_, err = enrollment.Enroll(token, newTestCSR(t, "mallory"), "client")
+	assert.ErrorIs(t, err, ErrInvalidCSR)
+
+	_, err = enrollment.Enroll("unknown", newTestCSR(t, ""), "client")
+	assert.ErrorIs(t, err, ErrEnrollmentTokenInvalid)
+
+	// Неудачные попытки не расходуют токен
+	assert.Equal(t, "active", enrollment.List()[0].Status())
+
+	// Возвращенная запись - копия, срок истекает только у хранимой
+	enrollment.mu.Lock()
+	enrollment.tokens[record.TokenHash].ExpiresAt = time.Now().Add(-time.Minute)
+	enrollment.mu.Unlock()
+	_, err = enrollment.Enroll(token, newTestCSR(t, "bob"), "client")
+	assert.ErrorIs(t, err, ErrEnrollmentTokenInvalid)
+
+	revokedToken, revoked, err := enrollment.CreateToken(EnrollmentTokenRequest{ClientID: "bob"}, "admin")
+	require.NoError(t, err)
+	_, err = enrollment.RevokeToken(revoked.ID, "admin")
+	require.NoError(t, err)
+	_, err = enrollment.Enroll(revokedToken, newTestCSR(t, "bob"), "client")
+	assert.ErrorIs(t, err, ErrEnrollmentTokenInvalid)
+}
+
+func TestEnrollment_Persistence(t *testing.T) {
+	storeDir := t.TempDir()
+	enrollment, _ := newTestEnrollment(t, storeDir)
+
+	token, _, err := enrollment.CreateToken(EnrollmentTokenRequest{ClientID: "carol", TTLMinutes: 30}, "admin")
+	require.NoError(t, err)
+
+	reloaded, err := NewEnrollmentManager(enrollment.ca, nil, zap.NewNop())
+	require.NoError(t, err)
+	issued, err := reloaded.Enroll(token, newTestCSR(t, "carol"), "client")
+	require.NoError(t, err)
+	assert.Equal(t, "carol", issued.CommonName)
+}
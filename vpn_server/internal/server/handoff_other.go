@@ -0,0 +1,37 @@
+//go:build !unix
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// handoffSupported перезапуск с передачей сокета доступен
+const handoffSupported = false
+
+// inheritedPacketConn возвращает UDP сокет, переданный предыдущим процессом; nil - сокета нет
+func inheritedPacketConn() (net.PacketConn, error) {
+	return nil, nil
+}
+
+// waitForPredecessor ждет освобождения ресурсов предыдущим процессом; на этой платформе передачи нет
+func waitForPredecessor(logger *zap.Logger) error {
+	return nil
+}
+
+// packetConnFile возвращает копию дескриптора сокета для нового процесса
+func packetConnFile(conn net.PacketConn) (*os.File, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// startSuccessor запускает новый процесс сервера с унаследованным сокетом
+func startSuccessor(file *os.File) (*successor, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// watchRestartSignal перезапускает сервер по сигналу; на этой платформе сигнала нет
+func (s *Server) watchRestartSignal(done <-chan struct{}) {}
@@ -0,0 +1,127 @@
+//go:build unix
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// listenFDEnv передает новому процессу номер дескриптора унаследованного UDP сокета
+const listenFDEnv = "MASQUE_VPN_LISTEN_FD"
+
+// handoffFDEnv передает новому процессу номер дескриптора канала, который
+// предыдущий процесс закрывает, освободив свои ресурсы
+const handoffFDEnv = "MASQUE_VPN_HANDOFF_FD"
+
+// handoffSupported перезапуск с передачей сокета доступен
+const handoffSupported = true
+
+// inheritedPacketConn возвращает UDP сокет, переданный предыдущим процессом; nil - сокета нет
+func inheritedPacketConn() (net.PacketConn, error) {
+	value := os.Getenv(listenFDEnv)
+	if value == "" {
+		return nil, nil
+	}
+	// Следующему перезапуску переменная передается заново
+	os.Unsetenv(listenFDEnv)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s=%q: %w", listenFDEnv, value, err)
+	}
+	file := os.NewFile(uintptr(fd), "inherited-udp")
+	defer file.Close()
+	return net.FilePacketConn(file)
+}
+
+// waitForPredecessor ждет, пока предыдущий процесс завершит drain и освободит
+// TUN устройство, порты API и DNS, журнал кластера и учет трафика
+func waitForPredecessor(logger *zap.Logger) error {
+	value := os.Getenv(handoffFDEnv)
+	if value == "" {
+		return nil
+	}
+	os.Unsetenv(handoffFDEnv)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s=%q: %w", handoffFDEnv, value, err)
+	}
+	file := os.NewFile(uintptr(fd), "handoff")
+	defer file.Close()
+
+	logger.Info("Waiting for the previous server process to drain")
+	// Канал закрывается и при аварийном завершении предыдущего процесса
+	if _, err := io.Copy(io.Discard, file); err != nil {
+		return fmt.Errorf("failed to wait for the previous server process: %w", err)
+	}
+	return nil
+}
+
+// packetConnFile возвращает копию дескриптора сокета для нового процесса
+func packetConnFile(conn net.PacketConn) (*os.File, error) {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil, fmt.Errorf("cannot pass %T to a new process", conn)
+	}
+	return udpConn.File()
+}
+
+// startSuccessor запускает исполняемый файл сервера с теми же аргументами и
+// передает ему сокет третьим дескриптором, а канал ожидания - четвертым
+func startSuccessor(file *os.File) (*successor, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	wait, release, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer wait.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{file, wait}
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3", handoffFDEnv+"=4")
+	if err := cmd.Start(); err != nil {
+		release.Close()
+		return nil, err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	return &successor{pid: cmd.Process.Pid, release: release, exited: exited}, nil
+}
+
+// watchRestartSignal перезапускает сервер по SIGUSR2
+func (s *Server) watchRestartSignal(done <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-signals:
+			s.Logger.Info("Received SIGUSR2, restarting with the UDP socket handed over")
+			if err := s.Restart(); err != nil {
+				s.Logger.Error("Cannot restart", zap.Error(err))
+			}
+		}
+	}
+}
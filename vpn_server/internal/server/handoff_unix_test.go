@@ -0,0 +1,80 @@
+//go:build unix
+
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestInheritedPacketConn(t *testing.T) {
+	conn, err := inheritedPacketConn()
+	require.NoError(t, err)
+	assert.Nil(t, conn)
+
+	original, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer original.Close()
+	file, err := packetConnFile(original)
+	require.NoError(t, err)
+	defer file.Close()
+
+	// Новый процесс получает свою копию дескриптора
+	fd, err := syscall.Dup(int(file.Fd()))
+	require.NoError(t, err)
+	t.Setenv(listenFDEnv, strconv.Itoa(fd))
+
+	inherited, err := inheritedPacketConn()
+	require.NoError(t, err)
+	defer inherited.Close()
+	assert.Equal(t, original.LocalAddr().String(), inherited.LocalAddr().String())
+	assert.Empty(t, os.Getenv(listenFDEnv))
+
+	// Оба дескриптора - один сокет
+	_, err = inherited.WriteTo([]byte("ping"), original.LocalAddr())
+	require.NoError(t, err)
+	buf := make([]byte, 16)
+	n, _, err := original.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+}
+
+func TestWaitForPredecessor(t *testing.T) {
+	require.NoError(t, waitForPredecessor(zap.NewNop()))
+
+	wait, release, err := os.Pipe()
+	require.NoError(t, err)
+	defer release.Close()
+	fd, err := syscall.Dup(int(wait.Fd()))
+	require.NoError(t, err)
+	wait.Close()
+	t.Setenv(handoffFDEnv, strconv.Itoa(fd))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- waitForPredecessor(zap.NewNop())
+	}()
+
+	// Новый процесс ждет, пока предыдущий не закроет канал
+	select {
+	case <-done:
+		t.Fatal("returned before the previous process released its resources")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release.Close()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("did not return after the channel was closed")
+	}
+	assert.Empty(t, os.Getenv(handoffFDEnv))
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"strconv"
+	"strings"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// Источники идентичности в сертификате
+const (
+	identitySourceCN     = "cn"
+	identitySourceEmail  = "email"
+	identitySourceURI    = "uri"
+	identitySourceDNS    = "dns"
+	identitySourceSerial = "serial"
+	identitySourceNone   = "none"
+
+	groupSourceOU   = "ou"
+	groupSourceOID  = "oid"
+	groupSourceBoth = "both"
+)
+
+// ClientIdentity идентичность клиента, полученная из сертификата
+type ClientIdentity struct {
+	User   string   `json:"user"`
+	Device string   `json:"device,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	Serial string   `json:"serial"`
+}
+
+// SessionKey возвращает ключ сессии: у одного пользователя может быть несколько устройств
+func (id ClientIdentity) SessionKey() string {
+	if id.Device == "" {
+		return id.User
+	}
+	return id.User + ":" + id.Device
+}
+
+// InGroup проверяет членство в группе
+func (id ClientIdentity) InGroup(group string) bool {
+	for _, g := range id.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// IdentityMapper получает идентичность клиента из полей сертификата согласно [identity]
+type IdentityMapper struct {
+	config   common.IdentityConfig
+	groupOID asn1.ObjectIdentifier
+}
+
+// NewIdentityMapper проверяет конфигурацию и создает маппер; пустые поля получают значения по умолчанию
+func NewIdentityMapper(config common.IdentityConfig) (*IdentityMapper, error) {
+	if config.UserSource == "" {
+		config.UserSource = identitySourceCN
+	}
+	if config.DeviceSource == "" {
+		config.DeviceSource = identitySourceSerial
+	}
+	if config.GroupSource == "" {
+		config.GroupSource = groupSourceBoth
+	}
+
+	switch config.UserSource {
+	case identitySourceCN, identitySourceEmail, identitySourceURI, identitySourceDNS:
+	default:
+		return nil, fmt.Errorf("%w: unknown identity user_source %q", common.ErrInvalidConfig, config.UserSource)
+	}
+	switch config.DeviceSource {
+	case identitySourceCN, identitySourceEmail, identitySourceURI, identitySourceDNS,
+		identitySourceSerial, identitySourceNone:
+	default:
+		return nil, fmt.Errorf("%w: unknown identity device_source %q", common.ErrInvalidConfig, config.DeviceSource)
+	}
+	switch config.GroupSource {
+	case groupSourceOU, groupSourceOID, groupSourceBoth, identitySourceNone:
+	default:
+		return nil, fmt.Errorf("%w: unknown identity group_source %q", common.ErrInvalidConfig, config.GroupSource)
+	}
+
+	groupOID := OIDClientGroups
+	if config.GroupOID != "" {
+		oid, err := parseOID(config.GroupOID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid identity group_oid %q", common.ErrInvalidConfig, config.GroupOID)
+		}
+		groupOID = oid
+	}
+
+	return &IdentityMapper{config: config, groupOID: groupOID}, nil
+}
+
+// Map извлекает пользователя, устройство и группы из клиентского сертификата
+func (m *IdentityMapper) Map(cert *x509.Certificate) (ClientIdentity, error) {
+	identity := ClientIdentity{Serial: formatSerial(cert.SerialNumber)}
+
+	user, ok := m.lookup(cert, m.config.UserSource, m.config.UserPrefix)
+	if !ok || user == "" {
+		return ClientIdentity{}, fmt.Errorf("%w: certificate has no %s user identity",
+			common.ErrAuthenticationFailed, m.config.UserSource)
+	}
+	identity.User = user
+
+	if m.config.DeviceSource != identitySourceNone {
+		device, ok := m.lookup(cert, m.config.DeviceSource, m.config.DevicePrefix)
+		if !ok {
+			return ClientIdentity{}, fmt.Errorf("%w: certificate has no %s device identity",
+				common.ErrAuthenticationFailed, m.config.DeviceSource)
+		}
+		identity.Device = device
+	}
+
+	groups, err := m.groups(cert)
+	if err != nil {
+		return ClientIdentity{}, err
+	}
+	identity.Groups = groups
+
+	return identity, nil
+}
+
+// lookup возвращает значение поля source; для SAN берется первое значение с префиксом prefix
+func (m *IdentityMapper) lookup(cert *x509.Certificate, source, prefix string) (string, bool) {
+	var values []string
+	switch source {
+	case identitySourceCN:
+		values = []string{cert.Subject.CommonName}
+	case identitySourceSerial:
+		// Продленный сертификат несет серийный номер первого сертификата устройства
+		for _, ext := range cert.Extensions {
+			var device string
+			if ext.Id.Equal(OIDClientDevice) {
+				if _, err := asn1.Unmarshal(ext.Value, &device); err == nil && device != "" {
+					return device, true
+				}
+			}
+		}
+		return formatSerial(cert.SerialNumber), true
+	case identitySourceEmail:
+		values = cert.EmailAddresses
+	case identitySourceDNS:
+		values = cert.DNSNames
+	case identitySourceURI:
+		for _, u := range cert.URIs {
+			values = append(values, u.String())
+		}
+	}
+
+	for _, value := range values {
+		if strings.HasPrefix(value, prefix) && len(value) > len(prefix) {
+			return strings.TrimPrefix(value, prefix), true
+		}
+	}
+	return "", false
+}
+
+// groups собирает группы из OU и/или расширения group_oid без повторов
+func (m *IdentityMapper) groups(cert *x509.Certificate) ([]string, error) {
+	var groups []string
+	seen := make(map[string]bool)
+	add := func(values []string) {
+		for _, value := range values {
+			if value != "" && !seen[value] {
+				seen[value] = true
+				groups = append(groups, value)
+			}
+		}
+	}
+
+	source := m.config.GroupSource
+	if source == groupSourceOID || source == groupSourceBoth {
+		for _, ext := range cert.Extensions {
+			if !ext.Id.Equal(m.groupOID) {
+				continue
+			}
+			var values []string
+			if _, err := asn1.Unmarshal(ext.Value, &values); err != nil {
+				return nil, fmt.Errorf("%w: malformed groups extension: %v", common.ErrInvalidCertificate, err)
+			}
+			add(values)
+		}
+	}
+	if source == groupSourceOU || source == groupSourceBoth {
+		add(cert.Subject.OrganizationalUnit)
+	}
+	return groups, nil
+}
+
+// parseOID разбирает OID в точечной записи
+func parseOID(value string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("OID must have at least two arcs")
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		arc, err := strconv.Atoi(part)
+		if err != nil || arc < 0 {
+			return nil, fmt.Errorf("invalid OID arc %q", part)
+		}
+		oid[i] = arc
+	}
+	return oid, nil
+}
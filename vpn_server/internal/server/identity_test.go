@@ -0,0 +1,90 @@
+package server
+
+import (
+	"testing"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestIdentityMapper_Defaults(t *testing.T) {
+	ca, err := NewCertificateAuthority(newTestCAConfig(t, ""), nil, zap.NewNop())
+	require.NoError(t, err)
+	mapper, err := NewIdentityMapper(common.IdentityConfig{})
+	require.NoError(t, err)
+
+	laptop, err := ca.Issue(IssueRequest{CommonName: "alice", Groups: []string{"engineering", "vpn"}}, "admin")
+	require.NoError(t, err)
+	phone, err := ca.Issue(IssueRequest{CommonName: "alice", Groups: []string{"engineering"}}, "admin")
+	require.NoError(t, err)
+
+	first, err := mapper.Map(parseIssued(t, laptop))
+	require.NoError(t, err)
+	second, err := mapper.Map(parseIssued(t, phone))
+	require.NoError(t, err)
+
+	assert.Equal(t, "alice", first.User)
+	assert.Equal(t, laptop.Serial, first.Device)
+	// Группы есть и в OU, и в расширении - повторов быть не должно
+	assert.Equal(t, []string{"engineering", "vpn"}, first.Groups)
+	assert.True(t, first.InGroup("vpn"))
+	assert.False(t, second.InGroup("vpn"))
+
+	// Два устройства одного пользователя не конфликтуют
+	assert.NotEqual(t, first.SessionKey(), second.SessionKey())
+}
+
+func TestIdentityMapper_SANs(t *testing.T) {
+	ca, err := NewCertificateAuthority(newTestCAConfig(t, ""), nil, zap.NewNop())
+	require.NoError(t, err)
+	issued, err := ca.Issue(IssueRequest{
+		CommonName:     "Alice Smith",
+		EmailAddresses: []string{"alice@example.com"},
+		URIs:           []string{"https://example.com/profile", "spiffe://example.com/user/alice"},
+		DNSNames:       []string{"laptop-17.devices.example.com"},
+		Groups:         []string{"engineering"},
+	}, "admin")
+	require.NoError(t, err)
+	cert := parseIssued(t, issued)
+
+	mapper, err := NewIdentityMapper(common.IdentityConfig{
+		UserSource:   "uri",
+		UserPrefix:   "spiffe://example.com/user/",
+		DeviceSource: "dns",
+		GroupSource:  "oid",
+	})
+	require.NoError(t, err)
+	identity, err := mapper.Map(cert)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", identity.User)
+	assert.Equal(t, "laptop-17.devices.example.com", identity.Device)
+	assert.Equal(t, []string{"engineering"}, identity.Groups)
+	assert.Equal(t, "alice:laptop-17.devices.example.com", identity.SessionKey())
+
+	mapper, err = NewIdentityMapper(common.IdentityConfig{UserSource: "email", DeviceSource: "none", GroupOID: "1.2.3.4"})
+	require.NoError(t, err)
+	identity, err = mapper.Map(cert)
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", identity.SessionKey())
+	// Расширение с другим OID не учитывается, остается OU
+	assert.Equal(t, []string{"engineering"}, identity.Groups)
+
+	mapper, err = NewIdentityMapper(common.IdentityConfig{UserSource: "uri", UserPrefix: "spiffe://other.org/"})
+	require.NoError(t, err)
+	_, err = mapper.Map(cert)
+	assert.ErrorIs(t, err, common.ErrAuthenticationFailed)
+}
+
+func TestNewIdentityMapper_InvalidConfig(t *testing.T) {
+	for _, config := range []common.IdentityConfig{
+		{UserSource: "serial"},
+		{DeviceSource: "hostname"},
+		{GroupSource: "ldap"},
+		{GroupOID: "1.x.3"},
+	} {
+		_, err := NewIdentityMapper(config)
+		assert.ErrorIs(t, err, common.ErrInvalidConfig, "%+v", config)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap/zapcore"
+)
+
+// LogLevelRequest запрос изменения уровня журнала
+type LogLevelRequest struct {
+	Level string `json:"level" binding:"required"` // debug, info, warn, error
+}
+
+// getLogLevel возвращает текущий уровень журнала сервера
+func (api *APIServer) getLogLevel(c *gin.Context) {
+	if api.server.LogLevel == nil {
+		c.JSON(http.StatusOK, gin.H{"level": api.logger.Level().String(), "adjustable": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"level": api.server.LogLevel.String(), "adjustable": true})
+}
+
+// setLogLevel меняет уровень журнала без перезапуска сервера
+func (api *APIServer) setLogLevel(c *gin.Context) {
+	if api.server.LogLevel == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Log level cannot be changed at runtime"})
+		return
+	}
+	var req LogLevelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	level, err := zapcore.ParseLevel(req.Level)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	previous := api.server.LogLevel.Level()
+	api.server.LogLevel.SetLevel(level)
+	api.server.Audit.Record(c.ClientIP(), "server.log_level", api.server.Config.ServerName,
+		previous.String()+" -> "+level.String())
+	c.JSON(http.StatusOK, gin.H{"level": level.String(), "adjustable": true})
+}
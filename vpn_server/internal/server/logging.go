@@ -0,0 +1,63 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// newConnID идентификатор соединения CONNECT-IP, по которому строки журнала
+// одной сессии отличаются от строк переподключения того же клиента
+func newConnID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// sessionLogger журнал сессии с полями клиента
+func (s *Server) sessionLogger(session *ClientSession) *zap.Logger {
+	fields := []zap.Field{
+		zap.String("client_id", session.ID),
+		zap.String("session_id", session.ConnID),
+		zap.Stringer("assigned_ip", session.AssignedIP),
+	}
+	if session.RemoteAddr != "" {
+		fields = append(fields, zap.String("remote_addr", session.RemoteAddr))
+	}
+	if session.Node != "" {
+		fields = append(fields, zap.String("node", session.Node))
+	}
+	return s.Logger.With(fields...)
+}
+
+// requestLogger пишет строку журнала на каждый запрос API вместо текстового
+// журнала gin
+func requestLogger(logger *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		fields := []zap.Field{
+			zap.String("method", c.Request.Method),
+			zap.String("path", c.Request.URL.Path),
+			zap.Int("status", c.Writer.Status()),
+			zap.Duration("latency", time.Since(start)),
+			zap.String("client_ip", c.ClientIP()),
+		}
+		if errs := c.Errors.ByType(gin.ErrorTypePrivate).String(); errs != "" {
+			fields = append(fields, zap.String("error", errs))
+		}
+		switch {
+		case c.Writer.Status() >= http.StatusInternalServerError:
+			logger.Error("API request", fields...)
+		case c.Writer.Status() >= http.StatusBadRequest:
+			logger.Warn("API request", fields...)
+		default:
+			logger.Debug("API request", fields...)
+		}
+	}
+}
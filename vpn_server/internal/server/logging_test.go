@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSessionLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	s := &Server{Logger: zap.New(core)}
+	session := &ClientSession{
+		ID:         "alice:laptop",
+		ConnID:     newConnID(),
+		AssignedIP: netip.MustParseAddr("10.0.0.2"),
+		RemoteAddr: "192.0.2.10:51000",
+	}
+	assert.Len(t, session.ConnID, 16)
+	assert.NotEqual(t, session.ConnID, newConnID())
+
+	s.sessionLogger(session).Info("Closing session", zap.String("reason", "test"))
+	entries := logs.All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "alice:laptop", fields["client_id"])
+	assert.Equal(t, session.ConnID, fields["session_id"])
+	assert.Equal(t, "10.0.0.2", fields["assigned_ip"])
+	assert.Equal(t, "192.0.2.10:51000", fields["remote_addr"])
+	assert.Equal(t, "test", fields["reason"])
+	assert.NotContains(t, fields, "node")
+}
+
+func TestLogLevelAPI(t *testing.T) {
+	s := newTestDrainServer(t)
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	core, logs := observer.New(level)
+	s.Logger = zap.New(core)
+	s.LogLevel = &level
+	api, err := NewAPIServer(s)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	api.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/log-level", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"level":"info","adjustable":true}`, rec.Body.String())
+	// Успешные запросы API пишутся только на уровне debug
+	assert.Zero(t, logs.FilterMessage("API request").Len())
+
+	// Уровень меняет только администратор
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/v1/log-level", strings.NewReader(`{"level":"debug"}`)))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, zapcore.InfoLevel, level.Level())
+
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, newAdminRequest(http.MethodPut, "/api/v1/log-level", strings.NewReader(`{"level":"verbose"}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, zapcore.InfoLevel, level.Level())
+
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, newAdminRequest(http.MethodPut, "/api/v1/log-level", strings.NewReader(`{"level":"debug"}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, zapcore.DebugLevel, level.Level())
+
+	events := s.Audit.List(0)
+	require.NotEmpty(t, events)
+	assert.Equal(t, "server.log_level", events[len(events)-1].Action)
+	assert.Equal(t, "info -> debug", events[len(events)-1].Details)
+
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/log-level", nil))
+	var resp struct{ Level string }
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "debug", resp.Level)
+	requests := logs.FilterMessage("API request").FilterField(zap.String("path", "/api/v1/log-level")).All()
+	require.NotEmpty(t, requests)
+	assert.EqualValues(t, http.StatusOK, requests[len(requests)-1].ContextMap()["status"])
+
+	// Без общего уровня журнал нельзя перенастроить
+	s.LogLevel = nil
+	rec = httptest.NewRecorder()
+	api.router.ServeHTTP(rec, newAdminRequest(http.MethodPut, "/api/v1/log-level", strings.NewReader(`{"level":"warn"}`)))
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+}
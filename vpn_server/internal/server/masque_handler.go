@@ -2,20 +2,23 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/netip"
+	"strconv"
 	"strings"
 	"time"
 
 	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
 )
 
 // handleMASQUERequest обрабатывает MASQUE CONNECT-IP запросы
 func (s *Server) handleMASQUERequest(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received request: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	logger := s.Logger.With(zap.String("remote_addr", r.RemoteAddr))
+	logger.Debug("Received request", zap.String("method", r.Method), zap.String("path", r.URL.Path))
 
 	// MASQUE CONNECT-IP использует обычный HTTP CONNECT метод с специальными заголовками
 	if r.Method != http.MethodConnect {
@@ -34,6 +37,18 @@ func (s *Server) handleMASQUERequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Сервер в режиме drain не открывает новые сессии
+	if s.Draining() {
+		s.rejectDraining(w)
+		return
+	}
+
+	// Запрос из 0-RTT выполняется только после завершения рукопожатия
+	earlyData := isEarlyData(r)
+	if !s.confirmEarlyData(w, r) {
+		return
+	}
+
 	// Получаем клиентский сертификат для аутентификации
 	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
 		http.Error(w, "Client certificate required", http.StatusUnauthorized)
@@ -41,48 +56,96 @@ func (s *Server) handleMASQUERequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	clientCert := r.TLS.PeerCertificates[0]
-	clientID := clientCert.Subject.CommonName
-	if clientID == "" {
+	identity, err := s.Identity.Map(clientCert)
+	if err != nil {
+		logger.Warn("Rejected client certificate", zap.String("cert_serial", formatSerial(clientCert.SerialNumber)), zap.Error(err))
 		http.Error(w, "Invalid client certificate", http.StatusUnauthorized)
 		return
 	}
 
-	log.Printf("Client authenticated: %s", clientID)
+	// Второй фактор: токен должен принадлежать пользователю из сертификата
+	if s.BearerAuth != nil {
+		if err := s.BearerAuth.Authenticate(bearerToken(r), identity); err != nil {
+			logger.Warn("Bearer authentication failed", zap.String("user", identity.User), zap.Error(err))
+			s.Metrics.RecordError("bearer_auth_failed")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="masque-vpn", error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// Сессии различаются по паре (пользователь, устройство)
+	clientID := identity.SessionKey()
+	logger = logger.With(zap.String("client_id", clientID))
+	logger.Info("Client authenticated",
+		zap.String("user", identity.User),
+		zap.String("device", identity.Device),
+		zap.Strings("groups", identity.Groups))
+
+	// Исчерпанная квота трафика
+	if resetAt, err := s.Quotas.Check(identity); err != nil {
+		logger.Warn("Rejected session", zap.Error(err))
+		s.Metrics.RecordError("quota_rejected")
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(resetAt).Seconds())+1))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	// Создаем сессию клиента
+	connID := newConnID()
+	logger = logger.With(zap.String("session_id", connID))
+	session := &ClientSession{
+		ConnID:     connID,
+		RemoteAddr: r.RemoteAddr,
+		Conn:       common.NewMASQUEConnForServer(logger), // без прямого доступа к stream до HTTP/3 hijacking
+		CertSerial: identity.Serial,
+		Identity:   identity,
+		FecEnabled: s.Config.FEC.Enabled,
+		Shaper:     s.Shaping.NewShaper(s.rateLimitFor(identity)),
+	}
 
-	// Выделяем IP адрес для клиента
-	assignedPrefix, err := s.assignIPToClient(clientID)
+	// Применяем политику одновременных сессий и выделяем IP адрес
+	assignedPrefix, evicted, err := s.openSession(session)
+	s.closeEvictedSessions(evicted, "replaced by a new session of "+identity.User)
 	if err != nil {
-		log.Printf("Failed to assign IP to client %s: %v", clientID, err)
+		session.Conn.Close()
+		if errors.Is(err, ErrSessionLimit) {
+			logger.Warn("Rejected session", zap.Error(err))
+			s.Metrics.RecordError("session_limit")
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, ErrClusterUnavailable) {
+			// Клиент перейдет на другой узел
+			logger.Warn("Rejected session", zap.Error(err))
+			s.Metrics.RecordError("cluster_unavailable")
+			http.Error(w, "Cluster unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		logger.Error("Failed to assign IP", zap.Error(err))
 		http.Error(w, "Failed to assign IP", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Assigned IP %s to client %s", assignedPrefix, clientID)
+	logger = s.sessionLogger(session)
+	logger.Info("Assigned IP", zap.Stringer("assigned_prefix", assignedPrefix))
 
 	// Отправляем успешный ответ CONNECT
 	w.Header().Set("Content-Type", "application/masque")
+	s.setNetworkHeaders(w.Header())
 	w.WriteHeader(http.StatusOK)
 
+	// Через поток ответа сервер в режиме drain просит клиента перейти на другой сервер
+	s.attachCapsules(session, w)
+	defer session.detachCapsules()
+
 	// Для HTTP/3 hijacking нужно использовать другой подход
 	// Пока используем упрощенную реализацию без hijacking
-	log.Printf("MASQUE CONNECT request accepted for client %s", clientID)
-
-	// Создаем MASQUE соединение без прямого доступа к stream
 	// В реальной реализации здесь должен быть HTTP/3 hijacking
-	masqueConn := common.NewMASQUEConnForServer(nil)
-
-	// Создаем сессию клиента
-	session := &ClientSession{
-		Conn:       masqueConn,
-		FecEnabled: s.Config.FEC.Enabled,
-	}
-
-	// Сохраняем сессию
-	s.IPPoolMu.Lock()
-	s.IPConnMap[assignedPrefix.Addr()] = session
-	s.IPPoolMu.Unlock()
+	logger.Info("MASQUE CONNECT request accepted")
 
 	// Обновляем метрики
+	s.Metrics.RecordHandshake(handshakeKind(r, earlyData))
 	s.Metrics.RecordConnection()
 	defer s.Metrics.RecordDisconnection()
 
@@ -110,36 +173,17 @@ func (s *Server) handleServerInfo(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(response))
 }
 
-// assignIPToClient выделяет IP адрес клиенту
-func (s *Server) assignIPToClient(clientID string) (netip.Prefix, error) {
-	s.IPPoolMu.Lock()
-	defer s.IPPoolMu.Unlock()
-
-	// Проверяем, есть ли уже назначенный IP
-	if existingIP, exists := s.ClientIPMap[clientID]; exists {
-		return netip.PrefixFrom(existingIP, 32), nil
-	}
-
-	// Выделяем новый IP
-	assignedPrefix, err := s.IPPool.Allocate(clientID)
-	if err != nil {
-		return netip.Prefix{}, fmt.Errorf("failed to allocate IP: %w", err)
-	}
-
-	s.ClientIPMap[clientID] = assignedPrefix.Addr()
-	return assignedPrefix, nil
-}
-
 // handleClientConnection обрабатывает соединение с клиентом
 func (s *Server) handleClientConnection(session *ClientSession, clientID string, assignedIP netip.Addr, stream interface{}) {
+	logger := s.sessionLogger(session)
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Panic in client connection handler for %s: %v", clientID, r)
+			logger.Error("Panic in client connection handler", zap.Any("panic", r))
 			s.Metrics.RecordError("panic")
 		}
 	}()
 
-	log.Printf("Starting connection handler for client %s (IP: %s)", clientID, assignedIP)
+	logger.Debug("Starting connection handler")
 	connectionStart := time.Now()
 
 	// Создаем контекст с таймаутом
@@ -157,7 +201,7 @@ func (s *Server) handleClientConnection(session *ClientSession, clientID string,
 			}
 		}()
 		
-		log.Printf("TUN->Client proxy started for %s", clientID)
+		logger.Debug("TUN->Client proxy started")
 		
 		// Реализуем прокси от TUN к клиенту
 		if err := s.proxyTunToClient(ctx, session, assignedIP); err != nil {
@@ -176,7 +220,7 @@ func (s *Server) handleClientConnection(session *ClientSession, clientID string,
 			}
 		}()
 		
-		log.Printf("Client->TUN proxy started for %s", clientID)
+		logger.Debug("Client->TUN proxy started")
 		
 		// Реализуем прокси от клиента к TUN
 		if err := s.proxyClientToTun(ctx, session, assignedIP); err != nil {
@@ -191,11 +235,11 @@ func (s *Server) handleClientConnection(session *ClientSession, clientID string,
 	select {
 	case err := <-errChan:
 		if err != nil {
-			log.Printf("Proxy error for client %s: %v", clientID, err)
+			logger.Warn("Proxy error", zap.Error(err))
 			s.Metrics.RecordError("proxy_error")
 		}
 	case <-ctx.Done():
-		log.Printf("Connection timeout for client %s", clientID)
+		logger.Warn("Connection timeout")
 		s.Metrics.RecordError("timeout")
 	}
 
@@ -203,19 +247,20 @@ func (s *Server) handleClientConnection(session *ClientSession, clientID string,
 	duration := time.Since(connectionStart).Seconds()
 	s.Metrics.RecordConnectionDuration(duration)
 
-	log.Printf("Connection handler finished for client %s (duration: %.2fs)", clientID, duration)
+	logger.Info("Connection handler finished", zap.Float64("duration_seconds", duration))
 	
 	// Очищаем ресурсы
-	s.cleanupClientSession(clientID, assignedIP)
+	s.cleanupClientSession(session)
 }
 
 // proxyTunToClient проксирует пакеты от TUN устройства к клиенту
 func (s *Server) proxyTunToClient(ctx context.Context, session *ClientSession, clientIP netip.Addr) error {
-	log.Printf("Starting TUN->Client proxy for IP %s", clientIP)
+	logger := s.sessionLogger(session)
+	logger.Debug("Starting TUN->Client proxy")
 	
 	// Проверяем наличие TUN устройства
 	if s.TunDev == nil {
-		log.Printf("TUN device not available, TUN->Client proxy disabled for IP %s", clientIP)
+		logger.Debug("TUN device not available, TUN->Client proxy disabled")
 		<-ctx.Done()
 		return nil
 	}
@@ -225,7 +270,7 @@ func (s *Server) proxyTunToClient(ctx context.Context, session *ClientSession, c
 	for {
 		select {
 		case <-ctx.Done():
-			log.Printf("TUN->Client proxy stopped for IP %s (context cancelled)", clientIP)
+			logger.Debug("TUN->Client proxy stopped (context cancelled)")
 			return nil
 		default:
 		}
@@ -234,7 +279,7 @@ func (s *Server) proxyTunToClient(ctx context.Context, session *ClientSession, c
 		n, err := s.TunDev.ReadPacket(buffer, 100) // 100ms timeout
 		if err != nil {
 			if isNetworkClosed(err) {
-				log.Printf("TUN device closed, stopping TUN->Client proxy for IP %s", clientIP)
+				logger.Debug("TUN device closed, stopping TUN->Client proxy")
 				return nil
 			}
 			// Игнорируем таймауты и продолжаем
@@ -261,14 +306,20 @@ func (s *Server) proxyTunToClient(ctx context.Context, session *ClientSession, c
 			continue // Пакет не для этого клиента
 		}
 
+		// Ограничение полосы клиента
+		if !s.shapePacket(ctx, session, directionDownload, n) {
+			continue
+		}
+
 		// Отправляем пакет клиенту через MASQUE соединение
 		if err := session.Conn.WritePacket(packetData); err != nil {
 			if isNetworkClosed(err) {
-				log.Printf("MASQUE connection closed, stopping TUN->Client proxy for IP %s", clientIP)
+				logger.Debug("MASQUE connection closed, stopping TUN->Client proxy")
 				return nil
 			}
 			return fmt.Errorf("failed to write packet to MASQUE connection: %w", err)
 		}
+		s.accountTraffic(session, directionDownload, n)
 		
 		// Обновляем метрики
 		s.Metrics.PacketsForwarded.Inc()
@@ -278,11 +329,12 @@ func (s *Server) proxyTunToClient(ctx context.Context, session *ClientSession, c
 
 // proxyClientToTun проксирует пакеты от клиента к TUN устройству
 func (s *Server) proxyClientToTun(ctx context.Context, session *ClientSession, clientIP netip.Addr) error {
-	log.Printf("Starting Client->TUN proxy for IP %s", clientIP)
+	logger := s.sessionLogger(session)
+	logger.Debug("Starting Client->TUN proxy")
 	
 	// Проверяем наличие TUN устройства
 	if s.TunDev == nil {
-		log.Printf("TUN device not available, Client->TUN proxy disabled for IP %s", clientIP)
+		logger.Debug("TUN device not available, Client->TUN proxy disabled")
 		<-ctx.Done()
 		return nil
 	}
@@ -292,7 +344,7 @@ func (s *Server) proxyClientToTun(ctx context.Context, session *ClientSession, c
 	for {
 		select {
 		case <-ctx.Done():
-			log.Printf("Client->TUN proxy stopped for IP %s (context cancelled)", clientIP)
+			logger.Debug("Client->TUN proxy stopped (context cancelled)")
 			return nil
 		default:
 		}
@@ -301,7 +353,7 @@ func (s *Server) proxyClientToTun(ctx context.Context, session *ClientSession, c
 		n, err := session.Conn.ReadPacket(buffer)
 		if err != nil {
 			if isNetworkClosed(err) {
-				log.Printf("MASQUE connection closed, stopping Client->TUN proxy for IP %s", clientIP)
+				logger.Debug("MASQUE connection closed, stopping Client->TUN proxy")
 				return nil
 			}
 			// Игнорируем таймауты и продолжаем
@@ -325,18 +377,24 @@ func (s *Server) proxyClientToTun(ctx context.Context, session *ClientSession, c
 		
 		// Проверяем, что пакет от правильного клиента
 		if srcIP != clientIP {
-			log.Printf("Packet from wrong source IP %s, expected %s", srcIP, clientIP)
+			logger.Debug("Dropping packet from wrong source IP", zap.Stringer("src_ip", srcIP))
+			continue
+		}
+
+		// Ограничение полосы клиента
+		if !s.shapePacket(ctx, session, directionUpload, n) {
 			continue
 		}
 
 		// Отправляем пакет в TUN устройство
 		if err := s.TunDev.WritePacket(packetData, 0); err != nil {
 			if isNetworkClosed(err) {
-				log.Printf("TUN device closed, stopping Client->TUN proxy for IP %s", clientIP)
+				logger.Debug("TUN device closed, stopping Client->TUN proxy")
 				return nil
 			}
 			return fmt.Errorf("failed to write packet to TUN device: %w", err)
 		}
+		s.accountTraffic(session, directionUpload, n)
 		
 		// Обновляем метрики
 		s.Metrics.TunPacketsWritten.Inc()
@@ -345,21 +403,24 @@ func (s *Server) proxyClientToTun(ctx context.Context, session *ClientSession, c
 }
 
 // cleanupClientSession очищает ресурсы клиентской сессии
-func (s *Server) cleanupClientSession(clientID string, assignedIP netip.Addr) {
+func (s *Server) cleanupClientSession(session *ClientSession) {
 	s.IPPoolMu.Lock()
-	defer s.IPPoolMu.Unlock()
 
-	// Удаляем из карт
-	delete(s.ClientIPMap, clientID)
-	if session, exists := s.IPConnMap[assignedIP]; exists {
-		if session.Conn != nil {
-			session.Conn.Close()
-		}
-		delete(s.IPConnMap, assignedIP)
+	if session.Conn != nil {
+		session.Conn.Close()
+	}
+
+	// Сессия могла быть уже удалена через API или вытеснена новой сессией того же устройства
+	if current, exists := s.IPConnMap[session.AssignedIP]; !exists || current != session {
+		s.IPPoolMu.Unlock()
+		s.sessionLogger(session).Debug("Session was already removed")
+		return
 	}
 
-	// Освобождаем IP
-	s.IPPool.Release(assignedIP)
+	// Удаляем из карт и освобождаем IP
+	release := s.removeSessionLocked(session.ID, session.AssignedIP)
+	s.IPPoolMu.Unlock()
+	release()
 
-	log.Printf("Cleaned up session for client %s (IP: %s)", clientID, assignedIP)
+	s.sessionLogger(session).Info("Cleaned up session")
 }
\ No newline at end of file
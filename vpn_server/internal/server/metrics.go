@@ -31,6 +31,14 @@ type Metrics struct {
 	TunInterfaceStatus prometheus.Gauge
 	TunPacketsRead     prometheus.Counter
 	TunPacketsWritten  prometheus.Counter
+	
+	// Метрики ограничения полосы
+	ShapedBytes         *prometheus.CounterVec
+	ShapingDroppedBytes *prometheus.CounterVec
+	
+	// Метрики рукопожатий и 0-RTT
+	Handshakes        *prometheus.CounterVec
+	EarlyDataRequests *prometheus.CounterVec
 }
 
 // NewMetrics создает новый экземпляр метрик
@@ -107,6 +115,26 @@ func NewMetrics() *Metrics {
 			Name: "vpn_server_tun_packets_written_total",
 			Help: "Total packets written to TUN interface",
 		}),
+		
+		ShapedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vpn_server_shaped_bytes_total",
+			Help: "Bytes delayed by per-client bandwidth shaping",
+		}, []string{"direction"}),
+		
+		ShapingDroppedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vpn_server_shaping_dropped_bytes_total",
+			Help: "Bytes dropped by per-client bandwidth shaping",
+		}, []string{"direction"}),
+		
+		Handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vpn_server_handshakes_total",
+			Help: "CONNECT-IP sessions by TLS handshake: full, resumed, 0rtt",
+		}, []string{"type"}),
+		
+		EarlyDataRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vpn_server_early_data_requests_total",
+			Help: "Requests received in 0-RTT by outcome",
+		}, []string{"result"}),
 	}
 	
 	// Регистрируем все метрики
@@ -125,6 +153,10 @@ func NewMetrics() *Metrics {
 		metrics.TunInterfaceStatus,
 		metrics.TunPacketsRead,
 		metrics.TunPacketsWritten,
+		metrics.ShapedBytes,
+		metrics.ShapingDroppedBytes,
+		metrics.Handshakes,
+		metrics.EarlyDataRequests,
 	)
 	
 	return metrics
@@ -154,4 +186,24 @@ func (m *Metrics) RecordPacketProcessing(duration float64) {
 // RecordConnectionDuration записывает продолжительность соединения
 func (m *Metrics) RecordConnectionDuration(duration float64) {
 	m.ConnectionDuration.Observe(duration)
-}
\ No newline at end of file
+}
+
+// RecordShaping записывает задержанные или отброшенные ограничителем байты
+func (m *Metrics) RecordShaping(direction string, result shapeResult, bytes int) {
+	switch result {
+	case shapeDelayed:
+		m.ShapedBytes.WithLabelValues(direction).Add(float64(bytes))
+	case shapeDropped:
+		m.ShapingDroppedBytes.WithLabelValues(direction).Add(float64(bytes))
+		m.PacketsDropped.Inc()
+	}
+}
+// RecordHandshake записывает тип рукопожатия новой сессии
+func (m *Metrics) RecordHandshake(kind string) {
+	m.Handshakes.WithLabelValues(kind).Inc()
+}
+
+// RecordEarlyData записывает исход запроса, пришедшего в 0-RTT
+func (m *Metrics) RecordEarlyData(result string) {
+	m.EarlyDataRequests.WithLabelValues(result).Inc()
+}
@@ -0,0 +1,221 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const defaultNATTable = "masque_vpn"
+
+// sysctlRoot корень /proc/sys; подменяется в тестах
+var sysctlRoot = "/proc/sys"
+
+// NATManager правила маскарадинга nftables и sysctl IP forwarding, созданные сервером.
+// Все правила живут в отдельной таблице, поэтому Close удаляет их вместе с таблицей.
+type NATManager struct {
+	conn  *nftables.Conn
+	table *nftables.Table
+	// sysctl -> значение до включения forwarding, для восстановления в Close
+	sysctls map[string]string
+	logger  *zap.Logger
+}
+
+// NewNATManager включает IP forwarding и создает правила masquerade для сетей клиентов
+func NewNATManager(config common.NATConfig, prefixes []netip.Prefix, tunName string, logger *zap.Logger) (*NATManager, error) {
+	if config.Table == "" {
+		config.Table = defaultNATTable
+	}
+	if config.OutInterface != "" {
+		if _, err := net.InterfaceByName(config.OutInterface); err != nil {
+			return nil, fmt.Errorf("%w: nat out_interface %q: %v", common.ErrInvalidConfig, config.OutInterface, err)
+		}
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open nftables netlink connection: %w", err)
+	}
+	m := &NATManager{
+		conn:    conn,
+		table:   &nftables.Table{Name: config.Table, Family: nftables.TableFamilyINet},
+		sysctls: make(map[string]string),
+		logger:  logger,
+	}
+
+	if err := m.enableForwarding(prefixes); err != nil {
+		m.restoreSysctls()
+		return nil, err
+	}
+	if err := m.installRules(prefixes, config.OutInterface, tunName); err != nil {
+		m.restoreSysctls()
+		return nil, err
+	}
+
+	prefixStrings := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		prefixStrings[i] = prefix.String()
+	}
+	logger.Info("NAT enabled", zap.String("table", "inet "+config.Table), zap.Strings("masquerade", prefixStrings))
+	return m, nil
+}
+
+// installRules создает таблицу с цепочкой postrouting и правилом masquerade для каждой сети
+func (m *NATManager) installRules(prefixes []netip.Prefix, outInterface, tunName string) error {
+	// Таблица могла остаться после аварийного завершения: пересоздаем ее с нуля
+	if existing, err := m.conn.ListTableOfFamily(m.table.Name, m.table.Family); err == nil && existing != nil {
+		m.conn.DelTable(m.table)
+	}
+
+	m.conn.AddTable(m.table)
+	chain := m.conn.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    m.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	for _, prefix := range prefixes {
+		m.conn.AddRule(&nftables.Rule{
+			Table: m.table,
+			Chain: chain,
+			Exprs: masqueradeExprs(prefix, outInterface, tunName),
+		})
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("%w: failed to install nftables masquerade rules: %v", common.ErrSystemCall, err)
+	}
+	return nil
+}
+
+// masqueradeExprs собирает правило
+// "meta nfproto <ip|ip6> <ip|ip6> saddr <prefix> oifname <out|!= tun> masquerade"
+func masqueradeExprs(prefix netip.Prefix, outInterface, tunName string) []expr.Any {
+	prefix = prefix.Masked()
+	proto, offset := byte(unix.NFPROTO_IPV4), uint32(12)
+	if prefix.Addr().Is6() {
+		proto, offset = byte(unix.NFPROTO_IPV6), 8
+	}
+	addrLen := uint32(prefix.Addr().BitLen() / 8)
+	mask := net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen())
+
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: addrLen},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: addrLen, Mask: mask, Xor: make([]byte, addrLen)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: prefix.Addr().AsSlice()},
+	}
+
+	switch {
+	case outInterface != "":
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData(outInterface)},
+		)
+	case tunName != "":
+		// Трафик между клиентами остается внутри VPN без трансляции
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: ifnameData(tunName)},
+		)
+	}
+
+	return append(exprs, &expr.Masq{})
+}
+
+// ifnameData имя интерфейса в формате nftables: с завершающим нулем, дополненное до IFNAMSIZ
+func ifnameData(name string) []byte {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name+"\x00")
+	return data
+}
+
+// enableForwarding включает IP forwarding для семейств адресов клиентских сетей
+func (m *NATManager) enableForwarding(prefixes []netip.Prefix) error {
+	for _, prefix := range prefixes {
+		key := "net/ipv4/ip_forward"
+		if prefix.Addr().Is6() {
+			key = "net/ipv6/conf/all/forwarding"
+		}
+		if _, done := m.sysctls[key]; done {
+			continue
+		}
+
+		previous, err := readSysctl(key)
+		if err != nil {
+			return err
+		}
+		if previous == "1" {
+			continue
+		}
+		if err := writeSysctl(key, "1"); err != nil {
+			return err
+		}
+		m.sysctls[key] = previous
+		m.logger.Info("Enabled sysctl", zap.String("sysctl", strings.ReplaceAll(key, "/", ".")), zap.String("previous", previous))
+	}
+	return nil
+}
+
+// restoreSysctls возвращает sysctl, измененные сервером, к прежним значениям
+func (m *NATManager) restoreSysctls() error {
+	var errs []error
+	for key, previous := range m.sysctls {
+		if err := writeSysctl(key, previous); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(m.sysctls, key)
+		m.logger.Info("Restored sysctl", zap.String("sysctl", strings.ReplaceAll(key, "/", ".")), zap.String("value", previous))
+	}
+	return errors.Join(errs...)
+}
+
+// readSysctl читает значение sysctl, например net/ipv4/ip_forward
+func readSysctl(key string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(sysctlRoot, key))
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to read sysctl %s: %v", common.ErrSystemCall, key, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// writeSysctl записывает значение sysctl
+func writeSysctl(key, value string) error {
+	if err := os.WriteFile(filepath.Join(sysctlRoot, key), []byte(value+"\n"), 0644); err != nil {
+		return fmt.Errorf("%w: failed to set sysctl %s: %v", common.ErrSystemCall, key, err)
+	}
+	return nil
+}
+
+// Close удаляет таблицу nftables и восстанавливает sysctl
+func (m *NATManager) Close() error {
+	var errs []error
+	if m.table != nil {
+		m.conn.DelTable(m.table)
+		if err := m.conn.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete nftables table %s: %w", m.table.Name, err))
+		} else {
+			m.logger.Info("Removed nftables table", zap.String("table", "inet "+m.table.Name))
+		}
+		m.table = nil
+	}
+	if err := m.restoreSysctls(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
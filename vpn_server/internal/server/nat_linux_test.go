@@ -0,0 +1,81 @@
+//go:build linux
+
+package server
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+func TestMasqueradeExprs(t *testing.T) {
+	exprs := masqueradeExprs(netip.MustParsePrefix("10.0.0.7/24"), "", "tun0")
+	require.Len(t, exprs, 8)
+
+	assert.Equal(t, []byte{unix.NFPROTO_IPV4}, exprs[1].(*expr.Cmp).Data)
+	payload := exprs[2].(*expr.Payload)
+	assert.Equal(t, uint32(12), payload.Offset)
+	assert.Equal(t, uint32(4), payload.Len)
+	assert.Equal(t, []byte{255, 255, 255, 0}, exprs[3].(*expr.Bitwise).Mask)
+	// Адрес сети нормализуется
+	assert.Equal(t, []byte{10, 0, 0, 0}, exprs[4].(*expr.Cmp).Data)
+
+	oif := exprs[6].(*expr.Cmp)
+	assert.Equal(t, expr.CmpOpNeq, oif.Op)
+	assert.Equal(t, ifnameData("tun0"), oif.Data)
+	assert.IsType(t, &expr.Masq{}, exprs[7])
+
+	exprs = masqueradeExprs(netip.MustParsePrefix("fd00:10::/64"), "eth0", "tun0")
+	assert.Equal(t, []byte{unix.NFPROTO_IPV6}, exprs[1].(*expr.Cmp).Data)
+	assert.Equal(t, uint32(8), exprs[2].(*expr.Payload).Offset)
+	assert.Equal(t, uint32(16), exprs[2].(*expr.Payload).Len)
+	assert.Equal(t, expr.CmpOpEq, exprs[6].(*expr.Cmp).Op)
+	assert.Equal(t, ifnameData("eth0"), exprs[6].(*expr.Cmp).Data)
+
+	// Без TUN и внешнего интерфейса правило не проверяет oifname
+	assert.Len(t, masqueradeExprs(netip.MustParsePrefix("10.0.0.0/24"), "", ""), 6)
+}
+
+func TestNATManager_Forwarding(t *testing.T) {
+	root := t.TempDir()
+	previousRoot := sysctlRoot
+	sysctlRoot = root
+	t.Cleanup(func() { sysctlRoot = previousRoot })
+
+	writeTestSysctl(t, root, "net/ipv4/ip_forward", "0\n")
+	writeTestSysctl(t, root, "net/ipv6/conf/all/forwarding", "1\n")
+
+	m := &NATManager{sysctls: make(map[string]string), logger: zap.NewNop()}
+	require.NoError(t, m.enableForwarding([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("fd00:10::/64"),
+	}))
+
+	value, err := readSysctl("net/ipv4/ip_forward")
+	require.NoError(t, err)
+	assert.Equal(t, "1", value)
+	// Уже включенный forwarding не запоминается и не сбрасывается при остановке
+	assert.Equal(t, map[string]string{"net/ipv4/ip_forward": "0"}, m.sysctls)
+
+	require.NoError(t, m.Close())
+	value, err = readSysctl("net/ipv4/ip_forward")
+	require.NoError(t, err)
+	assert.Equal(t, "0", value)
+	value, err = readSysctl("net/ipv6/conf/all/forwarding")
+	require.NoError(t, err)
+	assert.Equal(t, "1", value)
+}
+
+func writeTestSysctl(t *testing.T, root, key, value string) {
+	t.Helper()
+	path := filepath.Join(root, key)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(value), 0644))
+}
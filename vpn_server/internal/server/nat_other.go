@@ -0,0 +1,24 @@
+//go:build !linux
+
+package server
+
+import (
+	"fmt"
+	"net/netip"
+
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+// NATManager управление NAT доступно только в Linux (nftables)
+type NATManager struct{}
+
+// NewNATManager сообщает, что управление NAT не поддерживается на этой платформе
+func NewNATManager(config common.NATConfig, prefixes []netip.Prefix, tunName string, logger *zap.Logger) (*NATManager, error) {
+	return nil, fmt.Errorf("%w: nat.enabled requires Linux with nftables", common.ErrInvalidConfig)
+}
+
+// Close ничего не делает
+func (m *NATManager) Close() error {
+	return nil
+}
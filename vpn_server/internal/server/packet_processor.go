@@ -2,26 +2,27 @@ package server
 
 import (
 	"fmt"
-	"log"
 	"net"
 	"net/netip"
+
+	"go.uber.org/zap"
 )
 
 // processPackets обрабатывает пакеты из TUN устройства
 func (s *Server) processPackets() {
 	buffer := make([]byte, 2048)
 	
-	log.Printf("Starting packet processor for TUN device %s", s.TunDev.Name())
+	s.Logger.Info("Starting packet processor", zap.String("tun", s.TunDev.Name()))
 	
 	for {
 		// Читаем пакет из TUN устройства
 		n, err := s.TunDev.ReadPacket(buffer, 0)
 		if err != nil {
 			if isNetworkClosed(err) {
-				log.Printf("TUN device closed, stopping packet processor")
+				s.Logger.Info("TUN device closed, stopping packet processor")
 				return
 			}
-			log.Printf("Error reading from TUN device: %v", err)
+			s.Logger.Warn("Error reading from TUN device", zap.Error(err))
 			continue
 		}
 
@@ -34,20 +35,20 @@ func (s *Server) processPackets() {
 		// Парсим IP пакет для определения назначения
 		destIP, err := s.parseDestinationIP(packetData)
 		if err != nil {
-			log.Printf("Failed to parse packet destination: %v", err)
+			s.Logger.Debug("Failed to parse packet destination", zap.Error(err))
 			continue
 		}
 
 		// Находим клиентскую сессию для этого IP
 		session := s.findClientSession(destIP)
 		if session == nil {
-			log.Printf("No client session found for destination IP %s", destIP)
+			s.Logger.Debug("No client session found for destination", zap.Stringer("dest_ip", destIP))
 			continue
 		}
 
 		// Отправляем пакет клиенту
 		if err := s.forwardPacketToClient(session, packetData); err != nil {
-			log.Printf("Failed to forward packet to client: %v", err)
+			s.sessionLogger(session).Debug("Failed to forward packet to client", zap.Error(err))
 			continue
 		}
 
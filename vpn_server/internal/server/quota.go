@@ -0,0 +1,380 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+const quotaFileName = "quota_usage.json"
+
+// Действия при превышении квоты
+const (
+	QuotaActionDisconnect = "disconnect"
+	QuotaActionThrottle   = "throttle"
+	QuotaActionNotify     = "notify"
+)
+
+// Периоды квоты
+const (
+	quotaPeriodDaily   = "daily"
+	quotaPeriodMonthly = "monthly"
+)
+
+const (
+	bytesPerMB = 1 << 20
+	// quotaSaveInterval период сохранения учета трафика на диск
+	quotaSaveInterval = time.Minute
+)
+
+// ErrQuotaExceeded квота трафика пользователя исчерпана
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+// quotaUsage трафик пользователя в текущих суточном и месячном периодах
+type quotaUsage struct {
+	Day        string `json:"day"` // начало периода, 2006-01-02
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+	// Превышение уже обработано в текущем периоде
+	DayNotified   bool `json:"day_notified,omitempty"`
+	MonthNotified bool `json:"month_notified,omitempty"`
+}
+
+// QuotaStatus состояние квоты пользователя
+type QuotaStatus struct {
+	common.QuotaLimit
+	Source         string    `json:"source"` // user, group:<name>, default
+	DayUsedBytes   int64     `json:"day_used_bytes"`
+	MonthUsedBytes int64     `json:"month_used_bytes"`
+	DayResetAt     time.Time `json:"day_reset_at"`
+	MonthResetAt   time.Time `json:"month_reset_at"`
+	Exceeded       string    `json:"exceeded,omitempty"` // daily или monthly
+}
+
+// ResetAt возвращает момент, когда снова станет доступен трафик превышенной квоты
+func (st QuotaStatus) ResetAt() time.Time {
+	if st.Exceeded == quotaPeriodMonthly {
+		return st.MonthResetAt
+	}
+	return st.DayResetAt
+}
+
+// QuotaManager учитывает трафик пользователей и проверяет квоты [quotas].
+// Учет хранится в state_file и переживает переподключения и перезапуск сервера.
+type QuotaManager struct {
+	config   common.QuotaConfig
+	location *time.Location
+	path     string
+	now      func() time.Time
+	logger   *zap.Logger
+
+	mu    sync.Mutex
+	usage map[string]*quotaUsage // пользователь -> трафик
+	dirty bool
+}
+
+// NewQuotaManager проверяет конфигурацию квот и загружает сохраненный учет трафика
+func NewQuotaManager(config common.ServerConfig, logger *zap.Logger) (*QuotaManager, error) {
+	quotas := config.Quotas
+	if err := validateQuotaLimit(quotaDefaultLimit(quotas)); err != nil {
+		return nil, fmt.Errorf("%w: quotas: %v", common.ErrInvalidConfig, err)
+	}
+	for user, limit := range quotas.Users {
+		if err := validateQuotaLimit(limit); err != nil {
+			return nil, fmt.Errorf("%w: quotas for user %s: %v", common.ErrInvalidConfig, user, err)
+		}
+	}
+	for group, limit := range quotas.Groups {
+		if err := validateQuotaLimit(limit); err != nil {
+			return nil, fmt.Errorf("%w: quotas for group %s: %v", common.ErrInvalidConfig, group, err)
+		}
+	}
+
+	if quotas.ResetDay == 0 {
+		quotas.ResetDay = 1
+	}
+	if quotas.ResetDay < 1 || quotas.ResetDay > 28 {
+		return nil, fmt.Errorf("%w: quotas reset_day must be between 1 and 28", common.ErrInvalidConfig)
+	}
+	location := time.UTC
+	if quotas.Timezone != "" {
+		loc, err := time.LoadLocation(quotas.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("%w: quotas timezone %q: %v", common.ErrInvalidConfig, quotas.Timezone, err)
+		}
+		location = loc
+	}
+
+	m := &QuotaManager{
+		config:   quotas,
+		location: location,
+		path:     quotas.StateFile,
+		now:      time.Now,
+		logger:   logger,
+		usage:    make(map[string]*quotaUsage),
+	}
+	if m.path == "" && config.CA.StoreDir != "" {
+		m.path = filepath.Join(config.CA.StoreDir, quotaFileName)
+	}
+	if m.path == "" {
+		logger.Warn("Traffic usage is kept in memory only (no quotas.state_file or ca.store_dir)")
+		return m, nil
+	}
+
+	data, err := os.ReadFile(m.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read quota usage: %w", err)
+	default:
+		if err := json.Unmarshal(data, &m.usage); err != nil {
+			return nil, fmt.Errorf("failed to parse quota usage %s: %w", m.path, err)
+		}
+	}
+	return m, nil
+}
+
+// quotaDefaultLimit квота по умолчанию из корня секции [quotas]
+func quotaDefaultLimit(config common.QuotaConfig) common.QuotaLimit {
+	return common.QuotaLimit{
+		DailyMB:      config.DailyMB,
+		MonthlyMB:    config.MonthlyMB,
+		Action:       config.Action,
+		ThrottleKbps: config.ThrottleKbps,
+	}
+}
+
+// validateQuotaLimit проверяет значения и действие квоты
+func validateQuotaLimit(limit common.QuotaLimit) error {
+	if limit.DailyMB < 0 || limit.MonthlyMB < 0 || limit.ThrottleKbps < 0 {
+		return fmt.Errorf("quota values must not be negative")
+	}
+	switch limit.Action {
+	case "", QuotaActionDisconnect, QuotaActionNotify:
+	case QuotaActionThrottle:
+		if limit.ThrottleKbps == 0 {
+			return fmt.Errorf("action %q requires throttle_kbps", limit.Action)
+		}
+	default:
+		return fmt.Errorf("unknown quota action %q", limit.Action)
+	}
+	return nil
+}
+
+// LimitFor выбирает квоту: пользователь, первая подходящая группа, значение по умолчанию
+func (m *QuotaManager) LimitFor(identity ClientIdentity) (common.QuotaLimit, string) {
+	limit, source := quotaDefaultLimit(m.config), "default"
+	if override, ok := m.config.Users[identity.User]; ok {
+		limit, source = override, "user"
+	} else {
+		for _, group := range identity.Groups {
+			if override, ok := m.config.Groups[group]; ok {
+				limit, source = override, "group:"+group
+				break
+			}
+		}
+	}
+	if limit.Action == "" {
+		limit.Action = QuotaActionDisconnect
+	}
+	return limit, source
+}
+
+// periods возвращает границы текущих суточного и месячного периодов
+func (m *QuotaManager) periods(now time.Time) (dayStart, dayEnd, monthStart, monthEnd time.Time) {
+	local := now.In(m.location)
+	dayStart = time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, m.location)
+	monthStart = time.Date(local.Year(), local.Month(), m.config.ResetDay, 0, 0, 0, 0, m.location)
+	if local.Before(monthStart) {
+		monthStart = monthStart.AddDate(0, -1, 0)
+	}
+	return dayStart, dayStart.AddDate(0, 0, 1), monthStart, monthStart.AddDate(0, 1, 0)
+}
+
+// usageLocked возвращает учет пользователя, обнуляя закончившиеся периоды; вызывается под m.mu
+func (m *QuotaManager) usageLocked(user string, now time.Time) *quotaUsage {
+	dayStart, _, monthStart, _ := m.periods(now)
+	day, month := dayStart.Format(time.DateOnly), monthStart.Format(time.DateOnly)
+
+	usage, ok := m.usage[user]
+	if !ok {
+		usage = &quotaUsage{}
+		m.usage[user] = usage
+	}
+	if usage.Day != day {
+		*usage = quotaUsage{Month: usage.Month, MonthBytes: usage.MonthBytes, MonthNotified: usage.MonthNotified, Day: day}
+		m.dirty = true
+	}
+	if usage.Month != month {
+		usage.Month, usage.MonthBytes, usage.MonthNotified = month, 0, false
+		m.dirty = true
+	}
+	return usage
+}
+
+// exceededPeriod возвращает превышенный период квоты или пустую строку
+func exceededPeriod(limit common.QuotaLimit, usage *quotaUsage) string {
+	if limit.MonthlyMB > 0 && usage.MonthBytes >= limit.MonthlyMB*bytesPerMB {
+		return quotaPeriodMonthly
+	}
+	if limit.DailyMB > 0 && usage.DayBytes >= limit.DailyMB*bytesPerMB {
+		return quotaPeriodDaily
+	}
+	return ""
+}
+
+// statusLocked формирует состояние квоты; вызывается под m.mu
+func (m *QuotaManager) statusLocked(identity ClientIdentity, now time.Time) QuotaStatus {
+	limit, source := m.LimitFor(identity)
+	usage := m.usageLocked(identity.User, now)
+	_, dayEnd, _, monthEnd := m.periods(now)
+	return QuotaStatus{
+		QuotaLimit:     limit,
+		Source:         source,
+		DayUsedBytes:   usage.DayBytes,
+		MonthUsedBytes: usage.MonthBytes,
+		DayResetAt:     dayEnd.UTC(),
+		MonthResetAt:   monthEnd.UTC(),
+		Exceeded:       exceededPeriod(limit, usage),
+	}
+}
+
+// Status возвращает состояние квоты пользователя
+func (m *QuotaManager) Status(identity ClientIdentity) QuotaStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.statusLocked(identity, m.now())
+}
+
+// Add учитывает n байт трафика пользователя. Возвращает состояние квоты, если она
+// превышена этим трафиком впервые в текущем периоде, иначе nil.
+func (m *QuotaManager) Add(identity ClientIdentity, n int64) *QuotaStatus {
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	usage := m.usageLocked(identity.User, now)
+	usage.DayBytes += n
+	usage.MonthBytes += n
+	m.dirty = true
+
+	status := m.statusLocked(identity, now)
+	switch status.Exceeded {
+	case quotaPeriodMonthly:
+		if usage.MonthNotified {
+			return nil
+		}
+		usage.MonthNotified = true
+	case quotaPeriodDaily:
+		if usage.DayNotified {
+			return nil
+		}
+		usage.DayNotified = true
+	default:
+		return nil
+	}
+	return &status
+}
+
+// Check отклоняет новую сессию, если квота исчерпана и действие - disconnect.
+// Возвращает время сброса исчерпанной квоты.
+func (m *QuotaManager) Check(identity ClientIdentity) (time.Time, error) {
+	status := m.Status(identity)
+	if status.Exceeded == "" || status.Action != QuotaActionDisconnect {
+		return time.Time{}, nil
+	}
+	quotaMB := status.DailyMB
+	if status.Exceeded == quotaPeriodMonthly {
+		quotaMB = status.MonthlyMB
+	}
+	return status.ResetAt(), fmt.Errorf("%w: %s quota of %d MB for user %s is used up, resets at %s",
+		ErrQuotaExceeded, status.Exceeded, quotaMB, identity.User, status.ResetAt().Format(time.RFC3339))
+}
+
+// Throttled возвращает ограничение полосы для пользователя, превысившего квоту с действием throttle
+func (m *QuotaManager) Throttled(identity ClientIdentity) (common.RateLimit, bool) {
+	status := m.Status(identity)
+	if status.Exceeded == "" || status.Action != QuotaActionThrottle {
+		return common.RateLimit{}, false
+	}
+	return common.RateLimit{DownloadKbps: status.ThrottleKbps, UploadKbps: status.ThrottleKbps}, true
+}
+
+// Save сохраняет учет трафика, если он изменился
+func (m *QuotaManager) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.path == "" || !m.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m.usage, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode quota usage: %w", err)
+	}
+	if err := common.WriteFileAtomic(m.path, data, 0600); err != nil {
+		return err
+	}
+	m.dirty = false
+	return nil
+}
+
+// accountTraffic учитывает трафик сессии и применяет квоту при ее превышении
+func (s *Server) accountTraffic(session *ClientSession, direction string, n int) {
+	if direction == directionDownload {
+		session.BytesSent.Add(int64(n))
+	} else {
+		session.BytesReceived.Add(int64(n))
+	}
+	if s.Quotas == nil {
+		return
+	}
+	if status := s.Quotas.Add(session.Identity, int64(n)); status != nil {
+		s.enforceQuota(session.Identity, *status)
+	}
+}
+
+// enforceQuota выполняет действие квоты при ее превышении
+func (s *Server) enforceQuota(identity ClientIdentity, status QuotaStatus) {
+	s.Logger.Warn("User exceeded traffic quota",
+		zap.String("user", identity.User),
+		zap.String("period", status.Exceeded),
+		zap.String("source", status.Source),
+		zap.String("action", status.Action))
+	s.Metrics.RecordError("quota_exceeded")
+	s.Audit.Record("quota", "quota.exceeded", identity.User,
+		fmt.Sprintf("period=%s action=%s resets_at=%s", status.Exceeded, status.Action, status.ResetAt().Format(time.RFC3339)))
+
+	switch status.Action {
+	case QuotaActionDisconnect:
+		count := s.DisconnectUser(identity.User)
+		s.Logger.Info("Disconnected sessions of user over quota", zap.String("user", identity.User), zap.Int("sessions", count))
+	case QuotaActionThrottle:
+		s.applyRateLimits()
+	}
+}
+
+// runQuotas периодически сохраняет учет трафика и снимает ограничения после сброса квот
+func (s *Server) runQuotas(done <-chan struct{}) {
+	ticker := time.NewTicker(quotaSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if err := s.Quotas.Save(); err != nil {
+			s.Logger.Error("Failed to save quota usage", zap.Error(err))
+		}
+		s.applyRateLimits()
+	}
+}
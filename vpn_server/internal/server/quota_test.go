@@ -0,0 +1,157 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestQuotas(t *testing.T, quotas common.QuotaConfig, now *time.Time) *QuotaManager {
+	t.Helper()
+	m, err := NewQuotaManager(common.ServerConfig{Quotas: quotas}, zap.NewNop())
+	require.NoError(t, err)
+	m.now = func() time.Time { return *now }
+	return m
+}
+
+func TestQuotaManager_DailyAndMonthly(t *testing.T) {
+	now := time.Date(2026, 3, 14, 10, 0, 0, 0, time.UTC)
+	m := newTestQuotas(t, common.QuotaConfig{DailyMB: 10, MonthlyMB: 25, ResetDay: 15}, &now)
+	alice := ClientIdentity{User: "alice", Device: "laptop"}
+	phone := ClientIdentity{User: "alice", Device: "phone"}
+
+	assert.Nil(t, m.Add(alice, 6*bytesPerMB))
+	// Квота общая для всех устройств пользователя
+	status := m.Add(phone, 4*bytesPerMB)
+	require.NotNil(t, status)
+	assert.Equal(t, quotaPeriodDaily, status.Exceeded)
+	assert.Equal(t, QuotaActionDisconnect, status.Action)
+	assert.Equal(t, time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC), status.ResetAt())
+	// Превышение сообщается один раз за период
+	assert.Nil(t, m.Add(alice, 1))
+
+	_, err := m.Check(phone)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	// Новые сутки и новый месячный период (reset_day = 15)
+	now = now.Add(24 * time.Hour)
+	_, err = m.Check(alice)
+	assert.NoError(t, err)
+	assert.Zero(t, m.Status(alice).MonthUsedBytes)
+
+	now = now.Add(24 * time.Hour)
+	assert.Nil(t, m.Add(alice, 9*bytesPerMB))
+	now = now.Add(24 * time.Hour)
+	assert.Nil(t, m.Add(alice, 9*bytesPerMB))
+	now = now.Add(24 * time.Hour)
+	status = m.Add(alice, 9*bytesPerMB)
+	require.NotNil(t, status)
+	assert.Equal(t, quotaPeriodMonthly, status.Exceeded)
+	assert.Equal(t, time.Date(2026, 4, 15, 0, 0, 0, 0, time.UTC), status.ResetAt())
+	assert.Equal(t, int64(9*bytesPerMB), status.DayUsedBytes)
+
+	// Месячная квота не сбрасывается вместе с суточной
+	now = now.Add(24 * time.Hour)
+	_, err = m.Check(alice)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+}
+
+func TestQuotaManager_Actions(t *testing.T) {
+	now := time.Date(2026, 3, 14, 10, 0, 0, 0, time.UTC)
+	m := newTestQuotas(t, common.QuotaConfig{
+		DailyMB: 1,
+		Users: map[string]common.QuotaLimit{
+			"alice": {DailyMB: 1, Action: QuotaActionThrottle, ThrottleKbps: 256},
+		},
+		Groups: map[string]common.QuotaLimit{
+			"guests": {DailyMB: 1, Action: QuotaActionNotify},
+		},
+	}, &now)
+
+	alice := ClientIdentity{User: "alice", Groups: []string{"guests"}}
+	guest := ClientIdentity{User: "guest", Groups: []string{"guests"}}
+
+	_, source := m.LimitFor(alice)
+	assert.Equal(t, "user", source)
+	_, source = m.LimitFor(guest)
+	assert.Equal(t, "group:guests", source)
+
+	_, throttled := m.Throttled(alice)
+	assert.False(t, throttled)
+	require.NotNil(t, m.Add(alice, bytesPerMB))
+	limit, throttled := m.Throttled(alice)
+	assert.True(t, throttled)
+	assert.Equal(t, common.RateLimit{DownloadKbps: 256, UploadKbps: 256}, limit)
+
+	// throttle и notify не отклоняют новые сессии
+	_, err := m.Check(alice)
+	assert.NoError(t, err)
+	require.NotNil(t, m.Add(guest, bytesPerMB))
+	_, err = m.Check(guest)
+	assert.NoError(t, err)
+	_, throttled = m.Throttled(guest)
+	assert.False(t, throttled)
+
+	// После превышения квоты с throttle ограничение сессии берется из квоты
+	s := newTestSessionServer(common.SessionConfig{})
+	s.Quotas = m
+	s.Shaping, err = NewBandwidthManager(common.ShapingConfig{DownloadKbps: 100000})
+	require.NoError(t, err)
+	limit, source = s.rateLimitFor(alice)
+	assert.Equal(t, "quota", source)
+	assert.Equal(t, int64(256), limit.DownloadKbps)
+	_, source = s.rateLimitFor(guest)
+	assert.Equal(t, "default", source)
+}
+
+func TestQuotaManager_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	now := time.Date(2026, 3, 14, 10, 0, 0, 0, time.UTC)
+	config := common.QuotaConfig{MonthlyMB: 100, StateFile: path}
+	alice := ClientIdentity{User: "alice"}
+
+	m := newTestQuotas(t, config, &now)
+	m.Add(alice, 42*bytesPerMB)
+	require.NoError(t, m.Save())
+
+	reloaded := newTestQuotas(t, config, &now)
+	assert.Equal(t, int64(42*bytesPerMB), reloaded.Status(alice).MonthUsedBytes)
+}
+
+func TestShutdown_SavesQuotaUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	now := time.Date(2026, 3, 14, 10, 0, 0, 0, time.UTC)
+	config := common.QuotaConfig{MonthlyMB: 100, StateFile: path}
+	alice := ClientIdentity{User: "alice"}
+
+	s := newTestDrainServer(t)
+	s.Quotas = newTestQuotas(t, config, &now)
+	s.Quotas.Add(alice, 7*bytesPerMB)
+
+	// Учет, не дождавшийся периодического сохранения, записывается при остановке
+	server, conn, _ := startTestHTTP3Server(t)
+	require.NoError(t, s.shutdown(server, conn))
+
+	reloaded := newTestQuotas(t, config, &now)
+	assert.Equal(t, int64(7*bytesPerMB), reloaded.Status(alice).MonthUsedBytes)
+}
+
+func TestNewQuotaManager_Invalid(t *testing.T) {
+	invalid := []common.QuotaConfig{
+		{DailyMB: -1},
+		{Action: "block"},
+		{Action: QuotaActionThrottle},
+		{ResetDay: 31},
+		{Timezone: "Mars/Olympus"},
+		{Groups: map[string]common.QuotaLimit{"guests": {MonthlyMB: -5}}},
+	}
+	for _, quotas := range invalid {
+		_, err := NewQuotaManager(common.ServerConfig{Quotas: quotas}, zap.NewNop())
+		assert.ErrorIs(t, err, common.ErrInvalidConfig, "%+v", quotas)
+	}
+}
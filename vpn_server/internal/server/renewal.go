@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+// maxRenewRequestSize ограничивает размер тела запроса продления
+const maxRenewRequestSize = 64 << 10
+
+// handleCertificateRenewal продлевает клиентский сертификат по CSR. Запрос приходит
+// по VPN-соединению, поэтому клиент аутентифицирован продлеваемым сертификатом.
+func (s *Server) handleCertificateRenewal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.CA == nil {
+		http.Error(w, "Certificate authority is disabled", http.StatusServiceUnavailable)
+		return
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "Client certificate required", http.StatusUnauthorized)
+		return
+	}
+	clientCert := r.TLS.PeerCertificates[0]
+
+	var req common.RenewRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRenewRequestSize)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	csr, err := parseCSR([]byte(req.CSR))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if csr.Subject.CommonName != "" && csr.Subject.CommonName != clientCert.Subject.CommonName {
+		http.Error(w, "CSR common name does not match the client certificate", http.StatusBadRequest)
+		return
+	}
+	// Продление без смены ключа не защищает от утечки старого ключа
+	if pub, ok := clientCert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(csr.PublicKey) {
+		http.Error(w, "Renewal requires a new key", http.StatusBadRequest)
+		return
+	}
+
+	issued, err := s.CA.Renew(clientCert, csr.PublicKey, "renewal:"+clientCert.Subject.CommonName)
+	switch {
+	case errors.Is(err, ErrCertificateNotFound):
+		http.Error(w, "Certificate was not issued by the built-in CA", http.StatusForbidden)
+		return
+	case errors.Is(err, common.ErrAuthenticationFailed):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		s.Logger.Error("Failed to renew certificate", zap.String("client", clientCert.Subject.CommonName), zap.Error(err))
+		http.Error(w, "Failed to renew certificate", http.StatusInternalServerError)
+		return
+	}
+
+	s.Logger.Info("Renewed certificate",
+		zap.String("client", clientCert.Subject.CommonName),
+		zap.String("old_serial", formatSerial(clientCert.SerialNumber)),
+		zap.String("new_serial", issued.Serial))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.enrollResponse(issued))
+}
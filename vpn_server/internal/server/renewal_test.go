@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// renewRequest формирует запрос продления от имени клиента с сертификатом peer
+func renewRequest(t *testing.T, peer *x509.Certificate, csrPEM []byte) *http.Request {
+	t.Helper()
+	body, err := json.Marshal(common.RenewRequest{CSR: string(csrPEM)})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, common.RenewPath, strings.NewReader(string(body)))
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{peer}}
+	return req
+}
+
+func TestHandleCertificateRenewal(t *testing.T) {
+	config := newTestCAConfig(t, "")
+	config.ServerName = "vpn.example.com"
+	config.ListenAddr = "0.0.0.0:4433"
+	audit, err := NewAuditLog("", zap.NewNop())
+	require.NoError(t, err)
+	ca, err := NewCertificateAuthority(config, audit, zap.NewNop())
+	require.NoError(t, err)
+	s := &Server{Config: config, Logger: zap.NewNop(), CA: ca, Audit: audit}
+
+	previous, err := ca.Issue(IssueRequest{
+		CommonName:   "alice",
+		Groups:       []string{"engineering"},
+		ValidityDays: 30,
+	}, "admin")
+	require.NoError(t, err)
+	peer := parseIssued(t, previous)
+
+	rec := httptest.NewRecorder()
+	s.handleCertificateRenewal(rec, renewRequest(t, peer, newTestCSR(t, "")))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp common.EnrollResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "alice", resp.ClientID)
+	assert.NotEqual(t, previous.Serial, resp.Serial)
+	assert.Equal(t, "vpn.example.com:4433", resp.ServerAddr)
+
+	renewed, err := ca.Get(resp.Serial)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"engineering"}, renewed.Groups)
+	assert.Empty(t, renewed.KeyPEM)
+	assert.WithinDuration(t, time.Now().Add(30*24*time.Hour), renewed.NotAfter, time.Hour)
+	// Продление - одно событие certificate.renew, а не новый выпуск
+	var actions []string
+	for _, event := range audit.List(0) {
+		actions = append(actions, event.Action)
+	}
+	assert.Equal(t, []string{"certificate.issue", "certificate.renew"}, actions)
+
+	// Старый сертификат остается действительным до истечения срока
+	assert.False(t, ca.IsRevoked(peer.SerialNumber))
+}
+
+func TestHandleCertificateRenewal_Rejections(t *testing.T) {
+	config := newTestCAConfig(t, "")
+	ca, err := NewCertificateAuthority(config, nil, zap.NewNop())
+	require.NoError(t, err)
+	s := &Server{Config: config, Logger: zap.NewNop(), CA: ca}
+
+	issued, err := ca.Issue(IssueRequest{CommonName: "bob"}, "admin")
+	require.NoError(t, err)
+	peer := parseIssued(t, issued)
+
+	t.Run("common name mismatch", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		s.handleCertificateRenewal(rec, renewRequest(t, peer, newTestCSR(t, "mallory")))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("revoked certificate", func(t *testing.T) {
+		revoked, err := ca.Issue(IssueRequest{CommonName: "bob"}, "admin")
+		require.NoError(t, err)
+		_, err = ca.Revoke(revoked.Serial, "lost", "admin")
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		s.handleCertificateRenewal(rec, renewRequest(t, parseIssued(t, revoked), newTestCSR(t, "bob")))
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("certificate from another issuer", func(t *testing.T) {
+		other, err := NewCertificateAuthority(newTestCAConfig(t, ""), nil, zap.NewNop())
+		require.NoError(t, err)
+		foreign, err := other.Issue(IssueRequest{CommonName: "bob"}, "admin")
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		s.handleCertificateRenewal(rec, renewRequest(t, parseIssued(t, foreign), newTestCSR(t, "bob")))
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		req := renewRequest(t, peer, newTestCSR(t, "bob"))
+		req.TLS = nil
+		rec := httptest.NewRecorder()
+		s.handleCertificateRenewal(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+}
+
+func TestHandleCertificateRenewal_KeepsSession(t *testing.T) {
+	config := newTestCAConfig(t, "")
+	ca, err := NewCertificateAuthority(config, nil, zap.NewNop())
+	require.NoError(t, err)
+	mapper, err := NewIdentityMapper(common.IdentityConfig{})
+	require.NoError(t, err)
+	// Адрес закрепляется за ключом сессии арендой кластера
+	s := newTestClusterServer(newTestCluster(t, 1)[0], common.SessionConfig{MaxSessions: 1})
+	s.CA = ca
+
+	issued, err := ca.Issue(IssueRequest{CommonName: "alice"}, "admin")
+	require.NoError(t, err)
+	peer := parseIssued(t, issued)
+	identity, err := mapper.Map(peer)
+	require.NoError(t, err)
+	first, _, err := openTestSession(t, s, identity)
+	require.NoError(t, err)
+
+	// Два продления подряд: устройство сохраняет серийный номер первого сертификата
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		s.handleCertificateRenewal(rec, renewRequest(t, peer, newTestCSR(t, "")))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp common.EnrollResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		renewed, err := ca.Get(resp.Serial)
+		require.NoError(t, err)
+		assert.Equal(t, issued.Serial, renewed.Device)
+		peer = parseIssued(t, renewed)
+	}
+
+	// Переподключение с продленным сертификатом заменяет прежнюю сессию и сохраняет адрес
+	renewedIdentity, err := mapper.Map(peer)
+	require.NoError(t, err)
+	assert.NotEqual(t, identity.Serial, renewedIdentity.Serial)
+	assert.Equal(t, identity.SessionKey(), renewedIdentity.SessionKey())
+
+	second, evicted, err := openTestSession(t, s, renewedIdentity)
+	require.NoError(t, err)
+	require.Len(t, evicted, 1)
+	assert.Same(t, first, evicted[0])
+	assert.Equal(t, first.AssignedIP, second.AssignedIP)
+}
@@ -3,7 +3,6 @@ package server
 import (
 	"context"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/netip"
@@ -13,11 +12,14 @@ import (
 	common "github.com/iselt/masque-vpn/common"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
 )
 
 // Server представляет MASQUE VPN сервер
 type Server struct {
 	Config      common.ServerConfig
+	Logger      *zap.Logger
+	LogLevel    *zap.AtomicLevel // уровень журнала, изменяемый через API; nil - задан при запуске
 	TunDev      *common.TUNDevice
 	IPPool      *common.IPPool
 	ClientIPMap map[string]netip.Addr
@@ -25,10 +27,64 @@ type Server struct {
 	IPPoolMu    sync.RWMutex
 	Metrics     *Metrics
 	APIServer   *APIServer
+	CA          *CertificateAuthority
+	Enrollment  *EnrollmentManager
+	Audit       *AuditLog
+	Identity    *IdentityMapper
+	BearerAuth  BearerAuthenticator // второй фактор после mTLS; nil - не требуется
+	Shaping     *BandwidthManager
+	Quotas      *QuotaManager
+	NAT         *NATManager // правила masquerade; nil - NAT не управляется сервером
+	DNS         *DNSServer  // встроенный DNS сервер на адресе шлюза; nil - выключен
+	State       StateBackend // общее состояние кластера; nil - сервер работает один
+
+	drain     drainState // режим drain перед остановкой или перезапуском
+	closeOnce sync.Once
 }
 
-// New создает новый экземпляр сервера
-func New(config common.ServerConfig) (*Server, error) {
+// New создает новый экземпляр сервера; подсистемы пишут в именованные потомки logger
+func New(config common.ServerConfig, logger *zap.Logger) (*Server, error) {
+	// При перезапуске с передачей сокета ресурсы еще заняты предыдущим процессом
+	if err := waitForPredecessor(logger); err != nil {
+		return nil, err
+	}
+
+	// Правила получения идентичности клиента из сертификата
+	identity, err := NewIdentityMapper(config.Identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateSessionConfig(config.Sessions); err != nil {
+		return nil, err
+	}
+
+	// Ограничение полосы клиентов
+	shaping, err := NewBandwidthManager(config.Shaping)
+	if err != nil {
+		return nil, err
+	}
+
+	// Квоты трафика и сохраненный учет трафика пользователей
+	quotas, err := NewQuotaManager(config, logger.Named("quota"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Второй фактор: JWT, проверяемый по локальному JWKS
+	var bearerAuth BearerAuthenticator
+	if config.JWT.Enabled {
+		bearerAuth, err = NewJWTAuthenticator(config.JWT)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize JWT authentication: %w", err)
+		}
+		logger.Info("JWT bearer authentication enabled", zap.String("audience", config.JWT.Audience))
+	}
+
+	if err := validateDNSConfig(config.DNS); err != nil {
+		return nil, err
+	}
+
 	// Создаем IP пул
 	networkInfo, err := common.NewNetworkInfo(config.AssignCIDR)
 	if err != nil {
@@ -47,9 +103,9 @@ func New(config common.ServerConfig) (*Server, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to create TUN device: %w", err)
 		}
-		log.Printf("TUN device created: %s", tunDev.Name())
+		logger.Info("TUN device created", zap.String("tun_device", tunDev.Name()))
 	} else {
-		log.Printf("TUN device disabled (empty tun_name)")
+		logger.Info("TUN device disabled (empty tun_name)")
 	}
 
 	// Инициализируем метрики
@@ -58,43 +114,112 @@ func New(config common.ServerConfig) (*Server, error) {
 		metrics.TunInterfaceStatus.Set(1) // TUN устройство активно
 	}
 
+	// Журнал аудита административных операций
+	audit, err := OpenAuditLog(config, logger.Named("audit"))
+	if err != nil {
+		closeTun(tunDev)
+		return nil, fmt.Errorf("failed to create audit log: %w", err)
+	}
+
+	// Встроенный CA включается, если задан ключ CA
+	var ca *CertificateAuthority
+	var enrollment *EnrollmentManager
+	if config.CAKeyFile != "" || config.CAKeyPEM != "" {
+		ca, err = NewCertificateAuthority(config, audit, logger.Named("ca"))
+		if err != nil {
+			closeTun(tunDev)
+			return nil, fmt.Errorf("failed to initialize certificate authority: %w", err)
+		}
+		enrollment, err = NewEnrollmentManager(ca, audit, logger.Named("enrollment"))
+		if err != nil {
+			closeTun(tunDev)
+			return nil, fmt.Errorf("failed to initialize enrollment: %w", err)
+		}
+	} else {
+		logger.Info("Certificate authority disabled (no CA key configured)")
+	}
+
 	server := &Server{
 		Config:      config,
+		Logger:      logger,
 		TunDev:      tunDev,
 		IPPool:      ipPool,
 		ClientIPMap: make(map[string]netip.Addr),
 		IPConnMap:   make(map[netip.Addr]*ClientSession),
 		Metrics:     metrics,
+		CA:          ca,
+		Enrollment:  enrollment,
+		Audit:       audit,
+		Identity:    identity,
+		BearerAuth:  bearerAuth,
+		Shaping:     shaping,
+		Quotas:      quotas,
 	}
 
 	// Создаем API сервер
 	apiServer, err := NewAPIServer(server)
 	if err != nil {
-		if tunDev != nil {
-			tunDev.Close()
-		}
+		closeTun(tunDev)
 		return nil, fmt.Errorf("failed to create API server: %w", err)
 	}
 	server.APIServer = apiServer
 
+	// Маскарадинг трафика клиентов
+	if config.NAT.Enabled {
+		nat, err := server.setupNAT()
+		if err != nil {
+			closeTun(tunDev)
+			return nil, fmt.Errorf("failed to set up NAT: %w", err)
+		}
+		server.NAT = nat
+	}
+
+	// Встроенный DNS сервер на адресе шлюза VPN сети
+	if config.DNS.Embedded {
+		dnsServer, err := server.setupDNS(networkInfo.GetGateway().Addr())
+		if err != nil {
+			if server.NAT != nil {
+				server.NAT.Close()
+			}
+			closeTun(tunDev)
+			return nil, fmt.Errorf("failed to start DNS server: %w", err)
+		}
+		server.DNS = dnsServer
+	}
+
+	// Аренды адресов, отзыв сертификатов и ограничения из API общие для узлов кластера
+	if config.Cluster.Enabled {
+		state, err := NewRaftState(config.Cluster, networkInfo.GetPrefix(), networkInfo.GetGateway().Addr(), logger.Named("cluster"))
+		if err != nil {
+			if server.DNS != nil {
+				server.DNS.Close()
+			}
+			if server.NAT != nil {
+				server.NAT.Close()
+			}
+			closeTun(tunDev)
+			return nil, fmt.Errorf("failed to start cluster node: %w", err)
+		}
+		server.State = state
+	}
+
 	// Запускаем обработчик пакетов только если есть TUN устройство
 	if tunDev != nil {
 		go server.processPackets()
-		log.Printf("TUN Device: %s", tunDev.Name())
-	} else {
-		log.Printf("TUN Device: disabled")
 	}
 
-	log.Printf("MASQUE VPN Server initialized")
-	log.Printf("Listen Address: %s", server.Config.ListenAddr)
-	log.Printf("VPN Network: %s", server.Config.AssignCIDR)
-	log.Printf("Advertised Routes: %v", server.Config.AdvertiseRoutes)
+	logger.Info("MASQUE VPN Server initialized",
+		zap.String("listen_addr", server.Config.ListenAddr),
+		zap.String("network_cidr", server.Config.AssignCIDR),
+		zap.Strings("advertise_routes", server.Config.AdvertiseRoutes))
 
 	return server, nil
 }
 
-// Run запускает сервер
+// Run запускает сервер; при возврате ресурсы сервера освобождены
 func (s *Server) Run(ctx context.Context) error {
+	defer s.Close()
+
 	// Настраиваем TLS
 	tlsConfig, err := s.setupTLSConfig()
 	if err != nil {
@@ -102,15 +227,25 @@ func (s *Server) Run(ctx context.Context) error {
 	}
 
 	// Настраиваем QUIC
+	// Активная миграция не отключается: клиенты переносят соединение на новый
+	// адрес при смене сети без повторного CONNECT-IP
 	quicConf := &quic.Config{
 		EnableDatagrams: true,
 		MaxIdleTimeout:  60 * time.Second,
 		KeepAlivePeriod: 30 * time.Second,
+		// 0-RTT ускоряет переподключение; защита от повтора - в confirmEarlyData
+		Allow0RTT: s.Config.Allow0RTT,
+	}
+	if s.Config.Allow0RTT {
+		s.Logger.Info("0-RTT enabled for resumed sessions")
 	}
 
 	// Создаем HTTP/3 сервер
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleMASQUERequest)
+
+	// Продление клиентских сертификатов через уже установленное соединение
+	mux.HandleFunc(common.RenewPath, s.rejectEarlyData(s.handleCertificateRenewal))
 	
 	// Добавляем эндпоинт для метрик
 	mux.Handle("/metrics", s.createMetricsHandler())
@@ -125,35 +260,82 @@ func (s *Server) Run(ctx context.Context) error {
 		QUICConfig: quicConf,
 	}
 
-	log.Printf("MASQUE VPN Server listening on %s", s.Config.ListenAddr)
-	log.Printf("API Server will start on %s", s.Config.APIServer.ListenAddr)
+	// Сокет остается открытым до конца drain, даже когда новые соединения уже не принимаются
+	conn, err := s.listenPacket()
+	if err != nil {
+		return err
+	}
+
+	s.Logger.Info("MASQUE VPN Server listening",
+		zap.String("listen_addr", s.Config.ListenAddr),
+		zap.String("api_listen_addr", s.Config.APIServer.ListenAddr))
 	
 	// Запускаем API сервер в отдельной горутине
 	go func() {
 		if err := s.APIServer.Start(); err != nil {
-			log.Printf("API Server error: %v", err)
+			s.Logger.Error("API server failed", zap.Error(err))
 		}
 	}()
 	
+	// Учет трафика для квот сохраняется периодически
+	go s.runQuotas(ctx.Done())
+
+	// Продление аренд и изменения состояния кластера
+	if s.State != nil {
+		go s.runCluster(ctx.Done())
+	}
+
+	// Перезапуск с передачей сокета новому процессу
+	go s.watchRestartSignal(ctx.Done())
+
 	// Запускаем MASQUE сервер в отдельной горутине
 	errChan := make(chan error, 1)
 	go func() {
-		errChan <- server.ListenAndServe()
+		errChan <- server.Serve(conn)
 	}()
 
-	// Ждем завершения или ошибки
+	// Ждем ошибки, сигнала завершения или drain через API
 	select {
 	case err := <-errChan:
+		conn.Close()
 		return err
 	case <-ctx.Done():
-		log.Printf("Shutting down server...")
-		return server.Close()
+		s.Logger.Info("Shutting down server...")
+	case <-s.drainRequested():
+	}
+
+	if s.restartRequested() {
+		return s.handOff(server, conn)
+	}
+	return s.shutdown(server, conn)
+}
+
+// listenPacket открывает UDP сокет сервера или берет переданный предыдущим процессом
+func (s *Server) listenPacket() (net.PacketConn, error) {
+	conn, err := inheritedPacketConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to use inherited UDP socket: %w", err)
+	}
+	if conn != nil {
+		s.Logger.Info("Serving on UDP socket inherited from the previous process", zap.Stringer("local_addr", conn.LocalAddr()))
+		return conn, nil
+	}
+	conn, err = net.ListenPacket("udp", s.Config.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", s.Config.ListenAddr, err)
 	}
+	return conn, nil
 }
 
 // handleHealthCheck обрабатывает запросы проверки здоровья
 func (s *Server) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	// Балансировщик перестает направлять клиентов на сервер в режиме drain
+	if s.Draining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":"draining","service":"masque-vpn-server"}`))
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status":"healthy","service":"masque-vpn-server"}`))
 }
@@ -169,9 +351,14 @@ func (s *Server) createMetricsHandler() http.Handler {
 	})
 }
 
-// Close закрывает сервер и освобождает ресурсы
+// Close закрывает сервер и освобождает ресурсы; повторный вызов ничего не делает
 func (s *Server) Close() error {
-	log.Printf("Closing MASQUE VPN Server...")
+	s.closeOnce.Do(s.close)
+	return nil
+}
+
+func (s *Server) close() {
+	s.Logger.Info("Closing MASQUE VPN Server...")
 	
 	// Закрываем все клиентские соединения
 	s.IPPoolMu.Lock()
@@ -181,14 +368,43 @@ func (s *Server) Close() error {
 				session.Conn.Close()
 			}
 		}
-		log.Printf("Closed connection for client %s", clientID)
+		s.Logger.Info("Closed connection", zap.String("client_id", clientID))
 	}
 	s.IPPoolMu.Unlock()
 
+	// Покидаем кластер; аренды сессий этого узла освободит следующий запуск или истечение срока
+	if s.State != nil {
+		if err := s.State.Close(); err != nil {
+			s.Logger.Warn("Error stopping cluster node", zap.Error(err))
+		}
+	}
+
+	// Сохраняем учет трафика
+	if s.Quotas != nil {
+		if err := s.Quotas.Save(); err != nil {
+			s.Logger.Warn("Error saving quota usage", zap.Error(err))
+		}
+	}
+
+	// Удаляем правила NAT и восстанавливаем sysctl
+	if s.NAT != nil {
+		if err := s.NAT.Close(); err != nil {
+			s.Logger.Warn("Error removing NAT rules", zap.Error(err))
+		}
+		s.NAT = nil
+	}
+
+	// Останавливаем встроенный DNS сервер
+	if s.DNS != nil {
+		if err := s.DNS.Close(); err != nil {
+			s.Logger.Warn("Error closing DNS server", zap.Error(err))
+		}
+	}
+
 	// Закрываем TUN устройство
 	if s.TunDev != nil {
 		if err := s.TunDev.Close(); err != nil {
-			log.Printf("Error closing TUN device: %v", err)
+			s.Logger.Warn("Error closing TUN device", zap.Error(err))
 		}
 		s.Metrics.TunInterfaceStatus.Set(0)
 	}
@@ -196,10 +412,92 @@ func (s *Server) Close() error {
 	// Закрываем API сервер
 	if s.APIServer != nil {
 		if err := s.APIServer.Close(); err != nil {
-			log.Printf("Error closing API server: %v", err)
+			s.Logger.Warn("Error closing API server", zap.Error(err))
 		}
 	}
 
-	log.Printf("MASQUE VPN Server closed")
-	return nil
-}
\ No newline at end of file
+	s.Logger.Info("MASQUE VPN Server closed")
+}
+
+// DisconnectCertificate закрывает активные сессии, установленные с сертификатом serial
+func (s *Server) DisconnectCertificate(serial string) int {
+	s.IPPoolMu.RLock()
+	var sessions []*ClientSession
+	for _, session := range s.IPConnMap {
+		if session.CertSerial == serial {
+			sessions = append(sessions, session)
+		}
+	}
+	s.IPPoolMu.RUnlock()
+
+	// Закрытие соединения завершает прокси-горутины, они сами очищают сессию
+	for _, session := range sessions {
+		if session.Conn != nil {
+			session.Conn.Close()
+		}
+	}
+	return len(sessions)
+}
+
+// DisconnectUser закрывает все активные сессии пользователя
+func (s *Server) DisconnectUser(user string) int {
+	s.IPPoolMu.RLock()
+	var sessions []*ClientSession
+	for _, session := range s.IPConnMap {
+		if session.Identity.User == user {
+			sessions = append(sessions, session)
+		}
+	}
+	s.IPPoolMu.RUnlock()
+
+	for _, session := range sessions {
+		if session.Conn != nil {
+			session.Conn.Close()
+		}
+	}
+	return len(sessions)
+}
+
+// setupNAT создает правила masquerade для assign_cidr и assign_cidr_v6
+func (s *Server) setupNAT() (*NATManager, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range []string{s.Config.AssignCIDR, s.Config.AssignCIDRv6} {
+		if cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid CIDR %q: %v", common.ErrInvalidConfig, cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	tunName := ""
+	if s.TunDev != nil {
+		tunName = s.TunDev.Name()
+	}
+	return NewNATManager(s.Config.NAT, prefixes, tunName, s.Logger.Named("nat"))
+}
+
+// setupDNS запускает встроенный DNS сервер; адрес шлюза есть на хосте только вместе с TUN устройством
+func (s *Server) setupDNS(gateway netip.Addr) (*DNSServer, error) {
+	if s.TunDev == nil {
+		return nil, fmt.Errorf("%w: dns.embedded requires tun_name", common.ErrInvalidConfig)
+	}
+	dnsServer, err := NewDNSServer(s.Config.DNS, gateway, s.lookupClientName, s.Logger.Named("dns"))
+	if err != nil {
+		return nil, err
+	}
+	if err := dnsServer.Listen(); err != nil {
+		return nil, err
+	}
+	go dnsServer.Serve()
+	return dnsServer, nil
+}
+
+// closeTun закрывает TUN устройство при ошибке инициализации
+func closeTun(tunDev *common.TUNDevice) {
+	if tunDev != nil {
+		tunDev.Close()
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"go.uber.org/zap"
+)
+
+// Политики одновременных сессий пользователя
+const (
+	SessionPolicyAllow   = "allow"
+	SessionPolicyReject  = "reject"
+	SessionPolicyReplace = "replace"
+)
+
+// ErrSessionLimit новая сессия отклонена политикой одновременных сессий
+var ErrSessionLimit = errors.New("session limit reached")
+
+// validateSessionConfig проверяет названия политик и пределы
+func validateSessionConfig(config common.SessionConfig) error {
+	check := func(scope string, policy common.SessionPolicy) error {
+		switch policy.Policy {
+		case "", SessionPolicyAllow, SessionPolicyReject, SessionPolicyReplace:
+		default:
+			return fmt.Errorf("%w: unknown session policy %q for %s", common.ErrInvalidConfig, policy.Policy, scope)
+		}
+		if policy.MaxSessions < 0 {
+			return fmt.Errorf("%w: negative max_sessions for %s", common.ErrInvalidConfig, scope)
+		}
+		return nil
+	}
+
+	if err := check("default", common.SessionPolicy{Policy: config.Policy, MaxSessions: config.MaxSessions}); err != nil {
+		return err
+	}
+	for user, policy := range config.Users {
+		if err := check("user "+user, policy); err != nil {
+			return err
+		}
+	}
+	for group, policy := range config.Groups {
+		if err := check("group "+group, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionPolicyFor выбирает политику: пользователь, затем первая подходящая группа, затем значение по умолчанию.
+// Пустая политика означает allow; для reject и replace предел по умолчанию - одна сессия.
+func (s *Server) sessionPolicyFor(identity ClientIdentity) common.SessionPolicy {
+	config := s.Config.Sessions
+	policy := common.SessionPolicy{Policy: config.Policy, MaxSessions: config.MaxSessions}
+	if override, ok := config.Users[identity.User]; ok {
+		policy = override
+	} else {
+		for _, group := range identity.Groups {
+			if override, ok := config.Groups[group]; ok {
+				policy = override
+				break
+			}
+		}
+	}
+
+	if policy.Policy == "" {
+		policy.Policy = SessionPolicyAllow
+	}
+	if policy.MaxSessions == 0 && policy.Policy != SessionPolicyAllow {
+		policy.MaxSessions = 1
+	}
+	return policy
+}
+
+// openSession применяет политику сессий, выделяет адрес и регистрирует session.
+// Вытесненные сессии уже удалены из карт; вызывающий должен закрыть их соединения.
+// Аренды кластера выдаются и освобождаются вне IPPoolMu: запись Raft ждет кворума,
+// а под этой блокировкой пересылаются пакеты всех клиентов.
+func (s *Server) openSession(session *ClientSession) (netip.Prefix, []*ClientSession, error) {
+	identity := session.Identity
+	sessionID := identity.SessionKey()
+	policy := s.sessionPolicyFor(identity)
+
+	s.IPPoolMu.Lock()
+
+	// Остальные сессии пользователя, в том числе на других узлах кластера
+	var others []*ClientSession
+	for _, other := range s.IPConnMap {
+		if other.Identity.User == identity.User && other.ID != sessionID {
+			others = append(others, other)
+		}
+	}
+	remoteReconnect := false
+	for _, other := range s.remoteSessions(identity.User) {
+		if other.ID == sessionID {
+			remoteReconnect = true
+		} else {
+			others = append(others, other)
+		}
+	}
+
+	// Повторный вход с того же устройства: старая сессия, скорее всего, оборвана.
+	// Сессия на другом узле закроется, когда аренда ее адреса перейдет к этой.
+	existingIP, reconnect := s.ClientIPMap[sessionID]
+	if (reconnect || remoteReconnect) && policy.Policy == SessionPolicyReject {
+		s.IPPoolMu.Unlock()
+		return netip.Prefix{}, nil, fmt.Errorf("%w: device %s is already connected", ErrSessionLimit, sessionID)
+	}
+
+	// От старых к новым
+	sort.Slice(others, func(i, j int) bool {
+		return others[i].StartedAt.Before(others[j].StartedAt)
+	})
+
+	var evicted []*ClientSession
+	if policy.MaxSessions > 0 && len(others) >= policy.MaxSessions {
+		if policy.Policy != SessionPolicyReplace {
+			s.IPPoolMu.Unlock()
+			return netip.Prefix{}, nil, fmt.Errorf("%w: user %s already has %d active session(s), policy %s allows %d",
+				ErrSessionLimit, identity.User, len(others), policy.Policy, policy.MaxSessions)
+		}
+		evicted = append(evicted, others[:len(others)-policy.MaxSessions+1]...)
+	}
+
+	var releases []func()
+	if reconnect {
+		if existing, connected := s.IPConnMap[existingIP]; connected {
+			evicted = append(evicted, existing)
+		} else {
+			releases = append(releases, s.removeSessionLocked(sessionID, existingIP))
+		}
+	}
+	for _, old := range evicted {
+		if old.Node != "" {
+			old := old
+			releases = append(releases, func() { s.releaseLease(old.ID, old.LeaseGeneration) })
+			continue
+		}
+		releases = append(releases, s.removeSessionLocked(old.ID, old.AssignedIP))
+	}
+
+	session.ID = sessionID
+	session.StartedAt = time.Now()
+
+	if s.State == nil {
+		defer s.IPPoolMu.Unlock()
+		assignedPrefix, err := s.IPPool.Allocate(sessionID)
+		if err != nil {
+			return netip.Prefix{}, evicted, fmt.Errorf("failed to allocate IP: %w", err)
+		}
+		s.installSessionLocked(session, assignedPrefix.Addr())
+		return assignedPrefix, evicted, nil
+	}
+	s.IPPoolMu.Unlock()
+
+	for _, release := range releases {
+		release()
+	}
+	assignedPrefix, err := s.acquireLease(session)
+	if err != nil {
+		return netip.Prefix{}, evicted, fmt.Errorf("failed to allocate IP: %w", err)
+	}
+
+	s.IPPoolMu.Lock()
+	defer s.IPPoolMu.Unlock()
+
+	// Пока применялась аренда, то же устройство могло подключиться снова;
+	// адрес остается за более поздней арендой
+	if current, ok := s.IPConnMap[assignedPrefix.Addr()]; ok {
+		if current.ID == sessionID && current.LeaseGeneration > session.LeaseGeneration {
+			return netip.Prefix{}, evicted, fmt.Errorf("%w: device %s connected again meanwhile", ErrSessionLimit, sessionID)
+		}
+		delete(s.ClientIPMap, current.ID)
+		delete(s.IPConnMap, current.AssignedIP)
+		evicted = append(evicted, current)
+	}
+	s.installSessionLocked(session, assignedPrefix.Addr())
+	return assignedPrefix, evicted, nil
+}
+
+// installSessionLocked регистрирует сессию с выданным адресом; вызывается под IPPoolMu
+func (s *Server) installSessionLocked(session *ClientSession, assignedIP netip.Addr) {
+	session.AssignedIP = assignedIP
+	s.ClientIPMap[session.ID] = assignedIP
+	s.IPConnMap[assignedIP] = session
+}
+
+// removeSessionLocked удаляет сессию из карт и освобождает адрес локального пула;
+// вызывается под IPPoolMu. Аренду кластера освобождает возвращенная функция,
+// ее нужно вызвать после снятия блокировки.
+func (s *Server) removeSessionLocked(sessionID string, assignedIP netip.Addr) (release func()) {
+	var generation uint64
+	if session, ok := s.IPConnMap[assignedIP]; ok {
+		generation = session.LeaseGeneration
+	}
+	delete(s.ClientIPMap, sessionID)
+	delete(s.IPConnMap, assignedIP)
+	if s.State != nil {
+		return func() { s.releaseLease(sessionID, generation) }
+	}
+	s.IPPool.Release(assignedIP)
+	return func() {}
+}
+
+// closeEvictedSessions закрывает соединения сессий, вытесненных политикой
+func (s *Server) closeEvictedSessions(evicted []*ClientSession, reason string) {
+	for _, session := range evicted {
+		s.sessionLogger(session).Info("Closing session", zap.String("reason", reason))
+		s.Metrics.RecordError("session_replaced")
+		if session.Conn != nil {
+			session.Conn.Close()
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestSessionServer(config common.SessionConfig) *Server {
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+	return &Server{
+		Config:      common.ServerConfig{Sessions: config},
+		Logger:      zap.NewNop(),
+		IPPool:      common.NewIPPool(prefix, netip.MustParseAddr("10.0.0.1")),
+		ClientIPMap: make(map[string]netip.Addr),
+		IPConnMap:   make(map[netip.Addr]*ClientSession),
+	}
+}
+
+func openTestSession(t *testing.T, s *Server, identity ClientIdentity) (*ClientSession, []*ClientSession, error) {
+	t.Helper()
+	session := &ClientSession{Identity: identity}
+	_, evicted, err := s.openSession(session)
+	// StartedAt должен различаться, чтобы порядок вытеснения был определен
+	time.Sleep(time.Millisecond)
+	return session, evicted, err
+}
+
+func TestOpenSession_AllowLimit(t *testing.T) {
+	s := newTestSessionServer(common.SessionConfig{MaxSessions: 2})
+
+	_, _, err := openTestSession(t, s, ClientIdentity{User: "alice", Device: "laptop"})
+	require.NoError(t, err)
+	_, _, err = openTestSession(t, s, ClientIdentity{User: "alice", Device: "phone"})
+	require.NoError(t, err)
+
+	_, _, err = openTestSession(t, s, ClientIdentity{User: "alice", Device: "tablet"})
+	assert.ErrorIs(t, err, ErrSessionLimit)
+	assert.Len(t, s.IPConnMap, 2)
+
+	// Предел считается для каждого пользователя отдельно
+	_, _, err = openTestSession(t, s, ClientIdentity{User: "bob", Device: "laptop"})
+	assert.NoError(t, err)
+}
+
+func TestOpenSession_SameDeviceReconnect(t *testing.T) {
+	s := newTestSessionServer(common.SessionConfig{})
+
+	first, _, err := openTestSession(t, s, ClientIdentity{User: "alice", Device: "laptop"})
+	require.NoError(t, err)
+	second, evicted, err := openTestSession(t, s, ClientIdentity{User: "alice", Device: "laptop"})
+	require.NoError(t, err)
+
+	// Старая сессия того же устройства вытесняется даже при allow
+	require.Len(t, evicted, 1)
+	assert.Same(t, first, evicted[0])
+	assert.Len(t, s.IPConnMap, 1)
+	assert.Same(t, second, s.IPConnMap[second.AssignedIP])
+}
+
+func TestOpenSession_Reject(t *testing.T) {
+	s := newTestSessionServer(common.SessionConfig{Policy: SessionPolicyReject})
+
+	first, _, err := openTestSession(t, s, ClientIdentity{User: "alice", Device: "laptop"})
+	require.NoError(t, err)
+
+	_, _, err = openTestSession(t, s, ClientIdentity{User: "alice", Device: "laptop"})
+	assert.ErrorIs(t, err, ErrSessionLimit)
+	_, _, err = openTestSession(t, s, ClientIdentity{User: "alice", Device: "phone"})
+	assert.ErrorIs(t, err, ErrSessionLimit)
+
+	assert.Same(t, first, s.IPConnMap[first.AssignedIP])
+}
+
+func TestOpenSession_ReplaceOldest(t *testing.T) {
+	s := newTestSessionServer(common.SessionConfig{Policy: SessionPolicyReplace, MaxSessions: 2})
+
+	oldest, _, err := openTestSession(t, s, ClientIdentity{User: "alice", Device: "laptop"})
+	require.NoError(t, err)
+	middle, _, err := openTestSession(t, s, ClientIdentity{User: "alice", Device: "phone"})
+	require.NoError(t, err)
+
+	newest, evicted, err := openTestSession(t, s, ClientIdentity{User: "alice", Device: "tablet"})
+	require.NoError(t, err)
+	require.Len(t, evicted, 1)
+	assert.Same(t, oldest, evicted[0])
+
+	assert.Len(t, s.IPConnMap, 2)
+	assert.NotContains(t, s.ClientIPMap, oldest.ID)
+	assert.Same(t, middle, s.IPConnMap[middle.AssignedIP])
+	assert.Same(t, newest, s.IPConnMap[newest.AssignedIP])
+}
+
+func TestSessionPolicyFor_Overrides(t *testing.T) {
+	s := newTestSessionServer(common.SessionConfig{
+		Policy:      SessionPolicyReject,
+		MaxSessions: 1,
+		Users: map[string]common.SessionPolicy{
+			"alice": {Policy: SessionPolicyAllow, MaxSessions: 5},
+		},
+		Groups: map[string]common.SessionPolicy{
+			"admins":  {Policy: SessionPolicyReplace, MaxSessions: 3},
+			"support": {Policy: SessionPolicyAllow},
+		},
+	})
+
+	// Пользователь важнее группы
+	policy := s.sessionPolicyFor(ClientIdentity{User: "alice", Groups: []string{"admins"}})
+	assert.Equal(t, common.SessionPolicy{Policy: SessionPolicyAllow, MaxSessions: 5}, policy)
+
+	// Первая подходящая группа в порядке из сертификата
+	policy = s.sessionPolicyFor(ClientIdentity{User: "bob", Groups: []string{"staff", "admins", "support"}})
+	assert.Equal(t, common.SessionPolicy{Policy: SessionPolicyReplace, MaxSessions: 3}, policy)
+
+	policy = s.sessionPolicyFor(ClientIdentity{User: "carol"})
+	assert.Equal(t, common.SessionPolicy{Policy: SessionPolicyReject, MaxSessions: 1}, policy)
+
+	// Без предела allow не ограничивает число сессий
+	policy = s.sessionPolicyFor(ClientIdentity{User: "dave", Groups: []string{"support"}})
+	assert.Equal(t, common.SessionPolicy{Policy: SessionPolicyAllow, MaxSessions: 0}, policy)
+}
+
+func TestValidateSessionConfig(t *testing.T) {
+	assert.NoError(t, validateSessionConfig(common.SessionConfig{}))
+	assert.ErrorIs(t, validateSessionConfig(common.SessionConfig{Policy: "kick"}), common.ErrInvalidConfig)
+	assert.ErrorIs(t, validateSessionConfig(common.SessionConfig{MaxSessions: -1}), common.ErrInvalidConfig)
+	assert.ErrorIs(t, validateSessionConfig(common.SessionConfig{
+		Groups: map[string]common.SessionPolicy{"admins": {Policy: "deny"}},
+	}), common.ErrInvalidConfig)
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// Направления трафика клиента
+const (
+	directionDownload = "download" // TUN -> клиент
+	directionUpload   = "upload"   // клиент -> TUN
+)
+
+const (
+	defaultMaxQueueDelay = 50 * time.Millisecond
+	// minBurstBytes вмещает несколько пакетов максимального размера
+	minBurstBytes = 32 << 10
+)
+
+// shapeResult результат прохождения пакета через ограничитель
+type shapeResult int
+
+const (
+	shapePassed  shapeResult = iota // токенов хватило
+	shapeDelayed                    // пакет задержан до появления токенов
+	shapeDropped                    // задержка превысила бы max_queue_delay_ms
+)
+
+// TokenBucket корзина токенов; токены - байты, пополняются со скоростью rate байт/с до burst
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket создает полную корзину
+func NewTokenBucket(bytesPerSecond, burst float64, now time.Time) *TokenBucket {
+	return &TokenBucket{rate: bytesPerSecond, burst: burst, tokens: burst, last: now}
+}
+
+// reserve забирает n байт и возвращает, сколько нужно подождать перед отправкой.
+// Если ждать пришлось бы дольше maxDelay, токены не забираются и возвращается false.
+func (b *TokenBucket) reserve(n int, now time.Time, maxDelay time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+
+	need := float64(n)
+	if b.tokens >= need {
+		b.tokens -= need
+		return 0, true
+	}
+
+	// Долг по токенам ставит следующие пакеты в очередь за этим
+	wait := time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxDelay {
+		return 0, false
+	}
+	b.tokens -= need
+	return wait, true
+}
+
+// ShapingStats счетчики ограничителя сессии в байтах
+type ShapingStats struct {
+	DownloadShapedBytes  int64 `json:"download_shaped_bytes"`
+	DownloadDroppedBytes int64 `json:"download_dropped_bytes"`
+	UploadShapedBytes    int64 `json:"upload_shaped_bytes"`
+	UploadDroppedBytes   int64 `json:"upload_dropped_bytes"`
+}
+
+// SessionShaper ограничитель полосы сессии в обоих направлениях.
+// Методы допускают nil: такая сессия не ограничивается.
+type SessionShaper struct {
+	maxDelay time.Duration
+
+	mu       sync.Mutex
+	limit    common.RateLimit
+	source   string       // откуда взято ограничение: quota, api, user, group:<name>, default
+	download *TokenBucket // nil - без ограничения
+	upload   *TokenBucket
+
+	downloadShaped  atomic.Int64
+	downloadDropped atomic.Int64
+	uploadShaped    atomic.Int64
+	uploadDropped   atomic.Int64
+}
+
+// newSessionShaper создает ограничитель с заданным ограничением
+func newSessionShaper(limit common.RateLimit, source string, maxDelay time.Duration) *SessionShaper {
+	sh := &SessionShaper{maxDelay: maxDelay}
+	sh.SetLimit(limit, source)
+	return sh
+}
+
+// SetLimit меняет ограничение на лету; корзины создаются заново полными
+func (sh *SessionShaper) SetLimit(limit common.RateLimit, source string) {
+	now := time.Now()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.limit = limit
+	sh.source = source
+	sh.download = newRateBucket(limit.DownloadKbps, limit.BurstKB, now)
+	sh.upload = newRateBucket(limit.UploadKbps, limit.BurstKB, now)
+}
+
+// newRateBucket переводит кбит/с и КБ в байты; nil, если ограничения нет
+func newRateBucket(kbps, burstKB int64, now time.Time) *TokenBucket {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := float64(kbps) * 1000 / 8
+	burst := float64(burstKB) * 1024
+	if burst == 0 {
+		burst = rate / 10
+		if burst < minBurstBytes {
+			burst = minBurstBytes
+		}
+	}
+	return NewTokenBucket(rate, burst, now)
+}
+
+// Limit возвращает текущее ограничение и его источник
+func (sh *SessionShaper) Limit() (common.RateLimit, string) {
+	if sh == nil {
+		return common.RateLimit{}, ""
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.limit, sh.source
+}
+
+// Wait пропускает пакет размером n байт: сразу, после задержки или отбрасывает его
+func (sh *SessionShaper) Wait(ctx context.Context, direction string, n int) shapeResult {
+	if sh == nil {
+		return shapePassed
+	}
+
+	sh.mu.Lock()
+	bucket, shaped, dropped := sh.upload, &sh.uploadShaped, &sh.uploadDropped
+	if direction == directionDownload {
+		bucket, shaped, dropped = sh.download, &sh.downloadShaped, &sh.downloadDropped
+	}
+	sh.mu.Unlock()
+	if bucket == nil {
+		return shapePassed
+	}
+
+	delay, ok := bucket.reserve(n, time.Now(), sh.maxDelay)
+	if !ok {
+		dropped.Add(int64(n))
+		return shapeDropped
+	}
+	if delay == 0 {
+		return shapePassed
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		dropped.Add(int64(n))
+		return shapeDropped
+	case <-timer.C:
+	}
+	shaped.Add(int64(n))
+	return shapeDelayed
+}
+
+// Stats возвращает счетчики задержанных и отброшенных байт
+func (sh *SessionShaper) Stats() ShapingStats {
+	if sh == nil {
+		return ShapingStats{}
+	}
+	return ShapingStats{
+		DownloadShapedBytes:  sh.downloadShaped.Load(),
+		DownloadDroppedBytes: sh.downloadDropped.Load(),
+		UploadShapedBytes:    sh.uploadShaped.Load(),
+		UploadDroppedBytes:   sh.uploadDropped.Load(),
+	}
+}
+
+// BandwidthManager выбирает ограничение полосы для сессий по [shaping] и
+// переопределениям, заданным через API
+type BandwidthManager struct {
+	config   common.ShapingConfig
+	maxDelay time.Duration
+
+	mu        sync.RWMutex
+	overrides map[string]common.RateLimit // ключ сессии или пользователь -> ограничение из API
+}
+
+// NewBandwidthManager проверяет конфигурацию и создает менеджер ограничений
+func NewBandwidthManager(config common.ShapingConfig) (*BandwidthManager, error) {
+	if err := validateRateLimit(common.RateLimit{
+		DownloadKbps: config.DownloadKbps,
+		UploadKbps:   config.UploadKbps,
+		BurstKB:      config.BurstKB,
+	}); err != nil {
+		return nil, fmt.Errorf("%w: shaping: %v", common.ErrInvalidConfig, err)
+	}
+	for user, limit := range config.Users {
+		if err := validateRateLimit(limit); err != nil {
+			return nil, fmt.Errorf("%w: shaping for user %s: %v", common.ErrInvalidConfig, user, err)
+		}
+	}
+	for group, limit := range config.Groups {
+		if err := validateRateLimit(limit); err != nil {
+			return nil, fmt.Errorf("%w: shaping for group %s: %v", common.ErrInvalidConfig, group, err)
+		}
+	}
+	if config.MaxQueueDelayMs < 0 {
+		return nil, fmt.Errorf("%w: negative shaping max_queue_delay_ms", common.ErrInvalidConfig)
+	}
+
+	maxDelay := defaultMaxQueueDelay
+	if config.MaxQueueDelayMs > 0 {
+		maxDelay = time.Duration(config.MaxQueueDelayMs) * time.Millisecond
+	}
+	return &BandwidthManager{
+		config:    config,
+		maxDelay:  maxDelay,
+		overrides: make(map[string]common.RateLimit),
+	}, nil
+}
+
+// validateRateLimit запрещает отрицательные значения
+func validateRateLimit(limit common.RateLimit) error {
+	if limit.DownloadKbps < 0 || limit.UploadKbps < 0 || limit.BurstKB < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	return nil
+}
+
+// LimitFor выбирает ограничение: API для сессии, API для пользователя, пользователь,
+// первая подходящая группа, значение по умолчанию
+func (m *BandwidthManager) LimitFor(identity ClientIdentity) (common.RateLimit, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if limit, ok := m.overrides[identity.SessionKey()]; ok {
+		return limit, "api"
+	}
+	if limit, ok := m.overrides[identity.User]; ok {
+		return limit, "api"
+	}
+	if limit, ok := m.config.Users[identity.User]; ok {
+		return limit, "user"
+	}
+	for _, group := range identity.Groups {
+		if limit, ok := m.config.Groups[group]; ok {
+			return limit, "group:" + group
+		}
+	}
+	return common.RateLimit{
+		DownloadKbps: m.config.DownloadKbps,
+		UploadKbps:   m.config.UploadKbps,
+		BurstKB:      m.config.BurstKB,
+	}, "default"
+}
+
+// NewShaper создает ограничитель для новой сессии
+func (m *BandwidthManager) NewShaper(limit common.RateLimit, source string) *SessionShaper {
+	return newSessionShaper(limit, source, m.maxDelay)
+}
+
+// SetOverride задает ограничение для ключа сессии или пользователя до перезапуска сервера
+func (m *BandwidthManager) SetOverride(id string, limit common.RateLimit) error {
+	if err := validateRateLimit(limit); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.overrides[id] = limit
+	return nil
+}
+
+// ReplaceOverrides заменяет все ограничения из API, например общими ограничениями кластера
+func (m *BandwidthManager) ReplaceOverrides(overrides map[string]common.RateLimit) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.overrides = make(map[string]common.RateLimit, len(overrides))
+	for id, limit := range overrides {
+		m.overrides[id] = limit
+	}
+}
+
+// ClearOverride удаляет ограничение, заданное через API
+func (m *BandwidthManager) ClearOverride(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.overrides[id]; !ok {
+		return false
+	}
+	delete(m.overrides, id)
+	return true
+}
+
+// rateLimitFor выбирает ограничение сессии; превышенная квота с действием throttle важнее остальных
+func (s *Server) rateLimitFor(identity ClientIdentity) (common.RateLimit, string) {
+	if s.Quotas != nil {
+		if limit, throttled := s.Quotas.Throttled(identity); throttled {
+			return limit, "quota"
+		}
+	}
+	return s.Shaping.LimitFor(identity)
+}
+
+// applyRateLimits пересчитывает ограничения активных сессий после изменения через API или квоты
+func (s *Server) applyRateLimits() {
+	s.IPPoolMu.RLock()
+	defer s.IPPoolMu.RUnlock()
+	for _, session := range s.IPConnMap {
+		if session.Shaper == nil {
+			continue
+		}
+		limit, source := s.rateLimitFor(session.Identity)
+		// SetLimit наполняет корзины заново, поэтому неизменное ограничение не трогаем
+		if current, currentSource := session.Shaper.Limit(); current != limit || currentSource != source {
+			session.Shaper.SetLimit(limit, source)
+		}
+	}
+}
+
+// shapePacket пропускает пакет через ограничитель сессии; false - пакет отброшен
+func (s *Server) shapePacket(ctx context.Context, session *ClientSession, direction string, n int) bool {
+	result := session.Shaper.Wait(ctx, direction, n)
+	s.Metrics.RecordShaping(direction, result, n)
+	return result != shapeDropped
+}
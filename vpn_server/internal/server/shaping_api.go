@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iselt/masque-vpn/common"
+)
+
+// ClientRateLimit текущее ограничение полосы сессии и его счетчики
+type ClientRateLimit struct {
+	common.RateLimit
+	Source string `json:"source"` // quota, api, user, group:<name>, default
+	ShapingStats
+}
+
+// clientRateLimit описывает ограничитель сессии для API
+func clientRateLimit(shaper *SessionShaper) *ClientRateLimit {
+	if shaper == nil {
+		return nil
+	}
+	limit, source := shaper.Limit()
+	return &ClientRateLimit{RateLimit: limit, Source: source, ShapingStats: shaper.Stats()}
+}
+
+// setClientRateLimit задает ограничение полосы для ключа сессии или пользователя.
+// Ограничение применяется к активным сессиям сразу и к новым сессиям до перезапуска сервера;
+// в кластере - на всех узлах и сохраняется при перезапуске.
+func (api *APIServer) setClientRateLimit(c *gin.Context) {
+	clientID := c.Param("id")
+
+	var limit common.RateLimit
+	if err := c.ShouldBindJSON(&limit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if err := api.server.Shaping.SetOverride(clientID, limit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	api.server.applyRateLimits()
+	if err := api.server.shareRateLimit(clientID, &limit); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to share rate limit with the cluster: " + err.Error()})
+		return
+	}
+
+	api.server.Audit.Record(c.ClientIP(), "rate_limit.set", clientID,
+		fmt.Sprintf("download=%dkbps upload=%dkbps burst=%dKB", limit.DownloadKbps, limit.UploadKbps, limit.BurstKB))
+
+	api.server.IPPoolMu.RLock()
+	sessionIDs := api.sessionIDsLocked(clientID)
+	api.server.IPPoolMu.RUnlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"client_id":  clientID,
+		"rate_limit": limit,
+		"sessions":   sessionIDs,
+	})
+}
+
+// clearClientRateLimit удаляет ограничение, заданное через API; снова действует [shaping]
+func (api *APIServer) clearClientRateLimit(c *gin.Context) {
+	clientID := c.Param("id")
+
+	if !api.server.Shaping.ClearOverride(clientID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No rate limit override for client"})
+		return
+	}
+	api.server.applyRateLimits()
+	if err := api.server.shareRateLimit(clientID, nil); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to share rate limit with the cluster: " + err.Error()})
+		return
+	}
+
+	api.server.Audit.Record(c.ClientIP(), "rate_limit.clear", clientID, "")
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Rate limit override removed",
+		"client_id": clientID,
+	})
+}
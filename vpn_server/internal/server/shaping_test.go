@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	common "github.com/iselt/masque-vpn/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket_Reserve(t *testing.T) {
+	start := time.Now()
+	// 1000 байт/с, корзина на 1500 байт
+	bucket := NewTokenBucket(1000, 1500, start)
+
+	delay, ok := bucket.reserve(1500, start, 0)
+	require.True(t, ok)
+	assert.Zero(t, delay)
+
+	// Корзина пуста: 500 байт придется ждать полсекунды
+	_, ok = bucket.reserve(500, start, 100*time.Millisecond)
+	assert.False(t, ok, "packet exceeding max delay must be dropped")
+	delay, ok = bucket.reserve(500, start, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, 500*time.Millisecond, delay)
+
+	// Следующий пакет стоит в очереди за задержанным
+	delay, ok = bucket.reserve(500, start, 2*time.Second)
+	require.True(t, ok)
+	assert.Equal(t, time.Second, delay)
+
+	// Пополнение не превышает емкость корзины
+	later := start.Add(time.Hour)
+	delay, ok = bucket.reserve(1500, later, 0)
+	require.True(t, ok)
+	assert.Zero(t, delay)
+	_, ok = bucket.reserve(1, later, 0)
+	assert.False(t, ok)
+}
+
+func TestSessionShaper_Wait(t *testing.T) {
+	// 8 кбит/с = 1000 байт/с, корзина 1 КБ, вниз без ограничения
+	shaper := newSessionShaper(common.RateLimit{UploadKbps: 8, BurstKB: 1}, "default", 200*time.Millisecond)
+	ctx := context.Background()
+
+	assert.Equal(t, shapePassed, shaper.Wait(ctx, directionDownload, 1<<20))
+	assert.Equal(t, shapePassed, shaper.Wait(ctx, directionUpload, 1024))
+	assert.Equal(t, shapeDelayed, shaper.Wait(ctx, directionUpload, 100))
+	assert.Equal(t, shapeDropped, shaper.Wait(ctx, directionUpload, 1000))
+
+	stats := shaper.Stats()
+	assert.Equal(t, int64(100), stats.UploadShapedBytes)
+	assert.Equal(t, int64(1000), stats.UploadDroppedBytes)
+	assert.Zero(t, stats.DownloadShapedBytes+stats.DownloadDroppedBytes)
+
+	// Снятие ограничения действует сразу
+	shaper.SetLimit(common.RateLimit{}, "api")
+	assert.Equal(t, shapePassed, shaper.Wait(ctx, directionUpload, 1<<20))
+
+	var unlimited *SessionShaper
+	assert.Equal(t, shapePassed, unlimited.Wait(ctx, directionUpload, 1<<20))
+}
+
+func TestBandwidthManager_LimitFor(t *testing.T) {
+	manager, err := NewBandwidthManager(common.ShapingConfig{
+		DownloadKbps: 10000,
+		UploadKbps:   2000,
+		Users: map[string]common.RateLimit{
+			"alice": {DownloadKbps: 50000, UploadKbps: 50000},
+		},
+		Groups: map[string]common.RateLimit{
+			"backup": {DownloadKbps: 1000, UploadKbps: 1000},
+		},
+	})
+	require.NoError(t, err)
+
+	alice := ClientIdentity{User: "alice", Device: "laptop", Groups: []string{"backup"}}
+	bob := ClientIdentity{User: "bob", Device: "nas", Groups: []string{"staff", "backup"}}
+	carol := ClientIdentity{User: "carol", Device: "phone"}
+
+	limit, source := manager.LimitFor(alice)
+	assert.Equal(t, "user", source)
+	assert.Equal(t, int64(50000), limit.DownloadKbps)
+
+	limit, source = manager.LimitFor(bob)
+	assert.Equal(t, "group:backup", source)
+	assert.Equal(t, int64(1000), limit.UploadKbps)
+
+	limit, source = manager.LimitFor(carol)
+	assert.Equal(t, "default", source)
+	assert.Equal(t, common.RateLimit{DownloadKbps: 10000, UploadKbps: 2000}, limit)
+
+	// Ограничение из API для пользователя важнее конфигурации, для сессии - важнее пользователя
+	require.NoError(t, manager.SetOverride("alice", common.RateLimit{DownloadKbps: 500}))
+	require.NoError(t, manager.SetOverride(alice.SessionKey(), common.RateLimit{DownloadKbps: 100}))
+	limit, source = manager.LimitFor(alice)
+	assert.Equal(t, "api", source)
+	assert.Equal(t, int64(100), limit.DownloadKbps)
+	limit, _ = manager.LimitFor(ClientIdentity{User: "alice", Device: "phone"})
+	assert.Equal(t, int64(500), limit.DownloadKbps)
+
+	assert.True(t, manager.ClearOverride(alice.SessionKey()))
+	assert.False(t, manager.ClearOverride(alice.SessionKey()))
+	assert.Error(t, manager.SetOverride("bob", common.RateLimit{UploadKbps: -1}))
+}
+
+func TestNewBandwidthManager_Invalid(t *testing.T) {
+	_, err := NewBandwidthManager(common.ShapingConfig{DownloadKbps: -1})
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+	_, err = NewBandwidthManager(common.ShapingConfig{
+		Groups: map[string]common.RateLimit{"backup": {BurstKB: -5}},
+	})
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+	_, err = NewBandwidthManager(common.ShapingConfig{MaxQueueDelayMs: -1})
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+}
+
+func TestApplyRateLimits(t *testing.T) {
+	s := newTestSessionServer(common.SessionConfig{})
+	manager, err := NewBandwidthManager(common.ShapingConfig{DownloadKbps: 1000})
+	require.NoError(t, err)
+	s.Shaping = manager
+
+	identity := ClientIdentity{User: "alice", Device: "laptop"}
+	session, _, err := openTestSession(t, s, identity)
+	require.NoError(t, err)
+	session.Shaper = manager.NewShaper(manager.LimitFor(identity))
+
+	require.NoError(t, manager.SetOverride("alice", common.RateLimit{DownloadKbps: 64}))
+	s.applyRateLimits()
+
+	limit, source := session.Shaper.Limit()
+	assert.Equal(t, "api", source)
+	assert.Equal(t, int64(64), limit.DownloadKbps)
+	assert.Equal(t, "api", clientRateLimit(session.Shaper).Source)
+}
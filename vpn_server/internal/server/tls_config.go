@@ -36,6 +36,7 @@ func (s *Server) setupTLSConfig() (*tls.Config, error) {
 			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
 		},
+		VerifyConnection: s.verifyClientNotRevoked,
 	}
 
 	return tlsConfig, nil
@@ -92,6 +93,24 @@ func (s *Server) loadCACertificate() (*x509.CertPool, error) {
 	return caCertPool, nil
 }
 
+// verifyClientNotRevoked отклоняет рукопожатие с сертификатом, отозванным встроенным CA
+// этого или другого узла кластера
+func (s *Server) verifyClientNotRevoked(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	serial := cs.PeerCertificates[0].SerialNumber
+	revoked := s.CA != nil && s.CA.IsRevoked(serial)
+	if !revoked && s.State != nil {
+		revoked = s.State.IsRevoked(formatSerial(serial))
+	}
+	if revoked {
+		s.Metrics.RecordError("revoked_certificate")
+		return fmt.Errorf("client certificate %s has been revoked", formatSerial(serial))
+	}
+	return nil
+}
+
 // validateClientCertificate проверяет клиентский сертификат
 func (s *Server) validateClientCertificate(cert *x509.Certificate) error {
 	if cert == nil {
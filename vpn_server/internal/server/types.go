@@ -1,7 +1,11 @@
 package server
 
 import (
+	"io"
+	"net/netip"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	common "github.com/iselt/masque-vpn/common"
 	common_fec "github.com/iselt/masque-vpn/common/fec"
@@ -9,7 +13,22 @@ import (
 
 // ClientSession holds per-client state including FEC
 type ClientSession struct {
+	ID           string // ключ сессии user:device
+	ConnID       string // идентификатор соединения CONNECT-IP для журнала
+	RemoteAddr   string // адрес клиента (host:port)
+	AssignedIP   netip.Addr
+	StartedAt    time.Time
 	Conn         *common.MASQUEConn
+	Capsules     io.Writer // поток ответа CONNECT-IP для капсул, под Mu; nil - сессия без потока
+	CertSerial   string // серийный номер клиентского сертификата (hex)
+	Identity     ClientIdentity
+	Shaper       *SessionShaper // ограничение полосы; nil - без ограничения
+	Node         string         // узел кластера с сессией другого узла; пусто - сессия этого узла
+	// Поколение аренды адреса в кластере; сессия закрывается, когда аренда освобождена или переподключена
+	LeaseGeneration uint64
+	// Учет трафика сессии: отправлено клиенту и получено от него
+	BytesSent     atomic.Int64
+	BytesReceived atomic.Int64
 	Encoder      *common_fec.XOREncoder
 	PacketBuffer [][]byte
 	SeqNum       uint32
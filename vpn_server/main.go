@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"runtime/pprof"
@@ -19,10 +20,13 @@ import (
 var (
 	serverConfig common.ServerConfig
 	logger       *zap.Logger
+	// atomicLevel is shared with the server so the API can change it at runtime
+	atomicLevel zap.AtomicLevel
 )
 
-// initLogger initializes structured logging with zap
-func initLogger(logLevel string) error {
+// initLogger initializes structured logging with zap. Production writes one
+// JSON object per line; log_format overrides the choice of encoding.
+func initLogger(logLevel string, logFormat string) error {
 	var config zap.Config
 	
 	// Determine environment and configure accordingly
@@ -32,13 +36,24 @@ func initLogger(logLevel string) error {
 		config = zap.NewDevelopmentConfig()
 		config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 	}
+	switch logFormat {
+	case "":
+	case "json":
+		config.Encoding = "json"
+		config.EncoderConfig.EncodeLevel = zapcore.LowercaseLevelEncoder
+	case "console":
+		config.Encoding = "console"
+	default:
+		return fmt.Errorf("unknown log_format %q (want json or console)", logFormat)
+	}
 	
 	// Set log level from configuration
 	level, err := zapcore.ParseLevel(logLevel)
 	if err != nil {
 		level = zapcore.InfoLevel
 	}
-	config.Level = zap.NewAtomicLevelAt(level)
+	atomicLevel = zap.NewAtomicLevelAt(level)
+	config.Level = atomicLevel
 	
 	// Configure time encoding
 	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
@@ -49,13 +64,23 @@ func initLogger(logLevel string) error {
 		return err
 	}
 	
-	// Replace global logger
+	// Replace global logger; libraries using the standard log package end up in it too
 	zap.ReplaceGlobals(logger)
+	zap.RedirectStdLog(logger)
 	
 	return nil
 }
 
 func main() {
+	// Administrative subcommands (e.g. `vpn-server bundle -client alice`)
+	if handled, err := runSubcommand(os.Args[1:]); handled {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if os.Getenv("PERF_PROFILE") != "" {
 		f, _ := os.OpenFile("cpu.pprof", os.O_CREATE|os.O_RDWR, 0666)
 		defer f.Close()
@@ -74,7 +99,7 @@ func main() {
 	}
 
 	// Initialize structured logging
-	if err := initLogger(serverConfig.LogLevel); err != nil {
+	if err := initLogger(serverConfig.LogLevel, serverConfig.LogFormat); err != nil {
 		panic("Failed to initialize logger: " + err.Error())
 	}
 	defer logger.Sync()
@@ -99,14 +124,16 @@ func main() {
 	}
 
 	// Initialize Server
-	srv, err := server.New(serverConfig)
+	srv, err := server.New(serverConfig, logger)
 	if err != nil {
 		logger.Fatal("Failed to initialize server", zap.Error(err))
 	}
+	srv.LogLevel = &atomicLevel
 
-	// Create context for graceful shutdown
+	// SIGINT/SIGTERM drain the server; a second signal terminates it at once
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	context.AfterFunc(ctx, stop)
 
 	logger.Info("Server initialized successfully, starting...")
 